@@ -0,0 +1,135 @@
+package webpcon
+
+import (
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+)
+
+// Options are the settings of Convert and ConvertFS. Start from
+// DefaultOptions, which has the command line's defaults; the zero value
+// encodes lossy at quality 0.
+type Options struct {
+	Quality       float32 // Lossy quality, 0 ~ 100
+	AlphaQuality  int     // Lossy alpha quality, 0 ~ 100. 100 keeps alpha lossless
+	Lossless      bool
+	NearLossless  int  // Near-lossless preprocessing level, 0 ~ 100. -1 = disabled
+	Exact         bool // Keep RGB values under fully transparent pixels
+	SharpYUV      bool
+	Effort        int       // Compression effort, 0 ~ 6, for the encoders that take it
+	Encoder       string    // "cgo" or "native", or "" to pick the best one built in
+	MaxMegapixels float64   // Largest image decoded, 0 for the default of 100
+	GIFFlatten    bool      // Convert an animated GIF's first frame instead of refusing it
+	Log           io.Writer // Where ConvertFS reports each file, nil for nowhere
+}
+
+// Info describes an image Convert converted.
+type Info struct {
+	Format string // Input format, as an extension like ".png"
+	Width  int    // Input dimensions
+	Height int
+	Size   int64  // Bytes of WebP written
+	Detail string // Encoder settings used, like "lossy q80"
+}
+
+// DefaultOptions returns the settings webpcon converts with when no flags
+// are given.
+func DefaultOptions() Options {
+	return Options{Quality: 80, AlphaQuality: 100, NearLossless: -1, Effort: 4}
+}
+
+// Convert converts one still image read from r to WebP written to w. It is
+// what "webpcon -" runs, and like it works in memory only: the format comes
+// from the content, and input that would need temporary files, like AVIF and
+// JPEG XL, is refused. See convertStream.
+func Convert(r io.Reader, w io.Writer, opts Options) (Info, error) {
+	o, err := opts.options()
+	if err != nil {
+		return Info{}, err
+	}
+	info, err := convertStream(r, w, o)
+	return Info{Format: info.format, Width: info.width, Height: info.height, Size: info.size, Detail: info.detail}, err
+}
+
+// Writer is where ConvertFS writes: the few file operations a conversion
+// needs, so the outputs can go anywhere an adapter reaches. Names are
+// slash-separated and relative, as with fs.FS, through which the outputs are
+// read back to verify them and to find the names already taken.
+type Writer interface {
+	fs.FS
+	CreateFile(name string) (io.WriteCloser, error)
+	Rename(oldname, newname string) error
+	Remove(name string) error
+	MkdirAll(name string, perm fs.FileMode) error
+}
+
+// ConvertFS converts the images of src, like a folder or a zip archive, to
+// WebP files written to dst under the same names, and adds them to the map
+// file at the root of dst. src is left as it is. Images are picked and
+// encoded as "webpcon convert" does, with no backup since the originals
+// stay where they are. A file that can't be converted is reported to
+// opts.Log and skipped; the error is what stopped the run.
+func ConvertFS(src fs.FS, dst Writer, opts Options) error {
+	o, err := opts.options()
+	if err != nil {
+		return err
+	}
+	cacheDir, err := os.MkdirTemp("", "webpcon-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(cacheDir)
+	log := opts.Log
+	if log == nil {
+		log = io.Discard
+	}
+	con := newConsole(log, false)
+	r, err := newCopyRun(src, dst, cacheDir, o, con)
+	if err != nil {
+		con.close()
+		return err
+	}
+	err = r.walk(r.visit)
+	con.close()
+	if serr := r.outputs.saveTo(dst); err == nil {
+		err = serr
+	}
+	return err
+}
+
+// options checks the fields and turns them into the settings convertStream
+// takes.
+func (o Options) options() (options, error) {
+	opts := defaultOptions()
+	switch {
+	case o.Quality < 0 || o.Quality > 100:
+		return opts, fmt.Errorf("quality must be between 0 and 100, got %g", o.Quality)
+	case o.AlphaQuality < 0 || o.AlphaQuality > 100:
+		return opts, fmt.Errorf("alpha quality must be between 0 and 100, got %d", o.AlphaQuality)
+	case o.NearLossless < -1 || o.NearLossless > 100:
+		return opts, fmt.Errorf("near-lossless level must be between 0 and 100, or -1, got %d", o.NearLossless)
+	case o.Effort < 0 || o.Effort > 6:
+		return opts, fmt.Errorf("effort must be between 0 and 6, got %d", o.Effort)
+	case o.MaxMegapixels < 0:
+		return opts, fmt.Errorf("megapixel limit must not be negative, got %g", o.MaxMegapixels)
+	}
+	opts.quality, opts.alphaQuality = o.Quality, o.AlphaQuality
+	opts.lossless, opts.nearLossless = o.Lossless, o.NearLossless
+	opts.exact, opts.sharpYUV, opts.effort = o.Exact, o.SharpYUV, o.Effort
+	opts.maxMegapixels, opts.gifFlatten = o.MaxMegapixels, o.GIFFlatten
+
+	// cwebp works through temporary files, so "auto" can't mean it here
+	opts.encoder = o.Encoder
+	if opts.encoder == "" {
+		opts.encoder = deterministicEncoder()
+	}
+	var err error
+	if opts.enc, err = selectEncoder(opts.encoder); err != nil {
+		return opts, err
+	}
+	if !opts.enc.lossy() {
+		opts.lossless = true
+	}
+	return opts, nil
+}
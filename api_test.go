@@ -0,0 +1,73 @@
+package webpcon
+
+import (
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+)
+
+func TestConvert(t *testing.T) {
+	quietly(t)
+	tests := []struct {
+		name   string
+		opts   func(*Options)
+		detail string
+	}{
+		{"defaults", func(*Options) {}, "q80"},
+		{"quality", func(o *Options) { o.Quality = 55 }, "q55"},
+		{"lossless", func(o *Options) { o.Lossless = true }, "lossless"},
+	}
+	for _, tt := range tests {
+		opts := DefaultOptions()
+		tt.opts(&opts)
+		var out bytes.Buffer
+		info, err := Convert(bytes.NewReader(encodeFixture(t, ".png", 20, 10)), &out, opts)
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if info.Format != ".png" || info.Width != 20 || info.Height != 10 || info.Size != int64(out.Len()) {
+			t.Errorf("%s: Convert = %+v, wrote %d bytes", tt.name, info, out.Len())
+		}
+		if sniffFormat(out.Bytes()) != ".webp" {
+			t.Errorf("%s: Convert wrote %q, want WebP", tt.name, sniffFormat(out.Bytes()))
+		}
+		if !strings.Contains(info.Detail, tt.detail) {
+			t.Errorf("%s: Convert detail = %q, want it to mention %q", tt.name, info.Detail, tt.detail)
+		}
+	}
+}
+
+func TestConvertInvalidOptions(t *testing.T) {
+	quietly(t)
+	for _, opts := range []Options{
+		{Quality: 101, AlphaQuality: 100, NearLossless: -1},
+		{Quality: 80, AlphaQuality: -1, NearLossless: -1},
+		{Quality: 80, AlphaQuality: 100, NearLossless: -2},
+		{Quality: 80, AlphaQuality: 100, NearLossless: -1, Effort: 7},
+		{Quality: 80, AlphaQuality: 100, NearLossless: -1, MaxMegapixels: -1},
+		{Quality: 80, AlphaQuality: 100, NearLossless: -1, Encoder: "nope"},
+		{Quality: 80, AlphaQuality: 100, NearLossless: -1, Encoder: "cwebp"},
+	} {
+		if _, err := Convert(bytes.NewReader(encodeFixture(t, ".png", 4, 4)), io.Discard, opts); err == nil {
+			t.Errorf("Convert with %+v succeeded", opts)
+		}
+	}
+}
+
+// TestConvertRefuses checks Convert refuses what "webpcon -" does.
+func TestConvertRefuses(t *testing.T) {
+	quietly(t)
+	opts := DefaultOptions()
+	opts.MaxMegapixels = 1
+	for name, data := range map[string][]byte{
+		"webp":         []byte("RIFF\x00\x00\x00\x00WEBPVP8 "),
+		"animated gif": animatedGIFFixture(t, 4, 4, 3),
+		"too large":    encodeFixture(t, ".png", 1200, 1000),
+	} {
+		if _, err := Convert(bytes.NewReader(data), io.Discard, opts); err == nil {
+			t.Errorf("%s: Convert succeeded", name)
+		}
+	}
+}
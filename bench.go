@@ -0,0 +1,175 @@
+package webpcon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultBenchSample is how many files bench encodes unless --sample says
+// otherwise. Each is encoded once per quality, so it's smaller than estimate's.
+const defaultBenchSample = 20
+
+var defaultBenchQualities = []int{60, 70, 80, 90}
+
+// benchResult sums up one quality setting over the sample.
+type benchResult struct {
+	Quality  int     `json:"quality"`
+	Size     int64   `json:"size"`  // Total bytes of the sample's WebP files
+	Ratio    float64 `json:"ratio"` // Size / source size
+	PSNR     float64 `json:"psnr"`  // Mean, in dB
+	SSIM     float64 `json:"ssim"`  // Mean, 1 = identical
+	Duration string  `json:"duration"`
+
+	elapsed time.Duration
+}
+
+type benchReport struct {
+	Seed       int64          `json:"seed"`
+	Sampled    int            `json:"sampled"`
+	SourceSize int64          `json:"sourceSize"`
+	Results    []*benchResult `json:"results"`
+}
+
+// benchQualities encodes a random sample of the project's images at each
+// lossy quality and reports the output size against PSNR and SSIM, measured
+// on the decoded WebP. Nothing in the tree is written.
+func benchQualities(root string, opts options) error {
+	qualities := opts.qualities
+	if qualities == nil {
+		qualities = defaultBenchQualities
+	}
+	n := opts.sample
+	if !opts.set["sample"] {
+		n = defaultBenchSample
+	}
+	eligible, seed, err := shuffledSources(root, opts)
+	if err != nil {
+		return err
+	}
+	n = min(n, len(eligible))
+	if !opts.jsonOutput {
+		fmt.Fprintf(stdout, "📐 Encoding %d of %d eligible file(s) at quality %s (seed %d)\n", n, len(eligible), joinInts(qualities), seed)
+	}
+
+	report := benchReport{Seed: seed}
+	for _, q := range qualities {
+		report.Results = append(report.Results, &benchResult{Quality: q})
+	}
+	overrides := newOverrideLoader(root)
+	for _, src := range eligible[:n] {
+		path := filepath.Join(root, src.rel)
+		if err := benchFile(path, src, overrides, opts, report.Results); err != nil {
+			if !opts.jsonOutput {
+				fmt.Fprintf(stdout, "⚠️  Leaving %s out of the sample: %v\n", src.rel, err)
+			}
+			continue
+		}
+		report.Sampled++
+		report.SourceSize += src.size
+	}
+	if report.Sampled == 0 {
+		return fmt.Errorf("no eligible images could be sampled under %s", root)
+	}
+	for _, r := range report.Results {
+		r.PSNR /= float64(report.Sampled)
+		r.SSIM /= float64(report.Sampled)
+		r.Ratio = float64(r.Size) / float64(report.SourceSize)
+		r.Duration = r.elapsed.Round(time.Millisecond).String()
+	}
+
+	if opts.jsonOutput {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, string(data))
+		return nil
+	}
+	fmt.Fprintf(stdout, "   %-8s %10s %9s %9s %7s %9s\n", "quality", "size", "of source", "PSNR", "SSIM", "time")
+	for _, r := range report.Results {
+		fmt.Fprintf(stdout, "   q%-7d %10s %8.1f%% %7.2fdB %7.4f %9s\n", r.Quality, formatSize(r.Size), r.Ratio*100, r.PSNR, r.SSIM, r.Duration)
+	}
+	fmt.Fprintf(stdout, "📊 %d file(s), %s of source images\n", report.Sampled, formatSize(report.SourceSize))
+	return nil
+}
+
+// benchFile encodes one image at every quality and adds its numbers to results.
+// Only lossy encoding is compared, so lossless settings and --target-size are
+// turned off for the run.
+func benchFile(path string, src source, overrides *overrideLoader, opts options, results []*benchResult) error {
+	fopts, err := overrides.optionsFor(path, opts)
+	if err != nil {
+		return err
+	}
+	fopts.lossless, fopts.nearLossless, fopts.quantize, fopts.targetSize = false, -1, 0, 0
+	if !fopts.enc.lossy() {
+		return fmt.Errorf("the %s encoder only writes lossless WebP", fopts.enc.name())
+	}
+
+	f, err := os.Open(longPath(path))
+	if err != nil {
+		return err
+	}
+	img, err := decodeSized(f, src.ext, fopts)
+	f.Close()
+	if err != nil {
+		return err
+	}
+
+	type measured struct {
+		size       int64
+		psnr, ssim float64
+		elapsed    time.Duration
+	}
+	var out []measured
+	for _, r := range results {
+		fopts.quality = float32(r.Quality)
+		var buf bytes.Buffer
+		start := time.Now()
+		res, err := encodeStatic(&buf, img, osFile(path), src.ext, src.rel, fopts)
+		elapsed := time.Since(start)
+		if err != nil {
+			return err
+		}
+		q, err := compareOutput(res.encoded, &buf)
+		if err != nil {
+			return err
+		}
+		out = append(out, measured{res.size, q.psnr, q.ssim, elapsed})
+	}
+	// Only count files that made it through every quality
+	for i, m := range out {
+		results[i].Size += m.size
+		results[i].PSNR += m.psnr
+		results[i].SSIM += m.ssim
+		results[i].elapsed += m.elapsed
+	}
+	return nil
+}
+
+// parseQualities parses a comma separated list of 0 ~ 100 qualities.
+func parseQualities(name, v string) ([]int, error) {
+	var qs []int
+	for _, part := range strings.Split(v, ",") {
+		q, err := parseLevel(name, strings.TrimSpace(part))
+		if err != nil {
+			return nil, err
+		}
+		qs = append(qs, q)
+	}
+	return qs, nil
+}
+
+func joinInts(ns []int) string {
+	s := make([]string, len(ns))
+	for i, n := range ns {
+		s[i] = strconv.Itoa(n)
+	}
+	return strings.Join(s, ",")
+}
@@ -0,0 +1,345 @@
+package webpcon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"io/fs"
+	"math/bits"
+
+	"golang.org/x/image/bmp"
+)
+
+// BMP support beyond golang.org/x/image/bmp, which only reads uncompressed
+// 8, 24 and 32 bit files with the standard channel layout. Older tools also
+// write RLE-compressed, 1/4/16 bit and bitfield files, and 32 bit files whose
+// alpha the library either refuses or drops. Those go through the fallback
+// decoder below. JPEG and PNG compressed BMPs are left as unsupported.
+
+// BMP compression methods.
+const (
+	biRGB            = 0
+	biRLE8           = 1
+	biRLE4           = 2
+	biBitfields      = 3
+	biJPEG           = 4
+	biPNG            = 5
+	biAlphaBitfields = 6
+)
+
+// bmpInfo is what the fallback decoder needs from a BMP's headers.
+type bmpInfo struct {
+	width, height int
+	topDown       bool
+	bpp           int
+	compression   uint32
+	offset        int           // Of the pixel data
+	masks         [4]uint32     // Red, green, blue, alpha
+	palette       color.Palette // For 1, 4 and 8 bits per pixel
+}
+
+// readBMPInfo parses the file and info headers, and the masks and palette
+// that follow them. data only needs to hold the headers, not the pixels.
+func readBMPInfo(data []byte) (bmpInfo, error) {
+	var b bmpInfo
+	le := binary.LittleEndian
+	if len(data) < 26 || string(data[:2]) != "BM" {
+		return b, errors.New("bmp: invalid format")
+	}
+	b.offset = int(le.Uint32(data[10:]))
+	headerLen := int(le.Uint32(data[14:]))
+	if len(data) < 14+headerLen {
+		return b, io.ErrUnexpectedEOF
+	}
+
+	entrySize := 4
+	planes := 1
+	switch headerLen {
+	case 12: // OS/2 BITMAPCOREHEADER
+		b.width, b.height = int(le.Uint16(data[18:])), int(le.Uint16(data[20:]))
+		planes, b.bpp = int(le.Uint16(data[22:])), int(le.Uint16(data[24:]))
+		entrySize = 3
+	case 40, 52, 56, 108, 124:
+		b.width, b.height = int(int32(le.Uint32(data[18:]))), int(int32(le.Uint32(data[22:])))
+		planes, b.bpp = int(le.Uint16(data[26:])), int(le.Uint16(data[28:]))
+		b.compression = le.Uint32(data[30:])
+	default:
+		return b, unsupported("BMP header of %d bytes", headerLen)
+	}
+	if b.height < 0 {
+		b.height, b.topDown = -b.height, true
+	}
+	if b.width <= 0 || b.height <= 0 || planes != 1 {
+		return b, errors.New("bmp: invalid header")
+	}
+
+	switch b.compression {
+	case biRGB:
+		if b.bpp != 1 && b.bpp != 4 && b.bpp != 8 && b.bpp != 16 && b.bpp != 24 && b.bpp != 32 {
+			return b, unsupported("BMP with %d bits per pixel", b.bpp)
+		}
+	case biRLE8, biRLE4:
+		if b.compression == biRLE8 && b.bpp != 8 || b.compression == biRLE4 && b.bpp != 4 || b.topDown {
+			return b, errors.New("bmp: invalid RLE header")
+		}
+	case biBitfields, biAlphaBitfields:
+		if b.bpp != 16 && b.bpp != 32 {
+			return b, unsupported("BMP bitfields with %d bits per pixel", b.bpp)
+		}
+	case biJPEG:
+		return b, unsupported("BMP compression 'JPEG'")
+	case biPNG:
+		return b, unsupported("BMP compression 'PNG'")
+	default:
+		return b, unsupported("BMP compression %d", b.compression)
+	}
+
+	// Masks live in the info header from BITMAPV2 on, and right after a
+	// plain BITMAPINFOHEADER otherwise
+	end := 14 + headerLen
+	switch {
+	case b.compression == biBitfields || b.compression == biAlphaBitfields:
+		n := 3
+		if b.compression == biAlphaBitfields || headerLen >= 56 {
+			n = 4
+		}
+		at := 54
+		if headerLen == 40 {
+			at = end
+			end += 4 * n
+		}
+		if len(data) < at+4*n {
+			return b, io.ErrUnexpectedEOF
+		}
+		for i := range n {
+			b.masks[i] = le.Uint32(data[at+4*i:])
+		}
+	case b.bpp == 16:
+		b.masks = [4]uint32{0x7c00, 0x3e0, 0x1f}
+	case b.bpp == 32:
+		b.masks = [4]uint32{0xff0000, 0xff00, 0xff}
+		// Like browsers, the alpha mask of a BITMAPV3 header or later is
+		// honored; an older header means the fourth byte is padding
+		if headerLen >= 56 {
+			b.masks[3] = le.Uint32(data[66:])
+		}
+	}
+
+	if b.bpp <= 8 {
+		n := 1 << b.bpp
+		if headerLen >= 40 {
+			if used := int(le.Uint32(data[46:])); used > 0 && used < n {
+				n = used
+			}
+		}
+		if len(data) < end+n*entrySize {
+			return b, io.ErrUnexpectedEOF
+		}
+		b.palette = make(color.Palette, n)
+		for i := range b.palette {
+			p := data[end+i*entrySize:]
+			b.palette[i] = color.NRGBA{p[2], p[1], p[0], 0xff}
+		}
+	}
+	return b, nil
+}
+
+// decodeBMP decodes a BMP file, falling back to decodeBMPFallback for the
+// variants golang.org/x/image/bmp refuses.
+func decodeBMP(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	img, err := bmp.Decode(bytes.NewReader(data))
+	if errors.Is(err, bmp.ErrUnsupported) {
+		return decodeBMPFallback(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if m, ok := img.(*image.NRGBA); ok {
+		opaqueIfClear(m)
+	}
+	return img, nil
+}
+
+// decodeBMPConfig reads a BMP's dimensions, including those of the variants
+// only decodeBMP's fallback reads.
+func decodeBMPConfig(r io.Reader) (image.Config, error) {
+	data, err := io.ReadAll(io.LimitReader(r, 14+124+16+256*4))
+	if err != nil {
+		return image.Config{}, err
+	}
+	b, err := readBMPInfo(data)
+	if err != nil {
+		return image.Config{}, err
+	}
+	return image.Config{ColorModel: color.NRGBAModel, Width: b.width, Height: b.height}, nil
+}
+
+// checkBMP reads just the headers of the BMP name in fsys, see checkSupported.
+func checkBMP(fsys fs.FS, name string) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = decodeBMPConfig(f)
+	return err
+}
+
+// decodeBMPFallback decodes any BMP readBMPInfo accepts.
+func decodeBMPFallback(data []byte) (image.Image, error) {
+	b, err := readBMPInfo(data)
+	if err != nil {
+		return nil, err
+	}
+	if b.offset >= len(data) || b.width*b.height > maxBMPPixels {
+		return nil, errors.New("bmp: invalid header")
+	}
+	img := image.NewNRGBA(image.Rect(0, 0, b.width, b.height))
+	pixels := data[b.offset:]
+
+	if b.compression == biRLE8 || b.compression == biRLE4 {
+		decodeBMPRLE(img, pixels, b)
+		return img, nil
+	}
+
+	stride := (b.bpp*b.width + 31) / 32 * 4
+	if len(pixels) < stride*b.height {
+		return nil, io.ErrUnexpectedEOF
+	}
+	for row := range b.height {
+		y := b.height - 1 - row
+		if b.topDown {
+			y = row
+		}
+		src := pixels[row*stride:]
+		for x := range b.width {
+			var c color.NRGBA
+			switch b.bpp {
+			case 1, 4, 8:
+				bit := x * b.bpp
+				i := int(src[bit/8]>>(8-b.bpp-bit%8)) & (1<<b.bpp - 1)
+				c = paletteColor(b.palette, i)
+			case 16:
+				c = maskedColor(uint32(binary.LittleEndian.Uint16(src[2*x:])), b.masks)
+			case 24:
+				c = color.NRGBA{src[3*x+2], src[3*x+1], src[3*x], 0xff}
+			case 32:
+				c = maskedColor(binary.LittleEndian.Uint32(src[4*x:]), b.masks)
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	if b.masks[3] != 0 {
+		opaqueIfClear(img)
+	}
+	return img, nil
+}
+
+// maxBMPPixels bounds the image a BMP header can make the fallback allocate,
+// as RLE data is much smaller than the image it describes.
+const maxBMPPixels = 1 << 28
+
+// decodeBMPRLE expands RLE4 or RLE8 data into img. Pixels the data skips over
+// with end-of-line and delta codes stay transparent, as in browsers. Runs past
+// the edge are clipped and truncated data ends the image early.
+func decodeBMPRLE(img *image.NRGBA, data []byte, b bmpInfo) {
+	x, y := 0, 0
+	set := func(i int) {
+		if x < b.width && y < b.height {
+			img.SetNRGBA(x, b.height-1-y, paletteColor(b.palette, i))
+		}
+		x++
+	}
+	for p := 0; p+1 < len(data) && y < b.height; {
+		n, c := int(data[p]), int(data[p+1])
+		p += 2
+		if n > 0 {
+			for i := range n {
+				if b.compression == biRLE8 {
+					set(c)
+				} else if i%2 == 0 {
+					set(c >> 4)
+				} else {
+					set(c & 0xf)
+				}
+			}
+			continue
+		}
+		switch c {
+		case 0: // End of line
+			x, y = 0, y+1
+		case 1: // End of bitmap
+			return
+		case 2: // Delta
+			if p+1 >= len(data) {
+				return
+			}
+			x, y = x+int(data[p]), y+int(data[p+1])
+			p += 2
+		default: // c literal pixels, padded to a whole number of words
+			size := c
+			if b.compression == biRLE4 {
+				size = (c + 1) / 2
+			}
+			if p+size > len(data) {
+				return
+			}
+			for i := range c {
+				if b.compression == biRLE8 {
+					set(int(data[p+i]))
+				} else if i%2 == 0 {
+					set(int(data[p+i/2] >> 4))
+				} else {
+					set(int(data[p+i/2] & 0xf))
+				}
+			}
+			p += size + size%2
+		}
+	}
+}
+
+func paletteColor(p color.Palette, i int) color.NRGBA {
+	if i >= len(p) {
+		return color.NRGBA{0, 0, 0, 0xff}
+	}
+	return p[i].(color.NRGBA)
+}
+
+// maskedColor extracts the channels of a 16 or 32 bit pixel, scaling each to
+// 8 bits. Without an alpha mask the pixel is opaque.
+func maskedColor(v uint32, masks [4]uint32) color.NRGBA {
+	channel := func(mask uint32) uint8 {
+		if mask == 0 {
+			return 0
+		}
+		shift := bits.TrailingZeros32(mask)
+		top := mask >> shift
+		return uint8(uint64(v&mask>>shift) * 255 / uint64(top))
+	}
+	c := color.NRGBA{channel(masks[0]), channel(masks[1]), channel(masks[2]), 0xff}
+	if masks[3] != 0 {
+		c.A = channel(masks[3])
+	}
+	return c
+}
+
+// opaqueIfClear makes a completely transparent image opaque. Many tools
+// write 32 bit BMPs with an alpha mask but leave the alpha bytes zero, and
+// browsers show those as opaque too.
+func opaqueIfClear(img *image.NRGBA) {
+	for i := 3; i < len(img.Pix); i += 4 {
+		if img.Pix[i] != 0 {
+			return
+		}
+	}
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+}
@@ -0,0 +1,111 @@
+package webpcon
+
+import (
+	"bytes"
+	"image/color"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+var (
+	bmpRed   = color.NRGBA{255, 0, 0, 255}
+	bmpGreen = color.NRGBA{0, 255, 0, 255}
+	bmpBlue  = color.NRGBA{0, 0, 255, 255}
+	bmpClear = color.NRGBA{}
+)
+
+// bmpVariants are the BMP layouts the fallback decoder reads, with the
+// pixels they hold, top row first.
+var bmpVariants = []struct {
+	name string
+	bmp  bmpVariant
+	want [][]color.NRGBA
+}{
+	{"rle8", bmpVariant{headerLen: 40, width: 4, height: 2, bpp: 8, compression: biRLE8,
+		palette: []color.NRGBA{bmpRed, bmpGreen, bmpBlue},
+		pixels: []byte{
+			4, 1, 0, 0, // Bottom row: 4 green, end of line
+			0, 3, 0, 2, 1, 0, // Top row: red, blue, green, padded to a word
+			0, 1, // End of bitmap, the last pixel is left out
+		}},
+		[][]color.NRGBA{{bmpRed, bmpBlue, bmpGreen, bmpClear}, {bmpGreen, bmpGreen, bmpGreen, bmpGreen}}},
+	{"rle4", bmpVariant{headerLen: 40, width: 4, height: 2, bpp: 4, compression: biRLE4,
+		palette: []color.NRGBA{bmpRed, bmpGreen},
+		pixels: []byte{
+			4, 0x01, 0, 0, // Bottom row: red and green alternating, end of line
+			0, 2, 2, 0, // Delta: skip 2 pixels
+			2, 0x11, // 2 green
+			0, 1,
+		}},
+		[][]color.NRGBA{{bmpClear, bmpClear, bmpGreen, bmpGreen}, {bmpRed, bmpGreen, bmpRed, bmpGreen}}},
+	{"v4-alpha-bitfields", bmpVariant{headerLen: 108, width: 2, height: 1, bpp: 32, compression: biBitfields,
+		masks:  []uint32{0xff0000, 0xff00, 0xff, 0xff000000},
+		pixels: []byte{10, 20, 30, 128, 0, 0, 255, 64}},
+		[][]color.NRGBA{{{30, 20, 10, 128}, {255, 0, 0, 64}}}},
+	{"v5-alpha", bmpVariant{headerLen: 124, width: 2, height: 1, bpp: 32, compression: biRGB,
+		masks:  []uint32{0xff0000, 0xff00, 0xff, 0xff000000},
+		pixels: []byte{10, 20, 30, 128, 0, 0, 255, 64}},
+		[][]color.NRGBA{{{30, 20, 10, 128}, {255, 0, 0, 64}}}},
+	{"v5-clear-alpha", bmpVariant{headerLen: 124, width: 2, height: 1, bpp: 32, compression: biRGB,
+		masks:  []uint32{0xff0000, 0xff00, 0xff, 0xff000000},
+		pixels: []byte{10, 20, 30, 0, 0, 0, 255, 0}}, // Alpha never written: opaque
+		[][]color.NRGBA{{{30, 20, 10, 255}, {255, 0, 0, 255}}}},
+	{"bitfields-565", bmpVariant{headerLen: 40, width: 2, height: -1, bpp: 16, compression: biBitfields,
+		masks:  []uint32{0xf800, 0x07e0, 0x001f},
+		pixels: []byte{0x00, 0xf8, 0x1f, 0x00}},
+		[][]color.NRGBA{{bmpRed, bmpBlue}}},
+}
+
+func TestDecodeBMPVariants(t *testing.T) {
+	for _, v := range bmpVariants {
+		data := bmpFixture(v.bmp)
+		cfg, err := decodeBMPConfig(bytes.NewReader(data))
+		if err != nil || cfg.Width != len(v.want[0]) || cfg.Height != len(v.want) {
+			t.Errorf("%s: config %dx%d, %v", v.name, cfg.Width, cfg.Height, err)
+		}
+		img, err := decodeBMP(bytes.NewReader(data))
+		if err != nil {
+			t.Errorf("%s: %v", v.name, err)
+			continue
+		}
+		for y, row := range v.want {
+			for x, want := range row {
+				if got := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA); got != want {
+					t.Errorf("%s: pixel %d,%d is %v, want %v", v.name, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+// TestConvertBMPVariants converts each variant, and checks a BMP no decoder
+// reads is reported and left where it is, never moved to the backup.
+func TestConvertBMPVariants(t *testing.T) {
+	log := quietly(t)
+	var files []fixtureFile
+	for _, v := range bmpVariants {
+		files = append(files, fixtureFile{"bmp/" + v.name + ".bmp", bmpFixture(v.bmp)})
+	}
+	pngBMP := bmpFixture(bmpVariant{headerLen: 40, width: 2, height: 2, compression: biPNG, pixels: encodeFixture(t, ".png", 2, 2)})
+	files = append(files, fixtureFile{"bmp/png-compressed.bmp", pngBMP})
+	root := writeFixtureTree(t, files)
+
+	convertTree(t, root, testOptions(t, "--encoder", "native"))
+	entries := readMapFile(t, root)
+	for _, v := range bmpVariants {
+		if e := entries["bmp/"+v.name+".bmp"]; e == nil || e.Width != len(v.want[0]) || e.Height != len(v.want) {
+			t.Errorf("%s: map entry %+v", v.name, e)
+		}
+	}
+	if !strings.Contains(log.String(), "1 file(s) skipped as unsupported or unreadable:") || !strings.Contains(log.String(), "- bmp/png-compressed.bmp\n") {
+		t.Errorf("the PNG compressed BMP isn't reported as unsupported:\n%s", log)
+	}
+	if data, err := os.ReadFile(filepath.Join(root, "bmp", "png-compressed.bmp")); err != nil || !bytes.Equal(data, pngBMP) {
+		t.Errorf("the PNG compressed BMP isn't left in place: %v", err)
+	}
+	if fileExists(filepath.Join(root, ".webpcon_backup", "bmp", "png-compressed.bmp")) {
+		t.Error("the PNG compressed BMP was backed up")
+	}
+}
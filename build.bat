@@ -5,7 +5,7 @@ echo Installing Go dependencies...
 go mod tidy
 
 echo Building webpcon.exe...
-go build -o webpcon.exe main.go
+go build -o webpcon.exe ./cmd/webpcon
 
 echo.
 echo Done! You can run webpcon.exe now.
\ No newline at end of file
@@ -7,7 +7,7 @@ echo "Installing Go dependencies..."
 go mod tidy
 
 echo "Building webpcon..."
-go build -o webpcon main.go
+go build -o webpcon ./cmd/webpcon
 
 echo
 echo "Done! You can run ./webpcon now."
\ No newline at end of file
@@ -0,0 +1,84 @@
+package webpcon
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+)
+
+// outputChanges lists WebP files, relative to the project root, that differ
+// between two map files.
+type outputChanges struct {
+	Added    []string `json:"added"`
+	Modified []string `json:"modified"`
+	Removed  []string `json:"removed"`
+}
+
+// changedOutputs compares the project's map file with an older copy, such as
+// the one from the last deploy, and lists the WebP files added, modified or
+// removed since. An output counts as modified when its hash differs, or when
+// either map has no hash for it to compare.
+func changedOutputs(root, oldPath string, asJSON bool) error {
+	if oldPath == "" {
+		return fmt.Errorf("changed needs --since-map <old map file>")
+	}
+	cur, err := loadMapping(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", mapFileName, err)
+		return err
+	}
+	old, err := loadMappingFile(oldPath)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", oldPath, err)
+		return err
+	}
+
+	before, after := outputHashes(old), outputHashes(cur)
+	c := outputChanges{Added: []string{}, Modified: []string{}, Removed: []string{}}
+	for webp, hash := range after {
+		prev, ok := before[webp]
+		switch {
+		case !ok:
+			c.Added = append(c.Added, webp)
+		case hash == "" || prev == "" || hash != prev:
+			c.Modified = append(c.Modified, webp)
+		}
+	}
+	for webp := range before {
+		if _, ok := after[webp]; !ok {
+			c.Removed = append(c.Removed, webp)
+		}
+	}
+	sort.Strings(c.Added)
+	sort.Strings(c.Modified)
+	sort.Strings(c.Removed)
+
+	if asJSON {
+		data, err := json.MarshalIndent(c, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, string(data))
+		return nil
+	}
+	for _, l := range []struct {
+		mark  string
+		files []string
+	}{{"+", c.Added}, {"~", c.Modified}, {"-", c.Removed}} {
+		for _, f := range l.files {
+			fmt.Fprintf(stdout, "   %s %s\n", l.mark, f)
+		}
+	}
+	fmt.Fprintf(stdout, "📋 %d added, %d modified, %d removed since %s\n", len(c.Added), len(c.Modified), len(c.Removed), oldPath)
+	return nil
+}
+
+// outputHashes maps each WebP file in m to its hash. Duplicates share one
+// output, so the same file can show up under several sources.
+func outputHashes(m *mapping) map[string]string {
+	hashes := map[string]string{}
+	for _, e := range m.entries {
+		hashes[e.WebP] = e.SHA256
+	}
+	return hashes
+}
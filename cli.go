@@ -0,0 +1,468 @@
+package webpcon
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+)
+
+// flagDoc describes one flag for --help, completion and parsing.
+type flagDoc struct {
+	names []string // Long name first, then aliases
+	value string   // Placeholder for the value; "" for flags without one
+	help  string
+}
+
+var flagDocs = []flagDoc{
+	// Encoding
+	{[]string{"--quality", "-q"}, "<0-100>", "Lossy quality (default 80). With decode, the JPEG quality (default 90)"},
+	{[]string{"--alpha-quality"}, "<0-100>", "Lossy alpha quality. 100 (default) keeps alpha lossless"},
+	{[]string{"--lossless"}, "", "Encode losslessly"},
+	{[]string{"--near-lossless"}, "<0-100>", "Lossless with near-lossless preprocessing, lower is smaller"},
+	{[]string{"--quantize"}, "<2-256|auto>", "Reduce to this many colors and encode losslessly. auto only quantizes images of few colors"},
+	{[]string{"--dither"}, "", "With --quantize, spread the color error with Floyd-Steinberg dithering"},
+	{[]string{"--target-size"}, "<size>", "Pick the quality so each file fits in this size, like 200KB"},
+	{[]string{"--exact"}, "", "Keep RGB values under fully transparent pixels"},
+	{[]string{"--sharp-yuv"}, "", "Slower RGB to YUV conversion that avoids color bleeding"},
+	{[]string{"--grayscale"}, "", "Convert to grayscale"},
+	{[]string{"--convert-to-srgb"}, "", "Convert images with an embedded ICC profile to sRGB"},
+	{[]string{"--flatten"}, "<#rrggbb>", "Composite transparent images onto this color"},
+	{[]string{"--max-width"}, "<px>", "Downscale wider images"},
+	{[]string{"--max-height"}, "<px>", "Downscale taller images"},
+	{[]string{"--fast-resize"}, "", "Resize with a faster, lower quality filter"},
+	{[]string{"--enable-gif", "--gif"}, "", "Convert animated GIFs to animated WebP (experimental)"},
+	{[]string{"--enable-avif-input"}, "", "Also convert AVIF images, with avifdec or --external-decoder"},
+	{[]string{"--enable-jxl-input"}, "", "Also convert JPEG XL images, with djxl or --external-decoder"},
+	{[]string{"--encoder"}, "<name>", "Encoder backend: " + strings.Join(encoderNames(), ", ") + " or auto (default)"},
+	{[]string{"--deterministic"}, "", "Give byte-identical WebP files for identical input, for build caches"},
+	{[]string{"--effort"}, "<0-6>", "Compression effort, higher is slower and smaller (default 4)"},
+	{[]string{"--preset"}, "<name>", "Start from a named set of encoding settings"},
+	{[]string{"--profile"}, "<file>", "Load settings saved with webpcon profile export. Flags given as well override them"},
+
+	// Selection
+	{[]string{"--min-dimension"}, "<px>", "Skip images narrower or shorter than this"},
+	{[]string{"--min-width"}, "<px>", "Skip images narrower than this"},
+	{[]string{"--min-height"}, "<px>", "Skip images shorter than this"},
+	{[]string{"--only-referenced"}, "", "Only convert images the project's source files reference"},
+	{[]string{"--exclude-regex"}, "<pattern>", "Leave alone files whose relative path matches a regular expression. Repeatable"},
+	{[]string{"--vendored-dirs"}, "<dirs>", "Comma separated folders of vendored code to leave alone, besides those detected"},
+	{[]string{"--include-vendored"}, "<dirs>", "Comma separated folders to convert even though they look vendored"},
+	{[]string{"--since"}, "<date|duration>", "Only convert images modified since a date like 2024-05-01 or within a duration like 72h"},
+	{[]string{"--git-since"}, "<ref>", "Only convert images added or modified in git since ref"},
+	{[]string{"--no-manifest-detect"}, "", "Don't leave icons listed in the web app manifest alone"},
+	{[]string{"--convert-icons"}, "", "Convert icons too: manifest icons, <link> icons and icon-sized PNGs in icons/ or favicons/"},
+	{[]string{"--framework"}, "<name>", "Apply a framework's layout: " + strings.Join(frameworkNames(), ", ") + " or auto"},
+
+	// Conversion
+	{[]string{"--hardlink-dupes"}, "", "Hard link the outputs of identical images instead of copying"},
+	{[]string{"--placeholders"}, "<kind>", "Record a blurhash or thumb placeholder in the map file"},
+	{[]string{"--fallback"}, "<formats>", "Also leave a re-encoded, resized JPEG or PNG in place of each original, like jpeg:80,png"},
+	{[]string{"--placeholder-files"}, "", "Also write thumb placeholders next to the WebP files"},
+	{[]string{"--rewrite-refs"}, "", "Point references in source files at the WebP files"},
+	{[]string{"--exclude-converted"}, "", "With --rewrite-refs, leave references to images without a WebP alone. Always on"},
+	{[]string{"--add-dimensions"}, "", "With --rewrite-refs, add width and height to <img> tags"},
+	{[]string{"--emit-picture-codemod"}, "", "With --rewrite-refs and --fallback, wrap <img> tags in HTML in a <picture> offering the WebP"},
+	{[]string{"--convert-data-uris"}, "", "Re-encode data URI images in CSS and HTML as WebP"},
+	{[]string{"--metrics"}, "", "Measure the PSNR and SSIM of each output"},
+	{[]string{"--min-ssim"}, "<0-1>", "Flag outputs below this SSIM and fail the run"},
+	{[]string{"--keep-low-ssim"}, "", "Keep the original instead of a WebP below --min-ssim"},
+	{[]string{"--verify-full"}, "", "Fully decode each output after writing it, not just check its header"},
+	{[]string{"--trash"}, "", "Send originals to the system trash instead of the backup"},
+	{[]string{"--yes", "-y"}, "", "Add webpcon's files to .gitignore in a git repository without asking"},
+	{[]string{"--chmod-readonly"}, "", "Lift the read-only attribute to back up read-only files"},
+	{[]string{"--ignore-disk-check"}, "", "Skip the free disk space check"},
+	{[]string{"--disk-full-timeout"}, "<duration>", "When the disk fills up, how long to wait for space before stopping (default 10m)"},
+	{[]string{"--no-pause-on-enospc"}, "", "When the disk fills up, stop right away instead of waiting for space"},
+	{[]string{"--streaming-walk"}, "", "Read folders in parallel and start converting before the whole tree is read, for huge trees"},
+	{[]string{"--check-locks"}, "", "Also leave alone files another program holds a flock on (Unix; on Windows locks always count)"},
+	{[]string{"--buffer-size"}, "<size>", "Read size for hashing, copying and verifying files (default 256KB), larger suits spinning disks"},
+	{[]string{"--space-factor"}, "<ratio>", "Share of the source size the outputs are assumed to need"},
+	{[]string{"--nice"}, "", "Same as --throttle 50: runs take about twice as long"},
+	{[]string{"--throttle"}, "<percent>", "Use only part of the machine. Runs take about 100/percent times as long"},
+	{[]string{"--limit"}, "<n>", "Stop after converting n files"},
+	{[]string{"--max-duration"}, "<duration>", "Stop starting new files after this long, like 10m"},
+	{[]string{"--filter-hook"}, "<command>", "Ask a command whether to convert each file"},
+	{[]string{"--post-hook"}, "<command>", "Run a command after each converted file"},
+	{[]string{"--post-run-hook"}, "<command>", "Run a command at the end with the summary JSON on stdin"},
+	{[]string{"--hook-strict"}, "", "Fail the run when a hook fails"},
+	{[]string{"--hook-timeout"}, "<duration>", "Time limit for each hook run (default 1m)"},
+	{[]string{"--trim"}, "<border>", "Crop a transparent or color=#rrggbb border off each still image before resizing"},
+	{[]string{"--trim-tolerance"}, "<n>", "With --trim, how far from the border color a pixel may be, 0 to 255 (default 0)"},
+	{[]string{"--watermark"}, "<file>", "Stamp this image onto each converted still image"},
+	{[]string{"--watermark-pos"}, "<pos>", "Where the watermark goes: top-left, top-right, bottom-left, bottom-right (default) or center"},
+	{[]string{"--watermark-opacity"}, "<n>", "Watermark opacity from 0 to 1 (default 1)"},
+	{[]string{"--watermark-scale"}, "<factor>", "Watermark width as a fraction of the image's (default 0.1)"},
+	{[]string{"--gif-flatten"}, "", "Convert animated GIFs to a still WebP of their first frame instead of skipping them"},
+	{[]string{"--listen"}, "<addr>", "serve: address to listen on, localhost:8080 by default"},
+	{[]string{"--cache-size"}, "<size>", "serve: memory for converted images, 64MB by default"},
+	{[]string{"--requality"}, "", "Re-encode images converted with other settings from their backups"},
+	{[]string{"--on-conflict"}, "<policy>", "For a WebP webpcon didn't write: skip (default), overwrite (default with --force) or rename"},
+	{[]string{"--group-by-dir"}, "<n>", "Add a table of counts and savings by the first n folders of each path to the summary"},
+	{[]string{"--files-from"}, "<file>", "Convert the paths listed in a file, one per line, instead of walking the folder; - reads stdin"},
+	{[]string{"--max-megapixels"}, "<n>", "Refuse images from stdin or serve larger than this, 100 by default"},
+	{[]string{"--gif-max-fps"}, "<fps>", "With --enable-gif, drop frames to at most this many per second, keeping the duration"},
+	{[]string{"--gif-scale"}, "<factor>", "With --enable-gif, resize animations by a factor like 0.5"},
+	{[]string{"--min-savings"}, "<percent>", "Keep animated GIFs, AVIF and JPEG XL files, and any with --target-size, whose WebP isn't at least this much smaller (default 0%)"},
+	{[]string{"--heartbeat"}, "<duration>", "Report files still encoding after this long, and every interval after (default 30s, 0 for never)"},
+	{[]string{"--file-timeout"}, "<duration>", "Abandon a file's encode after this long, keep the original and go on"},
+	{[]string{"--external-decoder"}, "<command>", "Decode images using unsupported features with a command writing PNG to stdout"},
+	{[]string{"--spot-check"}, "<n>", "Copy n originals and their WebP files side by side for a visual check, favoring the most compressed"},
+	{[]string{"--spot-check-dir"}, "<dir>", "Where --spot-check copies to, emptied on each run (default webpcon-check)"},
+	{[]string{"--progress-ndjson"}, "", "Write progress events as JSON lines to stdout, logs to stderr"},
+	{[]string{"--timings"}, "", "Time decoding, encoding and I/O of each file; add percentiles and the slowest files to the summary"},
+	{[]string{"--timings-csv"}, "<file>", "Write the --timings of each file to a CSV file too"},
+
+	// Other subcommands
+	{[]string{"--last-run"}, "", "Only revert the most recent run"},
+	{[]string{"--run"}, "<id>", "Only revert the run with this ID"},
+	{[]string{"--from-webp"}, "", "Rebuild originals with no backup from their WebP, as lossy copies"},
+	{[]string{"--sample"}, "<n>", "Number of files to encode"},
+	{[]string{"--seed"}, "<n>", "Seed for picking the sample or spot check, to repeat a run"},
+	{[]string{"--folders"}, "<list>", "selftest: comma-separated folders to copy whole instead of a sample"},
+	{[]string{"--qualities"}, "<list>", "Comma separated qualities to compare (default 60,70,80,90)"},
+	{[]string{"--to"}, "<format>", "png (default) or jpg"},
+	{[]string{"--repair-mode"}, "<mode>", "repair: restore (default) copies originals back, convert writes their WebP"},
+	{[]string{"--only-converted"}, "", "Only decode WebP files listed in the map file"},
+	{[]string{"--since-map"}, "<file>", "The older map file to compare with, e.g. from the last deploy"},
+	{[]string{"--fix-extensions"}, "", "Rename files to the extension of their content; convert renames WebP content to .webp"},
+	{[]string{"--json"}, "", "Print the report as JSON"},
+
+	// Safety
+	{[]string{"--force"}, "", "Skip the project path checks"},
+	{[]string{"--require-project-file"}, "<name>", "Also accept folders containing this file as projects"},
+	{[]string{"--safe-depth"}, "<n>", "Folders deeper than this need a project file (default 10)"},
+	{[]string{"--break-lock"}, "", "Remove a lock left behind by a run that no longer exists"},
+
+	// Everywhere
+	{[]string{"--no-emoji"}, "", "Start log lines with [tags] instead of emoji"},
+	{[]string{"--color"}, "<when>", "Color status lines: auto (on a terminal, unless NO_COLOR is set), always or never"},
+	{[]string{"--help", "-h"}, "", "Show this help"},
+}
+
+// valueFlags lists the flags that take a value.
+var valueFlags = func() map[string]bool {
+	m := map[string]bool{}
+	for _, f := range flagDocs {
+		for _, n := range f.names {
+			m[n] = f.value != ""
+		}
+	}
+	return m
+}()
+
+// Flag sets shared between subcommands, by long name.
+var (
+	encodingFlags = []string{"--quality", "--alpha-quality", "--lossless", "--near-lossless", "--quantize", "--dither", "--target-size", "--exact",
+		"--sharp-yuv", "--grayscale", "--convert-to-srgb", "--flatten", "--max-width", "--max-height", "--fast-resize",
+		"--enable-gif", "--gif-flatten", "--encoder", "--deterministic", "--effort", "--preset",
+		"--watermark", "--watermark-pos", "--watermark-opacity", "--watermark-scale", "--trim", "--trim-tolerance", "--profile"}
+	selectionFlags = []string{"--min-dimension", "--min-width", "--min-height", "--only-referenced", "--exclude-regex", "--vendored-dirs", "--include-vendored", "--since", "--git-since", "--no-manifest-detect", "--convert-icons",
+		"--framework", "--enable-avif-input", "--enable-jxl-input"}
+	safetyFlags = []string{"--force", "--require-project-file", "--safe-depth", "--break-lock"}
+	// globalFlags are taken by every command
+	globalFlags = []string{"--no-emoji", "--color", "--help"}
+)
+
+// command is one subcommand. Read-only commands skip the path safety check and
+// the project lock.
+type command struct {
+	name     string
+	summary  string
+	flags    []string // Long names of the flags it takes, besides globalFlags
+	readOnly bool
+	run      func(path string, opts options) error
+}
+
+var commands = []*command{
+	{name: "convert", summary: "Convert the project's images to WebP (the default)",
+		flags: concat(encodingFlags, selectionFlags, []string{"--hardlink-dupes", "--placeholders", "--placeholder-files",
+			"--fallback", "--rewrite-refs", "--exclude-converted", "--fix-extensions", "--add-dimensions", "--emit-picture-codemod", "--convert-data-uris", "--metrics", "--min-ssim", "--keep-low-ssim", "--verify-full",
+			"--trash", "--yes", "--chmod-readonly", "--ignore-disk-check", "--disk-full-timeout", "--no-pause-on-enospc", "--check-locks", "--streaming-walk", "--buffer-size", "--space-factor", "--nice", "--throttle", "--limit",
+			"--max-duration", "--filter-hook", "--post-hook", "--post-run-hook", "--hook-strict", "--hook-timeout",
+			"--gif-max-fps", "--gif-scale", "--max-megapixels", "--files-from", "--group-by-dir", "--requality", "--on-conflict", "--min-savings", "--heartbeat", "--file-timeout", "--external-decoder", "--spot-check", "--spot-check-dir", "--seed", "--progress-ndjson", "--timings", "--timings-csv"}, safetyFlags),
+		run: convertImages},
+	{name: "optimize", summary: "Recompress JPEG and PNG files in place, keeping their format",
+		flags: concat([]string{"--quality", "--exclude-regex", "--since", "--buffer-size"}, safetyFlags),
+		run:   optimizeImages},
+	{name: "revert", summary: "Restore the originals and delete the WebP files",
+		flags: concat([]string{"--last-run", "--run", "--from-webp", "--buffer-size"}, safetyFlags),
+		run: func(path string, opts options) error {
+			if opts.lastRun || opts.revertRun != "" {
+				return revertRun(path, opts.revertRun)
+			}
+			if opts.fromWebP {
+				_, err := runRevert(path, revertFromWebP)
+				return err
+			}
+			return revertImages(path)
+		}},
+	{name: "runs", summary: "List the recorded runs", flags: []string{"--json"}, readOnly: true,
+		run: func(path string, opts options) error { return listRuns(path, opts.jsonOutput) }},
+	{name: "history", summary: "List past converts and reverts with their options and savings", flags: []string{"--json"}, readOnly: true,
+		run: func(path string, opts options) error { return listHistory(path, opts.jsonOutput) }},
+	{name: "repair", summary: "Restore or convert the files an interrupted run left only in the backup",
+		flags: concat([]string{"--repair-mode"}, encodingFlags, safetyFlags),
+		run:   repairBackups},
+	{name: "status", summary: "Show what was converted and check webpcon's files are kept out of git", readOnly: true,
+		run: func(path string, opts options) error { return showStatus(path) }},
+	{name: "orphans", summary: "List images nothing references", flags: []string{"--json"}, readOnly: true,
+		run: func(path string, opts options) error { return listOrphans(path, opts.jsonOutput) }},
+	{name: "lint", summary: "Find images with the wrong extension, zero dimensions or truncated data",
+		flags: concat([]string{"--exclude-regex", "--enable-avif-input", "--enable-jxl-input", "--fix-extensions", "--rewrite-refs", "--json"}, safetyFlags),
+		run:   lintImages},
+	{name: "scan", summary: "List the images a conversion would take, with their hashes and dimensions",
+		flags: concat(selectionFlags, []string{"--json"}, safetyFlags),
+		run:   scanImages},
+	{name: "estimate", summary: "Predict the savings from a sample", readOnly: true,
+		flags: concat(encodingFlags, selectionFlags, []string{"--sample", "--seed", "--json"}),
+		run:   estimateSavings},
+	{name: "bench", summary: "Compare size and quality of lossy settings on a sample", readOnly: true,
+		flags: concat(encodingFlags, selectionFlags, []string{"--sample", "--seed", "--qualities", "--json"}),
+		run:   benchQualities},
+	{name: "changed", summary: "List WebP files added, modified or removed since an older map file", flags: []string{"--since-map", "--json"}, readOnly: true,
+		run: func(path string, opts options) error { return changedOutputs(path, opts.sinceMap, opts.jsonOutput) }},
+	{name: "verify", summary: "Check that the WebP files rewritten references point at exist", flags: []string{"--json"}, readOnly: true,
+		run: func(path string, opts options) error { return verifyRefs(path, opts.jsonOutput) }},
+	{name: "selftest", summary: "Check that convert then revert leaves a copy of a sample byte-identical", readOnly: true,
+		flags: concat(encodingFlags, selectionFlags, []string{"--rewrite-refs", "--on-conflict", "--sample", "--seed", "--folders"}),
+		run:   selftest},
+	{name: "serve", summary: "Serve the project over HTTP, converting images to WebP on request", readOnly: true,
+		flags: concat(encodingFlags, []string{"--listen", "--cache-size", "--max-megapixels"}),
+		run:   serveProject},
+	{name: "decode", summary: "Write PNG or JPEG copies of WebP files",
+		flags: concat([]string{"--to", "--only-converted", "--quality", "--flatten"}, safetyFlags),
+		run: func(path string, opts options) error {
+			return decodeWebPFiles(path, opts.decodeTo, opts.onlyConverted, opts)
+		}},
+}
+
+func concat(sets ...[]string) []string {
+	var all []string
+	for _, s := range sets {
+		all = append(all, s...)
+	}
+	return all
+}
+
+func findCommand(name string) *command {
+	for _, c := range commands {
+		if c.name == name {
+			return c
+		}
+	}
+	return nil
+}
+
+func findFlag(name string) *flagDoc {
+	for i, f := range flagDocs {
+		for _, n := range f.names {
+			if n == name {
+				return &flagDocs[i]
+			}
+		}
+	}
+	return nil
+}
+
+// accepts reports whether c takes the flag, given by any of its names.
+func (c *command) accepts(name string) bool {
+	f := findFlag(name)
+	if f == nil {
+		return false
+	}
+	for _, n := range concat(c.flags, globalFlags) {
+		if n == f.names[0] {
+			return true
+		}
+	}
+	return false
+}
+
+// invocation is a parsed command line.
+type invocation struct {
+	cmd   *command
+	path  string
+	flags []string // Flags and their values, for parseOptions
+	help  bool
+}
+
+// parseCommandLine splits the arguments into the subcommand, the project path
+// and the flags, which may come in any order. Both "webpcon revert <path>" and
+// the older "webpcon <path> revert" work, and a path alone means convert.
+// Unknown flags, and flags the subcommand doesn't take, are errors.
+func parseCommandLine(args []string) (invocation, error) {
+	var inv invocation
+	var positional []string
+	for i := 0; i < len(args); i++ {
+		arg := args[i]
+		if arg == "--" {
+			positional = append(positional, args[i+1:]...)
+			break
+		}
+		if !strings.HasPrefix(arg, "-") || arg == "-" {
+			positional = append(positional, arg)
+			continue
+		}
+		name, _, hasValue := strings.Cut(arg, "=")
+		if findFlag(name) == nil {
+			return inv, fmt.Errorf("unknown flag %s, see webpcon --help", name)
+		}
+		if name == "--help" || name == "-h" {
+			inv.help = true
+			continue
+		}
+		inv.flags = append(inv.flags, arg)
+		if valueFlags[name] && !hasValue && i+1 < len(args) {
+			i++
+			inv.flags = append(inv.flags, args[i])
+		}
+	}
+
+	if len(positional) > 0 && positional[0] == "help" {
+		inv.help = true
+		positional = positional[1:]
+	}
+	switch {
+	case len(positional) == 0:
+	case findCommand(positional[0]) != nil:
+		inv.cmd = findCommand(positional[0])
+		positional = positional[1:]
+		if len(positional) > 0 {
+			inv.path, positional = positional[0], positional[1:]
+		}
+	default:
+		inv.path, positional = positional[0], positional[1:]
+		if len(positional) > 0 {
+			if inv.cmd = findCommand(positional[0]); inv.cmd == nil {
+				return inv, fmt.Errorf("unknown command %q, see webpcon --help", positional[0])
+			}
+			positional = positional[1:]
+		}
+	}
+	if len(positional) > 0 {
+		return inv, fmt.Errorf("unexpected argument %q, see webpcon --help", positional[0])
+	}
+	if inv.cmd == nil && inv.path != "" {
+		inv.cmd = findCommand("convert")
+	}
+	if inv.help {
+		return inv, nil
+	}
+	if inv.cmd == nil {
+		return inv, nil
+	}
+	if inv.path == "" {
+		return inv, fmt.Errorf("webpcon %s needs a project path, see webpcon %s --help", inv.cmd.name, inv.cmd.name)
+	}
+	for _, arg := range inv.flags {
+		name, _, _ := strings.Cut(arg, "=")
+		if strings.HasPrefix(arg, "-") && findFlag(name) != nil && !inv.cmd.accepts(name) {
+			return inv, fmt.Errorf("webpcon %s doesn't take %s, see webpcon %s --help", inv.cmd.name, name, inv.cmd.name)
+		}
+	}
+	return inv, nil
+}
+
+// printUsage lists the subcommands, or with cmd set, its flags.
+func printUsage(w io.Writer, cmd *command) {
+	if cmd == nil {
+		fmt.Fprintln(w, "Usage:")
+		fmt.Fprintln(w, "  webpcon <command> <project-path> [flags]")
+		fmt.Fprintln(w, "  webpcon <project-path> [flags]\t# Same as webpcon convert <project-path>")
+		fmt.Fprintln(w, "  webpcon - [flags] < in > out.webp\t# Convert one image from stdin")
+		fmt.Fprintln(w, "  webpcon completion bash|zsh\t# Print a shell completion script")
+		fmt.Fprintln(w, "  webpcon profile export [flags] > profile.json\t# Save settings for --profile")
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Commands:")
+		for _, c := range commands {
+			fmt.Fprintf(w, "  %-10s %s\n", c.name, c.summary)
+		}
+		fmt.Fprintln(w)
+		fmt.Fprintln(w, "Run webpcon <command> --help for its flags.")
+		return
+	}
+
+	fmt.Fprintf(w, "Usage: webpcon %s <project-path> [flags]\n\n%s.\n\nFlags:\n", cmd.name, cmd.summary)
+	for _, name := range concat(cmd.flags, globalFlags) {
+		f := findFlag(name)
+		label := strings.Join(f.names, ", ")
+		if f.value != "" {
+			label += " " + f.value
+		}
+		fmt.Fprintf(w, "  %-32s %s\n", label, f.help)
+	}
+}
+
+// printCompletion writes a completion script for shell.
+func printCompletion(w io.Writer, shell string) error {
+	var names []string
+	for _, c := range commands {
+		names = append(names, c.name)
+	}
+	flagsOf := func(c *command) string {
+		var all []string
+		for _, name := range concat(c.flags, globalFlags) {
+			all = append(all, findFlag(name).names...)
+		}
+		sort.Strings(all)
+		return strings.Join(all, " ")
+	}
+
+	switch shell {
+	case "bash":
+		fmt.Fprintf(w, `_webpcon() {
+    local cur=${COMP_WORDS[COMP_CWORD]} cmd="" w flags
+    for w in "${COMP_WORDS[@]:1:COMP_CWORD-1}"; do
+        case " %s " in *" $w "*) cmd=$w ;; esac
+    done
+    if [[ $cur == -* ]]; then
+        case $cmd in
+`, strings.Join(names, " "))
+		for _, c := range commands {
+			pattern := c.name
+			if c.name == "convert" {
+				pattern = `convert|""`
+			}
+			fmt.Fprintf(w, "            %s) flags=%q ;;\n", pattern, flagsOf(c))
+		}
+		fmt.Fprintf(w, `        esac
+        COMPREPLY=($(compgen -W "$flags" -- "$cur"))
+        return
+    fi
+    [[ -z $cmd ]] && COMPREPLY=($(compgen -W "%s" -- "$cur"))
+    COMPREPLY+=($(compgen -d -- "$cur"))
+}
+complete -F _webpcon webpcon
+`, strings.Join(append(names, "help", "completion"), " "))
+	case "zsh":
+		fmt.Fprintf(w, "#compdef webpcon\n\n_webpcon() {\n    local -a commands\n    commands=(\n")
+		for _, c := range commands {
+			fmt.Fprintf(w, "        %q\n", c.name+":"+c.summary)
+		}
+		fmt.Fprintf(w, `    )
+    local cmd=${words[(r)(%s)]}
+    if [[ $PREFIX == -* ]]; then
+        case $cmd in
+`, strings.Join(names, "|"))
+		for _, c := range commands {
+			pattern := c.name
+			if c.name == "convert" {
+				pattern = `convert|""`
+			}
+			fmt.Fprintf(w, "            %s) compadd -- %s ;;\n", pattern, flagsOf(c))
+		}
+		fmt.Fprint(w, `        esac
+        return
+    fi
+    [[ -z $cmd ]] && _describe command commands
+    _files -/
+}
+
+compdef _webpcon webpcon
+`)
+	default:
+		return fmt.Errorf("completion expects bash or zsh, got %q", shell)
+	}
+	return nil
+}
@@ -0,0 +1,134 @@
+package webpcon
+
+import (
+	"bytes"
+	"os/exec"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestParseCommandLine(t *testing.T) {
+	for _, tt := range []struct {
+		args  []string
+		cmd   string // "" for none
+		path  string
+		flags []string
+		help  bool
+		err   string // "" for success
+	}{
+		{args: nil},
+		{args: []string{"proj"}, cmd: "convert", path: "proj"},
+		{args: []string{"revert", "proj"}, cmd: "revert", path: "proj"},
+		// The older order, path first
+		{args: []string{"proj", "revert"}, cmd: "revert", path: "proj"},
+		{args: []string{"--quality", "70", "convert", "proj", "--lossless"}, cmd: "convert", path: "proj", flags: []string{"--quality", "70", "--lossless"}},
+		{args: []string{"proj", "--quality=70", "-y"}, cmd: "convert", path: "proj", flags: []string{"--quality=70", "-y"}},
+		{args: []string{"--", "-odd"}, cmd: "convert", path: "-odd"},
+		{args: []string{"--help"}, help: true},
+		{args: []string{"help", "revert"}, cmd: "revert", help: true},
+		{args: []string{"revert", "-h"}, cmd: "revert", help: true},
+		// Help doesn't check the flags
+		{args: []string{"runs", "--quality", "70", "--help"}, cmd: "runs", flags: []string{"--quality", "70"}, help: true},
+
+		{args: []string{"proj", "--bogus"}, err: "unknown flag --bogus"},
+		{args: []string{"proj", "frobnicate"}, err: `unknown command "frobnicate"`},
+		{args: []string{"revert", "a", "b"}, err: `unexpected argument "b"`},
+		{args: []string{"revert"}, err: "webpcon revert needs a project path"},
+		{args: []string{"runs", "proj", "--quality", "70"}, err: "webpcon runs doesn't take --quality"},
+		{args: []string{"revert", "proj", "--from-webp", "--lossless"}, err: "webpcon revert doesn't take --lossless"},
+	} {
+		inv, err := parseCommandLine(tt.args)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%q: got %v, want an error with %q", tt.args, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.args, err)
+			continue
+		}
+		cmd := ""
+		if inv.cmd != nil {
+			cmd = inv.cmd.name
+		}
+		if cmd != tt.cmd || inv.path != tt.path || !slices.Equal(inv.flags, tt.flags) || inv.help != tt.help {
+			t.Errorf("%q: command %q, path %q, flags %q, help %t, want %q, %q, %q, %t",
+				tt.args, cmd, inv.path, inv.flags, inv.help, tt.cmd, tt.path, tt.flags, tt.help)
+		}
+	}
+}
+
+func TestPrintUsage(t *testing.T) {
+	var all []string
+	for _, c := range commands {
+		all = append(all, c.name+" ", c.summary)
+	}
+	for _, tt := range []struct {
+		cmd     string // "" for the list of commands
+		want    []string
+		notWant []string
+	}{
+		{"", append(all, "Usage:", "webpcon completion bash|zsh"), []string{"--quality"}},
+		{"convert", []string{"Usage: webpcon convert <project-path> [flags]", "--quality, -q <0-100>", "--yes, -y", "--help, -h"}, nil},
+		{"revert", []string{"Usage: webpcon revert", "--from-webp", "--last-run", "--break-lock"}, []string{"--quality", "--lossless"}},
+		{"runs", []string{"--json", "--no-emoji"}, []string{"--force", "--quality"}},
+		{"serve", []string{"--listen", "--cache-size", "--preset"}, []string{"--force", "--rewrite-refs"}},
+	} {
+		var buf bytes.Buffer
+		printUsage(&buf, findCommand(tt.cmd))
+		out := buf.String()
+		for _, s := range tt.want {
+			if !strings.Contains(out, s) {
+				t.Errorf("help for %q lacks %q:\n%s", tt.cmd, s, out)
+			}
+		}
+		for _, s := range tt.notWant {
+			if strings.Contains(out, s) {
+				t.Errorf("help for %q mentions %q:\n%s", tt.cmd, s, out)
+			}
+		}
+	}
+}
+
+// TestPrintCompletion checks each script offers the commands and each
+// command's flags, and is valid for its shell where that shell is installed.
+func TestPrintCompletion(t *testing.T) {
+	for _, tt := range []struct {
+		shell string
+		want  []string
+	}{
+		{"bash", []string{"complete -F _webpcon webpcon", `revert) flags="`, "--from-webp", `convert|"") flags="`, "help completion"}},
+		{"zsh", []string{"#compdef webpcon", `"revert:Restore the originals and delete the WebP files"`, "revert) compadd -- ", "compdef _webpcon webpcon"}},
+	} {
+		t.Run(tt.shell, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := printCompletion(&buf, tt.shell); err != nil {
+				t.Fatal(err)
+			}
+			out := buf.String()
+			for _, s := range append(tt.want, "decode", "--break-lock", "--no-emoji") {
+				if !strings.Contains(out, s) {
+					t.Errorf("lacks %q", s)
+				}
+			}
+			for _, line := range strings.Split(out, "\n") {
+				if strings.HasPrefix(strings.TrimSpace(line), "runs)") && strings.Contains(line, "--quality") {
+					t.Errorf("offers --quality to runs: %s", line)
+				}
+			}
+			if _, err := exec.LookPath(tt.shell); err != nil {
+				return
+			}
+			sh := exec.Command(tt.shell, "-n")
+			sh.Stdin = &buf
+			if msg, err := sh.CombinedOutput(); err != nil {
+				t.Errorf("%s -n: %v\n%s", tt.shell, err, msg)
+			}
+		})
+	}
+	if err := printCompletion(&bytes.Buffer{}, "fish"); err == nil {
+		t.Error("printCompletion accepted fish")
+	}
+}
@@ -0,0 +1,9 @@
+// Command webpcon converts the images of a web project to WebP. See the
+// README for its usage.
+package main
+
+import "redstonecraftgg/webpcon"
+
+func main() {
+	webpcon.Main()
+}
@@ -0,0 +1,112 @@
+package webpcon
+
+import (
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// source is an image the conversion walk will consider.
+type source struct {
+	rel     string
+	ext     string
+	size    int64
+	modTime time.Time
+}
+
+// scanSources lists the images under root the way the conversion walk finds
+// them, for checks that need to see the whole tree before anything changes.
+// Files matching --exclude-regex and vendored folders are left out like
+// excluded names.
+func scanSources(root string, opts options) []source {
+	return scanSourcesFS(osTree(root), opts)
+}
+
+// scanSourcesFS is scanSources for the tree fsys.
+func scanSourcesFS(fsys fs.FS, opts options) []source {
+	var sources []source
+	fs.WalkDir(fsys, ".", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return nil
+		}
+		rel := filepath.FromSlash(name)
+		if d.IsDir() {
+			if skipDirs[d.Name()] || opts.vendoredReason(fsys, rel) != "" {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return nil
+		}
+		if ext, ok := opts.sourceExt(d.Name(), rel); ok {
+			sources = append(sources, source{rel, ext, info.Size(), info.ModTime()})
+		}
+		return nil
+	})
+	return sources
+}
+
+// sourceExt returns the lowercase extension of the file called name, relPath
+// from the project root, and whether it is an image the conversion walk
+// considers.
+func (o options) sourceExt(name, relPath string) (string, bool) {
+	ext := strings.ToLower(filepath.Ext(name))
+	if skipFiles[name] || !imageExt[ext] || !o.inputEnabled(ext) || o.excluded(relPath) {
+		return ext, false
+	}
+	return ext, true
+}
+
+// findCollisions looks for source images whose WebP outputs would end up as
+// the same file on a case-insensitive filesystem (macOS, Windows): Logo.PNG
+// and logo.png, but also logo.png and logo.jpg. It returns the colliding
+// groups keyed by each member's pathKey.
+func findCollisions(sources []source) map[string][]string {
+	groups := map[string][]string{}
+	for _, src := range sources {
+		out := strings.ToLower(pathKey(webpRel(src.rel, src.ext)))
+		groups[out] = append(groups[out], filepath.ToSlash(src.rel))
+	}
+
+	collisions := map[string][]string{}
+	for _, g := range groups {
+		if len(g) < 2 {
+			continue
+		}
+		sort.Strings(g)
+		for _, rel := range g {
+			collisions[pathKey(rel)] = g
+		}
+	}
+	return collisions
+}
+
+// collisionCause tells why the members of a collision group share a WebP
+// file: the same WebP name outright, as for logo.jpg and logo.png, which
+// collides on every filesystem, or names that differ only by case.
+func collisionCause(group []string) string {
+	seen := map[string]bool{}
+	for _, rel := range group {
+		out := pathKey(webpRel(rel, filepath.Ext(rel)))
+		if seen[out] {
+			return "same WebP name"
+		}
+		seen[out] = true
+	}
+	return "WebP names differ only by case"
+}
+
+// others lists the members of group other than rel.
+func others(group []string, rel string) string {
+	var out []string
+	for _, g := range group {
+		if g != filepath.ToSlash(rel) {
+			out = append(out, g)
+		}
+	}
+	return strings.Join(out, ", ")
+}
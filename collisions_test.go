@@ -0,0 +1,77 @@
+package webpcon
+
+import (
+	"os"
+	"reflect"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestFindCollisions(t *testing.T) {
+	png := encodeFixture(t, ".png", 4, 4)
+	for _, tt := range []struct {
+		name  string
+		files []string
+		want  [][]string // Each group once, sorted
+	}{
+		{"none", []string{"a.png", "b.png", "sub/a.png"}, nil},
+		{"case", []string{"Logo.PNG", "logo.png"}, [][]string{{"Logo.PNG", "logo.png"}}},
+		{"formats", []string{"img/pic.jpg", "img/pic.png", "img/pic.gif"}, [][]string{{"img/pic.gif", "img/pic.jpg", "img/pic.png"}}},
+		{"folder case", []string{"Img/a.png", "img/a.png"}, [][]string{{"Img/a.png", "img/a.png"}}},
+		{"skipped folders", []string{"a.png", "node_modules/A.png", "dist/a.jpg"}, nil},
+		{"not images", []string{"a.png", "a.txt", "A.md"}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var files []fixtureFile
+			for _, rel := range tt.files {
+				files = append(files, fixtureFile{rel, png})
+			}
+			root := writeFixtureTree(t, files)
+			if entries, _ := os.ReadDir(root); len(tt.want) > 0 && strings.EqualFold(tt.files[0], tt.files[1]) && len(entries) < 2 {
+				t.Skip("this filesystem is case-insensitive")
+			}
+			var got [][]string
+			for _, g := range findCollisions(scanSources(root, testOptions(t))) {
+				if !slices.ContainsFunc(got, func(h []string) bool { return slices.Equal(g, h) }) {
+					got = append(got, g)
+				}
+			}
+			slices.SortFunc(got, func(a, b []string) int { return strings.Compare(a[0], b[0]) })
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("collisions %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestCollisionNormalForms puts both forms of one name in a folder, as
+// syncing between macOS and Linux can: they are one file on macOS, so they
+// collide, and neither is converted unless --force.
+func TestCollisionNormalForms(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		webp int
+	}{
+		{nil, 0},
+		{[]string{"--force"}, 2},
+	} {
+		root := writeFixtureTree(t, []fixtureFile{
+			{cafeNFC + ".png", encodeFixture(t, ".png", 12, 10)},
+			{cafeNFD + ".png", encodeFixture(t, ".png", 10, 12)},
+		})
+		if entries, _ := os.ReadDir(root); len(entries) != 2 {
+			t.Skip("this filesystem normalizes names")
+		}
+		convertTree(t, root, testOptions(t, tt.args...))
+		n := 0
+		for rel := range treeFiles(t, root) {
+			if strings.HasSuffix(rel, ".webp") {
+				n++
+			}
+		}
+		if n != tt.webp {
+			t.Errorf("%v: %d WebP file(s) written, want %d", tt.args, n, tt.webp)
+		}
+	}
+}
@@ -0,0 +1,90 @@
+package webpcon
+
+import (
+	"fmt"
+	"path/filepath"
+)
+
+// What --on-conflict does with a source whose WebP name is taken by a file
+// webpcon didn't write, like a hand-made photo.webp next to photo.jpg.
+const (
+	conflictSkip      = "skip"      // Leave the source alone (the default)
+	conflictOverwrite = "overwrite" // Replace the file (the default under --force)
+	conflictRename    = "rename"    // Write photo.jpg.webp instead
+)
+
+// webpConflict is a source whose WebP name was taken, and what was done.
+type webpConflict struct {
+	File   string `json:"file"`
+	WebP   string `json:"webp"`   // The file that was there
+	Action string `json:"action"` // "skipped", "overwritten" or "renamed"
+	Output string `json:"output,omitempty"`
+}
+
+// conflictPolicy is --on-conflict, or overwrite when only --force is given.
+func (o options) conflictPolicy() string {
+	if o.onConflict == "" && o.force {
+		return conflictOverwrite
+	}
+	if o.onConflict == "" {
+		return conflictSkip
+	}
+	return o.onConflict
+}
+
+// writtenOutputs is the set of WebP files the map file lists, by pathKey.
+// Any other file of a WebP's name was put there by someone else.
+func (m *mapping) writtenOutputs() map[string]bool {
+	written := make(map[string]bool, len(m.entries))
+	for _, e := range m.entries {
+		written[pathKey(filepath.FromSlash(e.WebP))] = true
+	}
+	return written
+}
+
+// wrote records webp, relative to the project root, as written by this run,
+// so a later source of the same WebP name doesn't take it for someone else's.
+func (s *selector) wrote(webp string) {
+	s.written[pathKey(webp)] = true
+}
+
+// taken tells whether webp, relative to the project root, exists in s.dst
+// without webpcon having written it.
+func (s *selector) taken(webp string) bool {
+	return !s.written[pathKey(webp)] && treeHas(s.dst, webp)
+}
+
+// outputFor returns where the WebP of the source relPath goes, and the file
+// of its usual name that had to be avoided or is overwritten, if any. It is
+// "" when the way is clear.
+func (s *selector) outputFor(relPath, ext string) (webp, conflict string) {
+	webp = webpRel(relPath, ext)
+	if !s.taken(webp) {
+		return webp, ""
+	}
+	if s.opts.conflictPolicy() == conflictRename {
+		return relPath + ".webp", webp
+	}
+	return webp, webp
+}
+
+// addConflict records what happened to a source whose WebP name was taken.
+func (s *summary) addConflict(relPath, webp, action, output string) {
+	s.conflicts = append(s.conflicts, webpConflict{filepath.ToSlash(relPath), filepath.ToSlash(webp), action, filepath.ToSlash(output)})
+}
+
+// printConflicts lists the sources whose WebP name was taken.
+func (s *summary) printConflicts() {
+	if len(s.conflicts) == 0 {
+		return
+	}
+	fmt.Fprintf(stdout, "⚠️  %d file(s) had their WebP name taken by a file webpcon didn't write (--on-conflict %s):\n", len(s.conflicts), s.conflictPolicy)
+	for _, c := range s.conflicts {
+		switch c.Action {
+		case "renamed":
+			fmt.Fprintf(stdout, "   %s: %s kept, wrote %s\n", c.File, c.WebP, c.Output)
+		default:
+			fmt.Fprintf(stdout, "   %s: %s %s\n", c.File, c.WebP, c.Action)
+		}
+	}
+}
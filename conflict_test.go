@@ -0,0 +1,116 @@
+package webpcon
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// handMadeWebP is a WebP webpcon didn't write, as someone might put next to
+// a source.
+func handMadeWebP(tb testing.TB) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	if err := (nativeEncoder{}).encode(&buf, fixtureImage(8, 8), encodeOptions{lossless: true}); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestOnConflict converts a JPEG whose WebP name is taken by a hand-made
+// WebP under each --on-conflict policy, then reverts. Skipping and renaming
+// leave the hand-made file as it was through both.
+func TestOnConflict(t *testing.T) {
+	hand := handMadeWebP(t)
+	files := []fixtureFile{
+		{"photos/beach.jpg", encodeFixture(t, ".jpg", 64, 48)},
+		{"photos/beach.webp", hand},
+		{"img/logo.png", encodeFixture(t, ".png", 40, 30)},
+	}
+	for _, tt := range []struct {
+		name   string
+		args   []string
+		policy string
+		action string
+		output string // Where the WebP of photos/beach.jpg goes, "" for nowhere
+	}{
+		{"default", nil, conflictSkip, "skipped", ""},
+		{"skip", []string{"--on-conflict", "skip"}, conflictSkip, "skipped", ""},
+		{"force", []string{"--force"}, conflictOverwrite, "overwritten", "photos/beach.webp"},
+		{"overwrite", []string{"--on-conflict", "overwrite"}, conflictOverwrite, "overwritten", "photos/beach.webp"},
+		{"rename", []string{"--on-conflict", "rename"}, conflictRename, "renamed", "photos/beach.jpg.webp"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			quietly(t)
+			root := writeFixtureTree(t, files)
+			before := treeFiles(t, root)
+			sum := convertTree(t, root, testOptions(t, append([]string{"--encoder", "native"}, tt.args...)...))
+			if sum.OnConflict != tt.policy {
+				t.Errorf("policy %q, want %q", sum.OnConflict, tt.policy)
+			}
+			if len(sum.Conflicts) != 1 || sum.Conflicts[0].File != "photos/beach.jpg" || sum.Conflicts[0].Action != tt.action {
+				t.Fatalf("conflicts %+v, want photos/beach.jpg %s", sum.Conflicts, tt.action)
+			}
+
+			after := treeFiles(t, root)
+			e := readMapFile(t, root)["photos/beach.jpg"]
+			switch {
+			case tt.output == "":
+				if e != nil || after["photos/beach.jpg"] == nil {
+					t.Errorf("photos/beach.jpg converted despite %s", tt.policy)
+				}
+			case e == nil || e.WebP != tt.output || e.Renamed != (tt.policy == conflictRename):
+				t.Errorf("photos/beach.jpg mapped as %+v, want %s", e, tt.output)
+			}
+			if kept := bytes.Equal(after["photos/beach.webp"], hand); kept != (tt.policy != conflictOverwrite) {
+				t.Errorf("hand-made photos/beach.webp kept %t under %s", kept, tt.policy)
+			}
+			if readMapFile(t, root)["img/logo.png"] == nil {
+				t.Error("img/logo.png, without a conflict, wasn't converted")
+			}
+
+			if err := revertImages(root); err != nil {
+				t.Fatal(err)
+			}
+			if tt.policy != conflictOverwrite {
+				checkReverted(t, root, before)
+			}
+		})
+	}
+	if _, err := parseOptions([]string{"--on-conflict", "merge"}); err == nil {
+		t.Error("--on-conflict merge was accepted")
+	}
+}
+
+// TestRevertFromWebPHandMade checks revert --from-webp, with the backup gone,
+// rebuilds only what webpcon wrote and leaves a hand-made WebP alone.
+func TestRevertFromWebPHandMade(t *testing.T) {
+	quietly(t)
+	hand := handMadeWebP(t)
+	root := writeFixtureTree(t, []fixtureFile{
+		{"img/logo.png", encodeFixture(t, ".png", 40, 30)},
+		{"img/hero.webp", hand},
+	})
+	convertTree(t, root, testOptions(t, "--encoder", "native"))
+	if err := os.RemoveAll(filepath.Join(root, ".webpcon_backup")); err != nil {
+		t.Fatal(err)
+	}
+	res, err := runRevert(root, revertFromWebP)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(res.Reconstructed, []string{"img/logo.png"}) {
+		t.Errorf("rebuilt %q, want img/logo.png", res.Reconstructed)
+	}
+	after := treeFiles(t, root)
+	if !bytes.Equal(after["img/hero.webp"], hand) {
+		t.Error("img/hero.webp, hand-made, changed")
+	}
+	for _, rel := range []string{"img/hero.png", "img/logo.webp"} {
+		if _, ok := after[rel]; ok {
+			t.Errorf("%s left after revert --from-webp", rel)
+		}
+	}
+}
@@ -0,0 +1,886 @@
+package webpcon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// convertRun is what the files of one conversion run share, set up by
+// runConvert before the walk.
+type convertRun struct {
+	root       string
+	src        fs.FS  // The files under root, what is converted
+	dst        Writer // Where the WebP files go, the project itself but with ConvertFS
+	outRoot    string // dst on disk, "" with ConvertFS
+	cacheDir   string // Where animations are built
+	copyOut    bool   // With ConvertFS: the originals stay in src, with no backup
+	opts       options
+	sum        *summary
+	thr        *throttle
+	overrides  *overrideLoader
+	encoded    map[string]encodedOutput // Dedupe key -> first file converted with it
+	sel        *selector
+	collisions map[string][]string // See findCollisions
+	filter     *filterHook         // With --filter-hook, nil without
+	hashes     *hashCache
+	outputs    *mapping
+	runs       *runLog
+	run        *runRecord
+	bin        trasher // With --trash
+	con        *console
+	prog       *progress
+	started    int // Files started, for --limit
+	runStart   time.Time
+}
+
+// fileConversion is one file on its way through the stages of a conversion.
+type fileConversion struct {
+	path  string
+	rel   string // From the project root
+	info  os.FileInfo
+	ext   string // In lower case
+	out   *fileLog
+	fopts options // The run's options with the file's overrides applied
+
+	outRel   string // WebP file from the project root, see outputFor
+	webpPath string
+	external bool   // Decoded by --external-decoder
+	hash     string // Of the original
+	bakPath  string // Where the original went; its own path with --trash
+
+	perm       fs.FileMode
+	readOnly   bool   // Lifted for the move by --chmod-readonly
+	superseded string // Where an earlier backup of a different version went
+	created    bool   // Set once the WebP file exists, if only in part
+	done       bool   // Set once the WebP is in place
+
+	// What the progress events and the summary groups are told
+	status  string
+	reason  string
+	outSize int64
+
+	ft        fileTiming
+	fileStart time.Time
+	start     time.Time // When decoding started, for the encode time
+}
+
+// name is the name in src and dst of path, a path under root.
+func (r *convertRun) name(path string) string {
+	rel, _ := filepath.Rel(r.root, path)
+	return treeName(rel)
+}
+
+// walk walks src as filepath.Walk walks root, calling visit with the paths
+// under root.
+func (r *convertRun) walk(visit filepath.WalkFunc) error {
+	return fs.WalkDir(r.src, ".", func(name string, d fs.DirEntry, err error) error {
+		path := filepath.Join(r.root, filepath.FromSlash(name))
+		if err != nil {
+			return visit(path, nil, err)
+		}
+		info, err := d.Info()
+		if err != nil {
+			return visit(path, nil, err)
+		}
+		return visit(path, info, nil)
+	})
+}
+
+// move renames the file at oldRel to newRel, both relative to root. With
+// ConvertFS the file stays in src and is copied to dst instead.
+func (r *convertRun) move(oldRel, newRel string) error {
+	if !r.copyOut {
+		return r.dst.Rename(treeName(oldRel), treeName(newRel))
+	}
+	in, err := r.src.Open(treeName(oldRel))
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	return writeTreeFile(r.dst, treeName(newRel), in)
+}
+
+// visit is the filepath.WalkFunc of a conversion: it picks the files to
+// convert, counts them against --limit and --max-duration, and hands them to
+// convertFile.
+func (r *convertRun) visit(path string, info os.FileInfo, err error) (ferr error) {
+	if errors.Is(err, syscall.EMFILE) {
+		return err // Rather than skip the rest of a folder without a word
+	}
+	if err != nil {
+		return nil
+	}
+	if r.opts.interrupted() {
+		return errInterrupted
+	}
+	rel, _ := filepath.Rel(r.root, path)
+	if info.IsDir() {
+		if skipDirs[info.Name()] || r.opts.excludedDir(rel) {
+			return filepath.SkipDir
+		}
+		if reason := r.opts.vendoredReason(r.src, rel); reason != "" {
+			r.con.printf("⏭️ Skipping vendored folder %s (%s)\n", rel, reason)
+			r.sum.vendored = append(r.sum.vendored, vendoredDir{filepath.ToSlash(rel), reason})
+			return filepath.SkipDir
+		}
+		return nil
+	}
+	out := r.con.file(rel)
+	defer out.done()
+
+	ok, reason, detail, err := r.sel.shouldConvert(rel, info)
+	if reason == skipNotImage || reason == skipExcluded {
+		r.sel.logSkip(out, r.sum, path, rel, reason, detail)
+		return nil
+	}
+	f := &fileConversion{path: path, rel: rel, info: info, out: out, status: "skipped", reason: reason}
+	defer func() {
+		var full *diskFullError
+		var busy *inUseError
+		if errors.As(ferr, &full) || errors.As(ferr, &busy) {
+			return // Reported by convert once it is retried or given up on
+		}
+		err := ferr
+		if errors.Is(err, errInterrupted) {
+			f.status, f.reason, err = "skipped", skipNotAttempted, nil // Rolled back
+		}
+		r.prog.fileFinished(rel, f.status, f.reason, info.Size(), f.outSize, err)
+		r.sum.addToGroup(rel, f.status, info.Size(), f.outSize, err != nil)
+	}()
+	if fileInUse(err) {
+		out.printf("🔒 %s is in use by another program, leaving it for now: %v\n", rel, err)
+		return &inUseError{rel, info.Size(), err}
+	}
+	if r.sum.permissionDenied(out, rel, err) {
+		return nil
+	}
+	if err != nil {
+		out.printf("❌ Error reading image header %s: %v\n", path, err)
+		return err
+	}
+	if !ok {
+		r.sel.logSkip(out, r.sum, path, rel, reason, detail)
+		return nil
+	}
+	f.ext = strings.ToLower(filepath.Ext(info.Name()))
+	// Checked before anything else looks at its WebP name. Read errors
+	// are left to checkSupported
+	if format, _ := sniffFile(r.src, treeName(rel), f.ext); format == ".webp" {
+		f.reason = skipMisnamedWebP
+		return r.sum.misnamedWebP(out, rel, r.sel, r.opts.fixExtensions, r.move)
+	}
+	if group := r.collisions[pathKey(rel)]; group != nil {
+		r.sum.addCollision(group)
+		out.printf("⚠️  %s shares its WebP file with %s (%s)\n", path, others(group, rel), collisionCause(group))
+	}
+	outRel, conflict := r.sel.outputFor(rel, f.ext)
+	switch {
+	case conflict == "":
+	case outRel != conflict:
+		r.sum.addConflict(rel, conflict, "renamed", outRel)
+		out.printf("⚠️  %s exists and wasn't written by webpcon, writing %s instead\n", filepath.ToSlash(conflict), filepath.ToSlash(outRel))
+	default:
+		r.sum.addConflict(rel, conflict, "overwritten", "")
+		out.printf("⚠️  Overwriting %s, which wasn't written by webpcon\n", filepath.ToSlash(conflict))
+	}
+	f.outRel, f.webpPath = outRel, filepath.Join(r.outRoot, outRel)
+
+	// Files the decoders can't read are left alone rather than failing the
+	// run after the original was moved. With --external-decoder, those
+	// using unsupported features go to it instead
+	if err := checkSupported(r.src, treeName(rel), f.ext); err != nil {
+		if fileInUse(err) {
+			out.printf("🔒 %s is in use by another program, leaving it for now: %v\n", rel, err)
+			return &inUseError{rel, info.Size(), err}
+		}
+		if r.sum.permissionDenied(out, rel, err) {
+			return nil
+		}
+		reason := unsupportedReason(err)
+		if reason == "" || r.opts.externalDecoder == "" {
+			r.sum.skipUnsupported(out, rel, reason, err)
+			return nil
+		}
+		f.external = true
+	}
+
+	// Past --limit or --max-duration the rest is only counted, for the next run
+	if r.sum.stopped == "" {
+		if r.opts.limit > 0 && r.started >= r.opts.limit {
+			r.sum.stopped = fmt.Sprintf("--limit %d", r.opts.limit)
+		} else if r.opts.maxDuration > 0 && time.Since(r.runStart) >= r.opts.maxDuration {
+			r.sum.stopped = fmt.Sprintf("--max-duration %s", r.opts.maxDuration)
+		}
+		if r.sum.stopped != "" {
+			r.con.printf("⏸️  Reached %s, leaving the remaining files for the next run\n", r.sum.stopped)
+		}
+	}
+	if r.sum.stopped != "" {
+		r.sum.remaining++
+		f.reason = skipNotAttempted
+		return nil
+	}
+	r.started++
+	return r.convertFile(f)
+}
+
+// convertFile converts a file visit picked: it applies the overrides and
+// the filter hook, backs the original up, and reuses the output of an
+// identical file or decodes and encodes it.
+func (r *convertRun) convertFile(f *fileConversion) (ferr error) {
+	r.thr.pause()
+	f.out.println("🔄 Converting:", f.path)
+	r.prog.fileStarted(f.rel)
+	f.fileStart = time.Now()
+	f.ft = fileTiming{file: filepath.ToSlash(f.rel)}
+
+	var err error
+	if f.fopts, err = r.overrides.optionsFor(f.path, r.opts); err != nil {
+		f.out.printf("❌ Error reading option overrides: %v\n", err)
+		return err
+	}
+	if skip, err := r.applyFilter(f); skip || err != nil {
+		return err
+	}
+
+	ioStart := time.Now()
+	f.hash, err = r.hashes.hash(r.src, f.rel, f.info)
+	f.ft.io += time.Since(ioStart)
+	if fileInUse(err) {
+		return r.inUse(f, err)
+	}
+	if r.sum.permissionDenied(f.out, f.rel, err) {
+		return nil
+	}
+	if err != nil {
+		f.out.printf("❌ Error hashing %s: %v\n", f.path, err)
+		return err
+	}
+	dedupeKey := f.hash + f.ext + f.fopts.encodeKey()
+	if r.opts.checkLocks {
+		if err := advisoryLock(f.path); fileInUse(err) {
+			return r.inUse(f, err)
+		}
+	}
+
+	if skip, err := r.backUp(f); skip || err != nil {
+		return err
+	}
+	if r.opts.trash {
+		defer r.trashOriginal(f)
+	}
+	if f.readOnly {
+		defer os.Chmod(longPath(f.bakPath), f.perm)
+	}
+	defer func() { ferr = r.rollBack(f, ferr) }()
+
+	if first, ok := r.encoded[dedupeKey]; ok {
+		return r.reuseDuplicate(f, first)
+	}
+	f.start = time.Now()
+	img, frames, err := r.decode(f)
+	if img == nil {
+		return err
+	}
+	if r.opts.interrupted() {
+		return errInterrupted
+	}
+	if frames != nil && len(frames.Image) > 1 {
+		err = r.convertAnimation(f, frames)
+	} else {
+		err = r.convertStill(f, img)
+	}
+	if f.done {
+		r.encoded[dedupeKey] = encodedOutput{f.rel, f.outRel, f.webpPath}
+	}
+	return err
+}
+
+// inUse leaves a file another program has open, before anything was moved,
+// for convert to try again at the end of the run.
+func (r *convertRun) inUse(f *fileConversion, err error) error {
+	r.started--
+	f.out.printf("🔒 %s is in use by another program, leaving it for now: %v\n", f.rel, err)
+	return &inUseError{f.rel, f.info.Size(), err}
+}
+
+// applyFilter asks --filter-hook about f, applying any options it returns.
+// skip is set for a file it vetoed or failed on.
+func (r *convertRun) applyFilter(f *fileConversion) (skip bool, err error) {
+	if r.filter == nil {
+		return false, nil
+	}
+	verdict, err := r.filter.check(f.path, f.rel)
+	if err != nil {
+		f.out.printf("⚠️  Filter hook failed for %s, leaving it untouched: %v\n", f.rel, err)
+		r.sum.filtered = append(r.sum.filtered, f.rel)
+		return true, nil
+	}
+	if verdict.skip {
+		f.out.printf("⏭️ Skipping %s (vetoed by filter hook)\n", f.rel)
+		r.sum.filtered = append(r.sum.filtered, f.rel)
+		return true, nil
+	}
+	if verdict.overrides != nil {
+		if err := verdict.overrides.apply(&f.fopts); err != nil {
+			f.out.printf("❌ Bad options from filter hook for %s: %v\n", f.rel, err)
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+// backUp moves the original of f into the backup. With --trash it stays
+// where it is, to be read there and go to the trash once its WebP has been
+// written. With ConvertFS it stays too, and its folder is made in dst. skip is
+// set for a file left alone.
+func (r *convertRun) backUp(f *fileConversion) (skip bool, err error) {
+	// A backup an earlier run still needs is the oldest original and
+	// stays; this one goes under the run's own directory
+	f.bakPath = filepath.Join(r.root, ".webpcon_backup", f.rel)
+	if r.runs.backedUp(r.root, f.bakPath) {
+		f.bakPath = filepath.Join(r.root, ".webpcon_backup", runsDir, r.run.ID, f.rel)
+	}
+	f.perm = f.info.Mode().Perm()
+	ioStart := time.Now()
+	defer func() { f.ft.io += time.Since(ioStart) }()
+	if r.copyOut {
+		f.bakPath = f.path
+		if err := r.dst.MkdirAll(path.Dir(treeName(f.outRel)), 0755); err != nil {
+			f.out.printf("❌ Error creating directory for %s: %v\n", f.outRel, err)
+			return true, err
+		}
+		return false, nil
+	}
+	if r.opts.trash {
+		f.bakPath = f.path
+		return false, nil
+	}
+
+	bakDir := filepath.Dir(f.bakPath)
+	if err := r.dst.MkdirAll(r.name(bakDir), 0755); err != nil {
+		f.out.printf("❌ Error creating backup directory %s: %v\n", bakDir, err)
+		return true, err
+	}
+
+	// A backup left from before a plain revert is the file as it was
+	// then. If the file changed since, that backup is moved aside
+	// rather than overwritten.
+	if old, err := hashFS(r.dst, r.name(f.bakPath)); err == nil && old != f.hash {
+		supersededRel := filepath.Join(".webpcon_backup", supersededDir, r.run.ID, f.rel)
+		f.superseded = filepath.Join(r.root, supersededRel)
+		if err := r.dst.MkdirAll(r.name(filepath.Dir(f.superseded)), 0755); err != nil {
+			f.out.printf("❌ Error creating backup directory %s: %v\n", filepath.Dir(f.superseded), err)
+			return true, err
+		}
+		if err := r.dst.Rename(r.name(f.bakPath), r.name(f.superseded)); err != nil {
+			f.out.printf("❌ Error moving the earlier backup of %s aside: %v\n", f.rel, err)
+			return true, err
+		}
+		f.out.printf("💾 Kept the earlier, different backup of %s as %s\n", f.rel, supersededRel)
+	}
+
+	// Windows refuses to move read-only files. With --chmod-readonly the
+	// attribute is lifted for the move and put back on the backup.
+	readOnly := r.opts.chmodReadonly && f.perm&0200 == 0
+	if readOnly {
+		os.Chmod(longPath(f.path), f.perm|0200)
+	}
+	if err := r.dst.Rename(r.name(f.path), r.name(f.bakPath)); err != nil {
+		if readOnly {
+			os.Chmod(longPath(f.path), f.perm)
+		}
+		if f.superseded != "" {
+			r.dst.Rename(r.name(f.superseded), r.name(f.bakPath))
+		}
+		if fileInUse(err) {
+			return true, r.inUse(f, err)
+		}
+		if r.sum.permissionDenied(f.out, f.rel, err) {
+			return true, nil
+		}
+		f.out.printf("❌ Error moving %s to backup: %v\n", f.path, err)
+		return true, err
+	}
+	f.readOnly = readOnly
+	f.out.printf("💾 Moved to backup: %s\n", f.rel)
+	return false, nil
+}
+
+// trashOriginal sends the original of f to the trash with --trash, once its
+// WebP is in place.
+func (r *convertRun) trashOriginal(f *fileConversion) {
+	if !f.done {
+		return
+	}
+	if err := r.bin.trash(f.path); err != nil {
+		f.out.printf("⚠️  Could not move %s to the trash, it was left in place: %v\n", f.rel, err)
+		return
+	}
+	r.outputs.get(f.rel).Trashed = true
+	f.out.printf("🗑️  Moved to trash: %s\n", f.rel)
+}
+
+// putBack moves the original of f back from the backup.
+func (r *convertRun) putBack(f *fileConversion) bool {
+	if r.opts.trash || r.copyOut {
+		return true
+	}
+	if r.dst.Rename(r.name(f.bakPath), r.name(f.path)) != nil {
+		return false
+	}
+	if f.readOnly {
+		os.Chmod(longPath(f.path), f.perm)
+	}
+	if f.superseded != "" {
+		r.dst.Rename(r.name(f.superseded), r.name(f.bakPath))
+	}
+	return true
+}
+
+// rollBack rolls f back when ferr is a full disk, for convert to try it
+// again once there is room, or an interruption, and returns the error to
+// report.
+func (r *convertRun) rollBack(f *fileConversion, ferr error) error {
+	interrupted := errors.Is(ferr, errInterrupted)
+	if f.done || !diskFull(ferr) && !interrupted {
+		return ferr
+	}
+	if f.created {
+		r.dst.Remove(treeName(f.outRel))
+		r.outputs.remove(f.rel)
+	}
+	deleteCache(r.cacheDir)
+	if interrupted {
+		if !r.putBack(f) {
+			f.out.printf("❌ Error putting back %s after the interruption; the original is in %s\n", f.rel, f.bakPath)
+			return fmt.Errorf("%s: could not put the original back", f.rel)
+		}
+		f.out.printf("↩️  Rolled back %s, the run was interrupted\n", f.rel)
+		return ferr
+	}
+	if !r.putBack(f) {
+		f.out.printf("❌ Error putting back %s after the disk filled up; the original is in %s\n", f.rel, f.bakPath)
+		return ferr
+	}
+	return &diskFullError{f.rel, f.info.Size(), ferr}
+}
+
+// finish records f once its WebP is in place, and runs --post-hook.
+func (r *convertRun) finish(f *fileConversion) error {
+	f.done = true
+	f.status = "converted"
+	if fi, err := fs.Stat(r.dst, treeName(f.outRel)); err == nil {
+		f.outSize = fi.Size()
+	}
+	r.sum.sourceSize += f.info.Size()
+	r.sum.outputSize += f.outSize
+	r.run.add(r.root, f.rel, f.bakPath)
+	r.sel.wrote(f.outRel)
+	if e := r.outputs.get(f.rel); e != nil {
+		e.Run, e.ConvertedAt, e.Options, e.Preset = r.run.ID, r.run.Time.Format(time.RFC3339), f.fopts.encodeKey(), f.fopts.preset
+		e.Renamed = f.outRel != webpRel(f.rel, f.ext)
+		if f.superseded != "" {
+			e.SupersededBackup = filepath.ToSlash(filepath.Join(".webpcon_backup", supersededDir, r.run.ID, f.rel))
+		}
+	}
+	if r.opts.postHook == "" {
+		return nil
+	}
+	vars := map[string]string{"src": f.path, "dst": f.webpPath, "backup": f.bakPath}
+	if err := runHook(r.opts.postHook, vars, nil, r.opts.hookTimeout); err != nil {
+		f.out.printf("⚠️  Post-hook failed for %s: %v\n", f.rel, err)
+		r.sum.hookFailed = append(r.sum.hookFailed, f.rel)
+		if r.opts.hookStrict {
+			return err
+		}
+	}
+	return nil
+}
+
+// verify checks the written WebP of f. A bad one fails the conversion: it is
+// deleted and the original put back.
+func (r *convertRun) verify(f *fileConversion, width, height int) error {
+	verifyStart := time.Now()
+	err := verifyWebP(r.dst, treeName(f.outRel), width, height, r.opts.verifyFull)
+	f.ft.io += time.Since(verifyStart)
+	if err == nil {
+		return nil
+	}
+	r.dst.Remove(treeName(f.outRel))
+	if r.putBack(f) {
+		f.out.printf("❌ Bad output for %s, kept the original: %v\n", f.rel, err)
+	} else {
+		f.out.printf("❌ Bad output for %s, the original is in %s: %v\n", f.rel, f.bakPath, err)
+	}
+	return fmt.Errorf("%s: %v", f.rel, err)
+}
+
+// keepSmaller puts the original of f back when its WebP of size doesn't
+// save enough, see options.saves.
+func (r *convertRun) keepSmaller(f *fileConversion, size int64) error {
+	if !r.putBack(f) {
+		f.out.printf("❌ Error putting back %s, which is smaller than its WebP; the original is in %s\n", f.rel, f.bakPath)
+		return fmt.Errorf("%s: could not put the original back", f.rel)
+	}
+	r.sum.keptSmaller = append(r.sum.keptSmaller, f.rel)
+	f.out.printf("↩️  Kept %s, it is already smaller than its WebP (%s vs %s)\n", f.rel, formatSize(f.info.Size()), formatSize(size))
+	return nil
+}
+
+// restore puts the original of f back when the output can't be written for
+// lack of permissions.
+func (r *convertRun) restore(f *fileConversion, err error) bool {
+	if !errors.Is(err, fs.ErrPermission) || !r.putBack(f) {
+		return false
+	}
+	return r.sum.permissionDenied(f.out, f.rel, err)
+}
+
+// score runs measure when --metrics is on. A result below --min-ssim is
+// flagged, and with --keep-low-ssim the original is put back, the WebP
+// deleted and keep is false.
+func (r *convertRun) score(f *fileConversion, measure func() (*qualityScore, error)) (q *qualityScore, keep bool) {
+	if !r.opts.metrics {
+		return nil, true
+	}
+	q, err := measure()
+	if err != nil {
+		f.out.printf("⚠️  Could not measure the quality of %s: %v\n", f.rel, err)
+		return nil, true
+	}
+	if r.opts.minSSIM > 0 && q.ssim < r.opts.minSSIM {
+		r.sum.lowSSIM = append(r.sum.lowSSIM, f.rel)
+		if r.opts.keepLowSSIM && r.putBack(f) {
+			r.dst.Remove(treeName(f.outRel))
+			f.out.printf("↩️  SSIM %.4f is below %g, kept the original: %s\n", q.ssim, r.opts.minSSIM, f.rel)
+			return q, false
+		}
+		f.out.printf("⚠️  SSIM %.4f is below --min-ssim %g: %s\n", q.ssim, r.opts.minSSIM, f.rel)
+	}
+	return q, true
+}
+
+// reuseDuplicate places the output of first, an identical file converted
+// earlier in the run with the same settings, as the WebP of f.
+func (r *convertRun) reuseDuplicate(f *fileConversion, first encodedOutput) error {
+	prev := r.outputs.get(first.relPath)
+	sha := ""
+	if prev != nil {
+		sha = prev.SHA256
+	}
+	// Hard links only work on disk, and fall back to copying there
+	how, err := "copied", error(nil)
+	if f.fopts.hardlinkDupes {
+		how, err = reuseOutput(first.webpPath, f.webpPath, true, sha)
+	} else {
+		err = copyTreeFile(r.dst, treeName(first.outRel), treeName(f.outRel), sha)
+	}
+	if r.restore(f, err) {
+		return nil
+	}
+	if err != nil {
+		f.out.printf("❌ Error reusing %s for %s: %v\n", first.webpPath, f.webpPath, err)
+		return err
+	}
+	if prev != nil && prev.Width > 0 {
+		if err := r.verify(f, prev.Width, prev.Height); err != nil {
+			return err
+		}
+	}
+	r.sum.addDuplicate(first.relPath, f.rel)
+	e := r.outputs.add(f.rel, f.outRel)
+	if prev != nil {
+		e.BlurHash, e.Placeholder = prev.BlurHash, prev.Placeholder
+		e.PSNR, e.SSIM, e.SHA256 = prev.PSNR, prev.SSIM, prev.SHA256
+		e.setSize(prev.Width, prev.Height)
+		e.Trim = prev.Trim
+		if thumb := placeholderPath(first.webpPath); r.opts.placeholderFiles && fileExists(thumb) {
+			if _, err := reuseOutput(thumb, placeholderPath(f.webpPath), f.fopts.hardlinkDupes, ""); err != nil {
+				f.out.printf("⚠️  Could not copy placeholder for %s: %v\n", f.rel, err)
+			}
+		}
+		if prev.Fallback != "" {
+			if err := copyFile(filepath.Join(r.root, prev.Fallback), f.path); err != nil {
+				f.out.printf("❌ Error copying the fallback of %s for %s: %v\n", first.relPath, f.rel, err)
+				return err
+			}
+			e.Fallback = filepath.ToSlash(f.rel)
+		}
+	}
+	f.out.printf("✅ Converted (duplicate of %s, %s): %s -> %s\n", first.relPath, how, f.rel, filepath.Base(f.webpPath))
+	return r.finish(f)
+}
+
+// decode decodes the backed up original of f, see decodeOriginal, putting
+// it back when that fails. img is nil when there is nothing to encode, with
+// err nil for a file skipped as unsupported.
+func (r *convertRun) decode(f *fileConversion) (img image.Image, frames *gif.GIF, err error) {
+	in, err := r.src.Open(r.name(f.bakPath))
+	if err != nil {
+		f.out.printf("❌ Error opening backup file %s: %v\n", f.bakPath, err)
+		return nil, nil, err
+	}
+	img, frames, repairs, err := decodeOriginal(in, f.bakPath, f.ext, f.external, f.fopts)
+	// Not deferred: encoding can take long and has no use for the file
+	in.Close()
+	f.ft.decode = time.Since(f.start)
+	if err != nil {
+		if !r.putBack(f) {
+			f.out.printf("❌ Error decoding image %s: %v\n", f.bakPath, err)
+			return nil, nil, err
+		}
+		if reason := unsupportedReason(err); reason != "" {
+			r.sum.skipUnsupported(f.out, f.rel, reason, err)
+			return nil, nil, nil
+		}
+		var malformed *malformedGIFError
+		if errors.As(err, &malformed) {
+			r.sum.skipUnsupported(f.out, f.rel, malformed.Error(), err)
+			return nil, nil, nil
+		}
+		f.out.printf("❌ Error decoding image %s, kept the original: %v\n", f.rel, err)
+		return nil, nil, err
+	}
+	for _, repair := range repairs {
+		f.out.printf("⚠️  %s: %s\n", f.rel, repair)
+	}
+	return img, frames, nil
+}
+
+// convertAnimation encodes the frames of an animated GIF to the WebP of f,
+// keeping the GIF when that doesn't save enough.
+func (r *convertRun) convertAnimation(f *fileConversion, frames *gif.GIF) error {
+	cacheDir := r.cacheDir
+	// Built next to the frames, as the GIF stays if it is smaller
+	animPath := filepath.Join(cacheDir, "animated.webp")
+	encodeStart := time.Now()
+	anim, encoding, err := encodeAnimation(f.out, frames, cacheDir, animPath, f.fopts, r.thr)
+	f.ft.encode = time.Since(encodeStart)
+	var malformed *malformedGIFError
+	if errors.As(err, &malformed) {
+		deleteCache(cacheDir)
+		if !r.putBack(f) {
+			f.out.printf("❌ Error putting back %s after its frames failed; the original is in %s\n", f.rel, f.bakPath)
+			return err
+		}
+		r.sum.skipUnsupported(f.out, f.rel, malformed.Error(), err)
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if r.opts.interrupted() {
+		return errInterrupted
+	}
+	outFrames := len(frames.Image)
+	if anim.frames != nil {
+		outFrames = len(anim.frames)
+	}
+	animInfo, err := os.Stat(longPath(animPath))
+	if err != nil {
+		f.out.printf("❌ Error reading animated WebP: %v\n", err)
+		return err
+	}
+	if !r.opts.saves(animInfo.Size(), f.info.Size()) {
+		deleteCache(cacheDir)
+		return r.keepSmaller(f, animInfo.Size())
+	}
+	if err := r.moveAnimation(animPath, f.outRel); err != nil {
+		f.out.printf("❌ Error moving animated WebP to %s: %v\n", f.webpPath, err)
+		return err
+	}
+	f.created = true
+	if err := r.verify(f, anim.width, anim.height); err != nil {
+		deleteCache(cacheDir)
+		return err
+	}
+	// Palette frames are stored losslessly, so there is nothing to measure
+	var q *qualityScore
+	keep := true
+	if encoding != paletteEncoding {
+		q, keep = r.score(f, func() (*qualityScore, error) { return compareFrame(cacheDir, 0, f.fopts) })
+	}
+	deleteCache(cacheDir)
+	if !keep {
+		return nil
+	}
+	r.sum.add("animated (experimental)")
+	r.sum.animations = append(r.sum.animations, animationReport{f.rel, len(frames.Image), outFrames,
+		frames.Config.Width, frames.Config.Height, anim.width, anim.height, encoding})
+	e := r.outputs.add(f.rel, f.outRel)
+	e.setSize(anim.width, anim.height)
+	e.setQuality(q)
+	// The animation encoder writes the file itself, so it is read back
+	ioStart := time.Now()
+	if e.SHA256, err = hashFS(r.dst, treeName(f.outRel)); err != nil {
+		f.out.printf("⚠️  Could not hash %s: %v\n", f.webpPath, err)
+	}
+	f.ft.io += time.Since(ioStart)
+	if r.opts.placeholders != "" {
+		if err := addPlaceholder(e, frames.Image[0], f.fopts.enc, r.opts.placeholders, f.webpPath, r.opts.placeholderFiles); err != nil {
+			f.out.printf("⚠️  Could not create placeholder for %s: %v\n", f.rel, err)
+		}
+	}
+	r.sum.encodeTime[f.rel] = time.Since(f.start)
+	f.ft.width, f.ft.height = frames.Config.Width, frames.Config.Height
+	r.sum.addTiming(f.ft, f.fileStart)
+	f.out.printf("✅ Converted (experimental, %s%s): %s -> %s\n", encoding, q.label(), f.rel, filepath.Base(f.webpPath))
+	return r.finish(f)
+}
+
+// moveAnimation moves the animation built at animPath, in the cache on
+// disk, to outRel in dst.
+func (r *convertRun) moveAnimation(animPath, outRel string) error {
+	in, err := os.Open(longPath(animPath))
+	if err != nil {
+		return err
+	}
+	err = writeTreeFile(r.dst, treeName(outRel), in)
+	in.Close()
+	if err == nil {
+		os.Remove(longPath(animPath))
+	}
+	return err
+}
+
+// convertStill encodes img, the decoded original of f, to its WebP.
+func (r *convertRun) convertStill(f *fileConversion, img image.Image) error {
+	ioStart := time.Now()
+	outFile, err := r.dst.CreateFile(treeName(f.outRel))
+	f.ft.io += time.Since(ioStart)
+	if r.restore(f, err) {
+		return nil
+	}
+	if err != nil {
+		f.out.printf("❌ Error creating WebP file %s: %v\n", f.webpPath, err)
+		return err
+	}
+	f.created = true
+
+	// The output is hashed on its way to disk for the map file. With
+	// --metrics it is kept in memory too, to decode it again
+	var data bytes.Buffer
+	outHash := sha256.New()
+	w := io.MultiWriter(outFile, outHash)
+	if r.opts.metrics {
+		w = io.MultiWriter(outFile, outHash, &data)
+	}
+	var res staticResult
+	encodeStart := time.Now()
+	err = watch(f.out, f.rel, r.opts.heartbeat, r.opts.fileTimeout, r.opts.interrupt, func() (err error) {
+		res, err = encodeStatic(w, img, srcFile{r.src, r.name(f.bakPath)}, f.ext, f.rel, f.fopts)
+		return err
+	})
+	f.ft.encode = time.Since(encodeStart)
+	var timeout *timeoutError
+	if errors.As(err, &timeout) {
+		// The encode goes on in the background, its writes to the closed file fail
+		outFile.Close()
+		r.dst.Remove(treeName(f.outRel))
+		r.sum.timedOut = append(r.sum.timedOut, f.rel)
+		if !r.putBack(f) {
+			f.out.printf("❌ %s: %v; the original is in %s\n", f.rel, err, f.bakPath)
+			return err
+		}
+		f.out.printf("❌ %s: %v, kept the original\n", f.rel, err)
+		return nil
+	}
+	if errors.Is(err, errInterrupted) {
+		outFile.Close() // As above; rollBack deletes it
+		return err
+	}
+	if err != nil {
+		outFile.Close()
+		f.out.printf("❌ Error encoding WebP for %s: %v\n", f.bakPath, err)
+		return err
+	}
+	ioStart = time.Now()
+	err = outFile.Close()
+	f.ft.io += time.Since(ioStart)
+	if err != nil {
+		f.out.printf("❌ Error writing WebP file %s: %v\n", f.webpPath, err)
+		return err
+	}
+	if err := r.verify(f, res.width, res.height); err != nil {
+		return err
+	}
+	// AVIF and JPEG XL often beat WebP, and then the original stays. So
+	// does one the quality --target-size settled on doesn't beat
+	if _, optIn := optInFormats[f.ext]; (optIn || f.fopts.targetSize > 0) && !r.opts.saves(res.size, f.info.Size()) {
+		r.dst.Remove(treeName(f.outRel))
+		return r.keepSmaller(f, res.size)
+	}
+	q, keep := r.score(f, func() (*qualityScore, error) { return compareOutput(res.encoded, &data) })
+	if !keep {
+		return nil
+	}
+	if res.overTarget {
+		f.out.printf("⚠️  %s is still %s at the lowest quality (target %s)\n", f.rel, formatSize(res.size), formatSize(f.fopts.targetSize))
+		r.sum.overTarget = append(r.sum.overTarget, f.rel)
+	}
+
+	r.sum.add(res.mode)
+	if res.warning != "" {
+		f.out.printf("⚠️  %s: %s\n", f.rel, res.warning)
+	}
+	e := r.outputs.add(f.rel, f.outRel)
+	e.setSize(res.width, res.height)
+	e.Trim = res.trim
+	e.setQuality(q)
+	e.SHA256 = hex.EncodeToString(outHash.Sum(nil))
+	if r.opts.placeholders != "" {
+		if err := addPlaceholder(e, res.img, f.fopts.enc, r.opts.placeholders, f.webpPath, r.opts.placeholderFiles); err != nil {
+			f.out.printf("⚠️  Could not create placeholder for %s: %v\n", f.rel, err)
+		}
+	}
+	if err := r.writeFallback(f, res.img, e); err != nil {
+		return err
+	}
+	r.sum.encodeTime[f.rel] = time.Since(f.start)
+	f.ft.width, f.ft.height = img.Bounds().Dx(), img.Bounds().Dy()
+	r.sum.addTiming(f.ft, f.fileStart)
+	f.out.printf("✅ Converted (%s%s): %s -> %s\n", res.detail, q.label(), f.rel, filepath.Base(f.webpPath))
+	return r.finish(f)
+}
+
+// writeFallback writes the --fallback copy of f in place of its original,
+// from img, the pixels its WebP was encoded from, and records it in e.
+func (r *convertRun) writeFallback(f *fileConversion, img image.Image, e *mapEntry) error {
+	format := fallbackFormat(f.ext)
+	if format == "" {
+		return nil
+	}
+	quality, ok := r.opts.fallback[format]
+	if !ok {
+		return nil
+	}
+	reencoded, err := writeFallback(f.path, f.bakPath, img, format, quality)
+	switch {
+	case err != nil:
+		f.out.printf("⚠️  Could not write the fallback for %s, copying the original instead: %v\n", f.rel, err)
+		if err := copyFile(f.bakPath, f.path); err != nil {
+			f.out.printf("❌ Error copying %s back: %v\n", f.rel, err)
+			return err
+		}
+	case reencoded:
+		f.out.printf("💾 Wrote fallback: %s\n", f.rel)
+	default:
+		f.out.printf("💾 Re-encoding %s didn't make it smaller, its fallback is a copy of the original\n", f.rel)
+	}
+	e.Fallback = filepath.ToSlash(f.rel)
+	return nil
+}
@@ -0,0 +1,116 @@
+package webpcon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// dataURIFileExt lists the source files --convert-data-uris looks in.
+var dataURIFileExt = map[string]bool{
+	".html": true, ".htm": true, ".css": true, ".scss": true, ".sass": true, ".less": true,
+}
+
+// dataURI matches a base64 PNG, JPEG or GIF data URI. The payload is taken up
+// to the first character that can't be base64, so a truncated or otherwise
+// broken one still matches and gets reported.
+var dataURI = regexp.MustCompile(`(?i)data:image/(png|jpe?g|gif);base64,([A-Za-z0-9+/=]*)`)
+
+// convertDataURIs re-encodes the images embedded as data URIs in the project's
+// CSS and HTML files as WebP, replacing each URI whose WebP is smaller. Files
+// are backed up the same way --rewrite-refs backs them up, so revert restores
+// them. Resizing, color conversion and --target-size don't apply to embedded
+// images, and animated GIFs are left as they are.
+func convertDataURIs(root string, opts options) error {
+	opts.maxWidth, opts.maxHeight, opts.toSRGB, opts.targetSize = 0, 0, false, 0
+
+	total, saved := 0, int64(0)
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if skipDirs[info.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !dataURIFileExt[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+
+		data, err := os.ReadFile(longPath(path))
+		if err != nil {
+			fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", path, err)
+			return err
+		}
+		relPath, _ := filepath.Rel(root, path)
+		n, before, after := 0, int64(0), int64(0)
+		text := dataURI.ReplaceAllStringFunc(string(data), func(uri string) string {
+			sub := dataURI.FindStringSubmatch(uri)
+			webp, err := dataURIToWebP(sub[1], sub[2], relPath, opts)
+			if err != nil {
+				fmt.Fprintf(stdout, "⚠️  Leaving a data URI in %s alone: %v\n", relPath, err)
+				return uri
+			}
+			if webp == "" || len(webp) >= len(uri) {
+				return uri
+			}
+			n++
+			before += int64(len(uri))
+			after += int64(len(webp))
+			return webp
+		})
+		if n == 0 {
+			return nil
+		}
+
+		if err := writeRefFile(root, relPath, text, info.Mode().Perm()); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "✏️  Converted %d data URI(s) in %s (%s -> %s)\n", n, relPath, formatSize(before), formatSize(after))
+		total += n
+		saved += before - after
+		return nil
+	})
+	if total > 0 {
+		fmt.Fprintf(stdout, "💾 Data URIs: %d converted, %s saved\n", total, formatSize(saved))
+	}
+	return err
+}
+
+// dataURIToWebP decodes one data URI's payload and returns the WebP data URI
+// for it, or "" for an animated GIF.
+func dataURIToWebP(format, payload, relPath string, opts options) (string, error) {
+	raw, err := base64.StdEncoding.DecodeString(payload)
+	if err != nil {
+		return "", fmt.Errorf("invalid base64: %v", err)
+	}
+	ext := "." + strings.ToLower(format)
+	if ext == ".jpeg" {
+		ext = ".jpg"
+	}
+	if ext == ".gif" {
+		g, err := decodeGIFAll(bytes.NewReader(raw))
+		if err != nil {
+			return "", fmt.Errorf("invalid GIF: %v", err)
+		}
+		if len(g.Image) > 1 {
+			return "", nil
+		}
+	}
+	img, err := decodeImage(bytes.NewReader(raw), ext)
+	if err != nil {
+		return "", fmt.Errorf("invalid %s: %v", strings.ToUpper(ext[1:]), err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := encodeStatic(&buf, img, srcFile{}, ext, relPath, opts.withExtensionDefaults(ext)); err != nil {
+		return "", err
+	}
+	return "data:image/webp;base64," + base64.StdEncoding.EncodeToString(buf.Bytes()), nil
+}
@@ -0,0 +1,138 @@
+package webpcon
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// defaultDecodeQuality is the JPEG quality decode uses unless --quality is given.
+const defaultDecodeQuality = 90
+
+// decodeWebPFiles writes a PNG or JPEG next to each WebP under root, for tools
+// that can't read WebP. With onlyConverted, only WebP files listed in the map
+// file are decoded. Existing files are never overwritten, and animated WebP
+// files are skipped.
+func decodeWebPFiles(root, to string, onlyConverted bool, opts options) error {
+	var converted map[string]bool
+	if onlyConverted {
+		outputs, err := loadMapping(root)
+		if err != nil {
+			fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", mapFileName, err)
+			return err
+		}
+		converted = map[string]bool{}
+		for _, e := range outputs.entries {
+			converted[pathKey(e.WebP)] = true
+		}
+	}
+	quality := defaultDecodeQuality
+	if opts.set["quality"] {
+		quality = int(opts.quality)
+	}
+	bg := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	if opts.flatten != nil {
+		bg = *opts.flatten
+	}
+
+	decoded, skipped := 0, 0
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if skipDirs[info.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(info.Name()))
+		if ext != ".webp" || skipFiles[info.Name()] {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		if converted != nil && !converted[pathKey(rel)] {
+			return nil
+		}
+
+		outPath := path[:len(path)-len(ext)] + "." + to
+		if fileExists(outPath) {
+			fmt.Fprintf(stdout, "⏭️ Skipping %s (%s already exists)\n", rel, filepath.Base(outPath))
+			skipped++
+			return nil
+		}
+		data, err := os.ReadFile(longPath(path))
+		if err != nil {
+			fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", path, err)
+			return err
+		}
+		if isAnimatedWebP(data) {
+			fmt.Fprintf(stdout, "⏭️ Skipping %s (animated WebP)\n", rel)
+			skipped++
+			return nil
+		}
+		img, err := decodeImage(bytes.NewReader(data), ".webp")
+		if err != nil {
+			fmt.Fprintf(stdout, "❌ Error decoding %s: %v\n", path, err)
+			return err
+		}
+
+		out, err := os.Create(longPath(outPath))
+		if err != nil {
+			fmt.Fprintf(stdout, "❌ Error creating %s: %v\n", outPath, err)
+			return err
+		}
+		err = encodeDecoded(out, toNRGBA(img), to, quality, bg)
+		if cerr := out.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(longPath(outPath))
+			fmt.Fprintf(stdout, "❌ Error writing %s: %v\n", outPath, err)
+			return err
+		}
+		decoded++
+		fmt.Fprintf(stdout, "✅ Decoded: %s -> %s\n", rel, filepath.Base(outPath))
+		return nil
+	})
+	fmt.Fprintln(stdout)
+	fmt.Fprintf(stdout, "📊 Summary: %d decoded, %d skipped\n", decoded, skipped)
+	return err
+}
+
+// encodeDecoded writes img as PNG, or as JPEG composited onto bg since JPEG
+// has no alpha.
+func encodeDecoded(w io.Writer, img *image.NRGBA, to string, quality int, bg color.NRGBA) error {
+	if to == "png" {
+		return png.Encode(w, img)
+	}
+	var src image.Image = img
+	if !isOpaque(img) {
+		src = flattenOnto(img, bg)
+	}
+	return jpeg.Encode(w, src, &jpeg.Options{Quality: quality})
+}
+
+// isAnimatedWebP reports whether data is an extended WebP with the animation
+// flag set.
+func isAnimatedWebP(data []byte) bool {
+	return len(data) > 20 && string(data[12:16]) == "VP8X" && data[20]&0x02 != 0
+}
+
+// parseDecodeFormat checks a --to value.
+func parseDecodeFormat(v string) (string, error) {
+	switch f := strings.ToLower(v); f {
+	case "png", "jpg":
+		return f, nil
+	case "jpeg":
+		return "jpg", nil
+	}
+	return "", fmt.Errorf("--to expects png or jpg, got %q", v)
+}
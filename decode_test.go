@@ -0,0 +1,98 @@
+package webpcon
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDecodeConfigFrom(t *testing.T) {
+	for _, ext := range fixtureFormats {
+		cfg, err := decodeConfigFrom(bytes.NewReader(encodeFixture(t, ext, 12, 7)), ext)
+		if err != nil {
+			t.Errorf("decodeConfigFrom(%s): %v", ext, err)
+			continue
+		}
+		if cfg.Width != 12 || cfg.Height != 7 {
+			t.Errorf("decodeConfigFrom(%s) = %dx%d, want 12x7", ext, cfg.Width, cfg.Height)
+		}
+	}
+}
+
+func FuzzDecodeConfigFrom(f *testing.F) {
+	for _, ext := range fixtureFormats {
+		f.Add(encodeFixture(f, ext, 4, 4), ext)
+	}
+	f.Add(animatedGIFFixture(f, 4, 4, 2), ".gif")
+	f.Fuzz(func(t *testing.T, data []byte, ext string) {
+		// Errors are expected, panics are not
+		cfg, err := decodeConfigFrom(bytes.NewReader(data), ext)
+		if err == nil && (cfg.Width < 0 || cfg.Height < 0) {
+			t.Fatalf("decodeConfigFrom = %dx%d", cfg.Width, cfg.Height)
+		}
+	})
+}
+
+// panicReader panics on the first read past its data, standing in for a
+// decoder bug tripped by a malformed file.
+type panicReader struct{ r *bytes.Reader }
+
+func (p panicReader) Read(b []byte) (int, error) {
+	if p.r.Len() == 0 {
+		panic("index out of range")
+	}
+	return p.r.Read(b)
+}
+
+func TestDecodePanics(t *testing.T) {
+	for _, ext := range fixtureFormats {
+		data := encodeFixture(t, ext, 12, 7)
+		head := data[:min(len(data), 40)]
+		if _, err := decodeImage(panicReader{bytes.NewReader(head)}, ext); err == nil || !strings.Contains(err.Error(), "decoder crashed") {
+			t.Errorf("decodeImage(%s): %v, want the panic as an error", ext, err)
+		}
+		if _, err := decodeConfigFrom(panicReader{bytes.NewReader(data[:min(len(data), 8)])}, ext); err == nil {
+			t.Errorf("decodeConfigFrom(%s): no error", ext)
+		}
+	}
+}
+
+// corruptFixtures are the fixture images cut off after their signature, cut
+// short and with garbled bytes past their signature, named by how they were
+// broken. testdata/fuzz holds them as seeds for the fuzz targets.
+func corruptFixtures(tb testing.TB) []fixtureFile {
+	tb.Helper()
+	var files []fixtureFile
+	for _, ext := range fixtureFormats {
+		data := encodeFixture(tb, ext, 24, 16)
+		garbled := bytes.Clone(data)
+		for i := 12; i < len(garbled); i += 3 {
+			garbled[i] ^= 0xa5
+		}
+		files = append(files,
+			fixtureFile{"header-" + ext[1:] + ext, data[:16]},
+			fixtureFile{"truncated-" + ext[1:] + ext, data[:len(data)/3]},
+			fixtureFile{"garbled-" + ext[1:] + ext, garbled})
+	}
+	return files
+}
+
+// TestConvertCorrupt converts each broken image: it fails or is skipped,
+// and is put back where it was, as it was, with no WebP left behind.
+func TestConvertCorrupt(t *testing.T) {
+	for _, f := range corruptFixtures(t) {
+		t.Run(f.rel, func(t *testing.T) {
+			quietly(t)
+			root := writeFixtureTree(t, []fixtureFile{f})
+			convertImages(root, testOptions(t, "--encoder", "native"))
+			after := treeFiles(t, root)
+			if got, ok := after[f.rel]; !ok || !bytes.Equal(got, f.data) {
+				t.Errorf("%s not put back as it was", f.rel)
+			}
+			if _, ok := after[strings.TrimSuffix(f.rel, filepath.Ext(f.rel))+".webp"]; ok {
+				t.Errorf("%s converted", f.rel)
+			}
+		})
+	}
+}
@@ -0,0 +1,66 @@
+package webpcon
+
+import (
+	"fmt"
+	"time"
+)
+
+// defaultSpaceFactor is the share of the source size the WebP outputs are
+// assumed to need. Originals are only renamed into the backup, so the outputs
+// are the only new data. WebP is usually far smaller; this errs on the safe side.
+const defaultSpaceFactor = 0.6
+
+// checkDiskSpace refuses to start when the outputs likely won't fit on the
+// filesystem holding root (and with it the backup directory).
+func checkDiskSpace(root string, sources []source, factor float64) error {
+	var total int64
+	for _, src := range sources {
+		total += src.size
+	}
+	need := int64(float64(total) * factor)
+	free, err := freeSpace(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "⚠️  Could not check free disk space: %v\n", err)
+		return nil
+	}
+	if free < need {
+		return fmt.Errorf("not enough disk space: the WebP files may need about %s but only %s is free. Use --ignore-disk-check to run anyway",
+			formatSize(need), formatSize(free))
+	}
+	return nil
+}
+
+// defaultDiskFullTimeout is how long a run that filled the disk waits for
+// space to be freed before giving up, see --disk-full-timeout.
+const defaultDiskFullTimeout = 10 * time.Minute
+
+// diskFullPoll is how often a paused run checks the free space again.
+const diskFullPoll = 5 * time.Second
+
+// diskFullError is a file's conversion stopped by a full disk. The file has
+// been rolled back and can be tried again once there is room.
+type diskFullError struct {
+	relPath string
+	size    int64 // The source's size, as much free space as resuming needs
+	err     error
+}
+
+func (e *diskFullError) Error() string { return fmt.Sprintf("%s: %v", e.relPath, e.err) }
+func (e *diskFullError) Unwrap() error { return e.err }
+
+// waitForSpace pauses the run after the disk holding root filled up, until
+// need bytes are free or timeout has passed, and tells whether to resume.
+// written is how much the run wrote before, for the message.
+func waitForSpace(con *console, root string, need, written int64, timeout time.Duration) bool {
+	con.printf("💽 The disk holding %s is full. This run wrote %s so far. Waiting up to %s for %s to be freed...\n",
+		mountPoint(root), formatSize(written), timeout, formatSize(need))
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		time.Sleep(min(diskFullPoll, time.Until(deadline)))
+		if free, err := freeSpace(root); err == nil && free >= need {
+			con.printf("💽 %s free again, resuming\n", formatSize(free))
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,45 @@
+//go:build !windows
+
+package webpcon
+
+import (
+	"errors"
+	"path/filepath"
+	"syscall"
+)
+
+// freeSpace returns the bytes available to unprivileged users on the
+// filesystem holding path.
+func freeSpace(path string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(path, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// diskFull tells whether err is the filesystem running out of space.
+func diskFull(err error) bool {
+	return errors.Is(err, syscall.ENOSPC) || errors.Is(err, syscall.EDQUOT)
+}
+
+// mountPoint returns the top folder of the filesystem holding path, for
+// messages. It is path itself when that can't be found out.
+func mountPoint(path string) string {
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return path
+	}
+	var st syscall.Stat_t
+	if syscall.Stat(path, &st) != nil {
+		return path
+	}
+	for {
+		parent := filepath.Dir(path)
+		var pst syscall.Stat_t
+		if parent == path || syscall.Stat(parent, &pst) != nil || pst.Dev != st.Dev {
+			return path
+		}
+		path = parent
+	}
+}
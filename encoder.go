@@ -0,0 +1,104 @@
+package webpcon
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"os/exec"
+	"sort"
+	"strings"
+)
+
+// encodeOptions are the settings every encoder backend understands.
+type encodeOptions struct {
+	lossless bool
+	quality  float32 // Lossy quality, 0 ~ 100
+	exact    bool    // Keep RGB under transparent pixels (lossless only)
+	effort   int     // Compression effort, 0 (fast) ~ 6 (smallest). Not every backend can tune it
+}
+
+// encoder is a WebP encoder backend. Images handed to encode follow the
+// image package's conventions: an *image.RGBA holds premultiplied samples and
+// an *image.NRGBA straight ones.
+type encoder interface {
+	name() string
+	lossy() bool  // Whether lossy encoding is supported; if not, everything is lossless
+	effort() bool // Whether encodeOptions.effort has any effect
+	encode(w io.Writer, img image.Image, opts encodeOptions) error
+}
+
+// animation is an animated image ready to encode.
+type animation struct {
+	frames     []image.Image // NRGBA, or Paletted for a color-indexed frame
+	durations  []uint        // Milliseconds per frame
+	disposals  []uint
+	loopCount  uint16
+	background uint32
+}
+
+// animationEncoder is implemented by backends that can write animated WebP.
+type animationEncoder interface {
+	encodeAnimation(w io.Writer, a animation) error
+}
+
+// encoders lists the backends compiled into this binary, by --encoder name.
+var encoders = map[string]func() (encoder, error){
+	"native": func() (encoder, error) { return nativeEncoder{}, nil },
+	"cwebp": func() (encoder, error) {
+		path, err := exec.LookPath("cwebp")
+		if err != nil {
+			return nil, fmt.Errorf("cwebp not found in PATH")
+		}
+		return cwebpEncoder{path: path}, nil
+	},
+}
+
+// selectEncoder returns the backend for an --encoder value. "auto" takes
+// libwebp through cgo when the binary was built with it, then a cwebp found
+// in PATH, then the pure Go encoder.
+func selectEncoder(name string) (encoder, error) {
+	if name == "auto" {
+		for _, n := range []string{"cgo", "cwebp", "native"} {
+			if newEnc, ok := encoders[n]; ok {
+				if enc, err := newEnc(); err == nil {
+					return enc, nil
+				}
+			}
+		}
+	}
+	newEnc, ok := encoders[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown or unavailable encoder %q (available: auto, %s)", name, strings.Join(encoderNames(), ", "))
+	}
+	return newEnc()
+}
+
+// deterministicEncoder is what "auto" means with --deterministic: a backend
+// whose output only depends on the webpcon binary, never on what else is
+// installed. That is libwebp compiled in through cgo, which encodes on one
+// thread with a fixed method, or else the pure Go encoder. Neither writes
+// metadata, so identical input and settings give identical bytes.
+func deterministicEncoder() string {
+	if _, ok := encoders["cgo"]; ok {
+		return "cgo"
+	}
+	return "native"
+}
+
+func encoderNames() []string {
+	names := make([]string, 0, len(encoders))
+	for n := range encoders {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// animationEncoderFor returns enc if it can write animations, and otherwise
+// the pure Go encoder, which always can.
+func animationEncoderFor(enc encoder) animationEncoder {
+	if ae, ok := enc.(animationEncoder); ok {
+		return ae
+	}
+	return nativeEncoder{}
+}
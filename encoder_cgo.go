@@ -0,0 +1,47 @@
+//go:build cgo
+
+package webpcon
+
+import (
+	"image"
+	"io"
+
+	"github.com/chai2010/webp"
+)
+
+func init() {
+	encoders["cgo"] = func() (encoder, error) { return cgoEncoder{}, nil }
+}
+
+// cgoEncoder uses libwebp through cgo. It compresses best but needs a C
+// toolchain at build time. chai2010/webp has no setting for libwebp's method,
+// so the effort is always libwebp's default, 4.
+type cgoEncoder struct{}
+
+func (cgoEncoder) name() string { return "cgo" }
+func (cgoEncoder) lossy() bool  { return true }
+func (cgoEncoder) effort() bool { return false }
+
+func (cgoEncoder) encode(w io.Writer, img image.Image, opts encodeOptions) error {
+	switch img.(type) {
+	case *image.Gray, *image.YCbCr:
+	default:
+		// chai2010/webp hands the samples of an *image.RGBA to libwebp as
+		// they are, which reads them as straight, and premultiplies
+		// everything else first
+		n := toNRGBA(img)
+		img = &image.RGBA{Pix: n.Pix, Stride: n.Stride, Rect: n.Rect}
+	}
+	return webp.Encode(w, img, &webp.Options{Lossless: opts.lossless, Quality: opts.quality, Exact: opts.exact})
+}
+
+// decodeWebP reads a WebP image with libwebp. chai2010/webp returns the
+// straight samples in an *image.RGBA, so they are handed on as *image.NRGBA.
+func decodeWebP(r io.Reader) (image.Image, error) {
+	img, err := webp.Decode(r)
+	if err != nil {
+		return nil, err
+	}
+	m := img.(*image.RGBA)
+	return &image.NRGBA{Pix: m.Pix, Stride: m.Stride, Rect: m.Rect}, nil
+}
@@ -0,0 +1,68 @@
+package webpcon
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// cwebpEncoder runs a cwebp binary found in PATH. It is the only backend
+// that honors --effort (cwebp -m).
+type cwebpEncoder struct {
+	path string
+}
+
+func (cwebpEncoder) name() string { return "cwebp" }
+func (cwebpEncoder) lossy() bool  { return true }
+func (cwebpEncoder) effort() bool { return true }
+
+func (e cwebpEncoder) encode(w io.Writer, img image.Image, opts encodeOptions) error {
+	dir, err := os.MkdirTemp("", "webpcon-cwebp-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	in, out := filepath.Join(dir, "in.png"), filepath.Join(dir, "out.webp")
+	f, err := os.Create(in)
+	if err != nil {
+		return err
+	}
+	err = png.Encode(f, toNRGBA(img))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	args := []string{"-quiet", "-m", strconv.Itoa(opts.effort)}
+	if opts.lossless {
+		args = append(args, "-lossless")
+	} else {
+		args = append(args, "-q", strconv.FormatFloat(float64(opts.quality), 'g', -1, 32))
+	}
+	if opts.exact {
+		args = append(args, "-exact")
+	}
+	args = append(args, in, "-o", out)
+	var stderr bytes.Buffer
+	cmd := exec.Command(e.path, args...)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return fmt.Errorf("cwebp: %v: %s", err, bytes.TrimSpace(stderr.Bytes()))
+	}
+
+	data, err := os.ReadFile(out)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
+}
@@ -0,0 +1,30 @@
+package webpcon
+
+import (
+	"image"
+	"io"
+
+	"github.com/HugoSmits86/nativewebp"
+)
+
+// nativeEncoder is the pure Go encoder. It needs no toolchain but only
+// writes lossless WebP, and it is the one backend that can write animations.
+type nativeEncoder struct{}
+
+func (nativeEncoder) name() string { return "native" }
+func (nativeEncoder) lossy() bool  { return false }
+func (nativeEncoder) effort() bool { return false }
+
+func (nativeEncoder) encode(w io.Writer, img image.Image, opts encodeOptions) error {
+	return nativewebp.Encode(w, toNRGBA(img), nil)
+}
+
+func (nativeEncoder) encodeAnimation(w io.Writer, a animation) error {
+	return nativewebp.EncodeAll(w, &nativewebp.Animation{
+		Images:          a.frames,
+		Durations:       a.durations,
+		Disposals:       a.disposals,
+		LoopCount:       a.loopCount,
+		BackgroundColor: a.background,
+	}, nil)
+}
@@ -0,0 +1,15 @@
+//go:build !cgo
+
+package webpcon
+
+import (
+	"image"
+	"io"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+// decodeWebP reads a WebP image with the pure Go decoder.
+func decodeWebP(r io.Reader) (image.Image, error) {
+	return xwebp.Decode(r)
+}
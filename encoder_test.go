@@ -0,0 +1,245 @@
+package webpcon
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+// TestDeterministic converts the same tree twice with each backend
+// --deterministic may pick, with a few settings, and compares the bytes.
+func TestDeterministic(t *testing.T) {
+	quietly(t)
+	var files []fixtureFile
+	for _, ext := range fixtureFormats {
+		files = append(files, fixtureFile{"img/" + ext[1:] + ext, encodeFixture(t, ext, 37, 21)})
+	}
+	for _, name := range []string{"cgo", "native"} {
+		t.Run(name, func(t *testing.T) {
+			testEncoder(t, name)
+			for _, args := range [][]string{nil, {"--lossless"}, {"--quality", "50", "--sharp-yuv"}, {"--near-lossless", "60"}} {
+				opts := testOptions(t, append([]string{"--deterministic", "--encoder", name}, args...)...)
+				var trees [2]map[string][]byte
+				for i := range trees {
+					root := writeFixtureTree(t, files)
+					convertTree(t, root, opts)
+					trees[i] = treeFiles(t, root)
+				}
+				n := 0
+				for _, rel := range slices.Sorted(maps.Keys(trees[0])) {
+					if !strings.HasSuffix(rel, ".webp") {
+						continue
+					}
+					n++
+					if !bytes.Equal(trees[0][rel], trees[1][rel]) {
+						t.Errorf("%s %v: differs between two conversions of the same tree", rel, args)
+					}
+				}
+				if n != len(files) {
+					t.Errorf("%v: %d WebP file(s) written, want %d", args, n, len(files))
+				}
+			}
+		})
+	}
+}
+
+// TestExact converts an image whose top left corner is fully transparent and
+// checks which settings keep the RGB under it.
+func TestExact(t *testing.T) {
+	src := fixtureImage(37, 21)
+	in := encodeFixture(t, ".png", 37, 21)
+	for _, tt := range []struct {
+		name string
+		args []string
+		kept bool
+	}{
+		{"exact", []string{"--exact"}, true},
+		{"exact, native encoder", []string{"--exact", "--encoder", "native"}, true},
+		{"exact, lossless", []string{"--exact", "--lossless"}, true},
+		// libwebp cleans them up otherwise, which is what makes the above
+		// worth testing
+		{"default", nil, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root := writeFixtureTree(t, []fixtureFile{{"sprites.png", in}})
+			convertTree(t, root, testOptions(t, tt.args...))
+			if n := hiddenRGBDiffs(t, src, treeFiles(t, root)["sprites.webp"]); (n == 0) != tt.kept {
+				t.Errorf("%d transparent pixel(s) lost their RGB, want kept %v", n, tt.kept)
+			}
+		})
+	}
+}
+
+// TestEncoders encodes an image with each backend this build has, lossless
+// and lossy where the backend can, and decodes it back.
+func TestEncoders(t *testing.T) {
+	src := fixtureImage(37, 21)
+	for _, name := range append([]string{"auto"}, encoderNames()...) {
+		t.Run(name, func(t *testing.T) {
+			enc := testEncoder(t, name)
+			for _, opts := range []encodeOptions{
+				{lossless: true, effort: 4},
+				{lossless: true, exact: true, effort: 0},
+				{quality: 75, effort: 4},
+			} {
+				var buf bytes.Buffer
+				if err := enc.encode(&buf, straightNRGBA(src), opts); err != nil {
+					t.Fatalf("%+v: %v", opts, err)
+				}
+				img, err := xwebp.Decode(&buf)
+				if err != nil {
+					t.Fatalf("%+v: %v", opts, err)
+				}
+				if img.Bounds() != src.Bounds() {
+					t.Errorf("%+v: decoded to %v", opts, img.Bounds())
+				}
+				if _, lossy := img.(*image.YCbCr); lossy && (opts.lossless || !enc.lossy()) {
+					t.Errorf("%+v: lossy output", opts)
+				}
+			}
+		})
+	}
+	if _, err := selectEncoder("magic"); err == nil {
+		t.Error("an unknown encoder was accepted")
+	}
+}
+
+// TestPremultiplied encodes a half-transparent *image.RGBA, premultiplied as
+// TIFF associated alpha and the GIF compositor give it, losslessly with each
+// backend: the colors read back through decodeWebP are the straight ones.
+func TestPremultiplied(t *testing.T) {
+	want := color.NRGBA{200, 100, 50, 128}
+	src := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	draw.Draw(src, src.Rect, image.NewUniform(want), image.Point{}, draw.Src)
+	if c := toNRGBA(src).NRGBAAt(3, 3); absDiff(c, want) > 1 {
+		t.Errorf("toNRGBA: %v, want %v", c, want)
+	}
+	for _, name := range encoderNames() {
+		t.Run(name, func(t *testing.T) {
+			var buf bytes.Buffer
+			if err := testEncoder(t, name).encode(&buf, src, encodeOptions{lossless: true}); err != nil {
+				t.Fatal(err)
+			}
+			img, err := decodeWebP(&buf)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if c := color.NRGBAModel.Convert(img.At(3, 3)).(color.NRGBA); absDiff(c, want) > 1 {
+				t.Errorf("decoded %v, want %v", c, want)
+			}
+		})
+	}
+}
+
+// absDiff is the largest difference between the channels of a and b.
+func absDiff(a, b color.NRGBA) int {
+	d := 0
+	for _, p := range [][2]uint8{{a.R, b.R}, {a.G, b.G}, {a.B, b.B}, {a.A, b.A}} {
+		d = max(d, int(p[0])-int(p[1]), int(p[1])-int(p[0]))
+	}
+	return d
+}
+
+// hiddenRGBDiffs decodes the WebP data and counts the fully transparent
+// pixels of src whose RGB it doesn't have.
+func hiddenRGBDiffs(tb testing.TB, src *image.NRGBA, data []byte) int {
+	tb.Helper()
+	img, err := xwebp.Decode(bytes.NewReader(data))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	n := 0
+	for y := range src.Rect.Dy() {
+		for x := range src.Rect.Dx() {
+			w := src.NRGBAAt(x, y)
+			if w.A != 0 {
+				continue
+			}
+			if got, ok := img.(*image.NRGBA); !ok || got.NRGBAAt(x, y) != w {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestToGrayscale(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 1))
+	src.SetNRGBA(0, 0, color.NRGBA{255, 0, 0, 255})
+	src.SetNRGBA(1, 0, color.NRGBA{0, 255, 0, 128})
+	src.SetNRGBA(2, 0, color.NRGBA{0, 0, 255, 0})
+	src.SetNRGBA(3, 0, color.NRGBA{200, 200, 200, 255})
+	// Rec. 709 weights: 0.2126, 0.7152, 0.0722
+	want := []color.NRGBA{{54, 54, 54, 255}, {182, 182, 182, 128}, {18, 18, 18, 0}, {200, 200, 200, 255}}
+	got := toGrayscale(src)
+	for x, w := range want {
+		if c := got.NRGBAAt(x, 0); c != w {
+			t.Errorf("%v became %v, want %v", src.NRGBAAt(x, 0), c, w)
+		}
+	}
+}
+
+// TestGrayscale converts a file of each format with --grayscale and checks
+// every decoded pixel is gray. Lossy output is decoded through YUV, so it is
+// allowed one or two levels between channels.
+func TestGrayscale(t *testing.T) {
+	var files []fixtureFile
+	for _, ext := range fixtureFormats {
+		files = append(files, fixtureFile{ext[1:] + ext, encodeFixture(t, ext, 33, 21)})
+	}
+	for _, tt := range []struct {
+		args      []string
+		tolerance int
+	}{
+		{[]string{"--lossless"}, 0},
+		{[]string{"--near-lossless", "60"}, 0},
+		{[]string{"--quality", "60"}, 2},
+		{[]string{"--quality", "90", "--sharp-yuv"}, 2},
+	} {
+		root := writeFixtureTree(t, files)
+		convertTree(t, root, testOptions(t, append([]string{"--grayscale"}, tt.args...)...))
+		n := 0
+		for rel, data := range treeFiles(t, root) {
+			if !strings.HasSuffix(rel, ".webp") {
+				continue
+			}
+			n++
+			img, err := xwebp.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("%v %s: %v", tt.args, rel, err)
+			}
+			if x, y, c := colouredPixel(img, tt.tolerance); x >= 0 {
+				t.Errorf("%v %s: pixel %d,%d is %v", tt.args, rel, x, y, c)
+			}
+		}
+		if n != len(files) {
+			t.Errorf("%v: %d WebP file(s) written, want %d", tt.args, n, len(files))
+		}
+	}
+}
+
+// colouredPixel returns the first pixel of img whose channels differ by more
+// than tolerance, or -1, -1.
+func colouredPixel(img image.Image, tolerance int) (x, y int, c color.NRGBA) {
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			if c.A == 0 {
+				continue
+			}
+			hi, lo := max(c.R, c.G, c.B), min(c.R, c.G, c.B)
+			if int(hi-lo) > tolerance {
+				return x, y, c
+			}
+		}
+	}
+	return -1, -1, color.NRGBA{}
+}
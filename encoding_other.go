@@ -0,0 +1,20 @@
+//go:build !windows
+
+package webpcon
+
+import (
+	"os"
+	"strings"
+)
+
+// outputUTF8 reports whether the locale's character set is UTF-8. With no
+// locale set at all the terminal is trusted, since Go writes UTF-8 anyway.
+func outputUTF8() bool {
+	for _, name := range []string{"LC_ALL", "LC_CTYPE", "LANG"} {
+		if v := os.Getenv(name); v != "" {
+			v = strings.ToLower(v)
+			return strings.Contains(v, "utf-8") || strings.Contains(v, "utf8")
+		}
+	}
+	return true
+}
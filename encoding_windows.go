@@ -0,0 +1,20 @@
+//go:build windows
+
+package webpcon
+
+import "syscall"
+
+var procGetConsoleOutputCP = syscall.NewLazyDLL("kernel32.dll").NewProc("GetConsoleOutputCP")
+
+// cpUTF8 is the UTF-8 code page.
+const cpUTF8 = 65001
+
+// outputUTF8 reports whether the console shows UTF-8. Output that isn't going
+// to a console is written as UTF-8 either way.
+func outputUTF8() bool {
+	if !stdoutTTY {
+		return true
+	}
+	cp, _, _ := procGetConsoleOutputCP.Call()
+	return cp == cpUTF8
+}
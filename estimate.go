@@ -0,0 +1,258 @@
+package webpcon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// defaultSample is how many files estimate encodes unless --sample says otherwise.
+const defaultSample = 100
+
+// z95 is the normal quantile for a two-sided 95% confidence interval.
+const z95 = 1.96
+
+// extEstimate is the extrapolated result for one extension, or for all of them.
+type extEstimate struct {
+	Ext           string `json:"ext,omitempty"`
+	Eligible      int    `json:"eligible"`
+	Sampled       int    `json:"sampled"`
+	SourceSize    int64  `json:"sourceSize"`
+	EstimatedSize int64  `json:"estimatedSize"`
+	Savings       int64  `json:"savings"`
+	SavingsLow    int64  `json:"savingsLow"` // 95% confidence interval
+	SavingsHigh   int64  `json:"savingsHigh"`
+
+	variance float64
+}
+
+type estimateReport struct {
+	Seed  int64          `json:"seed"`
+	Total extEstimate    `json:"total"`
+	ByExt []*extEstimate `json:"byExtension"`
+}
+
+// sampled is one sample file: its source size and encoded size.
+type sampled struct {
+	ext     string
+	in, out float64
+}
+
+// estimateSavings encodes a random sample of the files a conversion would
+// take, in memory, and extrapolates the total savings. Sizes are extrapolated
+// per extension with a ratio estimator. Nothing in the tree is written.
+func estimateSavings(root string, opts options) error {
+	eligible, seed, err := shuffledSources(root, opts)
+	if err != nil {
+		return err
+	}
+	n := min(opts.sample, len(eligible))
+	if !opts.jsonOutput {
+		fmt.Fprintf(stdout, "📐 Encoding %d of %d eligible file(s) in memory (seed %d)\n", n, len(eligible), seed)
+	}
+
+	overrides := newOverrideLoader(root)
+	var samples []sampled
+	for _, src := range eligible[:n] {
+		path := filepath.Join(root, src.rel)
+		out, err := encodedSize(path, src.rel, src.ext, overrides, opts)
+		if err != nil {
+			if !opts.jsonOutput {
+				fmt.Fprintf(stdout, "⚠️  Leaving %s out of the sample: %v\n", src.rel, err)
+			}
+			continue
+		}
+		samples = append(samples, sampled{src.ext, float64(src.size), float64(out)})
+	}
+	if len(samples) == 0 {
+		return fmt.Errorf("no eligible images could be sampled under %s", root)
+	}
+
+	report := estimateReport{Seed: seed, Total: extEstimate{Eligible: len(eligible), Sampled: len(samples)}}
+	byExt := map[string]*extEstimate{}
+	for _, src := range eligible {
+		e := byExt[src.ext]
+		if e == nil {
+			e = &extEstimate{Ext: src.ext}
+			byExt[src.ext] = e
+			report.ByExt = append(report.ByExt, e)
+		}
+		e.Eligible++
+		e.SourceSize += src.size
+	}
+	sort.Slice(report.ByExt, func(i, j int) bool { return report.ByExt[i].SourceSize > report.ByExt[j].SourceSize })
+
+	_, pooled := ratio(samples)
+	for _, e := range report.ByExt {
+		var own []sampled
+		for _, s := range samples {
+			if s.ext == e.Ext {
+				own = append(own, s)
+			}
+		}
+		e.extrapolate(own, samples, pooled)
+		report.Total.SourceSize += e.SourceSize
+		report.Total.EstimatedSize += e.EstimatedSize
+		report.Total.variance += e.variance
+	}
+	report.Total.finish()
+
+	if opts.jsonOutput {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, string(data))
+		return nil
+	}
+	for _, e := range report.ByExt {
+		fmt.Fprintf(stdout, "   %-6s %4d/%-6d %9s -> %-9s saves %s (%s ~ %s)\n", e.Ext, e.Sampled, e.Eligible,
+			formatSize(e.SourceSize), formatSize(e.EstimatedSize), formatSize(e.Savings), formatSize(e.SavingsLow), formatSize(e.SavingsHigh))
+	}
+	t := report.Total
+	pct := 0.0
+	if t.SourceSize > 0 {
+		pct = float64(t.Savings) / float64(t.SourceSize) * 100
+	}
+	fmt.Fprintf(stdout, "💾 Estimated savings: %s of %s (%.0f%%), 95%% confidence %s ~ %s\n",
+		formatSize(t.Savings), formatSize(t.SourceSize), pct, formatSize(t.SavingsLow), formatSize(t.SavingsHigh))
+	return nil
+}
+
+// shuffledSources returns the eligible images in random order, so any prefix
+// is a random sample, along with the seed used. The seed comes from --seed or
+// else the clock.
+func shuffledSources(root string, opts options) ([]source, int64, error) {
+	seed := opts.seed
+	if !opts.set["seed"] {
+		seed = time.Now().UnixNano()
+	}
+	eligible, err := eligibleSources(root, opts)
+	if err != nil {
+		return nil, 0, err
+	}
+	rng := rand.New(rand.NewSource(seed))
+	rng.Shuffle(len(eligible), func(i, j int) { eligible[i], eligible[j] = eligible[j], eligible[i] })
+	return eligible, seed, nil
+}
+
+// eligibleSources lists the images a conversion would take, minus the ones it
+// would leave alone regardless of their content.
+func eligibleSources(root string, opts options) ([]source, error) {
+	icons, err := projectIcons(root, opts)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error %v\n", err)
+		return nil, err
+	}
+	var referenced *projectRefs
+	if opts.onlyReferenced {
+		if referenced, err = scanRefs(root); err != nil {
+			fmt.Fprintf(stdout, "❌ Error scanning for image references: %v\n", err)
+			return nil, err
+		}
+	}
+	var changed map[string]bool
+	if opts.gitSince != "" {
+		var err error
+		if changed, err = gitChanged(root, opts.gitSince); err != nil {
+			fmt.Fprintf(stdout, "❌ %v\n", err)
+			return nil, err
+		}
+	}
+
+	outputs, err := loadMapping(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", mapFileName, err)
+		return nil, err
+	}
+	sources := scanSources(root, opts)
+	sel := &selector{opts, outputs, icons, referenced, changed, findCollisions(sources), outputs.writtenOutputs(), osTree(root), osTree(root)}
+
+	var eligible []source
+	for _, src := range sources {
+		info, err := fs.Stat(sel.src, treeName(src.rel))
+		if err != nil {
+			continue
+		}
+		if ok, _, _, err := sel.shouldConvert(src.rel, info); ok && err == nil {
+			eligible = append(eligible, src)
+		}
+	}
+	return eligible, nil
+}
+
+// encodedSize encodes one file with its effective options and returns the
+// size of the WebP. Animated GIFs count as their first frame.
+func encodedSize(path, relPath, ext string, overrides *overrideLoader, opts options) (int64, error) {
+	fopts, err := overrides.optionsFor(path, opts)
+	if err != nil {
+		return 0, err
+	}
+	f, err := os.Open(longPath(path))
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	img, err := decodeSized(f, ext, fopts)
+	if err != nil {
+		return 0, err
+	}
+	res, err := encodeStatic(io.Discard, img, osFile(path), ext, relPath, fopts)
+	return res.size, err
+}
+
+// ratio returns the ratio of encoded to source bytes over samples and the
+// variance of the residuals around it.
+func ratio(samples []sampled) (r, residual float64) {
+	var in, out float64
+	for _, s := range samples {
+		in += s.in
+		out += s.out
+	}
+	if in > 0 {
+		r = out / in
+	}
+	if len(samples) < 2 {
+		return r, math.NaN()
+	}
+	for _, s := range samples {
+		d := s.out - r*s.in
+		residual += d * d
+	}
+	return r, residual / float64(len(samples)-1)
+}
+
+// extrapolate estimates the encoded size of every eligible file of e's
+// extension from own, its sampled files. Extensions the sample missed, or hit
+// only once, borrow the ratio or residual variance of the whole sample.
+func (e *extEstimate) extrapolate(own, all []sampled, pooled float64) {
+	e.Sampled = len(own)
+	r, residual := ratio(own)
+	if len(own) == 0 {
+		r, _ = ratio(all)
+	}
+	if math.IsNaN(residual) {
+		residual = pooled
+	}
+	e.EstimatedSize = int64(math.Round(r * float64(e.SourceSize)))
+
+	// Variance of a ratio estimate of a total, with the finite population correction
+	n, N := float64(max(len(own), 1)), float64(e.Eligible)
+	if !math.IsNaN(residual) {
+		e.variance = N * N * (1 - min(n/N, 1)) * residual / n
+	}
+	e.finish()
+}
+
+func (e *extEstimate) finish() {
+	e.Savings = e.SourceSize - e.EstimatedSize
+	margin := int64(math.Round(z95 * math.Sqrt(e.variance)))
+	e.SavingsLow, e.SavingsHigh = e.Savings-margin, e.Savings+margin
+}
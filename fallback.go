@@ -0,0 +1,86 @@
+package webpcon
+
+import (
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// defaultFallbackQuality is the JPEG quality of --fallback jpeg without one.
+const defaultFallbackQuality = 80
+
+// parseFallback reads a --fallback value: a comma separated list of jpeg[:q]
+// and png. Each format's fallback is written for sources of that format, as
+// only those can replace the original under its own name. The result maps
+// "jpeg" and "png" to the JPEG quality, 0 for PNG.
+func parseFallback(v string) (map[string]int, error) {
+	formats := map[string]int{}
+	for _, f := range strings.Split(v, ",") {
+		name, q, hasQuality := strings.Cut(strings.TrimSpace(f), ":")
+		switch {
+		case (name == "jpeg" || name == "jpg") && !hasQuality:
+			formats["jpeg"] = defaultFallbackQuality
+		case name == "jpeg" || name == "jpg":
+			n, err := strconv.Atoi(q)
+			if err != nil || n < 1 || n > 100 {
+				return nil, fmt.Errorf("--fallback expects a JPEG quality of 1 to 100, got %q", q)
+			}
+			formats["jpeg"] = n
+		case name == "png" && !hasQuality:
+			formats["png"] = 0
+		default:
+			return nil, fmt.Errorf("--fallback expects jpeg[:quality] or png, got %q", f)
+		}
+	}
+	return formats, nil
+}
+
+// fallbackFormat returns the --fallback format for a source extension.
+func fallbackFormat(ext string) string {
+	switch ext {
+	case ".jpg", ".jpeg", ".jpe", ".jfif":
+		return "jpeg"
+	case ".png":
+		return "png"
+	}
+	return ""
+}
+
+// writeFallback encodes img, the pixels the WebP was made from, at path in
+// the given format. When that isn't smaller than the original at bakPath,
+// the original is copied instead. It reports which one it wrote.
+func writeFallback(path, bakPath string, img image.Image, format string, quality int) (reencoded bool, err error) {
+	f, err := os.Create(longPath(path))
+	if err != nil {
+		return false, err
+	}
+	if format == "jpeg" {
+		err = jpeg.Encode(f, img, &jpeg.Options{Quality: quality})
+	} else {
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(f, img)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(longPath(path))
+		return false, err
+	}
+
+	fi, err := os.Stat(longPath(path))
+	if err != nil {
+		return false, err
+	}
+	orig, err := os.Stat(longPath(bakPath))
+	if err != nil {
+		return false, err
+	}
+	if fi.Size() < orig.Size() {
+		return true, nil
+	}
+	return false, copyFile(bakPath, path)
+}
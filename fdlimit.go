@@ -0,0 +1,24 @@
+package webpcon
+
+// openFiles bounds the files the parallel stages, the hashing pre-scan and
+// the streaming walk, hold open at once. Their worker counts follow the
+// CPUs, and on a big machine that can be more descriptors than a low
+// ulimit -n (256 on macOS) leaves once the conversion has its own open.
+var openFiles = make(chan struct{}, openFileSlots(walkDirs, fileLimit()))
+
+// openFileSlots is how many files the parallel stages may hold open: one per
+// worker, but no more than a quarter of limit, the descriptor limit, when it
+// is known (not 0).
+func openFileSlots(workers int, limit uint64) int {
+	n := max(workers, 1)
+	if q := limit / 4; limit > 0 && q < uint64(n) {
+		n = max(int(q), 1)
+	}
+	return n
+}
+
+// acquireFile waits for a slot to open a file in, see openFiles. The file
+// must be closed before releaseFile.
+func acquireFile() { openFiles <- struct{}{} }
+
+func releaseFile() { <-openFiles }
@@ -0,0 +1,24 @@
+package webpcon
+
+import "testing"
+
+func TestOpenFileSlots(t *testing.T) {
+	tests := []struct {
+		workers int
+		limit   uint64
+		want    int
+	}{
+		{16, 0, 16},        // Limit unknown
+		{16, 256, 16},      // Room for every worker
+		{128, 256, 64},     // A quarter of the limit
+		{8, 2, 1},          // Never none
+		{0, 0, 1},          // Never none
+		{8, 1 << 63, 8},    // Unlimited
+		{32, 1024 * 4, 32}, // Exactly a quarter left
+	}
+	for _, tt := range tests {
+		if got := openFileSlots(tt.workers, tt.limit); got != tt.want {
+			t.Errorf("openFileSlots(%d, %d) = %d, want %d", tt.workers, tt.limit, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,14 @@
+//go:build !windows
+
+package webpcon
+
+import "syscall"
+
+// fileLimit returns the soft limit on open descriptors, 0 if unknown.
+func fileLimit() uint64 {
+	var rl syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &rl); err != nil {
+		return 0
+	}
+	return uint64(rl.Cur)
+}
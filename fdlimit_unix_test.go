@@ -0,0 +1,54 @@
+//go:build !windows
+
+package webpcon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// TestConvertUnderFileLimit converts a couple of thousand tiny images, with
+// the streaming walk and the hashing pre-scan, under a descriptor limit far
+// below their count.
+func TestConvertUnderFileLimit(t *testing.T) {
+	if testing.Short() {
+		t.Skip("converts 2000 files")
+	}
+	quietly(t)
+	png := encodeFixture(t, ".png", 2, 2)
+	var files []fixtureFile
+	for d := 0; d < 40; d++ {
+		for i := 0; i < 50; i++ {
+			files = append(files, fixtureFile{fmt.Sprintf("d%02d/sub/img%02d.png", d, i), png})
+		}
+	}
+	root := writeFixtureTree(t, files)
+	// Distinct files, so none is handled as a duplicate
+	for i, f := range files {
+		path := filepath.Join(root, filepath.FromSlash(f.rel))
+		if err := os.WriteFile(path, encodeFixture(t, ".png", 2+i%40, 2+i/40), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var saved syscall.Rlimit
+	if err := syscall.Getrlimit(syscall.RLIMIT_NOFILE, &saved); err != nil {
+		t.Skip(err)
+	}
+	lowered := saved
+	lowered.Cur = 64
+	if err := syscall.Setrlimit(syscall.RLIMIT_NOFILE, &lowered); err != nil {
+		t.Skip(err)
+	}
+	t.Cleanup(func() { syscall.Setrlimit(syscall.RLIMIT_NOFILE, &saved) })
+
+	// Half through the hashing pre-scan, the rest with the streaming walk
+	first := convertTree(t, root, testOptions(t, "--encoder", "native", "--exclude-regex", "^d[01]"))
+	second := convertTree(t, root, testOptions(t, "--encoder", "native", "--streaming-walk"))
+	if n := first.Converted + second.Converted; n != len(files) || first.Converted != len(files)/2 {
+		t.Errorf("converted %d then %d of %d files", first.Converted, second.Converted, len(files))
+	}
+}
@@ -0,0 +1,7 @@
+//go:build windows
+
+package webpcon
+
+// fileLimit returns 0: Windows has no per-process limit on open handles
+// that a run could come near.
+func fileLimit() uint64 { return 0 }
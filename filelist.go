@@ -0,0 +1,96 @@
+package webpcon
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// listedSources reads the --files-from list, one path relative to root per
+// line ("-" reads stdin), and returns its images as the conversion walk
+// would have found them. Entries that don't exist, aren't images, lie
+// outside root or in a folder the walk skips are reported and left out; the
+// rest go through the usual skip rules when converted.
+func listedSources(root string, opts options) ([]source, error) {
+	var r io.Reader = os.Stdin
+	if opts.filesFrom != "-" {
+		f, err := os.Open(longPath(opts.filesFrom))
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	var sources []source
+	seen := map[string]bool{}
+	scan := bufio.NewScanner(r)
+	for scan.Scan() {
+		line := strings.TrimSpace(scan.Text())
+		if line == "" {
+			continue
+		}
+		rel := filepath.Clean(filepath.FromSlash(line))
+		if filepath.IsAbs(rel) {
+			// find and git print absolute paths on request
+			if abs, err := filepath.Abs(root); err == nil {
+				rel, _ = filepath.Rel(abs, rel)
+			}
+		}
+		if why := listedSkipReason(root, rel, opts); why != "" {
+			fmt.Fprintf(stdout, "⏭️ Skipping listed %s (%s)\n", filepath.ToSlash(line), why)
+			continue
+		}
+		info, err := os.Stat(longPath(filepath.Join(root, rel)))
+		switch {
+		case err != nil:
+			fmt.Fprintf(stdout, "⚠️  Skipping listed %s (%v)\n", filepath.ToSlash(line), unwrapPathError(err))
+			continue
+		case info.IsDir():
+			fmt.Fprintf(stdout, "⏭️ Skipping listed %s (a folder, list its files instead)\n", filepath.ToSlash(line))
+			continue
+		}
+		ext := strings.ToLower(filepath.Ext(rel))
+		if !imageExt[ext] || !opts.inputEnabled(ext) {
+			fmt.Fprintf(stdout, "⏭️ Skipping listed %s (not an image webpcon converts)\n", filepath.ToSlash(line))
+			continue
+		}
+		if key := pathKey(rel); !seen[key] {
+			seen[key] = true
+			sources = append(sources, source{rel, ext, info.Size(), info.ModTime()})
+		}
+	}
+	return sources, scan.Err()
+}
+
+// listedSkipReason tells why the walk would never reach rel, or "".
+func listedSkipReason(root, rel string, opts options) string {
+	if rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "outside the project"
+	}
+	parts := splitPath(rel)
+	if len(parts) == 0 {
+		return ""
+	}
+	for i, part := range parts[:len(parts)-1] {
+		if skipDirs[part] {
+			return "in " + part
+		}
+		if reason := opts.vendoredReason(osTree(root), filepath.Join(parts[:i+1]...)); reason != "" {
+			return "vendored, " + reason
+		}
+	}
+	return ""
+}
+
+// unwrapPathError drops the operation and path from err, which the message
+// around it already names.
+func unwrapPathError(err error) error {
+	if pe, ok := err.(*os.PathError); ok {
+		return pe.Err
+	}
+	return err
+}
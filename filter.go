@@ -0,0 +1,135 @@
+package webpcon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+// filterBatchSize caps how many paths go to one batched --filter-hook run.
+const filterBatchSize = 200
+
+// filterVerdict is what --filter-hook decided for one file.
+type filterVerdict struct {
+	skip      bool
+	overrides *fileOverrides // Settings for this file only, if the hook gave any
+}
+
+// filterHook asks an external command whether each file may be converted.
+//
+// By default the command runs once per file with the path appended to its
+// arguments (or put where {src} is): exit code 0 converts the file, anything
+// else skips it, and JSON on stdout such as {"quality": 95} overrides settings
+// for that file. A command containing {files} instead runs once per batch of
+// paths and prints one JSON line per file it has an opinion on:
+//
+//	{"path": "img/a.png", "skip": true}
+//	{"path": "img/b.png", "options": {"quality": 95}}
+type filterHook struct {
+	args    []string
+	timeout time.Duration
+	batched map[string]filterVerdict // By pathKey, for batch mode
+}
+
+func newFilterHook(command string, timeout time.Duration) (*filterHook, error) {
+	args, err := splitArgs(command)
+	if err != nil {
+		return nil, err
+	}
+	return &filterHook{args: args, timeout: timeout}, nil
+}
+
+func (f *filterHook) isBatch() bool {
+	return slices.ContainsFunc(f.args, func(a string) bool { return strings.Contains(a, "{files}") })
+}
+
+// prefetch runs a batch-mode hook over all candidate files up front.
+func (f *filterHook) prefetch(root string, sources []source) error {
+	f.batched = map[string]filterVerdict{}
+	for start := 0; start < len(sources); start += filterBatchSize {
+		var paths []string
+		rels := map[string]string{} // Path as passed -> relative path
+		for _, src := range sources[start:min(start+filterBatchSize, len(sources))] {
+			p := filepath.Join(root, src.rel)
+			paths = append(paths, p)
+			rels[p] = src.rel
+		}
+		var args []string
+		for _, a := range f.args {
+			if a == "{files}" {
+				args = append(args, paths...)
+			} else {
+				args = append(args, a)
+			}
+		}
+		var out bytes.Buffer
+		if err := execHook(args, nil, &out, f.timeout); err != nil {
+			return err
+		}
+		sc := bufio.NewScanner(&out)
+		for sc.Scan() {
+			line := strings.TrimSpace(sc.Text())
+			if line == "" {
+				continue
+			}
+			var v struct {
+				Path    string          `json:"path"`
+				Skip    bool            `json:"skip"`
+				Options json.RawMessage `json:"options"`
+			}
+			if err := json.Unmarshal([]byte(line), &v); err != nil {
+				return fmt.Errorf("bad filter hook output %q: %v", line, err)
+			}
+			verdict := filterVerdict{skip: v.Skip}
+			if len(v.Options) > 0 {
+				o, err := parseOverrides(v.Options)
+				if err != nil {
+					return fmt.Errorf("bad options for %s: %v", v.Path, err)
+				}
+				verdict.overrides = o
+			}
+			rel, ok := rels[v.Path]
+			if !ok {
+				rel = v.Path // Taken as relative to the project root
+			}
+			f.batched[pathKey(rel)] = verdict
+		}
+	}
+	return nil
+}
+
+// check returns the verdict for one file.
+func (f *filterHook) check(path, rel string) (filterVerdict, error) {
+	if f.batched != nil {
+		return f.batched[pathKey(rel)], nil
+	}
+	args := substitute(f.args, map[string]string{"src": path})
+	if !slices.ContainsFunc(f.args, func(a string) bool { return strings.Contains(a, "{src}") }) {
+		args = append(args, path)
+	}
+	var out bytes.Buffer
+	err := execHook(args, nil, &out, f.timeout)
+	var exit *exec.ExitError
+	if errors.As(err, &exit) {
+		return filterVerdict{skip: true}, nil
+	}
+	if err != nil {
+		return filterVerdict{}, err
+	}
+	verdict := filterVerdict{}
+	if data := bytes.TrimSpace(out.Bytes()); len(data) > 0 {
+		o, err := parseOverrides(data)
+		if err != nil {
+			return filterVerdict{}, fmt.Errorf("bad options on stdout: %v", err)
+		}
+		verdict.overrides = o
+	}
+	return verdict, nil
+}
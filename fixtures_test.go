@@ -0,0 +1,197 @@
+package webpcon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// fixtureImage is a w x h gradient with a transparent corner, so conversions
+// have color, alpha and detail to work with.
+func fixtureImage(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			a := uint8(0xff)
+			if x < w/4 && y < h/4 {
+				a = 0
+			}
+			img.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / max(w-1, 1)), uint8(y * 255 / max(h-1, 1)), uint8((x + y) % 256), a})
+		}
+	}
+	return img
+}
+
+// encodeFixture returns a w x h fixtureImage encoded in the format of ext:
+// .jpg, .png, .bmp, .tiff or .gif.
+func encodeFixture(tb testing.TB, ext string, w, h int) []byte {
+	tb.Helper()
+	img := fixtureImage(w, h)
+	var buf bytes.Buffer
+	var err error
+	switch ext {
+	case ".jpg":
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: 90})
+	case ".png":
+		err = png.Encode(&buf, img)
+	case ".bmp":
+		err = bmp.Encode(&buf, img)
+	case ".tiff":
+		err = tiff.Encode(&buf, img, nil)
+	case ".gif":
+		err = gif.Encode(&buf, img, nil)
+	default:
+		tb.Fatalf("encodeFixture: no encoder for %s", ext)
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// animatedGIFFixture returns an animated GIF of w x h frames, each in
+// different colors.
+func animatedGIFFixture(tb testing.TB, w, h, frames int) []byte {
+	tb.Helper()
+	a := &gif.GIF{}
+	for i := range frames {
+		p := image.NewPaletted(image.Rect(0, 0, w, h), palette.Plan9)
+		for j := range p.Pix {
+			p.Pix[j] = uint8(i*37 + j%7)
+		}
+		a.Image = append(a.Image, p)
+		a.Delay = append(a.Delay, 10)
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, a); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// fixtureFormats are the formats encodeFixture writes.
+var fixtureFormats = []string{".jpg", ".png", ".bmp", ".tiff", ".gif"}
+
+// fixtureFile is one file of a fixture tree.
+type fixtureFile struct {
+	rel  string // Slash-separated, from the root
+	data []byte
+}
+
+// fixtureTree returns a small project holding every format a conversion
+// takes, still and animated, in nested folders and in folders the walk
+// skips, with sources colliding on their WebP name, a duplicate, files
+// that aren't images and odd names.
+func fixtureTree(tb testing.TB) []fixtureFile {
+	tb.Helper()
+	logo := encodeFixture(tb, ".png", 40, 30)
+	return []fixtureFile{
+		{"index.html", []byte(`<img src="photos/beach.jpg"><img src="img/logo.png">` + "\n")},
+		{"style.css", []byte(".hero { background: url(img/nested/deep/chart.bmp); }\n")},
+		{"notes.txt", []byte("not an image\n")},
+		{"photos/beach.jpg", encodeFixture(tb, ".jpg", 64, 48)},
+		{"photos/old.jpeg", encodeFixture(tb, ".jpg", 48, 64)},
+		{"photos/phone.jpe", encodeFixture(tb, ".jpg", 30, 20)},
+		{"photos/camera.jfif", encodeFixture(tb, ".jpg", 20, 30)},
+		{"img/logo.png", logo},
+		{"img/logo-copy.png", logo},
+		{"img/still.gif", encodeFixture(tb, ".gif", 24, 24)},
+		{"img/spinner.gif", animatedGIFFixture(tb, 16, 16, 3)},
+		{"img/nested/deep/chart.bmp", encodeFixture(tb, ".bmp", 33, 17)},
+		{"img/nested/deep/scan.tiff", encodeFixture(tb, ".tiff", 17, 33)},
+		{"node_modules/pkg/icon.png", encodeFixture(tb, ".png", 8, 8)},
+		{"dist/bundle.png", encodeFixture(tb, ".png", 8, 8)},
+		{"collide/pic.jpg", encodeFixture(tb, ".jpg", 10, 10)},
+		{"collide/pic.png", encodeFixture(tb, ".png", 10, 11)},
+		{"collide/Case.png", encodeFixture(tb, ".png", 12, 10)},
+		{"collide/case.png", encodeFixture(tb, ".png", 10, 12)},
+		{"odd/with space.png", encodeFixture(tb, ".png", 9, 9)},
+		{"odd/ünïcödé.png", encodeFixture(tb, ".png", 9, 10)},
+		{"odd/multi.dot.name.PNG", encodeFixture(tb, ".png", 10, 9)},
+		{"odd/100% #1&2.png", encodeFixture(tb, ".png", 11, 9)},
+	}
+}
+
+// writeFixtureTree writes files under a new temporary folder and returns it.
+func writeFixtureTree(tb testing.TB, files []fixtureFile) string {
+	tb.Helper()
+	root := tb.TempDir()
+	for _, f := range files {
+		path := filepath.Join(root, filepath.FromSlash(f.rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			tb.Fatal(err)
+		}
+		if err := os.WriteFile(path, f.data, 0644); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return root
+}
+
+// testEncoder returns the encoder backend name, skipping the test when this
+// build doesn't have it.
+func testEncoder(tb testing.TB, name string) encoder {
+	tb.Helper()
+	enc, err := selectEncoder(name)
+	if err != nil {
+		tb.Skipf("no %s encoder in this build: %v", name, err)
+	}
+	return enc
+}
+
+// bmpVariant describes a BMP for bmpFixture to write, in the layouts
+// golang.org/x/image/bmp doesn't read.
+type bmpVariant struct {
+	headerLen   int // 40 (BITMAPINFOHEADER), 108 (BITMAPV4HEADER) or 124 (BITMAPV5HEADER)
+	width       int
+	height      int // Negative for top-down rows
+	bpp         int
+	compression uint32
+	masks       []uint32      // Red, green, blue and maybe alpha; after a 40 byte header or in a larger one
+	palette     []color.NRGBA // Written as BGRA
+	pixels      []byte        // Rows or RLE data, as they go in the file
+}
+
+// bmpFixture writes v as a BMP file.
+func bmpFixture(v bmpVariant) []byte {
+	le := binary.LittleEndian
+	info := make([]byte, v.headerLen)
+	le.PutUint32(info[0:], uint32(v.headerLen))
+	le.PutUint32(info[4:], uint32(int32(v.width)))
+	le.PutUint32(info[8:], uint32(int32(v.height)))
+	le.PutUint16(info[12:], 1)
+	le.PutUint16(info[14:], uint16(v.bpp))
+	le.PutUint32(info[16:], v.compression)
+	le.PutUint32(info[20:], uint32(len(v.pixels)))
+	le.PutUint32(info[32:], uint32(len(v.palette)))
+	var extra []byte
+	for i, m := range v.masks {
+		if v.headerLen > 40 {
+			le.PutUint32(info[40+4*i:], m)
+		} else {
+			extra = le.AppendUint32(extra, m)
+		}
+	}
+	for _, c := range v.palette {
+		extra = append(extra, c.B, c.G, c.R, 0)
+	}
+	offset := 14 + len(info) + len(extra)
+	file := []byte("BM")
+	file = le.AppendUint32(file, uint32(offset+len(v.pixels)))
+	file = le.AppendUint32(file, 0)
+	file = le.AppendUint32(file, uint32(offset))
+	file = append(file, info...)
+	file = append(file, extra...)
+	return append(file, v.pixels...)
+}
@@ -0,0 +1,165 @@
+package webpcon
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// areaPolicy is how --framework treats the images in one top-level folder.
+type areaPolicy int
+
+const (
+	// areaInPlace folders are served as they are and referenced by URL. Their
+	// images are converted, but references to them are left alone.
+	areaInPlace areaPolicy = iota
+	// areaRewrite folders are imported through the bundler, so references to
+	// their images are rewritten to the WebP files.
+	areaRewrite
+	// areaSkip folders are generated by the framework and never touched.
+	// They are matched by name at any depth, like skipDirs.
+	areaSkip
+)
+
+type area struct {
+	dir    string
+	policy areaPolicy
+}
+
+// framework describes a front-end framework's project layout. Folders it
+// doesn't list are converted as without --framework.
+type framework struct {
+	name    string
+	title   string
+	markers []string // Files at the project root that give it away
+	dep     string   // package.json dependency that gives it away
+	areas   []area
+}
+
+// frameworks are tried in order by --framework auto. Nuxt builds on Vite, so
+// it comes first.
+var frameworks = []*framework{
+	{name: "nextjs", title: "Next.js", dep: "next",
+		markers: []string{"next.config.js", "next.config.mjs", "next.config.ts"},
+		areas: []area{{"public", areaInPlace}, {"src", areaRewrite}, {"app", areaRewrite}, {"pages", areaRewrite},
+			{"components", areaRewrite}, {".next", areaSkip}}},
+	{name: "nuxt", title: "Nuxt", dep: "nuxt",
+		markers: []string{"nuxt.config.ts", "nuxt.config.js"},
+		areas: []area{{"public", areaInPlace}, {"static", areaInPlace}, {"assets", areaRewrite}, {"components", areaRewrite},
+			{"pages", areaRewrite}, {"src", areaRewrite}, {".nuxt", areaSkip}, {".output", areaSkip}}},
+	{name: "vite", title: "Vite", dep: "vite",
+		markers: []string{"vite.config.ts", "vite.config.js", "vite.config.mjs"},
+		areas:   []area{{"public", areaInPlace}, {"src", areaRewrite}}},
+}
+
+func frameworkNames() []string {
+	names := make([]string, len(frameworks))
+	for i, f := range frameworks {
+		names[i] = f.name
+	}
+	return names
+}
+
+// parseFramework checks a --framework value.
+func parseFramework(v string) (string, error) {
+	if v == "auto" {
+		return v, nil
+	}
+	for _, f := range frameworks {
+		if f.name == v {
+			return v, nil
+		}
+	}
+	return "", fmt.Errorf("--framework expects %s or auto, got %q", strings.Join(frameworkNames(), ", "), v)
+}
+
+// selectFramework resolves --framework for the project at root and applies
+// its defaults to opts: the generated folders are skipped and references are
+// rewritten as with --rewrite-refs, except to images in in-place folders.
+func selectFramework(root string, opts *options) error {
+	if opts.framework == "" {
+		return nil
+	}
+	var fw *framework
+	if opts.framework == "auto" {
+		var err error
+		if fw, err = detectFramework(root); err != nil {
+			fmt.Fprintf(stdout, "❌ Error reading package.json: %v\n", err)
+			return err
+		}
+		if fw == nil {
+			fmt.Fprintln(stdout, "🔎 No known framework detected, converting as usual")
+			return nil
+		}
+		fmt.Fprintf(stdout, "🔎 Detected a %s project\n", fw.title)
+	} else {
+		for _, f := range frameworks {
+			if f.name == opts.framework {
+				fw = f
+			}
+		}
+	}
+
+	opts.fw = fw
+	for _, a := range fw.areas {
+		if a.policy == areaSkip {
+			skipDirs[a.dir] = true
+		}
+	}
+	opts.rewriteRefs = true
+	return nil
+}
+
+// detectFramework looks for a framework's config file at root, then for its
+// package in package.json.
+func detectFramework(root string) (*framework, error) {
+	for _, f := range frameworks {
+		for _, m := range f.markers {
+			if fileExists(filepath.Join(root, m)) {
+				return f, nil
+			}
+		}
+	}
+
+	data, err := os.ReadFile(longPath(filepath.Join(root, "package.json")))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var pkg struct {
+		Dependencies    map[string]string `json:"dependencies"`
+		DevDependencies map[string]string `json:"devDependencies"`
+	}
+	if err := json.Unmarshal(data, &pkg); err != nil {
+		return nil, err
+	}
+	for _, f := range frameworks {
+		if pkg.Dependencies[f.dep] != "" || pkg.DevDependencies[f.dep] != "" {
+			return f, nil
+		}
+	}
+	return nil, nil
+}
+
+// policy returns the policy of the top-level folder relPath is in, if the
+// framework lists it.
+func (f *framework) policy(relPath string) (areaPolicy, bool) {
+	top, _, _ := strings.Cut(filepath.ToSlash(relPath), "/")
+	for _, a := range f.areas {
+		if a.dir == top {
+			return a.policy, true
+		}
+	}
+	return 0, false
+}
+
+// keepsRefs reports whether references to the image at relPath stay as they
+// are, because it is served by URL from an in-place folder.
+func (f *framework) keepsRefs(relPath string) bool {
+	p, ok := f.policy(relPath)
+	return ok && p == areaInPlace
+}
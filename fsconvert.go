@@ -0,0 +1,30 @@
+package webpcon
+
+import (
+	"fmt"
+	"io/fs"
+	"time"
+)
+
+// newCopyRun sets up the conversion ConvertFS runs: from src to dst, leaving
+// src as it is. The map file already in dst is added to, and animations are
+// built in cacheDir. Files are logged to log.
+func newCopyRun(src fs.FS, dst Writer, cacheDir string, opts options, log *console) (*convertRun, error) {
+	if opts.maxMegapixels == 0 {
+		opts.maxMegapixels = defaultMaxMegapixels
+	}
+	outputs, err := loadMappingFS(dst)
+	if err != nil {
+		return nil, fmt.Errorf("reading %s: %w", mapFileName, err)
+	}
+	sum := newSummary()
+	sum.verb = "exported"
+	collisions := findCollisions(scanSourcesFS(src, opts))
+	sel := &selector{opts: opts, outputs: outputs, collisions: collisions, written: outputs.writtenOutputs(), src: src, dst: dst}
+	r := &convertRun{root: ".", src: src, dst: dst, cacheDir: cacheDir, copyOut: true,
+		opts: opts, sum: sum, overrides: newOverrideLoaderFS(".", src), encoded: map[string]encodedOutput{},
+		sel: sel, collisions: collisions, hashes: &hashCache{entries: map[string]scanEntry{}}, outputs: outputs,
+		runs: &runLog{}, con: log, runStart: time.Now()}
+	r.run = r.runs.start(r.runStart)
+	return r, nil
+}
@@ -0,0 +1,187 @@
+package webpcon
+
+import (
+	"archive/zip"
+	"bytes"
+	"io"
+	"io/fs"
+	"strings"
+	"testing"
+	"testing/fstest"
+	"time"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+// memFS is a Writer in memory. Files appear when they are closed.
+type memFS map[string][]byte
+
+type memFile struct {
+	bytes.Buffer
+	fsys memFS
+	name string
+}
+
+func (f *memFile) Close() error {
+	f.fsys[f.name] = f.Bytes()
+	return nil
+}
+
+func (m memFS) Open(name string) (fs.File, error) {
+	fsys := fstest.MapFS{}
+	for n, data := range m {
+		fsys[n] = &fstest.MapFile{Data: data, Mode: 0644}
+	}
+	return fsys.Open(name)
+}
+
+func (m memFS) CreateFile(name string) (io.WriteCloser, error) {
+	return &memFile{fsys: m, name: name}, nil
+}
+
+func (m memFS) Rename(oldname, newname string) error {
+	data, ok := m[oldname]
+	if !ok {
+		return fs.ErrNotExist
+	}
+	delete(m, oldname)
+	m[newname] = data
+	return nil
+}
+
+func (m memFS) Remove(name string) error {
+	delete(m, name)
+	return nil
+}
+
+func (m memFS) MkdirAll(name string, perm fs.FileMode) error { return nil }
+
+// fixtureFS is the fixture tree as an fs.FS.
+func fixtureFS(tb testing.TB) fstest.MapFS {
+	tb.Helper()
+	fsys := fstest.MapFS{}
+	for _, f := range fixtureTree(tb) {
+		fsys[f.rel] = &fstest.MapFile{Data: f.data, Mode: 0644, ModTime: time.Now()}
+	}
+	return fsys
+}
+
+// copyToMemory runs the conversion of ConvertFS from src to a memFS, and
+// returns it and the run.
+func copyToMemory(tb testing.TB, src fs.FS, opts options) (memFS, *convertRun) {
+	tb.Helper()
+	out := memFS{}
+	r, err := newCopyRun(src, out, tb.TempDir(), opts, newConsole(stdout, false))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	err = r.walk(r.visit)
+	r.con.close()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return out, r
+}
+
+// TestConvertRunFS converts a tree read through fs.FS into memory: nothing
+// is read from or written to disk, and the source is left as it was.
+func TestConvertRunFS(t *testing.T) {
+	quietly(t)
+	src := fixtureFS(t)
+	before := len(src)
+	out, r := copyToMemory(t, src, testOptions(t, "--encoder", "native"))
+	if len(src) != before {
+		t.Errorf("the source went from %d to %d file(s)", before, len(src))
+	}
+	entries := r.outputs.entries
+	if len(entries) != r.sum.converted || len(out) != r.sum.converted {
+		t.Errorf("wrote %d file(s) and %d map entries, %d converted", len(out), len(entries), r.sum.converted)
+	}
+	for key, e := range entries {
+		cfg, err := xwebp.DecodeConfig(bytes.NewReader(out[e.WebP]))
+		if err != nil || cfg.Width != e.Width || cfg.Height != e.Height {
+			t.Errorf("%s -> %s: %v, %dx%d, map says %dx%d", key, e.WebP, err, cfg.Width, cfg.Height, e.Width, e.Height)
+		}
+		if strings.HasPrefix(key, "node_modules/") || strings.HasPrefix(key, "dist/") || strings.HasPrefix(key, "collide/") {
+			t.Errorf("%s converted from a folder or name convert skips", key)
+		}
+	}
+	if r.sum.animatedSkipped != 1 {
+		t.Errorf("skipped %d animated GIF(s), want 1", r.sum.animatedSkipped)
+	}
+	if len(r.sum.dupes) == 0 || !bytes.Equal(out["img/logo.webp"], out["img/logo-copy.webp"]) {
+		t.Error("img/logo-copy.png didn't reuse the WebP of img/logo.png")
+	}
+	if e := entries["odd/100% #1&2.png"]; e == nil || e.WebP != "odd/100% #1&2.webp" {
+		t.Errorf("odd/100%% #1&2.png converted as %+v", e)
+	}
+}
+
+func TestConvertRunFSSelection(t *testing.T) {
+	quietly(t)
+	out, r := copyToMemory(t, fixtureFS(t), testOptions(t, "--encoder", "native", "--exclude-regex", "^odd/", "--min-width", "31", "--max-megapixels", "0.003"))
+	for name := range out {
+		if strings.HasPrefix(name, "odd/") {
+			t.Errorf("%s written despite --exclude-regex", name)
+		}
+	}
+	if r.sum.tooSmall == 0 {
+		t.Error("no image skipped by --min-width")
+	}
+	if _, ok := out["photos/beach.webp"]; ok || len(r.sum.unsupported) == 0 {
+		t.Error("photos/beach.jpg, 64x48, written despite --max-megapixels 0.003")
+	}
+	if _, ok := out["img/logo.webp"]; !ok {
+		t.Error("img/logo.png, 40x30, not written")
+	}
+}
+
+// TestConvertFS converts a zip archive without extracting it, as the same
+// tree converts in memory, and writes the map file through the Writer.
+func TestConvertFS(t *testing.T) {
+	quietly(t)
+	var archive bytes.Buffer
+	zw := zip.NewWriter(&archive)
+	for _, file := range fixtureTree(t) {
+		w, err := zw.Create(file.rel)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(file.data)
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var log bytes.Buffer
+	opts := DefaultOptions()
+	opts.Encoder, opts.Log = "native", &log
+	got := memFS{}
+	if err := ConvertFS(zr, got, opts); err != nil {
+		t.Fatal(err)
+	}
+	want, _ := copyToMemory(t, fixtureFS(t), testOptions(t, "--encoder", "native"))
+	if _, ok := got[mapFileName]; !ok {
+		t.Errorf("no %s written", mapFileName)
+	}
+	if len(got) != len(want)+1 {
+		t.Errorf("ConvertFS wrote %d file(s), want %d and the map file", len(got), len(want))
+	}
+	for name, data := range want {
+		if !bytes.Equal(got[name], data) {
+			t.Errorf("%s differs between the zip and the folder", name)
+		}
+	}
+	if !strings.Contains(log.String(), "img/logo.png") {
+		t.Errorf("img/logo.png not in the log:\n%s", log.String())
+	}
+
+	opts.Quality = 101
+	if err := ConvertFS(zr, memFS{}, opts); err == nil {
+		t.Error("ConvertFS accepted quality 101")
+	}
+}
@@ -0,0 +1,265 @@
+package webpcon
+
+import (
+	"bufio"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"image/png"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// gifAnimation is an animated GIF's frames as they go to the frame cache.
+type gifAnimation struct {
+	frames    []draw.Image
+	delays    []uint // Milliseconds per frame
+	disposals []uint
+	width     int
+	height    int
+}
+
+// prepareGIF turns the frames of g into images to encode. Left alone, each
+// frame keeps its own bounds and disposal. --gif-max-fps and --gif-scale work
+// on whole frames instead: the GIF is played onto a canvas first, so dropping
+// a frame that only holds the changes since the last can't break the frames
+// after it, and each full frame clears the canvas for the next. Frames that
+// are empty or reach past the logical screen go through the canvas too,
+// which clips them to it.
+func prepareGIF(g *gif.GIF, opts options) gifAnimation {
+	a := gifAnimation{width: g.Config.Width, height: g.Config.Height}
+	if opts.gifMaxFPS == 0 && opts.gifScale == 0 && framesFit(g) {
+		for i, frame := range g.Image {
+			var rgba draw.Image
+			if opts.exact {
+				// Straight alpha with draw.Src keeps the palette RGB of transparent pixels
+				rgba = image.NewNRGBA(frame.Bounds())
+				draw.Draw(rgba, frame.Bounds(), frame, frame.Bounds().Min, draw.Src)
+			} else {
+				rgba = image.NewRGBA(frame.Bounds())
+				draw.Draw(rgba, frame.Bounds(), frame, image.Point{}, draw.Over)
+			}
+			a.frames = append(a.frames, rgba)
+			a.delays = append(a.delays, uint(g.Delay[i])*10)
+			a.disposals = append(a.disposals, uint(g.Disposal[i]))
+		}
+		return a
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, a.width, a.height))
+	minDelay := 0.0
+	if opts.gifMaxFPS > 0 {
+		minDelay = 1000 / opts.gifMaxFPS
+	}
+	elapsed, next := 0.0, 0.0 // When the current frame starts, and the next kept frame may
+	for i, frame := range g.Image {
+		var saved *image.RGBA
+		if g.Disposal[i] == gif.DisposalPrevious {
+			saved = image.NewRGBA(canvas.Bounds())
+			copy(saved.Pix, canvas.Pix)
+		}
+		draw.Draw(canvas, frame.Bounds(), frame, frame.Bounds().Min, draw.Over)
+
+		delay := uint(g.Delay[i]) * 10
+		if len(a.frames) == 0 || elapsed >= next {
+			full := image.NewRGBA(canvas.Bounds())
+			copy(full.Pix, canvas.Pix)
+			a.frames = append(a.frames, full)
+			a.delays = append(a.delays, delay)
+			a.disposals = append(a.disposals, 1)
+			next = elapsed + minDelay
+		} else {
+			// The frame is dropped and the last kept one shows for its time too
+			a.delays[len(a.delays)-1] += delay
+		}
+		elapsed += float64(delay)
+
+		switch g.Disposal[i] {
+		case gif.DisposalBackground:
+			draw.Draw(canvas, frame.Bounds(), image.Transparent, image.Point{}, draw.Src)
+		case gif.DisposalPrevious:
+			canvas = saved
+		}
+	}
+
+	if opts.gifScale > 0 {
+		a.width = max(int(math.Round(float64(a.width)*opts.gifScale)), 1)
+		a.height = max(int(math.Round(float64(a.height)*opts.gifScale)), 1)
+		for i, f := range a.frames {
+			a.frames[i] = resizeImage(f, a.width, a.height, opts.fastResize)
+		}
+	}
+	return a
+}
+
+// writeFrames saves the frames as PNG files to the frame cache.
+func (a gifAnimation) writeFrames(cacheDir string) error {
+	if err := os.MkdirAll(longPath(cacheDir), 0755); err != nil {
+		return err
+	}
+	for i, frame := range a.frames {
+		framePath := filepath.Join(cacheDir, fmt.Sprintf("frame_%02d.png", i))
+		out, err := os.Create(longPath(framePath))
+		if err != nil {
+			return err
+		}
+		err = png.Encode(out, frame)
+		out.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// paletteAnimMaxPixels is the largest canvas encoded straight from a GIF's
+// palettes. Small UI animations shrink that way; photos turned into GIFs past
+// it do better on the lossy path.
+const paletteAnimMaxPixels = 512 * 512
+
+// Encodings of an animated GIF, as reported in the summary.
+const (
+	paletteEncoding  = "lossless palette"
+	lossyEncoding    = "lossy"
+	losslessEncoding = "lossless"
+)
+
+// paletteAnimation tells whether g is encoded from its palettes: its global
+// and local palettes hold no more than 256 colors together, its canvas is
+// small and its frames sit at even offsets, the only ones WebP can store.
+// --gif-max-fps, --gif-scale and --grayscale need full color frames, as do
+// frames that don't fit the screen, see framesFit.
+func paletteAnimation(g *gif.GIF, opts options) bool {
+	if opts.gifMaxFPS > 0 || opts.gifScale > 0 || opts.grayscale || g.Config.Width*g.Config.Height > paletteAnimMaxPixels || !framesFit(g) {
+		return false
+	}
+	colors := map[color.RGBA]bool{}
+	add := func(p color.Palette) {
+		for _, c := range p {
+			colors[color.RGBAModel.Convert(c).(color.RGBA)] = true
+		}
+	}
+	if global, ok := g.Config.ColorModel.(color.Palette); ok {
+		add(global)
+	}
+	for _, frame := range g.Image {
+		if frame.Rect.Min.X%2 != 0 || frame.Rect.Min.Y%2 != 0 {
+			return false
+		}
+		add(frame.Palette)
+	}
+	return len(colors) <= 256
+}
+
+// buildPaletteWebp writes g to outPath with its frames left paletted, so each
+// is stored losslessly as palette indexes rather than expanded to RGBA and
+// through the lossy encoder.
+func buildPaletteWebp(g *gif.GIF, outPath string, enc encoder) error {
+	a := animation{loopCount: uint16(g.LoopCount), background: 0xffffffff}
+	for i, frame := range g.Image {
+		a.frames = append(a.frames, frame)
+		a.durations = append(a.durations, uint(g.Delay[i])*10)
+		a.disposals = append(a.disposals, uint(g.Disposal[i]))
+	}
+	if err := os.MkdirAll(longPath(filepath.Dir(outPath)), 0755); err != nil {
+		return err
+	}
+	out, err := os.Create(longPath(outPath))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	return animationEncoderFor(enc).encodeAnimation(out, a)
+}
+
+// decodeGIFAll is decodeGIFFrames without the list of repairs.
+func decodeGIFAll(r io.Reader) (*gif.GIF, error) {
+	g, _, err := decodeGIFFrames(r)
+	return g, err
+}
+
+// isAnimatedGIF tells whether the GIF at path has more than one frame. It
+// walks the GIF's blocks without decoding any pixels and stops at the second
+// image, so it costs little more than reading the header. A file it can't
+// make sense of counts as not animated, for the decoder to report.
+func isAnimatedGIF(path string) bool {
+	f, err := os.Open(longPath(path))
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	return gifAnimated(f)
+}
+
+// gifAnimated is isAnimatedGIF for a GIF read from r.
+func gifAnimated(r io.Reader) bool {
+	return gifFrameCount(r, 2) > 1
+}
+
+// gifFrameCount counts the images of a GIF read from rd, stopping once it
+// reaches limit, 0 for none. It walks the GIF's blocks without decoding any
+// pixels. A GIF cut short counts the images before the cut, and anything that
+// isn't a GIF counts 0.
+func gifFrameCount(rd io.Reader, limit int) int {
+	r := bufio.NewReader(rd)
+
+	var header [13]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil || string(header[:3]) != "GIF" {
+		return 0
+	}
+	if header[10]&0x80 != 0 {
+		// Global color table
+		if _, err := r.Discard(3 << (header[10]&7 + 1)); err != nil {
+			return 0
+		}
+	}
+	frames := 0
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return frames
+		}
+		switch b {
+		case 0x21: // Extension: label, then sub-blocks
+			if _, err := r.ReadByte(); err != nil || skipSubBlocks(r) != nil {
+				return frames
+			}
+		case 0x2C: // Image descriptor
+			if frames++; frames == limit {
+				return frames
+			}
+			var desc [9]byte
+			if _, err := io.ReadFull(r, desc[:]); err != nil {
+				return frames
+			}
+			if desc[8]&0x80 != 0 {
+				if _, err := r.Discard(3 << (desc[8]&7 + 1)); err != nil {
+					return frames
+				}
+			}
+			// LZW minimum code size, then the image data
+			if _, err := r.ReadByte(); err != nil || skipSubBlocks(r) != nil {
+				return frames
+			}
+		default: // Trailer, or something that isn't a GIF block
+			return frames
+		}
+	}
+}
+
+// skipSubBlocks reads past a run of GIF data sub-blocks and its terminator.
+func skipSubBlocks(r *bufio.Reader) error {
+	for {
+		n, err := r.ReadByte()
+		if err != nil || n == 0 {
+			return err
+		}
+		if _, err := r.Discard(int(n)); err != nil {
+			return err
+		}
+	}
+}
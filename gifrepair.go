@@ -0,0 +1,211 @@
+package webpcon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/gif"
+	"io"
+	"math"
+)
+
+// malformedGIFError is a GIF whose structure can't be made sense of, even
+// after repairGIF, or that the animation steps choke on. Such a file fails on
+// its own, its original put back, rather than ending the run.
+type malformedGIFError struct {
+	err error
+}
+
+func (e *malformedGIFError) Error() string { return "malformed GIF: " + e.err.Error() }
+func (e *malformedGIFError) Unwrap() error { return e.err }
+
+// decodeGIFFrames is gif.DecodeAll, with a decoder panic turned into an
+// error. GIFs the decoder refuses are repaired where repairGIF can and
+// decoded again; repairs says what was done, for the log. The frames of a
+// repaired GIF may reach past its logical screen, g.Config, see framesFit.
+func decodeGIFFrames(r io.Reader) (g *gif.GIF, repairs []string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			g, err = nil, &malformedGIFError{fmt.Errorf("decoder crashed: %v", p)}
+		}
+	}()
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, nil, err
+	}
+	g, err = gif.DecodeAll(bytes.NewReader(data))
+	if err != nil {
+		fixed, screen, repairs, ok := repairGIF(data)
+		if !ok {
+			return nil, nil, &malformedGIFError{err}
+		}
+		if g, err = gif.DecodeAll(bytes.NewReader(fixed)); err != nil {
+			return nil, nil, &malformedGIFError{err}
+		}
+		g.Config.Width, g.Config.Height = screen.Dx(), screen.Dy()
+		return g, repairs, checkGIF(g)
+	}
+	return g, nil, checkGIF(g)
+}
+
+// decodeGIFStill is gif.Decode, the first frame, with the GIFs the decoder
+// refuses repaired like decodeGIFFrames does and the frame clipped to the
+// logical screen.
+func decodeGIFStill(r io.Reader) (image.Image, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	img, err := gif.Decode(bytes.NewReader(data))
+	if err == nil {
+		return img, nil
+	}
+	fixed, screen, _, ok := repairGIF(data)
+	if !ok {
+		return nil, &malformedGIFError{err}
+	}
+	frame, rerr := gif.Decode(bytes.NewReader(fixed))
+	if rerr != nil {
+		return nil, &malformedGIFError{err}
+	}
+	clipped := frame.(*image.Paletted).SubImage(screen)
+	if clipped.Bounds().Empty() {
+		return nil, &malformedGIFError{fmt.Errorf("the first frame lies outside the %dx%d logical screen", screen.Dx(), screen.Dy())}
+	}
+	return clipped, nil
+}
+
+// checkGIF makes sure g has a delay and disposal for each of its frames
+// before anything indexes them together.
+func checkGIF(g *gif.GIF) error {
+	if len(g.Image) == 0 {
+		return &malformedGIFError{fmt.Errorf("no frames")}
+	}
+	if len(g.Delay) != len(g.Image) || len(g.Disposal) != len(g.Image) {
+		return &malformedGIFError{fmt.Errorf("%d frames but %d delays and %d disposals", len(g.Image), len(g.Delay), len(g.Disposal))}
+	}
+	return nil
+}
+
+// framesFit tells whether every frame of g is non-empty and within its
+// logical screen. Frames that aren't only go through the canvas, which clips
+// them, see prepareGIF.
+func framesFit(g *gif.GIF) bool {
+	screen := image.Rect(0, 0, g.Config.Width, g.Config.Height)
+	for _, frame := range g.Image {
+		if b := frame.Bounds(); b.Empty() || !b.In(screen) {
+			return false
+		}
+	}
+	return true
+}
+
+// repairGIF rewrites data, a GIF the decoder refused, into one it takes, as
+// far as the damage is to the block structure rather than the image data:
+//
+//   - A trailer missing, or blocks cut short or garbage after the last whole
+//     frame, as old encoders and interrupted downloads leave them: the GIF is
+//     ended after the last whole block.
+//   - Frames reaching past the logical screen, which the spec forbids and the
+//     decoder refuses: the screen is grown to hold them. screen is the one the
+//     GIF declared, which they are clipped to once decoded.
+//
+// ok is false when there is nothing it can repair, or no whole frame.
+func repairGIF(data []byte) (fixed []byte, screen image.Rectangle, repairs []string, ok bool) {
+	if len(data) < 13 || string(data[:3]) != "GIF" {
+		return nil, screen, nil, false
+	}
+	width, height := int(binary.LittleEndian.Uint16(data[6:])), int(binary.LittleEndian.Uint16(data[8:]))
+	pos := 13
+	if data[10]&0x80 != 0 {
+		pos += 3 << (data[10]&7 + 1) // Global color table
+	}
+	// subBlocks returns where the sub-blocks starting at p end, false when
+	// data does first
+	subBlocks := func(p int) (int, bool) {
+		for p < len(data) {
+			n := int(data[p])
+			p++
+			if n == 0 {
+				return p, true
+			}
+			p += n
+		}
+		return p, false
+	}
+
+	frames, right, bottom := 0, width, height
+	end := -1 // Where the GIF is cut and a trailer added, -1 when it has one
+blocks:
+	for {
+		if pos >= len(data) {
+			end = len(data)
+			repairs = append(repairs, "added the missing trailer")
+			break
+		}
+		switch data[pos] {
+		case 0x3B: // Trailer
+			data = data[:pos+1]
+			break blocks
+		case 0x21: // Extension: label, then sub-blocks
+			next, whole := subBlocks(pos + 2)
+			if !whole {
+				end = pos
+				repairs = append(repairs, fmt.Sprintf("dropped an extension cut short after frame %d", frames))
+				break blocks
+			}
+			pos = next
+		case 0x2C: // Image descriptor
+			if pos+10 > len(data) {
+				end = pos
+				repairs = append(repairs, fmt.Sprintf("dropped frame %d, which is cut short", frames+1))
+				break blocks
+			}
+			d := data[pos+1 : pos+10]
+			left, top := int(binary.LittleEndian.Uint16(d[0:])), int(binary.LittleEndian.Uint16(d[2:]))
+			w, h := int(binary.LittleEndian.Uint16(d[4:])), int(binary.LittleEndian.Uint16(d[6:]))
+			p := pos + 10
+			if d[8]&0x80 != 0 {
+				p += 3 << (d[8]&7 + 1) // Local color table
+			}
+			next, whole := subBlocks(p + 1) // Past the LZW minimum code size
+			if !whole {
+				end = pos
+				repairs = append(repairs, fmt.Sprintf("dropped frame %d, which is cut short", frames+1))
+				break blocks
+			}
+			frames++
+			right, bottom = max(right, left+w), max(bottom, top+h)
+			pos = next
+		default:
+			end = pos
+			repairs = append(repairs, fmt.Sprintf("dropped %d byte(s) after frame %d that aren't GIF blocks", len(data)-pos, frames))
+			break blocks
+		}
+	}
+	if frames == 0 || right > math.MaxUint16 || bottom > math.MaxUint16 {
+		return nil, screen, nil, false
+	}
+
+	fixed = data
+	if end >= 0 {
+		fixed = append(data[:end:end], 0x3B)
+	}
+	screen = image.Rect(0, 0, width, height)
+	if screen.Empty() {
+		// Nothing to clip to, the frames make the screen
+		screen = image.Rect(0, 0, right, bottom)
+	}
+	if right > width || bottom > height {
+		fixed = append([]byte(nil), fixed...)
+		binary.LittleEndian.PutUint16(fixed[6:], uint16(right))
+		binary.LittleEndian.PutUint16(fixed[8:], uint16(bottom))
+		if screen.Dx() == right && screen.Dy() == bottom {
+			repairs = append(repairs, fmt.Sprintf("sized the empty logical screen to the frames, %dx%d", right, bottom))
+		} else {
+			repairs = append(repairs, fmt.Sprintf("clipped frames reaching past the %dx%d logical screen", width, height))
+		}
+	}
+	return fixed, screen, repairs, len(repairs) > 0
+}
@@ -0,0 +1,130 @@
+package webpcon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// malformedGIFs are damaged versions of a 16x16, 3 frame animation, as old
+// encoders and cut downloads leave them, with what repairGIF should say and
+// the frames left. Those with no repair can't be saved.
+func malformedGIFs(tb testing.TB) []struct {
+	name   string
+	data   []byte
+	repair string
+	frames int
+} {
+	good := animatedGIFFixture(tb, 16, 16, 3)
+	screen := func(w, h int) []byte {
+		d := bytes.Clone(good)
+		binary.LittleEndian.PutUint16(d[6:], uint16(w))
+		binary.LittleEndian.PutUint16(d[8:], uint16(h))
+		return d
+	}
+	noTrailer := good[:len(good)-1]
+	header := 13
+	if good[10]&0x80 != 0 {
+		header += 3 << (good[10]&7 + 1) // Global color table
+	}
+	return []struct {
+		name   string
+		data   []byte
+		repair string
+		frames int
+	}{
+		{"no-trailer", noTrailer, "added the missing trailer", 3},
+		{"cut-short", good[:len(good)-6], "which is cut short", 2},
+		{"garbage", append(bytes.Clone(noTrailer), "\x00junk"...), "that aren't GIF blocks", 3},
+		{"oversized-frames", screen(8, 8), "clipped frames reaching past the 8x8 logical screen", 3},
+		{"empty-screen", screen(0, 0), "sized the empty logical screen to the frames, 16x16", 3},
+		{"no-frames", good[:header], "", 0},
+		{"not-a-gif", []byte("GIF89a"), "", 0},
+	}
+}
+
+func TestRepairGIF(t *testing.T) {
+	for _, tt := range malformedGIFs(t) {
+		g, repairs, err := decodeGIFFrames(bytes.NewReader(tt.data))
+		if tt.repair == "" {
+			var malformed *malformedGIFError
+			if !errors.As(err, &malformed) {
+				t.Errorf("%s: got %v, want a malformed GIF error", tt.name, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		if len(g.Image) != tt.frames || !strings.Contains(strings.Join(repairs, "; "), tt.repair) {
+			t.Errorf("%s: %d frames, repairs %q, want %d and %q", tt.name, len(g.Image), repairs, tt.frames, tt.repair)
+		}
+		if still, err := decodeGIFStill(bytes.NewReader(tt.data)); err != nil || !still.Bounds().In(image.Rect(0, 0, 16, 16)) {
+			t.Errorf("%s: first frame %v, %v", tt.name, still, err)
+		}
+	}
+}
+
+func TestCheckGIF(t *testing.T) {
+	frame := image.NewPaletted(image.Rect(0, 0, 2, 2), []color.Color{color.Black, color.White})
+	tests := []struct {
+		name string
+		g    gif.GIF
+		ok   bool
+	}{
+		{"matching", gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{5, 5}, Disposal: []byte{0, 0}}, true},
+		{"no frames", gif.GIF{}, false},
+		{"short delays", gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{5}, Disposal: []byte{0, 0}}, false},
+		{"short disposals", gif.GIF{Image: []*image.Paletted{frame, frame}, Delay: []int{5, 5}}, false},
+		{"extra delays", gif.GIF{Image: []*image.Paletted{frame}, Delay: []int{5, 5}, Disposal: []byte{0}}, false},
+	}
+	for _, tt := range tests {
+		err := checkGIF(&tt.g)
+		var malformed *malformedGIFError
+		if tt.ok != (err == nil) || (err != nil && !errors.As(err, &malformed)) {
+			t.Errorf("%s: checkGIF = %v", tt.name, err)
+		}
+	}
+}
+
+// TestConvertMalformedGIFs converts the damaged GIFs as animations and as
+// stills: the run completes, the repairable ones are converted and the others
+// fail on their own with their original in place.
+func TestConvertMalformedGIFs(t *testing.T) {
+	quietly(t)
+	for _, args := range [][]string{{"--enable-gif"}, {"--gif-flatten"}} {
+		var files []fixtureFile
+		for _, g := range malformedGIFs(t) {
+			files = append(files, fixtureFile{"gif/" + g.name + ".gif", g.data})
+		}
+		root := writeFixtureTree(t, files)
+		if err := convertImages(root, testOptions(t, append([]string{"--encoder", "native"}, args...)...)); err != nil {
+			t.Errorf("%v: the run failed: %v", args, err)
+			continue
+		}
+		entries := readMapFile(t, root)
+		for _, g := range malformedGIFs(t) {
+			rel := "gif/" + g.name + ".gif"
+			if g.repair != "" {
+				if entries[rel] == nil {
+					t.Errorf("%v: %s not converted", args, rel)
+				}
+				continue
+			}
+			if data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(rel))); err != nil || !bytes.Equal(data, g.data) {
+				t.Errorf("%v: %s not left in place: %v", args, rel, err)
+			}
+		}
+		if len(entries) != 5 {
+			t.Errorf("%v: converted %d, want the 5 repairable GIFs", args, len(entries))
+		}
+	}
+}
@@ -0,0 +1,61 @@
+package webpcon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/fs"
+	"os/exec"
+	"strings"
+)
+
+// gitChanged lists the files under root added or modified since ref, keyed by
+// pathKey relative to root. Uncommitted changes in the worktree count too.
+func gitChanged(root, ref string) (map[string]bool, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, fmt.Errorf("--git-since needs git, which was not found in PATH")
+	}
+	if err := exec.Command("git", "-C", root, "rev-parse", "--is-inside-work-tree").Run(); err != nil {
+		return nil, fmt.Errorf("--git-since: %s is not inside a git repository", root)
+	}
+
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", "-C", root, "diff", "--name-only", "--diff-filter=AM", "--relative", "-z", ref, "--")
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git diff %s: %s", ref, strings.TrimSpace(stderr.String()))
+	}
+	changed := map[string]bool{}
+	for _, name := range strings.Split(stdout.String(), "\x00") {
+		if name != "" {
+			changed[pathKey(name)] = true
+		}
+	}
+	return changed, nil
+}
+
+// lfsPointerPrefix starts every git LFS pointer file, which a checkout
+// without git lfs pull leaves in place of the real file.
+const lfsPointerPrefix = "version https://git-lfs.github.com/spec/v1"
+
+// lfsPointerMaxSize is more than a pointer file ever takes, so larger files
+// aren't opened to look.
+const lfsPointerMaxSize = 1024
+
+// isLFSPointer tells whether the file name in fsys, size bytes long, is a
+// git LFS pointer rather than content. A file it can't read isn't one.
+func isLFSPointer(fsys fs.FS, name string, size int64) bool {
+	if size > lfsPointerMaxSize {
+		return false
+	}
+	f, err := fsys.Open(name)
+	if err != nil {
+		return false
+	}
+	defer f.Close()
+	head := make([]byte, len(lfsPointerPrefix))
+	if _, err := io.ReadFull(f, head); err != nil {
+		return false
+	}
+	return string(head) == lfsPointerPrefix
+}
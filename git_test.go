@@ -0,0 +1,110 @@
+package webpcon
+
+import (
+	"bytes"
+	"maps"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// TestGitSince converts a repository with a committed, a modified and a new
+// image since HEAD: only the last two are converted.
+func TestGitSince(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not found")
+	}
+	root := writeFixtureTree(t, []fixtureFile{
+		{"img/kept.png", encodeFixture(t, ".png", 8, 8)},
+		{"img/edited.png", encodeFixture(t, ".png", 8, 8)},
+	})
+	git := func(args ...string) {
+		t.Helper()
+		cmd := exec.Command("git", append([]string{"-C", root, "-c", "user.name=t", "-c", "user.email=t@t", "-c", "commit.gpgsign=false"}, args...)...)
+		if out, err := cmd.CombinedOutput(); err != nil {
+			t.Fatalf("git %v: %v\n%s", args, err, out)
+		}
+	}
+	git("init", "-q")
+	git("add", "-A")
+	git("commit", "-q", "-m", "images")
+	if err := os.WriteFile(filepath.Join(root, "img/edited.png"), encodeFixture(t, ".png", 9, 9), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "img/new.png"), encodeFixture(t, ".png", 7, 7), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	changed, err := gitChanged(root, "HEAD")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Untracked files aren't in git diff: they count once added
+	if got, want := slices.Sorted(maps.Keys(changed)), []string{"img/edited.png"}; !slices.Equal(got, want) {
+		t.Errorf("changed since HEAD: %q, want %q", got, want)
+	}
+	git("add", "img/new.png")
+
+	convertTree(t, root, testOptions(t, "--git-since", "HEAD"))
+	files := treeFiles(t, root)
+	for rel, converted := range map[string]bool{"img/kept": false, "img/edited": true, "img/new": true} {
+		if _, ok := files[rel+".webp"]; ok != converted {
+			t.Errorf("%s.webp written: %v, want %v", rel, ok, converted)
+		}
+	}
+
+	if _, err := gitChanged(t.TempDir(), "HEAD"); err == nil {
+		t.Error("--git-since outside a repository succeeded")
+	}
+	if _, err := gitChanged(root, "no-such-ref"); err == nil {
+		t.Error("--git-since with an unknown ref succeeded")
+	}
+}
+
+// lfsPointer is what a checkout without git lfs pull leaves for an image.
+const lfsPointer = lfsPointerPrefix + "\noid sha256:4d7a214614ab2935c943f9e0ff69d22eadbb8f32b1258daaa5e2ca24d17e2393\nsize 12345\n"
+
+// TestLFSPointersLeftAlone runs convert and optimize over LFS pointers named
+// like images: they are listed, and not a byte of them moves.
+func TestLFSPointersLeftAlone(t *testing.T) {
+	quietly(t)
+	files := []fixtureFile{
+		{"img/hero.png", []byte(lfsPointer)},
+		{"img/photo.jpg", []byte(lfsPointer)},
+		{"img/real.png", encodeFixture(t, ".png", 8, 8)},
+	}
+	root := writeFixtureTree(t, files)
+	sum := convertTree(t, root, testOptions(t, "--encoder", "native"))
+	if want := []string{"img/hero.png", "img/photo.jpg"}; !slices.Equal(slices.Sorted(slices.Values(sum.LFSPointers)), want) {
+		t.Errorf("convert listed LFS pointers %v, want %v", sum.LFSPointers, want)
+	}
+	if sum.Converted != 1 {
+		t.Errorf("converted %d file(s), want only img/real.png", sum.Converted)
+	}
+	checkLFSPointers(t, root, files[:2])
+
+	root = writeFixtureTree(t, files)
+	if err := optimizeImages(root, testOptions(t)); err != nil {
+		t.Fatal(err)
+	}
+	checkLFSPointers(t, root, files[:2])
+}
+
+// checkLFSPointers checks the pointers are where they were, unchanged, and
+// have no backup.
+func checkLFSPointers(t *testing.T, root string, pointers []fixtureFile) {
+	t.Helper()
+	after := treeFiles(t, root)
+	for _, p := range pointers {
+		if !bytes.Equal(after[p.rel], p.data) {
+			t.Errorf("%s moved or changed", p.rel)
+		}
+	}
+	for _, rel := range slices.Sorted(maps.Keys(after)) {
+		if bytes.Equal(after[rel], []byte(lfsPointer)) && !slices.ContainsFunc(pointers, func(p fixtureFile) bool { return p.rel == rel }) {
+			t.Errorf("a copy of a pointer is at %s", rel)
+		}
+	}
+}
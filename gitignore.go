@@ -0,0 +1,134 @@
+package webpcon
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// gitignoreDeclined is left in the backup directory when the user says no to
+// adding webpcon's files to .gitignore, so they are asked only once.
+const gitignoreDeclined = ".gitignore-declined"
+
+// gitignoreEntries are the files webpcon creates in a project, as .gitignore
+// lines relative to the project root.
+var gitignoreEntries = []string{".webpcon_backup/", ".webcon_cache/", mapFileName}
+
+// inGitRepo reports whether root or a folder above it has a .git directory
+// (or file, for worktrees and submodules).
+func inGitRepo(root string) bool {
+	dir, err := filepath.Abs(root)
+	if err != nil {
+		return false
+	}
+	for {
+		if fileExists(filepath.Join(dir, ".git")) {
+			return true
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return false
+		}
+		dir = parent
+	}
+}
+
+// missingGitignoreEntries returns the gitignoreEntries the project's
+// .gitignore doesn't have yet, along with its current content.
+func missingGitignoreEntries(root string) ([]string, []byte, error) {
+	data, err := os.ReadFile(longPath(filepath.Join(root, ".gitignore")))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, nil, err
+	}
+	have := map[string]bool{}
+	for _, line := range strings.Split(string(data), "\n") {
+		// /name, name and name/ all cover the entry
+		line = strings.Trim(strings.TrimSpace(line), "/")
+		have[line] = true
+	}
+	var missing []string
+	for _, e := range gitignoreEntries {
+		if !have[strings.Trim(e, "/")] {
+			missing = append(missing, e)
+		}
+	}
+	return missing, data, nil
+}
+
+// offerGitignore asks to add webpcon's files to the project's .gitignore when
+// the project is in a git repository and they aren't listed yet. With yes it
+// adds them without asking. Without a terminal to ask on, nothing is done.
+func offerGitignore(root string, yes bool) error {
+	if !inGitRepo(root) {
+		return nil
+	}
+	declined := filepath.Join(root, ".webpcon_backup", gitignoreDeclined)
+	if !yes && (!isTerminal(os.Stdin) || fileExists(declined)) {
+		return nil
+	}
+	missing, data, err := missingGitignoreEntries(root)
+	if err != nil || len(missing) == 0 {
+		return err
+	}
+
+	if !yes {
+		if !ask(fmt.Sprintf("📋 This project is in a git repository. Add %s to .gitignore?", strings.Join(missing, ", "))) {
+			os.MkdirAll(longPath(filepath.Dir(declined)), 0755)
+			os.WriteFile(longPath(declined), nil, 0644)
+			return nil
+		}
+	}
+
+	// Keep the file's line endings, and start on a line of its own
+	nl := "\n"
+	if bytes.Contains(data, []byte("\r\n")) {
+		nl = "\r\n"
+	}
+	var add strings.Builder
+	if len(data) > 0 && !bytes.HasSuffix(data, []byte("\n")) {
+		add.WriteString(nl)
+	}
+	add.WriteString("# webpcon" + nl)
+	for _, e := range missing {
+		add.WriteString(e + nl)
+	}
+	f, err := os.OpenFile(longPath(filepath.Join(root, ".gitignore")), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.WriteString(add.String())
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		fmt.Fprintf(stdout, "✏️  Added %s to .gitignore\n", strings.Join(missing, ", "))
+	}
+	return err
+}
+
+// trackedArtifacts lists webpcon's files that git already tracks, which
+// .gitignore doesn't undo. It returns nil when git isn't available.
+func trackedArtifacts(root string) ([]string, error) {
+	if _, err := exec.LookPath("git"); err != nil {
+		return nil, nil
+	}
+	if err := exec.Command("git", "-C", root, "rev-parse", "--is-inside-work-tree").Run(); err != nil {
+		return nil, nil
+	}
+	var stdout, stderr bytes.Buffer
+	cmd := exec.Command("git", append([]string{"-C", root, "ls-files", "-z", "--"}, gitignoreEntries...)...)
+	cmd.Stdout, cmd.Stderr = &stdout, &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("git ls-files: %s", strings.TrimSpace(stderr.String()))
+	}
+	var tracked []string
+	for _, name := range strings.Split(stdout.String(), "\x00") {
+		if name != "" {
+			tracked = append(tracked, name)
+		}
+	}
+	return tracked, nil
+}
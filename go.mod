@@ -6,4 +6,6 @@ require (
 	github.com/HugoSmits86/nativewebp v1.2.0
 	github.com/chai2010/webp v1.4.0
 	golang.org/x/image v0.29.0
+	golang.org/x/net v0.42.0
+	golang.org/x/text v0.27.0
 )
@@ -0,0 +1,109 @@
+package webpcon
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// maxGroupRows is how many folders the --group-by-dir table lists before the
+// rest are added up as "other".
+const maxGroupRows = 10
+
+// dirGroup tallies the files under one folder for --group-by-dir.
+type dirGroup struct {
+	Dir        string `json:"dir"`
+	Converted  int    `json:"converted"`
+	Skipped    int    `json:"skipped"`
+	Failed     int    `json:"failed"`
+	SourceSize int64  `json:"sourceSize"` // Of the converted files
+	OutputSize int64  `json:"outputSize"`
+}
+
+func (g *dirGroup) saved() int64 { return g.SourceSize - g.OutputSize }
+
+// groupKey is the folder relPath counts towards: its first depth path
+// components, or fewer for files nearer the root, which is ".".
+func groupKey(relPath string, depth int) string {
+	parts := splitPath(filepath.Dir(relPath))
+	if len(parts) > depth {
+		parts = parts[:depth]
+	}
+	if len(parts) == 0 {
+		return "."
+	}
+	return strings.Join(parts, "/")
+}
+
+// addToGroup counts a file's outcome, as sent in its file_finished event,
+// under its folder. It does nothing without --group-by-dir.
+func (s *summary) addToGroup(relPath, status string, sourceSize, outputSize int64, failed bool) {
+	if s.groupDepth == 0 {
+		return
+	}
+	key := groupKey(relPath, s.groupDepth)
+	g := s.groups[key]
+	if g == nil {
+		g = &dirGroup{Dir: key}
+		s.groups[key] = g
+	}
+	switch {
+	case failed:
+		g.Failed++
+	case status == "converted":
+		g.Converted++
+		g.SourceSize += sourceSize
+		g.OutputSize += outputSize
+	default:
+		g.Skipped++
+	}
+}
+
+// sortedGroups returns the folders by bytes saved, most first.
+func (s *summary) sortedGroups() []dirGroup {
+	groups := make([]dirGroup, 0, len(s.groups))
+	for _, g := range s.groups {
+		groups = append(groups, *g)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		if groups[i].saved() != groups[j].saved() {
+			return groups[i].saved() > groups[j].saved()
+		}
+		return groups[i].Dir < groups[j].Dir
+	})
+	return groups
+}
+
+// printGroups prints the --group-by-dir table, folding the folders past
+// maxGroupRows into one "other" row.
+func (s *summary) printGroups() {
+	if len(s.groups) == 0 {
+		return
+	}
+	groups := s.sortedGroups()
+	if len(groups) > maxGroupRows {
+		other := dirGroup{Dir: fmt.Sprintf("other (%d folders)", len(groups)-maxGroupRows+1)}
+		for _, g := range groups[maxGroupRows-1:] {
+			other.Converted += g.Converted
+			other.Skipped += g.Skipped
+			other.Failed += g.Failed
+			other.SourceSize += g.SourceSize
+			other.OutputSize += g.OutputSize
+		}
+		groups = append(groups[:maxGroupRows-1], other)
+	}
+	width := len("folder")
+	for _, g := range groups {
+		width = max(width, len(g.Dir))
+	}
+	fmt.Fprintf(stdout, "📊 By folder:\n")
+	fmt.Fprintf(stdout, "   %-*s %9s %7s %6s %9s\n", width, "folder", "converted", "skipped", "failed", "saved")
+	for _, g := range groups {
+		saved := fmt.Sprintf("%9s", formatSize(g.saved()))
+		if g.saved() > 0 {
+			saved = paint(ansiGreen, saved)
+		}
+		fmt.Fprintf(stdout, "   %-*s %9d %7d %6d %s\n", width, g.Dir, g.Converted, g.Skipped, g.Failed, saved)
+	}
+}
@@ -0,0 +1,131 @@
+package webpcon
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"os/user"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// historyFileName is the file in the backup directory every convert and revert
+// appends a line to. Unlike the run log it is never rewritten, so it keeps
+// runs that were reverted since. No command deletes it: there is no purge of
+// the backup to offer keeping it, so it goes only with the backup directory.
+const historyFileName = "history.jsonl"
+
+type historyRecord struct {
+	Time       time.Time `json:"time"`
+	Command    string    `json:"command"`       // convert, optimize or revert
+	Run        string    `json:"run,omitempty"` // The run converted, or reverted with --last-run / --run
+	User       string    `json:"user,omitempty"`
+	Options    []string  `json:"options,omitempty"`
+	Files      int       `json:"files"`
+	SourceSize int64     `json:"sourceSize,omitempty"`
+	OutputSize int64     `json:"outputSize,omitempty"`
+	Savings    int64     `json:"savings,omitempty"`
+	Error      string    `json:"error,omitempty"`
+}
+
+// appendHistory adds r to the history, filling in the time and user. A history
+// that can't be written is only warned about, the run itself went through.
+func appendHistory(root string, r historyRecord, err error) {
+	r.Time = time.Now().UTC().Truncate(time.Second)
+	if u, uerr := user.Current(); uerr == nil {
+		r.User = u.Username
+	}
+	if err != nil {
+		r.Error = err.Error()
+	}
+	data, jerr := json.Marshal(r)
+	if jerr == nil {
+		jerr = appendLine(filepath.Join(root, ".webpcon_backup", historyFileName), data)
+	}
+	if jerr != nil {
+		fmt.Fprintf(stdout, "⚠️  Could not write %s: %v\n", historyFileName, jerr)
+	}
+}
+
+func appendLine(path string, line []byte) error {
+	if err := os.MkdirAll(longPath(filepath.Dir(path)), 0755); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(longPath(path), os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(append(line, '\n'))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+func loadHistory(root string) ([]historyRecord, error) {
+	f, err := os.Open(longPath(filepath.Join(root, ".webpcon_backup", historyFileName)))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var records []historyRecord
+	scan := bufio.NewScanner(f)
+	scan.Buffer(nil, 1<<20)
+	for n := 1; scan.Scan(); n++ {
+		if strings.TrimSpace(scan.Text()) == "" {
+			continue
+		}
+		var r historyRecord
+		if err := json.Unmarshal(scan.Bytes(), &r); err != nil {
+			return nil, fmt.Errorf("line %d: %v", n, err)
+		}
+		records = append(records, r)
+	}
+	return records, scan.Err()
+}
+
+// listHistory prints every convert and revert recorded for the project,
+// oldest first.
+func listHistory(root string, asJSON bool) error {
+	records, err := loadHistory(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", historyFileName, err)
+		return err
+	}
+	if asJSON {
+		if records == nil {
+			records = []historyRecord{}
+		}
+		data, err := json.MarshalIndent(records, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, string(data))
+		return nil
+	}
+	for _, r := range records {
+		line := fmt.Sprintf("   %s  %-7s  %-17s  %d file(s)", r.Time.Local().Format("2006-01-02 15:04:05"), r.Command, r.Run, r.Files)
+		if r.Command == "convert" || r.Command == "optimize" {
+			line += fmt.Sprintf(", saved %s", formatSize(r.Savings))
+		}
+		if r.User != "" {
+			line += "  by " + r.User
+		}
+		if len(r.Options) > 0 {
+			line += "  " + strings.Join(r.Options, " ")
+		}
+		if r.Error != "" {
+			line += "  ❌ " + r.Error
+		}
+		fmt.Fprintln(stdout, line)
+	}
+	fmt.Fprintf(stdout, "📋 %d run(s) in the history\n", len(records))
+	return nil
+}
@@ -0,0 +1,106 @@
+package webpcon
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const defaultHookTimeout = time.Minute
+
+// splitArgs splits a hook command line into arguments the way a POSIX shell
+// would, honoring quotes and backslashes, but without running a shell. Each
+// argument is substituted separately afterwards, so paths with spaces or
+// shell syntax in them stay a single, literal argument.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, r := range s {
+		switch {
+		case escaped:
+			// Inside double quotes a backslash only escapes $ ` " \ and newline
+			if quote == '"' && !strings.ContainsRune("$`\"\\\n", r) {
+				cur.WriteRune('\\')
+			}
+			cur.WriteRune(r)
+			escaped = false
+		case r == '\\' && quote != '\'':
+			escaped, inArg = true, true
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '"' || r == '\'':
+			quote, inArg = r, true
+		case r == ' ' || r == '\t' || r == '\n':
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 || escaped {
+		return nil, fmt.Errorf("unterminated quote or escape in %q", s)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	if len(args) == 0 {
+		return nil, errors.New("empty hook command")
+	}
+	return args, nil
+}
+
+// runHook runs a hook command with {name} placeholders replaced by vars and
+// stdin (if any) as its input. Its output goes to the terminal.
+func runHook(command string, vars map[string]string, stdin []byte, timeout time.Duration) error {
+	args, err := splitArgs(command)
+	if err != nil {
+		return err
+	}
+	return execHook(substitute(args, vars), stdin, stdout, timeout)
+}
+
+// substitute replaces {name} placeholders in each argument.
+func substitute(args []string, vars map[string]string) []string {
+	pairs := make([]string, 0, 2*len(vars))
+	for k, v := range vars {
+		pairs = append(pairs, "{"+k+"}", v)
+	}
+	r := strings.NewReplacer(pairs...)
+	out := make([]string, len(args))
+	for i, a := range args {
+		out[i] = r.Replace(a)
+	}
+	return out
+}
+
+func execHook(args []string, stdin []byte, stdout io.Writer, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+	cmd.Stdout, cmd.Stderr = stdout, os.Stderr
+	if stdin != nil {
+		cmd.Stdin = bytes.NewReader(stdin)
+	}
+	err := cmd.Run()
+	if ctx.Err() == context.DeadlineExceeded {
+		return fmt.Errorf("%s timed out after %s", args[0], timeout)
+	}
+	return err
+}
@@ -0,0 +1,439 @@
+package webpcon
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/color"
+	"io"
+	"io/fs"
+	"math"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Minimal ICC support for --convert-to-srgb: pull the embedded profile out of
+// PNG, JPEG and TIFF files and convert pixels from matrix/TRC RGB profiles
+// (Display P3, Adobe RGB, ProPhoto, ...) to sRGB. LUT-based and non-RGB
+// profiles are reported as unsupported and the pixels are left alone.
+
+var errUnsupportedProfile = errors.New("unsupported color profile")
+
+// srcFile is the file an image was decoded from, the name in fsys. The zero
+// value is for images that come from no file, like those read from stdin.
+type srcFile struct {
+	fsys fs.FS
+	name string
+}
+
+// osFile is the srcFile at path on disk.
+func osFile(path string) srcFile {
+	return srcFile{osTree(filepath.Dir(path)), filepath.Base(path)}
+}
+
+// readICC returns the embedded ICC profile of an image file, or nil if it has
+// none. Only the headers are read, not the image data.
+func readICC(src srcFile, ext string) ([]byte, error) {
+	if src.fsys == nil {
+		return nil, errors.New("the image comes from no file")
+	}
+	f, err := openSeekable(src.fsys, src.name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return iccFrom(f, ext)
+}
+
+// iccFrom is readICC for an image held by r.
+func iccFrom(r interface {
+	io.Reader
+	io.ReaderAt
+}, ext string) ([]byte, error) {
+	format, br := sniffReader(r, ext)
+	switch format {
+	case ".png":
+		return pngICC(br)
+	case ".jpg", ".jpeg", ".jpe", ".jfif":
+		return jpegICC(br), nil
+	case ".tiff":
+		return tiffICC(r), nil
+	}
+	return nil, nil
+}
+
+// maxICCSize bounds what a corrupt length field can make the readers below
+// allocate. Real profiles are at most a few MB.
+const maxICCSize = 64 << 20
+
+func pngICC(r io.Reader) ([]byte, error) {
+	const sig = "\x89PNG\r\n\x1a\n"
+	var head [8]byte
+	if _, err := io.ReadFull(r, head[:]); err != nil || string(head[:]) != sig {
+		return nil, nil
+	}
+	for {
+		if _, err := io.ReadFull(r, head[:]); err != nil {
+			return nil, nil
+		}
+		n := int64(binary.BigEndian.Uint32(head[:4]))
+		switch string(head[4:]) {
+		case "iCCP":
+			if n > maxICCSize {
+				return nil, nil
+			}
+			body := make([]byte, n)
+			if _, err := io.ReadFull(r, body); err != nil {
+				return nil, nil
+			}
+			// Profile name, NUL, compression method (always zlib), data
+			i := bytes.IndexByte(body, 0)
+			if i < 0 || i+2 > len(body) {
+				return nil, errors.New("malformed iCCP chunk")
+			}
+			zr, err := zlib.NewReader(bytes.NewReader(body[i+2:]))
+			if err != nil {
+				return nil, err
+			}
+			defer zr.Close()
+			return io.ReadAll(zr)
+		case "IDAT", "IEND":
+			return nil, nil // iCCP must come before the image data
+		}
+		if _, err := io.CopyN(io.Discard, r, n+4); err != nil {
+			return nil, nil
+		}
+	}
+}
+
+// jpegICC reassembles the profile from its APP2 "ICC_PROFILE" segments.
+func jpegICC(r io.Reader) []byte {
+	const tag = "ICC_PROFILE\x00"
+	parts := map[int][]byte{}
+	var b [4]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return nil
+	}
+	for {
+		if _, err := io.ReadFull(r, b[:]); err != nil || b[0] != 0xff {
+			break
+		}
+		marker := b[1]
+		if marker == 0xda || marker == 0xd9 { // Start of scan / end of image
+			break
+		}
+		n := int64(binary.BigEndian.Uint16(b[2:]))
+		if n < 2 {
+			break
+		}
+		if marker != 0xe2 {
+			if _, err := io.CopyN(io.Discard, r, n-2); err != nil {
+				break
+			}
+			continue
+		}
+		seg := make([]byte, n-2)
+		if _, err := io.ReadFull(r, seg); err != nil {
+			break
+		}
+		if len(seg) > len(tag)+2 && string(seg[:len(tag)]) == tag {
+			parts[int(seg[len(tag)])] = seg[len(tag)+2:]
+		}
+	}
+	if len(parts) == 0 {
+		return nil
+	}
+	seqs := make([]int, 0, len(parts))
+	for s := range parts {
+		seqs = append(seqs, s)
+	}
+	sort.Ints(seqs)
+	var out []byte
+	for _, s := range seqs {
+		out = append(out, parts[s]...)
+	}
+	return out
+}
+
+// tiffICC reads tag 34675 (InterColorProfile) from the first IFD.
+func tiffICC(r io.ReaderAt) []byte {
+	var head [8]byte
+	if _, err := r.ReadAt(head[:], 0); err != nil {
+		return nil
+	}
+	var bo binary.ByteOrder
+	switch string(head[:2]) {
+	case "II":
+		bo = binary.LittleEndian
+	case "MM":
+		bo = binary.BigEndian
+	default:
+		return nil
+	}
+	ifd := int64(bo.Uint32(head[4:]))
+	if ifd < 8 {
+		return nil
+	}
+	var count [2]byte
+	if _, err := r.ReadAt(count[:], ifd); err != nil {
+		return nil
+	}
+	entries := make([]byte, 12*int(bo.Uint16(count[:])))
+	if _, err := r.ReadAt(entries, ifd+2); err != nil {
+		return nil
+	}
+	for e := entries; len(e) >= 12; e = e[12:] {
+		if bo.Uint16(e) != 34675 {
+			continue
+		}
+		n := int64(bo.Uint32(e[4:]))
+		if n <= 4 {
+			return append([]byte{}, e[8:8+n]...)
+		}
+		if n > maxICCSize {
+			return nil
+		}
+		profile := make([]byte, n)
+		if _, err := r.ReadAt(profile, int64(bo.Uint32(e[8:]))); err != nil {
+			return nil
+		}
+		return profile
+	}
+	return nil
+}
+
+// iccProfile is a parsed matrix/TRC RGB profile.
+type iccProfile struct {
+	desc   string
+	matrix [3][3]float64 // Linear RGB -> XYZ (D50)
+	trc    [3]func(float64) float64
+}
+
+func parseICC(data []byte) (*iccProfile, error) {
+	if len(data) < 132 || string(data[36:40]) != "acsp" {
+		return nil, errors.New("not an ICC profile")
+	}
+	if space := string(data[16:20]); space != "RGB " {
+		return nil, fmt.Errorf("%w: %s color space", errUnsupportedProfile, strings.TrimSpace(space))
+	}
+	if pcs := string(data[20:24]); pcs != "XYZ " {
+		return nil, fmt.Errorf("%w: %s connection space", errUnsupportedProfile, strings.TrimSpace(pcs))
+	}
+
+	tags := map[string][]byte{}
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for i := 0; i < count; i++ {
+		e := 132 + i*12
+		if e+12 > len(data) {
+			return nil, errors.New("truncated ICC tag table")
+		}
+		off := int(binary.BigEndian.Uint32(data[e+4:]))
+		n := int(binary.BigEndian.Uint32(data[e+8:]))
+		if off < 0 || n < 0 || off+n > len(data) {
+			return nil, errors.New("ICC tag out of bounds")
+		}
+		tags[string(data[e:e+4])] = data[off : off+n]
+	}
+
+	p := &iccProfile{desc: iccDescription(tags["desc"])}
+	for c, sig := range []string{"rXYZ", "gXYZ", "bXYZ"} {
+		t := tags[sig]
+		if len(t) < 20 || string(t[:4]) != "XYZ " {
+			return nil, fmt.Errorf("%w: %s has no colorant matrix", errUnsupportedProfile, p.name())
+		}
+		for k := 0; k < 3; k++ {
+			p.matrix[k][c] = s15Fixed16(t[8+4*k:])
+		}
+	}
+	for c, sig := range []string{"rTRC", "gTRC", "bTRC"} {
+		f, err := parseTRC(tags[sig])
+		if err != nil {
+			return nil, fmt.Errorf("%w: %s %s: %v", errUnsupportedProfile, p.name(), sig, err)
+		}
+		p.trc[c] = f
+	}
+	return p, nil
+}
+
+func (p *iccProfile) name() string {
+	if p.desc == "" {
+		return "profile"
+	}
+	return p.desc
+}
+
+func s15Fixed16(b []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(b))) / 65536
+}
+
+// parseTRC builds a decoding (to linear) function from a curv or para tag.
+func parseTRC(t []byte) (func(float64) float64, error) {
+	if len(t) < 12 {
+		return nil, errors.New("missing tone curve")
+	}
+	switch string(t[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(t[8:]))
+		if len(t) < 12+2*n {
+			return nil, errors.New("truncated curve")
+		}
+		switch n {
+		case 0:
+			return func(v float64) float64 { return v }, nil
+		case 1:
+			g := float64(binary.BigEndian.Uint16(t[12:])) / 256
+			return func(v float64) float64 { return math.Pow(v, g) }, nil
+		}
+		table := make([]float64, n)
+		for i := range table {
+			table[i] = float64(binary.BigEndian.Uint16(t[12+2*i:])) / 65535
+		}
+		return func(v float64) float64 {
+			x := v * float64(n-1)
+			i := min(int(x), n-2)
+			return table[i] + (table[i+1]-table[i])*(x-float64(i))
+		}, nil
+	case "para":
+		fn := int(binary.BigEndian.Uint16(t[8:]))
+		nParams := []int{1, 3, 4, 5, 7}
+		if fn >= len(nParams) || len(t) < 12+4*nParams[fn] {
+			return nil, errors.New("unknown parametric curve")
+		}
+		var a [7]float64
+		for i := 0; i < nParams[fn]; i++ {
+			a[i] = s15Fixed16(t[12+4*i:])
+		}
+		g := a[0]
+		return func(x float64) float64 {
+			switch fn {
+			case 0:
+				return math.Pow(x, g)
+			case 1:
+				if x >= -a[2]/a[1] {
+					return math.Pow(a[1]*x+a[2], g)
+				}
+				return 0
+			case 2:
+				if x >= -a[2]/a[1] {
+					return math.Pow(a[1]*x+a[2], g) + a[3]
+				}
+				return a[3]
+			case 3:
+				if x >= a[4] {
+					return math.Pow(a[1]*x+a[2], g)
+				}
+				return a[3] * x
+			default:
+				if x >= a[4] {
+					return math.Pow(a[1]*x+a[2], g) + a[5]
+				}
+				return a[3]*x + a[6]
+			}
+		}, nil
+	}
+	return nil, fmt.Errorf("%q tone curves", string(t[:4]))
+}
+
+// iccDescription reads a desc (v2) or mluc (v4) tag, best effort.
+func iccDescription(t []byte) string {
+	if len(t) < 12 {
+		return ""
+	}
+	switch string(t[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(t[8:]))
+		if 12+n <= len(t) {
+			return strings.TrimRight(string(t[12:12+n]), "\x00")
+		}
+	case "mluc":
+		if len(t) < 28 {
+			return ""
+		}
+		n := int(binary.BigEndian.Uint32(t[20:]))
+		off := int(binary.BigEndian.Uint32(t[24:]))
+		if off+n > len(t) {
+			return ""
+		}
+		var sb strings.Builder
+		for i := off; i+1 < off+n; i += 2 {
+			sb.WriteRune(rune(binary.BigEndian.Uint16(t[i:])))
+		}
+		return sb.String()
+	}
+	return ""
+}
+
+// xyzD50ToSRGB converts PCS XYZ (D50) to linear sRGB, Bradford adapted.
+var xyzD50ToSRGB = [3][3]float64{
+	{3.1338561, -1.6168667, -0.4906146},
+	{-0.9787684, 1.9161415, 0.0334540},
+	{0.0719453, -0.2289914, 1.4052427},
+}
+
+// toSRGB converts img from the profile's color space to sRGB, keeping alpha.
+func (p *iccProfile) toSRGB(img image.Image) *image.NRGBA {
+	var m [3][3]float64
+	for i := 0; i < 3; i++ {
+		for j := 0; j < 3; j++ {
+			for k := 0; k < 3; k++ {
+				m[i][j] += xyzD50ToSRGB[i][k] * p.matrix[k][j]
+			}
+		}
+	}
+	var decode [3][256]float64
+	for c := 0; c < 3; c++ {
+		for v := 0; v < 256; v++ {
+			decode[c][v] = p.trc[c](float64(v) / 255)
+		}
+	}
+	const encodeSteps = 4096
+	var encode [encodeSteps + 1]uint8
+	for i := range encode {
+		encode[i] = uint8(math.Round(clamp255(linearToSRGB(float64(i)/encodeSteps) * 255)))
+	}
+
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			lin := [3]float64{decode[0][c.R], decode[1][c.G], decode[2][c.B]}
+			var rgb [3]uint8
+			for i := 0; i < 3; i++ {
+				v := m[i][0]*lin[0] + m[i][1]*lin[1] + m[i][2]*lin[2]
+				rgb[i] = encode[int(math.Round(min(max(v, 0), 1)*encodeSteps))]
+			}
+			out.SetNRGBA(x, y, color.NRGBA{rgb[0], rgb[1], rgb[2], c.A})
+		}
+	}
+	return out
+}
+
+// convertProfile converts img to sRGB using the profile embedded in the source
+// file. Images without a profile, or with one we can't handle, come back as-is
+// with a warning; the note describes what was done for the log line.
+func convertProfile(img image.Image, src srcFile, ext, relPath string) (image.Image, string) {
+	data, err := readICC(src, ext)
+	return applyProfile(img, data, err, relPath)
+}
+
+// applyProfile is convertProfile with the profile already read.
+func applyProfile(img image.Image, data []byte, err error, relPath string) (image.Image, string) {
+	if err != nil {
+		fmt.Fprintf(stdout, "⚠️  Could not read color profile of %s, colors left as-is: %v\n", relPath, err)
+		return img, ""
+	}
+	if data == nil {
+		return img, ""
+	}
+	p, err := parseICC(data)
+	if err != nil {
+		fmt.Fprintf(stdout, "⚠️  %s: %v, colors left as-is\n", relPath, err)
+		return img, ""
+	}
+	return p.toSRGB(img), "sRGB from " + p.name()
+}
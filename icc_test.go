@@ -0,0 +1,246 @@
+package webpcon
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"testing"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+// iccTag is one tag of a profile built by testProfile.
+type iccTag struct {
+	sig  string
+	data []byte
+}
+
+// testProfile builds a matrix/TRC RGB profile from D50-adapted colorants
+// and the sRGB tone curve, as Display P3 has.
+func testProfile(space, desc string, colorants [3][3]float64) []byte {
+	fixed := func(v float64) []byte { return binary.BigEndian.AppendUint32(nil, uint32(int32(math.Round(v*65536)))) }
+	xyz := func(c [3]float64) []byte {
+		b := append([]byte("XYZ "), 0, 0, 0, 0)
+		for _, v := range c {
+			b = append(b, fixed(v)...)
+		}
+		return b
+	}
+	// Parametric curve type 3: the sRGB curve
+	trc := append([]byte("para"), 0, 0, 0, 0, 0, 3, 0, 0)
+	for _, v := range []float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045} {
+		trc = append(trc, fixed(v)...)
+	}
+	d := append([]byte("desc"), 0, 0, 0, 0)
+	d = binary.BigEndian.AppendUint32(d, uint32(len(desc)))
+	d = append(d, desc...)
+	tags := []iccTag{
+		{"desc", d},
+		{"rXYZ", xyz(colorants[0])}, {"gXYZ", xyz(colorants[1])}, {"bXYZ", xyz(colorants[2])},
+		{"rTRC", trc}, {"gTRC", trc}, {"bTRC", trc},
+	}
+
+	header := make([]byte, 128)
+	copy(header[12:], "mntr")
+	copy(header[16:], space)
+	copy(header[20:], "XYZ ")
+	copy(header[36:], "acsp")
+	table := binary.BigEndian.AppendUint32(nil, uint32(len(tags)))
+	var body []byte
+	offset := 128 + 4 + 12*len(tags)
+	for _, t := range tags {
+		table = append(table, t.sig...)
+		table = binary.BigEndian.AppendUint32(table, uint32(offset+len(body)))
+		table = binary.BigEndian.AppendUint32(table, uint32(len(t.data)))
+		body = append(body, t.data...)
+		for len(body)%4 != 0 {
+			body = append(body, 0)
+		}
+	}
+	p := append(append(header, table...), body...)
+	binary.BigEndian.PutUint32(p, uint32(len(p)))
+	return p
+}
+
+// displayP3 are the colorants of Apple's Display P3 profile.
+var displayP3 = [3][3]float64{
+	{0.515102, 0.241182, -0.001050},
+	{0.291965, 0.692236, 0.041882},
+	{0.157153, 0.066582, 0.784378},
+}
+
+// p3ToSRGB converts an 8-bit Display P3 colour to sRGB with the D65 matrix,
+// independently of the ICC path, for reference.
+func p3ToSRGB(c color.NRGBA) color.NRGBA {
+	m := [3][3]float64{
+		{1.2249401, -0.2249404, 0},
+		{-0.0420569, 1.0420571, 0},
+		{-0.0196376, -0.0786361, 1.0982735},
+	}
+	// The sRGB curve, which Display P3 shares
+	decode := func(v uint8) float64 {
+		s := float64(v) / 255
+		if s <= 0.04045 {
+			return s / 12.92
+		}
+		return math.Pow((s+0.055)/1.055, 2.4)
+	}
+	encode := func(l float64) float64 {
+		if l <= 0.0031308 {
+			return 12.92 * l
+		}
+		return 1.055*math.Pow(l, 1/2.4) - 0.055
+	}
+	lin := [3]float64{decode(c.R), decode(c.G), decode(c.B)}
+	var out [3]uint8
+	for i := range out {
+		v := m[i][0]*lin[0] + m[i][1]*lin[1] + m[i][2]*lin[2]
+		out[i] = uint8(math.Round(encode(min(max(v, 0), 1)) * 255))
+	}
+	return color.NRGBA{out[0], out[1], out[2], c.A}
+}
+
+// p3Colours are swatches of the fixtures: a saturated P3 red, which sRGB
+// clips, colours inside both gamuts, and a gray, which no profile changes.
+var p3Colours = []color.NRGBA{
+	{255, 0, 0, 255}, {200, 100, 50, 255}, {180, 60, 60, 255}, {40, 160, 90, 128}, {128, 128, 128, 255},
+}
+
+// swatches lays p3Colours out side by side in 8 x 8 blocks.
+func swatches() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 8*len(p3Colours), 8))
+	for x := range img.Rect.Dx() {
+		for y := range 8 {
+			img.SetNRGBA(x, y, p3Colours[x/8])
+		}
+	}
+	return img
+}
+
+// withICC embeds profile in PNG or JPEG data.
+func withICC(tb testing.TB, data, profile []byte) []byte {
+	tb.Helper()
+	if bytes.HasPrefix(data, []byte("\xff\xd8")) {
+		seg := append([]byte("ICC_PROFILE\x00"), 1, 1)
+		seg = append(seg, profile...)
+		app2 := binary.BigEndian.AppendUint16([]byte{0xff, 0xe2}, uint16(len(seg)+2))
+		return append(append(append([]byte{}, data[:2]...), append(app2, seg...)...), data[2:]...)
+	}
+	var z bytes.Buffer
+	zw := zlib.NewWriter(&z)
+	zw.Write(profile)
+	zw.Close()
+	body := append([]byte("P3\x00\x00"), z.Bytes()...)
+	chunk := binary.BigEndian.AppendUint32(nil, uint32(len(body)))
+	chunk = append(chunk, "iCCP"...)
+	chunk = append(chunk, body...)
+	chunk = binary.BigEndian.AppendUint32(chunk, crc32.ChecksumIEEE(chunk[4:]))
+	// After the signature and the IHDR chunk, 8 + 25 bytes
+	return append(append(append([]byte{}, data[:33]...), chunk...), data[33:]...)
+}
+
+func TestParseICC(t *testing.T) {
+	for _, tt := range []struct {
+		name string
+		data []byte
+		want string // The profile's name, "" when it is refused
+	}{
+		{"Display P3", testProfile("RGB ", "Display P3", displayP3), "Display P3"},
+		{"CMYK", testProfile("CMYK", "Coated", displayP3), ""},
+		{"gray", testProfile("GRAY", "Gray", displayP3), ""},
+		{"not a profile", []byte("not a profile"), ""},
+		{"cut short", testProfile("RGB ", "Display P3", displayP3)[:200], ""},
+	} {
+		p, err := parseICC(tt.data)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("%s: accepted as %q", tt.name, p.name())
+		case tt.want != "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.want != "" && p.name() != tt.want:
+			t.Errorf("%s: named %q, want %q", tt.name, p.name(), tt.want)
+		}
+	}
+}
+
+// TestToSRGB converts the swatches from Display P3 and compares them with the
+// D65 matrix conversion, within a level for the rounding of the colorants.
+func TestToSRGB(t *testing.T) {
+	p, err := parseICC(testProfile("RGB ", "Display P3", displayP3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := p.toSRGB(swatches())
+	for i, c := range p3Colours {
+		checkSwatch(t, "toSRGB", p3ToSRGB(c), got.NRGBAAt(8*i+4, 4), 1)
+	}
+	if c := got.NRGBAAt(4, 4); c.R != 255 || c.G > 1 || c.B > 1 {
+		t.Errorf("P3 red became %v, want sRGB red", c)
+	}
+}
+
+// TestConvertToSRGB converts PNG and JPEG swatches carrying the profile with
+// --convert-to-srgb, and one with an unsupported profile, which leaves the
+// pixels alone.
+func TestConvertToSRGB(t *testing.T) {
+	var pngData, jpgData bytes.Buffer
+	if err := png.Encode(&pngData, swatches()); err != nil {
+		t.Fatal(err)
+	}
+	if err := jpeg.Encode(&jpgData, swatches(), &jpeg.Options{Quality: 100}); err != nil {
+		t.Fatal(err)
+	}
+	// The JPEG swatches are what it decodes to, without alpha
+	jpg, err := jpeg.Decode(bytes.NewReader(jpgData.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	jpgColour := func(i int) color.NRGBA { return color.NRGBAModel.Convert(jpg.At(8*i+4, 4)).(color.NRGBA) }
+	pngColour := func(i int) color.NRGBA { return p3Colours[i] }
+	same := func(c color.NRGBA) color.NRGBA { return c }
+
+	p3 := testProfile("RGB ", "Display P3", displayP3)
+	cmyk := testProfile("CMYK", "Coated", displayP3)
+	root := writeFixtureTree(t, []fixtureFile{
+		{"p3-png.png", withICC(t, pngData.Bytes(), p3)},
+		{"p3-jpg.jpg", withICC(t, jpgData.Bytes(), p3)},
+		{"cmyk.png", withICC(t, pngData.Bytes(), cmyk)},
+	})
+	convertTree(t, root, testOptions(t, "--lossless", "--convert-to-srgb"))
+	files := treeFiles(t, root)
+	for _, tt := range []struct {
+		webp string
+		src  func(i int) color.NRGBA
+		want func(color.NRGBA) color.NRGBA
+	}{
+		{"p3-png.webp", pngColour, p3ToSRGB},
+		{"p3-jpg.webp", jpgColour, p3ToSRGB},
+		{"cmyk.webp", pngColour, same},
+	} {
+		img, err := xwebp.Decode(bytes.NewReader(files[tt.webp]))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.webp, err)
+		}
+		for i := range p3Colours {
+			got := color.NRGBAModel.Convert(img.At(8*i+4, 4)).(color.NRGBA)
+			checkSwatch(t, tt.webp, tt.want(tt.src(i)), got, 1)
+		}
+	}
+}
+
+// checkSwatch compares two colours channel by channel, within tol.
+func checkSwatch(t *testing.T, what string, want, got color.NRGBA, tol int) {
+	t.Helper()
+	for _, d := range []int{int(got.R) - int(want.R), int(got.G) - int(want.G), int(got.B) - int(want.B), int(got.A) - int(want.A)} {
+		if d > tol || -d > tol {
+			t.Errorf("%s: got %v, want %v", what, got, want)
+			return
+		}
+	}
+}
@@ -0,0 +1,27 @@
+package webpcon
+
+import (
+	"errors"
+	"fmt"
+)
+
+// errLocked is a file another process holds a lock on, see advisoryLock.
+var errLocked = errors.New("locked by another process")
+
+// inUseError is a file left alone because another program had it open, like
+// an image open in Photoshop on Windows. It is tried once more at the end of
+// the run.
+type inUseError struct {
+	relPath string
+	size    int64
+	err     error
+}
+
+func (e *inUseError) Error() string { return fmt.Sprintf("%s: %v", e.relPath, e.err) }
+func (e *inUseError) Unwrap() error { return e.err }
+
+// fileInUse tells whether err comes from another program having the file
+// open or locked.
+func fileInUse(err error) bool {
+	return errors.Is(err, errLocked) || sharingViolation(err)
+}
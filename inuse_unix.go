@@ -0,0 +1,30 @@
+//go:build !windows
+
+package webpcon
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// sharingViolation is always false: Unix lets files be renamed while open.
+func sharingViolation(err error) bool { return false }
+
+// advisoryLock tells, with errLocked, whether another process holds a flock
+// on the file at path. Programs that take one are saying they're still
+// working on the file, though nothing stops it being moved.
+func advisoryLock(path string) error {
+	f, err := os.Open(longPath(path))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		if errors.Is(err, syscall.EWOULDBLOCK) {
+			return errLocked
+		}
+		return nil // Filesystems without flock support can't tell
+	}
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_UN)
+}
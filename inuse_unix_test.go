@@ -0,0 +1,151 @@
+//go:build !windows
+
+package webpcon
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+// TestLockHelper is not a test: run by lockFile in a process of its own, it
+// holds a flock on $WEBPCON_LOCK_HELPER until its stdin is closed.
+func TestLockHelper(t *testing.T) {
+	path := os.Getenv("WEBPCON_LOCK_HELPER")
+	if path == "" {
+		t.Skip("only run as a helper process")
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	fmt.Println("locked")
+	bufio.NewReader(os.Stdin).ReadString('\n')
+	os.Exit(0)
+}
+
+// lockFile has another process hold a flock on path. Calling the function
+// returned, or the end of the test, lets it go.
+func lockFile(t *testing.T, path string) (unlock func()) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^TestLockHelper$")
+	cmd.Env = append(os.Environ(), "WEBPCON_LOCK_HELPER="+path)
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	if line, _ := bufio.NewReader(out).ReadString('\n'); line != "locked\n" {
+		cmd.Process.Kill()
+		cmd.Wait()
+		t.Fatalf("lock helper: %q", line)
+	}
+	unlock = func() {
+		if cmd.ProcessState == nil {
+			stdin.Close()
+			cmd.Wait()
+		}
+	}
+	t.Cleanup(unlock)
+	return unlock
+}
+
+func TestAdvisoryLock(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "logo.png")
+	if err := os.WriteFile(path, encodeFixture(t, ".png", 8, 8), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := advisoryLock(path); err != nil {
+		t.Fatalf("unlocked file: %v", err)
+	}
+	unlock := lockFile(t, path)
+	err := advisoryLock(path)
+	if !errors.Is(err, errLocked) || !fileInUse(err) {
+		t.Fatalf("locked file: %v", err)
+	}
+	if !fileInUse(fmt.Errorf("moving logo.png: %w", err)) {
+		t.Error("a wrapped errLocked isn't in use")
+	}
+	if fileInUse(os.ErrPermission) {
+		t.Error("a permission error counts as in use")
+	}
+	unlock()
+	if err := advisoryLock(path); err != nil {
+		t.Errorf("file let go of: %v", err)
+	}
+}
+
+// lockTree returns a tree with img/logo.png and an unlocked copy of it.
+func lockTree(t *testing.T) string {
+	t.Helper()
+	logo := encodeFixture(t, ".png", 16, 16)
+	return writeFixtureTree(t, []fixtureFile{{"img/logo.png", logo}, {"img/logo-copy.png", logo}})
+}
+
+// TestConvertLockedFile converts a tree with one image locked: --check-locks
+// leaves it, and anything to do with it, alone and lists it; once let go, the
+// next run converts it.
+func TestConvertLockedFile(t *testing.T) {
+	log := quietly(t)
+	root := lockTree(t)
+	logo := filepath.Join(root, "img", "logo.png")
+	unlock := lockFile(t, logo)
+
+	convertTree(t, root, testOptions(t, "--encoder", "native", "--check-locks"))
+	if !strings.Contains(log.String(), "1 file(s) left untouched as another program still had them open (close it and run again):\n   - img/logo.png\n") {
+		t.Errorf("img/logo.png not listed as in use:\n%s", log)
+	}
+	files := treeFiles(t, root)
+	for _, rel := range []string{"img/logo.webp", ".webpcon_backup/img/logo.png"} {
+		if _, ok := files[rel]; ok {
+			t.Errorf("%s written for a locked file", rel)
+		}
+	}
+	if _, ok := files["img/logo.png"]; !ok {
+		t.Error("the locked file was moved")
+	}
+	if _, ok := readMapFile(t, root)["img/logo-copy.png"]; !ok {
+		t.Error("the unlocked copy of the locked file wasn't converted")
+	}
+
+	unlock()
+	log.Reset()
+	convertTree(t, root, testOptions(t, "--encoder", "native", "--check-locks"))
+	if strings.Contains(log.String(), "still had them open") {
+		t.Errorf("files in use once let go:\n%s", log)
+	}
+	if _, ok := readMapFile(t, root)["img/logo.png"]; !ok {
+		t.Error("img/logo.png not converted once let go")
+	}
+}
+
+// TestConvertIgnoresLocks checks a flock only counts with --check-locks.
+func TestConvertIgnoresLocks(t *testing.T) {
+	log := quietly(t)
+	root := lockTree(t)
+	lockFile(t, filepath.Join(root, "img", "logo.png"))
+	convertTree(t, root, testOptions(t, "--encoder", "native"))
+	if strings.Contains(log.String(), "still had them open") {
+		t.Errorf("files in use without --check-locks:\n%s", log)
+	}
+	if _, ok := readMapFile(t, root)["img/logo.png"]; !ok {
+		t.Error("img/logo.png not converted")
+	}
+}
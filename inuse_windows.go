@@ -0,0 +1,25 @@
+//go:build windows
+
+package webpcon
+
+import (
+	"errors"
+	"syscall"
+)
+
+// Windows error codes for a file another process has open without sharing
+// it, or has locked a range of, which syscall doesn't name.
+const (
+	errorSharingViolation syscall.Errno = 32
+	errorLockViolation    syscall.Errno = 33
+)
+
+// sharingViolation tells whether err comes from another process having the
+// file open without letting others move it.
+func sharingViolation(err error) bool {
+	return errors.Is(err, errorSharingViolation) || errors.Is(err, errorLockViolation)
+}
+
+// advisoryLock does nothing on Windows, where locks are enforced and opening
+// or moving a locked file fails with a sharing violation instead.
+func advisoryLock(path string) error { return nil }
@@ -0,0 +1,129 @@
+package webpcon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"sync"
+)
+
+// defaultBufferSize is the read size for hashing, copying and verifying
+// files unless --buffer-size says otherwise. Spinning disks do better with
+// larger reads, NVMe drives hardly care.
+const defaultBufferSize = 256 << 10
+
+// ioBufferSize is set by main from --buffer-size before any file is read.
+var ioBufferSize = defaultBufferSize
+
+var bufferPool = sync.Pool{New: func() any {
+	b := make([]byte, ioBufferSize)
+	return &b
+}}
+
+// copyBuffered is io.Copy through a pooled buffer of ioBufferSize, so large
+// files stream in fixed-size pieces whatever src and dst implement.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	b := bufferPool.Get().(*[]byte)
+	defer bufferPool.Put(b)
+	// Hide ReaderFrom and WriterTo, which would pick their own buffer size
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *b)
+}
+
+// copyOptions are the optional checks of copyFileWith.
+type copyOptions struct {
+	sync   bool   // Flush the copy to disk before returning
+	sha256 string // Expected hex digest of the content, if known
+}
+
+// copyError tells which stage of a copy failed: open, create, copy, size,
+// checksum, sync, close or attributes.
+type copyError struct {
+	stage    string
+	src, dst string
+	err      error
+}
+
+func (e *copyError) Error() string {
+	return fmt.Sprintf("copying %s to %s failed at %s: %v", e.src, e.dst, e.stage, e.err)
+}
+
+func (e *copyError) Unwrap() error { return e.err }
+
+// copyDest is the file a copy writes to.
+type copyDest interface {
+	io.Writer
+	Sync() error
+	Close() error
+}
+
+// createCopyDest opens dst for a copy, replacing it. Tests swap it for one
+// whose writes fail.
+var createCopyDest = func(dst string, perm fs.FileMode) (copyDest, error) {
+	return os.OpenFile(longPath(dst), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+}
+
+// copyFile copies src to dst, see copyFileWith.
+func copyFile(src, dst string) error {
+	return copyFileWith(src, dst, copyOptions{})
+}
+
+// copyFileWith copies src to dst, replacing dst, and keeps the permissions
+// and modification time of src. The byte count must match the size of src,
+// and the content o.sha256 when given. A failed copy leaves no dst behind.
+func copyFileWith(src, dst string, o copyOptions) error {
+	fail := func(stage string, err error) error {
+		return &copyError{stage, src, dst, err}
+	}
+	in, err := os.Open(longPath(src))
+	if err != nil {
+		return fail("open", err)
+	}
+	defer in.Close()
+	info, err := in.Stat()
+	if err != nil {
+		return fail("open", err)
+	}
+
+	out, err := createCopyDest(dst, info.Mode().Perm())
+	if err != nil {
+		return fail("create", err)
+	}
+	err = func() error {
+		h := sha256.New()
+		n, err := copyBuffered(io.MultiWriter(out, h), in)
+		if err != nil {
+			return fail("copy", err)
+		}
+		if n != info.Size() {
+			return fail("size", fmt.Errorf("copied %d of %d bytes", n, info.Size()))
+		}
+		if got := hex.EncodeToString(h.Sum(nil)); o.sha256 != "" && got != o.sha256 {
+			return fail("checksum", fmt.Errorf("got %s, expected %s", got, o.sha256))
+		}
+		if o.sync {
+			if err := out.Sync(); err != nil {
+				return fail("sync", err)
+			}
+		}
+		return nil
+	}()
+	if cerr := out.Close(); err == nil && cerr != nil {
+		err = fail("close", cerr)
+	}
+	if err != nil {
+		os.Remove(longPath(dst))
+		return err
+	}
+
+	// The mode given to OpenFile only applies to new files, minus the umask
+	if err := os.Chmod(longPath(dst), info.Mode().Perm()); err != nil {
+		return fail("attributes", err)
+	}
+	if err := os.Chtimes(longPath(dst), info.ModTime(), info.ModTime()); err != nil {
+		return fail("attributes", err)
+	}
+	return nil
+}
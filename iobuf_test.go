@@ -0,0 +1,319 @@
+package webpcon
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/fs"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"runtime/metrics"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// largeFile writes a size byte file of incompressible data under a new
+// temporary folder, as a stand-in for a big TIFF scan.
+func largeFile(b *testing.B, size int) string {
+	b.Helper()
+	path := filepath.Join(b.TempDir(), "scan.tiff")
+	f, err := os.Create(path)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+	r := rand.NewChaCha8([32]byte{})
+	if _, err := io.CopyN(f, r, int64(size)); err != nil {
+		b.Fatal(err)
+	}
+	return path
+}
+
+// trackPeakMemory returns a function reporting the most memory the
+// benchmark held: peak-heap-B, the live heap sampled every millisecond, and
+// on Linux peak-RSS-B, the kernel's record of the most memory this process
+// had resident, reset here through /proc.
+func trackPeakMemory(b *testing.B) func() {
+	b.Helper()
+	debug.FreeOSMemory()
+	rss := os.WriteFile("/proc/self/clear_refs", []byte("5"), 0) == nil
+	sample := []metrics.Sample{{Name: "/memory/classes/heap/objects:bytes"}}
+	var peak uint64
+	done, stopped := make(chan struct{}), make(chan struct{})
+	go func() {
+		defer close(stopped)
+		tick := time.NewTicker(time.Millisecond)
+		defer tick.Stop()
+		for {
+			metrics.Read(sample)
+			peak = max(peak, sample[0].Value.Uint64())
+			select {
+			case <-done:
+				return
+			case <-tick.C:
+			}
+		}
+	}()
+	return func() {
+		close(done)
+		<-stopped
+		b.ReportMetric(float64(peak), "peak-heap-B")
+		if rss {
+			if kb := peakRSSKB(); kb > 0 {
+				b.ReportMetric(float64(kb<<10), "peak-RSS-B")
+			}
+		}
+	}
+}
+
+// peakRSSKB reads VmHWM from /proc/self/status, or 0.
+func peakRSSKB() int64 {
+	f, err := os.Open("/proc/self/status")
+	if err != nil {
+		return 0
+	}
+	defer f.Close()
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		// VmHWM:	  123456 kB
+		if fields := strings.Fields(s.Text()); len(fields) == 3 && fields[0] == "VmHWM:" {
+			kb, _ := strconv.ParseInt(fields[1], 10, 64)
+			return kb
+		}
+	}
+	return 0
+}
+
+// TestCopyFile copies and hashes a file a few buffers long, with a last
+// buffer only part full.
+func TestCopyFile(t *testing.T) {
+	data := bytes.Repeat([]byte("webpcon "), ioBufferSize/5)
+	dir := t.TempDir()
+	src, dst := filepath.Join(dir, "src.png"), filepath.Join(dir, "dst.png")
+	if err := os.WriteFile(src, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyFile(src, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := os.ReadFile(dst); !bytes.Equal(got, data) {
+		t.Errorf("copyFile wrote %d bytes, want %d", len(got), len(data))
+	}
+	sum := sha256.Sum256(data)
+	if got, err := hashFile(src); err != nil || got != hex.EncodeToString(sum[:]) {
+		t.Errorf("hashFile: %s, %v", got, err)
+	}
+}
+
+// faultyDest is a copy destination on disk whose writes or sync fail.
+type faultyDest struct {
+	*os.File
+	limit   int64 // Bytes written before writes come up short
+	err     error // Returned by the write that comes up short, nil for a silent short write
+	syncErr error
+}
+
+func (d *faultyDest) Write(p []byte) (int, error) {
+	if int64(len(p)) <= d.limit {
+		d.limit -= int64(len(p))
+		return d.File.Write(p)
+	}
+	n, _ := d.File.Write(p[:d.limit])
+	d.limit = 0
+	return n, d.err
+}
+
+func (d *faultyDest) Sync() error {
+	if d.syncErr != nil {
+		return d.syncErr
+	}
+	return d.File.Sync()
+}
+
+// withFaultyDest makes copies write through d until the test ends.
+func withFaultyDest(t *testing.T, d faultyDest) {
+	saved := createCopyDest
+	createCopyDest = func(dst string, perm fs.FileMode) (copyDest, error) {
+		f, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+		if err != nil {
+			return nil, err
+		}
+		d := d
+		d.File = f
+		return &d, nil
+	}
+	t.Cleanup(func() { createCopyDest = saved })
+}
+
+func TestCopyFileWith(t *testing.T) {
+	dir := t.TempDir()
+	src := filepath.Join(dir, "src.png")
+	data := bytes.Repeat([]byte("webpcon "), 100000)
+	if err := os.WriteFile(src, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+	errDisk := errors.New("disk on fire")
+
+	tests := []struct {
+		name  string
+		src   string
+		dst   string
+		dest  *faultyDest
+		opts  copyOptions
+		stage string // "" for success
+	}{
+		{"ok", src, "ok.png", nil, copyOptions{sync: true, sha256: digest}, ""},
+		{"missing source", filepath.Join(dir, "none.png"), "missing.png", nil, copyOptions{}, "open"},
+		{"missing folder", src, filepath.Join("no", "such", "dir.png"), nil, copyOptions{}, "create"},
+		{"short write", src, "short.png", &faultyDest{limit: 1000}, copyOptions{}, "copy"},
+		{"write error", src, "failed.png", &faultyDest{limit: 300000, err: errDisk}, copyOptions{}, "copy"},
+		{"checksum", src, "checksum.png", nil, copyOptions{sha256: hex.EncodeToString(make([]byte, 32))}, "checksum"},
+		{"sync", src, "sync.png", &faultyDest{limit: 1 << 30, syncErr: errDisk}, copyOptions{sync: true}, "sync"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if tt.dest != nil {
+				withFaultyDest(t, *tt.dest)
+			}
+			dst := filepath.Join(dir, tt.dst)
+			err := copyFileWith(tt.src, dst, tt.opts)
+			if tt.stage == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, _ := os.ReadFile(dst)
+				info, _ := os.Stat(dst)
+				if !bytes.Equal(got, data) || info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+					t.Errorf("copy has %d bytes, mode %v, modified %v", len(got), info.Mode().Perm(), info.ModTime())
+				}
+				return
+			}
+			var ce *copyError
+			if !errors.As(err, &ce) || ce.stage != tt.stage {
+				t.Fatalf("got %v, want a copyError at %s", err, tt.stage)
+			}
+			if tt.dest != nil && tt.dest.err != nil && !errors.Is(err, tt.dest.err) {
+				t.Errorf("%v doesn't wrap %v", err, tt.dest.err)
+			}
+			if _, err := os.Lstat(dst); !errors.Is(err, fs.ErrNotExist) {
+				t.Errorf("a failed copy left %s behind", tt.dst)
+			}
+		})
+	}
+}
+
+// TestCopyTreeFile copies within a folder on disk, keeping the mode and
+// modification time, and within a tree in memory, where a checksum mismatch
+// leaves nothing behind.
+func TestCopyTreeFile(t *testing.T) {
+	data := bytes.Repeat([]byte("webpcon "), ioBufferSize/5)
+	sum := sha256.Sum256(data)
+	digest := hex.EncodeToString(sum[:])
+
+	dir := t.TempDir()
+	src := filepath.Join(dir, "a.webp")
+	if err := os.WriteFile(src, data, 0640); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Date(2021, 3, 4, 5, 6, 7, 0, time.UTC)
+	if err := os.Chtimes(src, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+	if err := copyTreeFile(osTree(dir), "a.webp", "b.webp", digest); err != nil {
+		t.Fatal(err)
+	}
+	got, _ := os.ReadFile(filepath.Join(dir, "b.webp"))
+	info, _ := os.Stat(filepath.Join(dir, "b.webp"))
+	if !bytes.Equal(got, data) || info.Mode().Perm() != 0640 || !info.ModTime().Equal(mtime) {
+		t.Errorf("copy has %d bytes, mode %v, modified %v", len(got), info.Mode().Perm(), info.ModTime())
+	}
+
+	mem := memFS{"img/a.webp": data}
+	if err := copyTreeFile(mem, "img/a.webp", "img/b.webp", digest); err != nil || !bytes.Equal(mem["img/b.webp"], data) {
+		t.Errorf("copy in memory: %v, %d bytes", err, len(mem["img/b.webp"]))
+	}
+	err := copyTreeFile(mem, "img/a.webp", "img/c.webp", hex.EncodeToString(make([]byte, 32)))
+	if ce := (*copyError)(nil); !errors.As(err, &ce) || ce.stage != "checksum" {
+		t.Errorf("got %v, want a copyError at checksum", err)
+	}
+	if len(mem) != 2 {
+		t.Errorf("a failed copy left %d file(s), want 2", len(mem))
+	}
+}
+
+// The benchmarks below compare reading a whole file into memory, as hashing
+// and copying used to, with streaming it through the pooled buffer. B/op,
+// peak-heap-B and peak-RSS-B show what each holds at its peak: the file
+// size for the former, next to nothing for the latter.
+
+const benchFileSize = 64 << 20
+
+func BenchmarkHashReadAll(b *testing.B) {
+	path := largeFile(b, benchFileSize)
+	b.SetBytes(benchFileSize)
+	b.ReportAllocs()
+	defer trackPeakMemory(b)()
+	for range b.N {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		sum := sha256.Sum256(data)
+		_ = hex.EncodeToString(sum[:])
+	}
+}
+
+func BenchmarkHashFile(b *testing.B) {
+	path := largeFile(b, benchFileSize)
+	b.SetBytes(benchFileSize)
+	b.ReportAllocs()
+	defer trackPeakMemory(b)()
+	for range b.N {
+		if _, err := hashFile(path); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyReadAll(b *testing.B) {
+	path := largeFile(b, benchFileSize)
+	dst := filepath.Join(b.TempDir(), "copy.tiff")
+	b.SetBytes(benchFileSize)
+	b.ReportAllocs()
+	defer trackPeakMemory(b)()
+	for range b.N {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := os.WriteFile(dst, data, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCopyFile(b *testing.B) {
+	path := largeFile(b, benchFileSize)
+	dst := filepath.Join(b.TempDir(), "copy.tiff")
+	b.SetBytes(benchFileSize)
+	b.ReportAllocs()
+	defer trackPeakMemory(b)()
+	for range b.N {
+		if err := copyFile(path, dst); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
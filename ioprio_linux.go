@@ -0,0 +1,20 @@
+package webpcon
+
+import "syscall"
+
+// I/O scheduling class and level for ioprio_set, see ioprio_set(2).
+const (
+	ioprioWhoProcess = 1
+	ioprioClassBE    = 2 // Best effort
+	ioprioClassShift = 13
+	ioprioLowest     = 7
+)
+
+// lowerIOPriority is the equivalent of ionice -c2 -n7 for the thread tid.
+func lowerIOPriority(tid int) error {
+	_, _, errno := syscall.Syscall(syscall.SYS_IOPRIO_SET, ioprioWhoProcess, uintptr(tid), ioprioClassBE<<ioprioClassShift|ioprioLowest)
+	if errno != 0 {
+		return errno
+	}
+	return nil
+}
@@ -0,0 +1,8 @@
+//go:build !linux && !windows
+
+package webpcon
+
+// lowerIOPriority does nothing where there's no per-process I/O priority.
+func lowerIOPriority() error {
+	return nil
+}
@@ -0,0 +1,106 @@
+//go:build cgo && libjpeg
+
+package webpcon
+
+/*
+#cgo LDFLAGS: -ljpeg
+#include <stdio.h>
+#include <stdlib.h>
+#include <setjmp.h>
+#include <jpeglib.h>
+
+struct webpcon_jpeg_error {
+	struct jpeg_error_mgr pub;
+	jmp_buf jump;
+};
+
+static void webpcon_jpeg_exit(j_common_ptr cinfo) {
+	longjmp(((struct webpcon_jpeg_error *)cinfo->err)->jump, 1);
+}
+
+static void webpcon_jpeg_silent(j_common_ptr cinfo) {}
+
+// Decodes data at 1/denom scale into a malloc'd buffer of RGB or gray
+// samples, or returns NULL. CMYK images are left to the Go decoder.
+static unsigned char *webpcon_jpeg_decode(unsigned char *data, unsigned long size, int denom,
+		int *width, int *height, int *channels) {
+	struct jpeg_decompress_struct cinfo;
+	struct webpcon_jpeg_error jerr;
+	unsigned char *volatile pixels = NULL;
+
+	cinfo.err = jpeg_std_error(&jerr.pub);
+	jerr.pub.error_exit = webpcon_jpeg_exit;
+	jerr.pub.output_message = webpcon_jpeg_silent;
+	if (setjmp(jerr.jump)) {
+		jpeg_destroy_decompress(&cinfo);
+		free(pixels);
+		return NULL;
+	}
+	jpeg_create_decompress(&cinfo);
+	jpeg_mem_src(&cinfo, data, size);
+	jpeg_read_header(&cinfo, TRUE);
+	if (cinfo.jpeg_color_space == JCS_CMYK || cinfo.jpeg_color_space == JCS_YCCK) {
+		jpeg_destroy_decompress(&cinfo);
+		return NULL;
+	}
+	cinfo.out_color_space = cinfo.jpeg_color_space == JCS_GRAYSCALE ? JCS_GRAYSCALE : JCS_RGB;
+	cinfo.scale_num = 1;
+	cinfo.scale_denom = denom;
+	jpeg_start_decompress(&cinfo);
+
+	*width = cinfo.output_width;
+	*height = cinfo.output_height;
+	*channels = cinfo.output_components;
+	size_t stride = (size_t)cinfo.output_width * cinfo.output_components;
+	pixels = malloc(stride * cinfo.output_height);
+	if (pixels == NULL) {
+		jpeg_destroy_decompress(&cinfo);
+		return NULL;
+	}
+	while (cinfo.output_scanline < cinfo.output_height) {
+		JSAMPROW row = pixels + stride * cinfo.output_scanline;
+		jpeg_read_scanlines(&cinfo, &row, 1);
+	}
+	jpeg_finish_decompress(&cinfo);
+	jpeg_destroy_decompress(&cinfo);
+	return pixels;
+}
+*/
+import "C"
+
+import (
+	"errors"
+	"image"
+	"unsafe"
+)
+
+// scaledJPEG tells whether decodeJPEGScaled can decode at reduced sizes.
+const scaledJPEG = true
+
+// decodeJPEGScaled decodes a JPEG at 1/denom of its size (denom 2, 4 or 8)
+// with libjpeg, which skips most of the inverse DCT work to get there.
+func decodeJPEGScaled(data []byte, denom int) (image.Image, error) {
+	if len(data) == 0 {
+		return nil, errors.New("empty JPEG")
+	}
+	var w, h, channels C.int
+	buf := C.CBytes(data)
+	defer C.free(buf)
+	pixels := C.webpcon_jpeg_decode((*C.uchar)(buf), C.ulong(len(data)), C.int(denom), &w, &h, &channels)
+	if pixels == nil {
+		return nil, errors.New("libjpeg could not decode the image at a reduced scale")
+	}
+	defer C.free(unsafe.Pointer(pixels))
+	src := unsafe.Slice((*byte)(unsafe.Pointer(pixels)), int(w)*int(h)*int(channels))
+
+	if channels == 1 {
+		img := image.NewGray(image.Rect(0, 0, int(w), int(h)))
+		copy(img.Pix, src)
+		return img, nil
+	}
+	img := image.NewRGBA(image.Rect(0, 0, int(w), int(h)))
+	for i, j := 0, 0; i < len(src); i, j = i+3, j+4 {
+		img.Pix[j], img.Pix[j+1], img.Pix[j+2], img.Pix[j+3] = src[i], src[i+1], src[i+2], 0xff
+	}
+	return img, nil
+}
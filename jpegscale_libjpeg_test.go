@@ -0,0 +1,35 @@
+//go:build cgo && libjpeg
+
+package webpcon
+
+import (
+	"image"
+	"testing"
+)
+
+func TestDecodeJPEGScaled(t *testing.T) {
+	for _, denom := range []int{2, 4, 8} {
+		img, err := decodeJPEGScaled(jpegFixture(t, 99, 50, false), denom)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, ok := img.(*image.RGBA); !ok {
+			t.Errorf("1/%d: decoded a %T, want *image.RGBA", denom, img)
+		}
+		if want := image.Rect(0, 0, (99+denom-1)/denom, (50+denom-1)/denom); img.Bounds() != want {
+			t.Errorf("1/%d: decoded %v, want %v", denom, img.Bounds(), want)
+		}
+	}
+	if img, err := decodeJPEGScaled(jpegFixture(t, 40, 40, true), 2); err != nil {
+		t.Fatal(err)
+	} else if _, ok := img.(*image.Gray); !ok {
+		t.Errorf("gray JPEG decoded as %T", img)
+	}
+
+	data := jpegFixture(t, 64, 64, false)
+	for name, bad := range map[string][]byte{"empty": nil, "not a JPEG": []byte("not a JPEG"), "truncated": data[:200]} {
+		if _, err := decodeJPEGScaled(bad, 2); err == nil {
+			t.Errorf("%s: decoded", name)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+//go:build !cgo || !libjpeg
+
+package webpcon
+
+import (
+	"errors"
+	"image"
+)
+
+// scaledJPEG tells whether decodeJPEGScaled can decode at reduced sizes. It
+// takes libjpeg, built in with -tags libjpeg.
+const scaledJPEG = false
+
+func decodeJPEGScaled(data []byte, denom int) (image.Image, error) {
+	return nil, errors.New("scaled JPEG decoding needs a build with -tags libjpeg")
+}
@@ -0,0 +1,124 @@
+package webpcon
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"testing"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+// jpegFixture returns a w x h JPEG of smooth gradients, as photos mostly are,
+// in color or gray. fixtureImage's sharp edges would measure how two
+// resamplings alias rather than whether they agree.
+func jpegFixture(tb testing.TB, w, h int, gray bool) []byte {
+	tb.Helper()
+	rgb := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			rgb.SetNRGBA(x, y, color.NRGBA{uint8(x * 255 / (w - 1)), uint8(y * 255 / (h - 1)), uint8((x + y) * 255 / (w + h - 2)), 0xff})
+		}
+	}
+	var img image.Image = rgb
+	if gray {
+		g := image.NewGray(rgb.Rect)
+		for y := range h {
+			for x := range w {
+				g.Set(x, y, rgb.At(x, y))
+			}
+		}
+		img = g
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: 95}); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestDecodeSized decodes JPEGs for a range of limits and checks the image,
+// once fitted, has the size and the look of the full decode fitted. Builds
+// without scaled decoding check the fallback gives the full image.
+func TestDecodeSized(t *testing.T) {
+	for _, tt := range []struct {
+		w, h, maxW, maxH int
+		gray             bool
+		denom            int // The scale picked with scaled decoding, 1 for none
+	}{
+		{800, 600, 400, 0, false, 2},   // Exactly 1/2
+		{800, 600, 100, 0, false, 8},   // Exactly 1/8
+		{801, 599, 120, 0, false, 4},   // Sizes that don't divide
+		{1001, 333, 0, 40, false, 8},   // By height
+		{640, 480, 300, 300, false, 2}, // Both
+		{640, 480, 639, 0, false, 1},   // Too close for any scale
+		{640, 480, 0, 0, false, 1},     // No limit
+		{300, 200, 400, 0, false, 1},   // Already small enough
+		{800, 600, 150, 0, true, 4},
+	} {
+		data := jpegFixture(t, tt.w, tt.h, tt.gray)
+		opts := options{maxWidth: tt.maxW, maxHeight: tt.maxH}
+		full, err := decodeImage(bytes.NewReader(data), ".jpg")
+		if err != nil {
+			t.Fatal(err)
+		}
+		img, err := decodeSized(bytes.NewReader(data), ".jpg", opts)
+		if err != nil {
+			t.Fatalf("%+v: %v", tt, err)
+		}
+
+		fb, b := full.Bounds(), img.Bounds()
+		denom := 1
+		if scaledJPEG {
+			denom = tt.denom
+		}
+		if want := image.Rect(0, 0, (fb.Dx()+denom-1)/denom, (fb.Dy()+denom-1)/denom); b != want {
+			t.Errorf("%+v: decoded %v, want %v", tt, b, want)
+		}
+		w, h, resize := fitSize(fb.Dx(), fb.Dy(), tt.maxW, tt.maxH)
+		if !resize {
+			if b != fb {
+				t.Errorf("%+v: decoded %v for no resize, want %v", tt, b, fb)
+			}
+			continue
+		}
+		if sw, sh, _ := fitSize(b.Dx(), b.Dy(), tt.maxW, tt.maxH); sw != w || sh != h {
+			t.Errorf("%+v: decoded %v fits to %dx%d, want %dx%d", tt, b, sw, sh, w, h)
+			continue
+		}
+		want, got := resizeImage(full, w, h, false), resizeImage(img, w, h, false)
+		if p := psnr(want, got); p < 40 {
+			t.Errorf("%+v: fitted from %v, %.1f dB off the full decode", tt, b, p)
+		}
+	}
+}
+
+// TestConvertScaledJPEG converts large JPEGs with --max-width and checks the
+// WebP files have the dimensions of the full decode fitted.
+func TestConvertScaledJPEG(t *testing.T) {
+	quietly(t)
+	root := writeFixtureTree(t, []fixtureFile{
+		{"photos/wide.jpg", jpegFixture(t, 1203, 802, false)},
+		{"photos/tall.jpg", jpegFixture(t, 600, 1601, false)},
+		{"photos/gray.jpg", jpegFixture(t, 960, 640, true)},
+	})
+	convertTree(t, root, testOptions(t, "--encoder", "native", "--max-width", "150", "--max-height", "150"))
+	files := treeFiles(t, root)
+	for _, tt := range []struct {
+		webp string
+		w, h int
+	}{
+		{"photos/wide.webp", 150, 100},
+		{"photos/tall.webp", 56, 150},
+		{"photos/gray.webp", 150, 100},
+	} {
+		cfg, err := xwebp.DecodeConfig(bytes.NewReader(files[tt.webp]))
+		if err != nil {
+			t.Fatalf("%s: %v", tt.webp, err)
+		}
+		if cfg.Width != tt.w || cfg.Height != tt.h {
+			t.Errorf("%s is %dx%d, want %dx%d", tt.webp, cfg.Width, cfg.Height, tt.w, tt.h)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package webpcon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"regexp"
+)
+
+// lintIssue is one problem lint found with an image.
+type lintIssue struct {
+	File      string `json:"file"`
+	Problem   string `json:"problem"` // mismatch, unrecognized, zeroSize, truncated or corrupt
+	Detail    string `json:"detail"`
+	Content   string `json:"content,omitempty"`   // For mismatch: the extension the content calls for
+	RenamedTo string `json:"renamedTo,omitempty"` // Set by --fix-extensions
+}
+
+type lintReport struct {
+	Checked int         `json:"checked"`
+	Issues  []lintIssue `json:"issues"`
+}
+
+// lintImages checks the project's images without converting anything:
+// content that doesn't match the extension, content that isn't an image at
+// all, zero dimensions and truncated or otherwise corrupt files. With
+// --fix-extensions mismatched files are renamed, and with --rewrite-refs the
+// references to them follow. Any problem left fails the command, for CI.
+func lintImages(root string, opts options) error {
+	if opts.rewriteRefs && !opts.fixExtensions {
+		return fmt.Errorf("--rewrite-refs only works together with --fix-extensions here")
+	}
+	report := lintReport{Issues: []lintIssue{}}
+	for _, src := range scanSources(root, opts) {
+		report.Checked++
+		if issue := lintFile(filepath.Join(root, src.rel), src.ext); issue != nil {
+			issue.File = filepath.ToSlash(src.rel)
+			report.Issues = append(report.Issues, *issue)
+		}
+	}
+
+	// Logs go to stderr while the report has stdout
+	restore := func() {}
+	if opts.jsonOutput {
+		restore = logsToStderr()
+	}
+	if opts.fixExtensions {
+		err := fixExtensions(root, report.Issues, opts.rewriteRefs)
+		restore()
+		if err != nil {
+			return err
+		}
+	}
+	restore()
+
+	left := 0
+	for _, issue := range report.Issues {
+		if issue.RenamedTo == "" {
+			left++
+		}
+	}
+	if opts.jsonOutput {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, string(data))
+	} else {
+		for _, issue := range report.Issues {
+			if issue.RenamedTo != "" {
+				continue
+			}
+			fmt.Fprintf(stdout, "⚠️  %s: %s\n", issue.File, issue.Detail)
+		}
+		if left == 0 {
+			fmt.Fprintf(stdout, "✅ Checked %d image(s), no problems left\n", report.Checked)
+		} else {
+			fmt.Fprintf(stdout, "📋 Checked %d image(s), %d problem(s)\n", report.Checked, left)
+		}
+	}
+	if left > 0 {
+		return fmt.Errorf("%d image(s) with problems", left)
+	}
+	return nil
+}
+
+// truncatedError matches the decoder errors for data that ends too early.
+// Only some of them wrap io.ErrUnexpectedEOF.
+var truncatedError = regexp.MustCompile(`unexpected EOF|not enough pixel data|short Huffman data|missing EOI`)
+
+// lintFile checks one image and returns its problem, if any.
+func lintFile(path, ext string) *lintIssue {
+	f, err := os.Open(longPath(path))
+	if err != nil {
+		return &lintIssue{Problem: "corrupt", Detail: err.Error()}
+	}
+	head := make([]byte, sniffLen)
+	n, _ := io.ReadFull(f, head)
+	f.Close()
+	if n == 0 {
+		return &lintIssue{Problem: "truncated", Detail: "empty file"}
+	}
+
+	var mismatch *lintIssue
+	switch format := sniffFormat(head[:n]); {
+	case format == "":
+		return &lintIssue{Problem: "unrecognized", Detail: "content isn't a known image format"}
+	case format != formatExt(ext):
+		mismatch = &lintIssue{Problem: "mismatch", Content: format,
+			Detail: fmt.Sprintf("%s content with a %s extension", formatNames[format], ext)}
+	}
+
+	// Valid files using features the decoders lack aren't a problem here
+	if err := checkSupported(osTree(filepath.Dir(path)), filepath.Base(path), ext); err != nil && unsupportedReason(err) != "" {
+		return mismatch
+	}
+	broken := func(err error) *lintIssue {
+		if errors.Is(err, io.ErrUnexpectedEOF) || truncatedError.MatchString(err.Error()) {
+			return &lintIssue{Problem: "truncated", Detail: "truncated: " + err.Error()}
+		}
+		return &lintIssue{Problem: "corrupt", Detail: err.Error()}
+	}
+	cfg, err := decodeConfig(path, ext)
+	if err != nil {
+		return broken(err)
+	}
+	if cfg.Width == 0 || cfg.Height == 0 {
+		return &lintIssue{Problem: "zeroSize", Detail: fmt.Sprintf("dimensions are %dx%d", cfg.Width, cfg.Height)}
+	}
+	f, err = os.Open(longPath(path))
+	if err != nil {
+		return &lintIssue{Problem: "corrupt", Detail: err.Error()}
+	}
+	defer f.Close()
+	if _, err := decodeImage(f, ext); err != nil && unsupportedReason(err) == "" {
+		return broken(err)
+	}
+	return mismatch
+}
+
+// fixExtensions renames the files with mismatch issues to the extension of
+// their content, unless a file of that name exists already. With refs
+// the references in the project's source files are updated like a
+// conversion's, backups included.
+func fixExtensions(root string, issues []lintIssue, refs bool) error {
+	renamed := &mapping{entries: map[string]*mapEntry{}}
+	for i := range issues {
+		issue := &issues[i]
+		if issue.Problem != "mismatch" {
+			continue
+		}
+		rel := filepath.FromSlash(issue.File)
+		newRel := rel[:len(rel)-len(filepath.Ext(rel))] + issue.Content
+		if fileExists(filepath.Join(root, newRel)) {
+			fmt.Fprintf(stdout, "⏭️ Not renaming %s, %s exists\n", issue.File, filepath.Base(newRel))
+			continue
+		}
+		if err := os.Rename(longPath(filepath.Join(root, rel)), longPath(filepath.Join(root, newRel))); err != nil {
+			fmt.Fprintf(stdout, "❌ Error renaming %s: %v\n", issue.File, err)
+			return err
+		}
+		issue.RenamedTo = filepath.ToSlash(newRel)
+		// The entry's output is the renamed file, so references go there
+		renamed.add(rel, newRel)
+		fmt.Fprintf(stdout, "✏️  Renamed %s to %s\n", issue.File, filepath.Base(newRel))
+	}
+	if !refs || len(renamed.entries) == 0 {
+		return nil
+	}
+	return rewriteRefs(root, renamed, false)
+}
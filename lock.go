@@ -0,0 +1,121 @@
+package webpcon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// errInterrupted ends a run stopped by SIGINT or SIGTERM.
+var errInterrupted = errors.New("interrupted")
+
+// runLock keeps two runs from working on the same tree at once. It is a file
+// in the backup directory holding the owner's PID, host and start time.
+type runLock struct {
+	path        string
+	stop        chan struct{}
+	interrupted chan struct{} // Closed on SIGINT or SIGTERM, see releaseOnSignal
+}
+
+// acquireLock takes the lock for root. A lock left behind by a process of
+// this host that no longer exists is only removed with breakStale set.
+func acquireLock(root string, breakStale bool) (*runLock, error) {
+	dir := filepath.Join(root, ".webpcon_backup")
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	path := filepath.Join(dir, ".lock")
+	host, _ := os.Hostname()
+	content := fmt.Sprintf("%d\n%s\n%s\n", os.Getpid(), host, time.Now().Format(time.RFC3339))
+
+	for attempt := 0; ; attempt++ {
+		f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+		if err == nil {
+			_, err = f.WriteString(content)
+			if cerr := f.Close(); err == nil {
+				err = cerr
+			}
+			if err != nil {
+				os.Remove(path)
+				return nil, err
+			}
+			l := &runLock{path: path, stop: make(chan struct{}), interrupted: make(chan struct{})}
+			l.releaseOnSignal()
+			return l, nil
+		}
+		if !errors.Is(err, os.ErrExist) || attempt > 0 {
+			return nil, err
+		}
+
+		// Only a process on this host can be looked up. A lock from another
+		// one, like a second CI container on a shared checkout, counts as live
+		pid, holderHost, started := readLock(path)
+		if holderHost != host {
+			return nil, fmt.Errorf("another webpcon run holds %s (held by %s:%d, started %s). It runs on another host and can't be checked from here; if it is gone, delete the lock by hand", path, holderHost, pid, started)
+		}
+		holder := fmt.Sprintf("PID %d on %s, started %s", pid, holderHost, started)
+		switch {
+		case processExists(pid):
+			return nil, fmt.Errorf("another webpcon run holds %s (%s)", path, holder)
+		case !breakStale:
+			return nil, fmt.Errorf("%s is held by %s, which looks stale. Use --break-lock to remove it", path, holder)
+		}
+		fmt.Fprintf(stdout, "🔓 Removing stale lock (%s)\n", holder)
+		if err := os.Remove(path); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func readLock(path string) (pid int, host, started string) {
+	data, _ := os.ReadFile(path)
+	fields := strings.SplitN(string(data), "\n", 3)
+	pid, _ = strconv.Atoi(fields[0])
+	if len(fields) > 1 {
+		host = fields[1]
+	}
+	if len(fields) > 2 {
+		started = strings.TrimSpace(fields[2])
+	}
+	return pid, host, started
+}
+
+// releaseOnSignal closes l.interrupted when the run is interrupted. Runs
+// watching it, through options.interrupt, roll back the file at hand and
+// return errInterrupted, so the map file and the run log are saved and the
+// lock released on the way out as after any run. Signals are then handled
+// as usual again: a second one ends the process at once, leaving the lock
+// for --break-lock.
+func (l *runLock) releaseOnSignal() {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case s := <-sig:
+			signal.Stop(sig)
+			fmt.Fprintf(stdout, "\n⛔ Interrupted (%v), stopping after the current file. Interrupt again to stop at once\n", s)
+			close(l.interrupted)
+		case <-l.stop:
+			signal.Stop(sig)
+		}
+	}()
+}
+
+// run calls fn holding the lock, and releases it however fn ends, a panic
+// included.
+func (l *runLock) run(fn func() error) error {
+	defer l.release()
+	return fn()
+}
+
+func (l *runLock) release() {
+	close(l.stop)
+	os.Remove(l.path)
+	os.Remove(filepath.Dir(l.path)) // Only succeeds if nothing was backed up
+}
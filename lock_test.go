@@ -0,0 +1,152 @@
+package webpcon
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestLock takes the lock of a tree: another run is refused while it's
+// held, even with --break-lock, and takes it once it's released.
+func TestLock(t *testing.T) {
+	root := t.TempDir()
+	lock, err := acquireLock(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := acquireLock(root, true); err == nil {
+		t.Error("took a lock held by a live run")
+	}
+	lock.release()
+	if _, err := os.Stat(lock.path); !os.IsNotExist(err) {
+		t.Errorf("lock not removed on release: %v", err)
+	}
+	lock, err = acquireLock(root, false)
+	if err != nil {
+		t.Fatalf("lock not taken after its release: %v", err)
+	}
+	lock.release()
+}
+
+// TestBreakStaleLock leaves the lock of a process of this host that has
+// exited: it's reported as stale, and only removed with --break-lock.
+func TestBreakStaleLock(t *testing.T) {
+	exited := exec.Command(os.Args[0], "-test.run=^$")
+	if err := exited.Run(); err != nil {
+		t.Fatal(err)
+	}
+	root := t.TempDir()
+	path := filepath.Join(root, ".webpcon_backup", ".lock")
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	host, _ := os.Hostname()
+	stale := fmt.Sprintf("%d\n%s\n2020-01-01T00:00:00Z\n", exited.Process.Pid, host)
+	if err := os.WriteFile(path, []byte(stale), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := acquireLock(root, false); err == nil || !strings.Contains(err.Error(), "--break-lock") {
+		t.Errorf("acquireLock over a stale lock = %v, want a hint to --break-lock", err)
+	}
+	lock, err := acquireLock(root, true)
+	if err != nil {
+		t.Fatalf("--break-lock didn't remove the stale lock: %v", err)
+	}
+	if pid, _, _ := readLock(path); pid != os.Getpid() {
+		t.Errorf("lock held by PID %d, want %d", pid, os.Getpid())
+	}
+	lock.release()
+}
+
+// TestLockReleasedOnPanic releases the lock of a command that panics, so
+// the next run doesn't need --break-lock.
+func TestLockReleasedOnPanic(t *testing.T) {
+	root := t.TempDir()
+	lock, err := acquireLock(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	func() {
+		defer func() { recover() }()
+		lock.run(func() error { panic("boom") })
+	}()
+	if _, err := os.Stat(lock.path); !os.IsNotExist(err) {
+		t.Errorf("lock left after a panic: %v", err)
+	}
+}
+
+// TestBackupCommandsLock checks the commands that change the backup take the
+// lock.
+func TestBackupCommandsLock(t *testing.T) {
+	for _, name := range []string{"convert", "revert", "repair"} {
+		if findCommand(name).readOnly {
+			t.Errorf("%s runs without the lock", name)
+		}
+	}
+}
+
+// interruptOnStart closes interrupt once a file is started, as a signal
+// arriving during its conversion would.
+type interruptOnStart chan struct{}
+
+func (c interruptOnStart) Write(p []byte) (int, error) {
+	if strings.Contains(string(p), `"file_started"`) {
+		select {
+		case <-c:
+		default:
+			close(c)
+		}
+	}
+	return len(p), nil
+}
+
+// TestInterruptRollsBack interrupts a conversion once its first file was
+// moved to the backup: that file is put back, no WebP is left, the map file
+// lists nothing, and the run returns so the lock can be released.
+func TestInterruptRollsBack(t *testing.T) {
+	log := quietly(t)
+	files := []fixtureFile{
+		{"a.png", encodeFixture(t, ".png", 8, 8)},
+		{"b.png", encodeFixture(t, ".png", 9, 9)},
+	}
+	root := writeFixtureTree(t, files)
+	lock, err := acquireLock(root, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions(t, "--encoder", "native")
+	opts.interrupt = lock.interrupted
+	opts.progress = newProgress(interruptOnStart(lock.interrupted))
+	_, err = runConvert(root, opts)
+	lock.release()
+	if !errors.Is(err, errInterrupted) {
+		t.Errorf("runConvert = %v, want %v", err, errInterrupted)
+	}
+
+	got := treeFiles(t, root)
+	for _, f := range files {
+		if string(got[f.rel]) != string(f.data) {
+			t.Errorf("%s wasn't put back as it was", f.rel)
+		}
+	}
+	for name := range got {
+		if strings.HasSuffix(name, ".webp") || strings.HasPrefix(name, ".webpcon_backup/") && strings.HasSuffix(name, ".png") {
+			t.Errorf("%s left after the interruption", name)
+		}
+	}
+	if !strings.Contains(log.String(), "Rolled back a.png") {
+		t.Error("a.png wasn't rolled back")
+	}
+	outputs, err := loadMapping(root)
+	if err != nil || len(outputs.entries) != 0 {
+		t.Errorf("map file: %v, %d entries, want none", err, len(outputs.entries))
+	}
+	if _, err := os.Stat(filepath.Join(root, ".webpcon_backup", ".lock")); !os.IsNotExist(err) {
+		t.Errorf("lock not released: %v", err)
+	}
+}
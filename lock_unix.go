@@ -0,0 +1,14 @@
+//go:build !windows
+
+package webpcon
+
+import "syscall"
+
+// processExists reports whether a process with the given PID is running.
+func processExists(pid int) bool {
+	if pid <= 0 {
+		return false
+	}
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
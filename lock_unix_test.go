@@ -0,0 +1,32 @@
+//go:build !windows
+
+package webpcon
+
+import (
+	"os"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// TestLockSignal checks SIGINT closes the lock's interrupted channel and
+// leaves the process running and the lock in place, for the run to release.
+func TestLockSignal(t *testing.T) {
+	quietly(t)
+	lock, err := acquireLock(t.TempDir(), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer lock.release()
+	if err := syscall.Kill(os.Getpid(), syscall.SIGINT); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-lock.interrupted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("SIGINT didn't interrupt the run")
+	}
+	if _, err := os.Stat(lock.path); err != nil {
+		t.Errorf("lock removed before the run returned: %v", err)
+	}
+}
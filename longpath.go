@@ -0,0 +1,21 @@
+package webpcon
+
+import "strings"
+
+// maxShortPath leaves some room below MAX_PATH (260) for file names that
+// Windows APIs append themselves.
+const maxShortPath = 240
+
+// extendedPath gives the absolute Windows path abs the \\?\ prefix (\\?\UNC\
+// for network shares) once it is too long for MAX_PATH. It only looks at the
+// string, so it is the same on every platform; longPath applies it on
+// Windows.
+func extendedPath(abs string) string {
+	if strings.HasPrefix(abs, `\\?\`) || len(abs) < maxShortPath {
+		return abs
+	}
+	if strings.HasPrefix(abs, `\\`) {
+		return `\\?\UNC\` + abs[2:]
+	}
+	return `\\?\` + abs
+}
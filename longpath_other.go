@@ -0,0 +1,8 @@
+//go:build !windows
+
+package webpcon
+
+// longPath returns p unchanged. Only Windows needs special long path handling.
+func longPath(p string) string {
+	return p
+}
@@ -0,0 +1,28 @@
+package webpcon
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestExtendedPath(t *testing.T) {
+	long := strings.Repeat(`node_modules\`, 20) + "logo.png" // 268 characters
+	tests := []struct {
+		abs, want string
+	}{
+		{`C:\site\img\logo.png`, `C:\site\img\logo.png`},
+		{`C:\` + long, `\\?\C:\` + long},
+		{`\\server\share\` + long, `\\?\UNC\server\share\` + long},
+		{`\\server\share\logo.png`, `\\server\share\logo.png`},
+		{`\\?\C:\` + long, `\\?\C:\` + long},
+		{`\\?\UNC\server\share\` + long, `\\?\UNC\server\share\` + long},
+		// The limit is on the whole path
+		{`C:\` + strings.Repeat("a", maxShortPath-4), `C:\` + strings.Repeat("a", maxShortPath-4)},
+		{`C:\` + strings.Repeat("a", maxShortPath-3), `\\?\C:\` + strings.Repeat("a", maxShortPath-3)},
+	}
+	for _, tt := range tests {
+		if got := extendedPath(tt.abs); got != tt.want {
+			t.Errorf("extendedPath(%.30q… %d long) = %.40q…, want %.40q…", tt.abs, len(tt.abs), got, tt.want)
+		}
+	}
+}
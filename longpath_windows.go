@@ -0,0 +1,22 @@
+//go:build windows
+
+package webpcon
+
+import (
+	"path/filepath"
+	"strings"
+)
+
+// longPath returns a form of p that Windows file APIs accept beyond MAX_PATH:
+// long paths are made absolute and given the \\?\ prefix, see extendedPath.
+// Only pass the result to file operations; print p itself.
+func longPath(p string) string {
+	if strings.HasPrefix(p, `\\?\`) {
+		return p
+	}
+	abs, err := filepath.Abs(p)
+	if err != nil || len(abs) < maxShortPath {
+		return p
+	}
+	return extendedPath(abs)
+}
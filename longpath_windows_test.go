@@ -0,0 +1,51 @@
+//go:build windows
+
+package webpcon
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestConvertLongPath converts and reverts an image whose path, and that of
+// its backup, are well past MAX_PATH.
+func TestConvertLongPath(t *testing.T) {
+	log := quietly(t)
+	root := t.TempDir()
+	dir := filepath.Join(root, strings.Repeat(`nested-folder-name\`, 16))
+	src := filepath.Join(dir, "logo.png")
+	if len(src) < 300 {
+		t.Fatalf("%s is only %d characters", src, len(src))
+	}
+	if err := os.MkdirAll(longPath(dir), 0755); err != nil {
+		t.Fatal(err)
+	}
+	data := encodeFixture(t, ".png", 20, 20)
+	if err := os.WriteFile(longPath(src), data, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if sum := convertTree(t, root, testOptions(t, "--encoder", "native")); sum.Converted != 1 {
+		t.Fatalf("converted %d file(s), want 1", sum.Converted)
+	}
+	if !fileExists(filepath.Join(dir, "logo.webp")) {
+		t.Error("no logo.webp")
+	}
+	rel, _ := filepath.Rel(root, src)
+	if !fileExists(filepath.Join(root, ".webpcon_backup", rel)) {
+		t.Error("no backup of logo.png")
+	}
+	if strings.Contains(log.String(), `\\?\`) {
+		t.Errorf("the log shows extended paths:\n%s", log)
+	}
+
+	if _, err := runRevert(root, revertFromBackup); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(longPath(src))
+	if err != nil || string(got) != string(data) {
+		t.Errorf("logo.png not restored: %v", err)
+	}
+}
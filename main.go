@@ -1,32 +1,48 @@
-package main
+package webpcon
 
 import (
 	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
 	"fmt"
 	"image"
+	"image/color"
 	"image/gif"
 	"image/jpeg"
 	"image/png"
+	"io"
+	"io/fs"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
 	"strings"
+	"syscall"
+	"time"
 
 	"image/draw"
 
-	"github.com/HugoSmits86/nativewebp"
-	"github.com/chai2010/webp"
-	"golang.org/x/image/bmp"
 	"golang.org/x/image/tiff"
+	xwebp "golang.org/x/image/webp"
 )
 
 var imageExt = map[string]bool{
 	".jpg":  true,
 	".jpeg": true,
+	".jpe":  true,
+	".jfif": true,
 	".png":  true,
 	".bmp":  true,
 	".gif":  true, // Will be converted into static image. gif conversion still in experiment
 	".tiff": true,
+	".avif": true, // Only with --enable-avif-input
+	".jxl":  true, // Only with --enable-jxl-input
+}
+
+// isJPEG reports whether ext, in lower case, is one of the JPEG extensions.
+func isJPEG(ext string) bool {
+	return ext == ".jpg" || ext == ".jpeg" || ext == ".jpe" || ext == ".jfif"
 }
 
 var skipDirs = map[string]bool{
@@ -35,84 +51,97 @@ var skipDirs = map[string]bool{
 	".webpcon_backup": true,
 	".webcon_cache":   true,
 	"dist":            true,
+	"webpcon-check":   true, // --spot-check's default folder
 	// Add another excluded folder if available
 }
 
 var skipFiles = map[string]bool{
 	"favicon.ico":       true,
-	"icon-192x192.png":  true,
-	"icon-512x512.png":  true,
 	"icon-template.svg": true,
 	// Add another if there's something you want to be excluded
 }
 
-func main() {
+// Main runs the webpcon command line on os.Args. It's the whole program:
+// cmd/webpcon only calls it.
+func Main() {
 	args := os.Args[1:]
-	if len(args) == 0 {
-		fmt.Println("Usage:")
-		fmt.Println("  webpcon <project-path>\t# Convert to WebP")
-		fmt.Println("  webpcon <project-path> revert\t# Revert to original")
-		return
-	}
-
-	path := args[0]
-	if !isSafePath(path) {
-		fmt.Println("⚠️  Path is too broad or suspicious. Operation cancelled.")
-		return
-	}
-
-	enableGif := false
-	for _, arg := range args {
-		if arg == "--enable-gif" || arg == "--gif" {
-			enableGif = true
+	if len(args) > 0 && args[0] == "completion" {
+		shell := ""
+		if len(args) > 1 {
+			shell = args[1]
 		}
+		if err := printCompletion(os.Stdout, shell); err != nil {
+			log.Fatal(err)
+		}
+		return
 	}
-
-	if len(args) > 1 && args[1] == "revert" {
-		err := revertImages(path)
-		if err != nil {
+	if len(args) > 0 && args[0] == "profile" {
+		if err := exportProfile(os.Stdout, args[1:]); err != nil {
 			log.Fatal(err)
 		}
 		return
 	}
-
-	err := convertImages(path, enableGif)
+	inv, err := parseCommandLine(args)
 	if err != nil {
 		log.Fatal(err)
 	}
-}
+	if inv.help || inv.cmd == nil {
+		printUsage(stdout, inv.cmd)
+		return
+	}
 
-func isSafePath(path string) bool {
-	abs, err := filepath.Abs(path)
+	if inv.flags, err = withProfile(inv.flags, inv.cmd); err != nil {
+		log.Fatal(err)
+	}
+	opts, err := parseOptions(inv.flags)
 	if err != nil {
-		return false
+		log.Fatal(err)
 	}
+	setupOutput(&opts)
+	ioBufferSize = int(opts.bufferSize)
 
-	if abs == "/" || len(abs) <= 3 {
-		fmt.Println("Path appears to be root or drive (", abs, ")")
-		return confirm()
+	path := inv.path
+	if path == "-" && inv.cmd.name == "convert" {
+		if err := convertStdin(opts); err != nil {
+			os.Exit(1)
+		}
+		return
 	}
-
-	projectFiles := []string{"package.json", "vite.config.ts", "vite.config.js", "next.config.js", "tsconfig.json", "vue.config.js", "nuxt.config.ts", "nuxt.config.js", "tsconfig.json", "jsconfig.json", "babel.config.js", "postcss.config.js", "tailwind.config.js", "angular.json", "svelte.config.js", "index.html"} // Add another if you want
-	found := false
-	for _, f := range projectFiles {
-		if _, err := os.Stat(filepath.Join(abs, f)); err == nil {
-			found = true
-			break
+	opts.printWarnings()
+	if err := selectFramework(path, &opts); err != nil {
+		log.Fatal(err)
+	}
+	if inv.cmd.readOnly {
+		if err := inv.cmd.run(path, opts); err != nil {
+			log.Fatal(explainFileLimit(err))
 		}
+		return
 	}
 
-	relParts := strings.Split(filepath.ToSlash(abs), "/")
-	if len(relParts) > 10 && !found {
-		fmt.Printf("Folder is too deep (%d level) and no project files found.\n", len(relParts))
-		return confirm()
+	if !isSafePath(path, opts) {
+		fmt.Fprintln(stdout, "⚠️  Path is too broad or suspicious. Operation cancelled.")
+		return
 	}
 
-	return true
+	lock, err := acquireLock(path, opts.breakLock)
+	if err != nil {
+		fmt.Fprintf(stdout, "🔒 %v\n", err)
+		os.Exit(1)
+	}
+	opts.interrupt = lock.interrupted
+	err = lock.run(func() error { return inv.cmd.run(path, opts) })
+	if err != nil {
+		log.Fatal(explainFileLimit(err))
+	}
 }
 
 func confirm() bool {
-	fmt.Print("Continue? (y/N): ")
+	return ask("Continue?")
+}
+
+// ask puts a yes/no question on the terminal. Anything but yes is no.
+func ask(question string) bool {
+	fmt.Fprint(stdout, question+" (y/N): ")
 	scan := bufio.NewScanner(os.Stdin)
 	if scan.Scan() {
 		ans := strings.ToLower(scan.Text())
@@ -121,243 +150,645 @@ func confirm() bool {
 	return false
 }
 
-func copyFile(src, dst string) error {
-	sourceFile, err := os.Open(src)
+// decodeConfig reads just the header of an image to get its dimensions.
+func decodeConfig(path, ext string) (image.Config, error) {
+	f, err := os.Open(longPath(path))
 	if err != nil {
-		return err
+		return image.Config{}, err
+	}
+	defer f.Close()
+	return decodeConfigFrom(f, ext)
+}
+
+// decodeConfigFrom is decodeConfig for an image read from r.
+func decodeConfigFrom(r io.Reader, ext string) (cfg image.Config, err error) {
+	defer recoverDecode(&err)
+	ext, r = sniffReader(r, ext)
+	switch ext {
+	case ".jpg", ".jpeg", ".jpe", ".jfif":
+		return jpeg.DecodeConfig(r)
+	case ".png":
+		return png.DecodeConfig(r)
+	case ".bmp":
+		return decodeBMPConfig(r)
+	case ".gif":
+		return gif.DecodeConfig(r)
+	case ".tiff":
+		return tiff.DecodeConfig(r)
+	case ".avif", ".jxl":
+		return decodeOptInConfig(r, ext)
+	case ".webp":
+		return xwebp.DecodeConfig(r)
 	}
-	defer sourceFile.Close()
+	return image.Config{}, fmt.Errorf("unsupported extension %s", ext)
+}
 
-	destFile, err := os.Create(dst)
+func hashFile(path string) (string, error) {
+	f, err := os.Open(longPath(path))
 	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := copyBuffered(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// reuseOutput places an already encoded WebP at dst, as a hard link when asked
+// (falling back to a copy, e.g. across devices) or as a plain copy. A copy is
+// checked against sha256, the hex digest from the map file, unless it's "".
+func reuseOutput(src, dst string, hardlink bool, sha256 string) (string, error) {
+	if hardlink {
+		os.Remove(longPath(dst))
+		if err := os.Link(longPath(src), longPath(dst)); err == nil {
+			return "hardlinked", nil
+		}
+	}
+	return "copied", copyFileWith(src, dst, copyOptions{sha256: sha256})
+}
+
+// webpRel is the output path for a source path relative to the project root.
+func webpRel(relPath, ext string) string {
+	return relPath[:len(relPath)-len(ext)] + ".webp"
+}
+
+func fileExists(path string) bool {
+	_, err := os.Stat(longPath(path))
+	return err == nil
+}
+
+// explainFileLimit adds advice to running out of file descriptors, whose
+// message alone doesn't say what to do. Files are converted one at a time,
+// and the parallel stages keep to openFiles, so this takes a very low limit
+// or something else holding many files open.
+func explainFileLimit(err error) error {
+	if !errors.Is(err, syscall.EMFILE) {
 		return err
 	}
-	defer destFile.Close()
+	return fmt.Errorf("%w: the limit on open files is too low, raise it with ulimit -n (macOS defaults to 256)", err)
+}
+
+// encodedOutput remembers a converted file so identical sources can reuse it.
+type encodedOutput struct {
+	relPath  string
+	outRel   string
+	webpPath string
+}
 
-	_, err = destFile.ReadFrom(sourceFile)
+// convertImages converts the images under root, see runConvert.
+func convertImages(root string, opts options) error {
+	_, err := runConvert(root, opts)
 	return err
 }
 
-func convertImages(root string, enableGif bool) error {
-	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
-		if err != nil {
-			return nil
+// runConvert converts the images under root, logging each file and printing
+// the summary, and returns the summary as reported to --post-run-hook. The
+// summary is nil if the run stopped before any file was looked at.
+func runConvert(root string, opts options) (*summaryJSON, error) {
+	if nested := nestedBackups(root); len(nested) > 0 {
+		for _, b := range nested {
+			fmt.Fprintf(stdout, "⛔ %s holds the backups of %s, converted on its own\n", b.dir, b.owner)
 		}
-		if info.IsDir() {
-			if skipDirs[info.Name()] {
-				return filepath.SkipDir
-			}
-			return nil
+		fmt.Fprintln(stdout, "⛔ Converting this folder too would back those images up a second time, and neither revert would undo the other. Run webpcon on each project instead, or revert them first.")
+		return nil, fmt.Errorf("%d project(s) below %s have backups of their own", len(nested), root)
+	}
+	sum := newSummary()
+	sum.groupDepth = opts.groupByDir
+	sum.conflictPolicy = opts.conflictPolicy()
+	if opts.timings {
+		sum.timings = []fileTiming{}
+	}
+	// Before the tree is hashed, which runs in parallel too
+	thr := startThrottle(opts.throttle)
+	overrides := newOverrideLoader(root)
+	icons, err := projectIcons(root, opts)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error %v\n", err)
+		return nil, err
+	}
+	var referenced *projectRefs
+	if opts.onlyReferenced {
+		var err error
+		if referenced, err = scanRefs(root); err != nil {
+			fmt.Fprintf(stdout, "❌ Error scanning for image references: %v\n", err)
+			return nil, err
 		}
-
-		if skipFiles[info.Name()] {
-			fmt.Println("⏭️ Skipping excluded file:", path)
-			return nil
+		fmt.Fprintf(stdout, "🔎 Found %d referenced image(s)\n", len(referenced.images))
+		referenced.warnDynamic()
+	}
+	if err := offerGitignore(root, opts.yes); err != nil {
+		fmt.Fprintf(stdout, "⚠️  Could not update .gitignore: %v\n", err)
+	}
+	var changed map[string]bool
+	if opts.gitSince != "" {
+		var err error
+		if changed, err = gitChanged(root, opts.gitSince); err != nil {
+			fmt.Fprintf(stdout, "❌ %v\n", err)
+			return nil, err
 		}
-
-		ext := strings.ToLower(filepath.Ext(info.Name()))
-		if !imageExt[ext] || ext == ".webp" {
-			return nil
+		fmt.Fprintf(stdout, "🔎 %d file(s) added or modified since %s\n", len(changed), opts.gitSince)
+	}
+	var bin trasher
+	if opts.trash {
+		var err error
+		if bin, err = newTrasher(); err != nil {
+			fmt.Fprintf(stdout, "❌ Trash is not available: %v\n", err)
+			return nil, err
 		}
-
-		fmt.Println("🔄 Converting:", path)
-
-		relPath, err := filepath.Rel(root, path)
-		if err != nil {
-			fmt.Printf("❌ Error getting relative path for %s: %v\n", path, err)
-			return err
+	}
+	// With --streaming-walk the tree isn't listed up front, so the checks
+	// needing all of it are skipped or, for collisions, done per folder
+	var sources []source
+	switch {
+	case opts.streamingWalk:
+		fmt.Fprintln(stdout, "🔎 Converting while the tree is read (--streaming-walk): no up-front disk space check, and collisions are only found within a folder")
+	case opts.filesFrom != "":
+		var err error
+		if sources, err = listedSources(root, opts); err != nil {
+			fmt.Fprintf(stdout, "❌ Error reading --files-from: %v\n", err)
+			return nil, err
 		}
-
-		bakPath := filepath.Join(root, ".webpcon_backup", relPath)
-		bakDir := filepath.Dir(bakPath)
-		if err := os.MkdirAll(bakDir, 0755); err != nil {
-			fmt.Printf("❌ Error creating backup directory %s: %v\n", bakDir, err)
-			return err
+	default:
+		sources = scanSources(root, opts)
+	}
+	if !opts.ignoreDiskCheck && !opts.streamingWalk {
+		if err := checkDiskSpace(root, sources, opts.spaceFactor); err != nil {
+			fmt.Fprintf(stdout, "💽 %v\n", err)
+			return nil, err
 		}
-
-		if err := os.Rename(path, bakPath); err != nil {
-			fmt.Printf("❌ Error moving %s to backup: %v\n", path, err)
-			return err
+	}
+	collisions := findCollisions(sources)
+	var images []source
+	for _, src := range sources {
+		if src.ext != ".webp" {
+			images = append(images, src)
+		}
+	}
+	hashes, err := prescan(root, images, false, opts.filesFrom == "" && !opts.streamingWalk)
+	if err != nil {
+		fmt.Fprintf(stdout, "⚠️  Could not save %s: %v\n", hashCacheName, err)
+	}
+	var filter *filterHook
+	if opts.filterHook != "" {
+		var err error
+		if filter, err = newFilterHook(opts.filterHook, opts.hookTimeout); err == nil && filter.isBatch() {
+			if opts.streamingWalk {
+				err = fmt.Errorf("a {files} hook is run over all files up front, which --streaming-walk doesn't list")
+			} else {
+				err = filter.prefetch(root, sources)
+			}
 		}
-		fmt.Printf("💾 Moved to backup: %s\n", relPath)
-
-		in, err := os.Open(bakPath)
 		if err != nil {
-			fmt.Printf("❌ Error opening backup file %s: %v\n", bakPath, err)
-			return err
+			fmt.Fprintf(stdout, "❌ Filter hook failed: %v\n", err)
+			return nil, err
 		}
-		defer in.Close()
-
-		var img image.Image
-		var gifFrames *gif.GIF
-		switch ext {
-		case ".jpg", ".jpeg":
-			img, err = jpeg.Decode(in)
-		case ".png":
-			img, err = png.Decode(in)
-		case ".bmp":
-			img, err = bmp.Decode(in)
-		case ".gif":
-			if enableGif {
-				gifFrames, err = gif.DecodeAll(in)
-				if err == nil && len(gifFrames.Image) > 1 {
-					cacheDir := filepath.Join(root, ".webcon_cache")
-					if err := gifExtractor(bakPath, cacheDir); err != nil {
-						fmt.Printf("❌ Error extracting GIF frame: %v\n", err)
-						return err
-					}
-					for i := range gifFrames.Image {
-						pngPath := filepath.Join(cacheDir, fmt.Sprintf("frame_%02d.png", i))
-						webpPath := filepath.Join(cacheDir, fmt.Sprintf("frame_%02d.webp", i))
-						err := frameCompress(pngPath, webpPath, 60)
-						if err != nil {
-							fmt.Printf("❌ Error compressing frame to WebP (frame %d): %v\n", i, err)
-							return err
-						}
-					}
-					webpPath := path[:len(path)-len(ext)] + ".webp"
-					err := buildAnimatedWebp(
-						cacheDir,
-						webpPath,
-						func() []uint {
-							d := make([]uint, len(gifFrames.Delay))
-							for i, v := range gifFrames.Delay {
-								d[i] = uint(v) * 10
-							}
-							return d
-						}(),
-						func() []uint {
-							d := make([]uint, len(gifFrames.Disposal))
-							for i, v := range gifFrames.Disposal {
-								d[i] = uint(v)
-							}
-							return d
-						}(),
-						uint16(gifFrames.LoopCount),
-						0xffffffff,
-					)
-					if err != nil {
-						fmt.Printf("❌ Error build animated WebP: %v\n", err)
-						return err
-					}
-					deleteCache(cacheDir)
-					fmt.Printf("✅ Converted (experimental): %s -> %s\n", relPath, filepath.Base(webpPath))
-					return nil
-				} else {
-					img, err = gif.Decode(in)
+	}
+	outputs, err := loadMapping(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", mapFileName, err)
+		return nil, err
+	}
+	runs, err := loadRunLog(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", runLogName, err)
+		return nil, err
+	}
+	if err := checkSettings(root, outputs, runs, overrides, opts, sum); err != nil {
+		return nil, err
+	}
+	run := runs.start(time.Now())
+	run.Root, _ = filepath.Abs(root)
+	con := newConsole(stdout, stdoutTTY)
+	prog := opts.progress
+	tree := osTree(root)
+	sel := &selector{opts, outputs, icons, referenced, changed, collisions, outputs.writtenOutputs(), tree, tree}
+	prog.runStarted(len(images))
+	r := &convertRun{root: root, src: tree, dst: tree, outRoot: root, cacheDir: filepath.Join(root, ".webcon_cache"), opts: opts, sum: sum, thr: thr, overrides: overrides, encoded: map[string]encodedOutput{},
+		sel: sel, collisions: collisions, filter: filter, hashes: hashes, outputs: outputs, runs: runs, run: run, bin: bin,
+		con: con, prog: prog, runStart: time.Now()}
+	// convert is r.visit, pausing the run when the disk fills up and trying
+	// the file again once there is room. Given up on, the file and all after
+	// it are left for the next run. Files in use by another program are
+	// put off until the end of the run, and tried once more then.
+	var full *diskFullError
+	var inUse []string // Paths put off, or still in use when retrying
+	retrying := false
+	convert := func(path string, info os.FileInfo, err error) error {
+		for {
+			ferr := r.visit(path, info, err)
+			var busy *inUseError
+			if errors.As(ferr, &busy) {
+				if retrying {
+					sum.inUse = append(sum.inUse, filepath.ToSlash(busy.relPath))
+					prog.fileFinished(busy.relPath, "skipped", skipInUse, busy.size, 0, nil)
+					sum.addToGroup(busy.relPath, "skipped", busy.size, 0, false)
 				}
-			} else {
-				img, err = gif.Decode(in)
+				inUse = append(inUse, path)
+				return nil
 			}
-		case ".tiff":
-			img, err = tiff.Decode(in)
-		default:
+			if !errors.As(ferr, &full) {
+				return ferr
+			}
+			r.started--
+			if !opts.noPauseOnENOSPC && waitForSpace(con, root, full.size, sum.outputSize, opts.diskFullTimeout) {
+				continue
+			}
+			sum.stopped = "disk full at " + mountPoint(root)
+			con.printf("⏸️  Stopped, %s, leaving %s and the remaining files for the next run\n", sum.stopped, full.relPath)
+			sum.remaining++
+			prog.fileFinished(full.relPath, "skipped", skipNotAttempted, full.size, 0, nil)
+			sum.addToGroup(full.relPath, "skipped", full.size, 0, false)
 			return nil
 		}
-		if err != nil {
-			fmt.Printf("❌ Error decoding image %s: %v\n", bakPath, err)
-			return err
+	}
+	if opts.filesFrom != "" {
+		// The listed files only, in the order given
+		for _, src := range sources {
+			info, serr := fs.Stat(tree, treeName(src.rel))
+			if serr != nil {
+				continue // Gone since the list was read
+			}
+			path := filepath.Join(root, src.rel)
+			if err = convert(path, info, nil); err != nil {
+				break
+			}
+		}
+	} else if opts.streamingWalk {
+		stop := make(chan struct{})
+		found := 0
+		for e := range streamWalk(root, opts, stop) {
+			if e.info != nil && !e.info.IsDir() {
+				rel, _ := filepath.Rel(root, e.path)
+				if ext, ok := opts.sourceExt(e.info.Name(), rel); ok && ext != ".webp" {
+					found++
+				}
+				if e.collision != nil {
+					collisions[pathKey(rel)] = e.collision
+				}
+			}
+			// Pruned folders have been left out by streamWalk already
+			if err = convert(e.path, e.info, e.err); err == filepath.SkipDir {
+				err = nil
+			}
+			if err != nil {
+				break
+			}
+		}
+		close(stop)
+		if err == nil {
+			prog.scanFinished(found)
+		}
+	} else {
+		err = r.walk(convert)
+	}
+	if err == nil && len(inUse) > 0 {
+		con.printf("🔒 Trying the %d file(s) that were in use again\n", len(inUse))
+		pending := inUse
+		retrying, inUse = true, nil
+		for _, path := range pending {
+			info, serr := fs.Stat(tree, r.name(path))
+			if serr != nil {
+				continue // Gone since
+			}
+			if err = convert(path, info, nil); err != nil {
+				break
+			}
+		}
+	}
+	con.close()
+	if err == nil && full != nil {
+		err = fmt.Errorf("stopped when the disk filled up: %v", full.err)
+	}
+	if err == nil && opts.convertDataURIs {
+		err = convertDataURIs(root, opts)
+	}
+	if err == nil && opts.rewriteRefs {
+		if opts.fw != nil {
+			outputs.keepRef = opts.fw.keepsRefs
+		}
+		outputs.picture = opts.emitPicture
+		err = rewriteRefs(root, outputs, opts.addDimensions)
+	}
+	if err == nil && opts.spotCheck > 0 {
+		err = spotCheck(root, run, outputs, opts)
+	}
+	if serr := outputs.save(); serr != nil {
+		fmt.Fprintf(stdout, "❌ Error writing %s: %v\n", mapFileName, serr)
+		if err == nil {
+			err = serr
+		}
+	}
+	if serr := runs.save(); serr != nil {
+		fmt.Fprintf(stdout, "❌ Error writing %s: %v\n", runLogName, serr)
+		if err == nil {
+			err = serr
+		}
+	}
+	if opts.timingsCSV != "" {
+		if terr := writeTimingsCSV(opts.timingsCSV, sum.timings); terr != nil {
+			fmt.Fprintf(stdout, "⚠️  Could not write %s: %v\n", opts.timingsCSV, terr)
 		}
+	}
+	sum.print()
+	if len(sum.timedOut) > 0 && err == nil {
+		err = fmt.Errorf("%d file(s) exceeded --file-timeout %s", len(sum.timedOut), opts.fileTimeout)
+	}
+	if len(sum.lowSSIM) > 0 && err == nil {
+		err = fmt.Errorf("%d file(s) below --min-ssim %g", len(sum.lowSSIM), opts.minSSIM)
+	}
+	h := historyRecord{Command: "convert", Options: opts.flags, Files: sum.converted,
+		SourceSize: sum.sourceSize, OutputSize: sum.outputSize, Savings: sum.sourceSize - sum.outputSize}
+	if sum.converted > 0 {
+		h.Run = run.ID
+	}
+	appendHistory(root, h, err)
+	prog.runFinished(sum.json(), err)
+	if opts.postRunHook != "" {
+		if herr := runHook(opts.postRunHook, nil, sum.json(), opts.hookTimeout); herr != nil {
+			fmt.Fprintf(stdout, "⚠️  Post-run hook failed: %v\n", herr)
+			if opts.hookStrict && err == nil {
+				err = herr
+			}
+		}
+	}
+	report := sum.report()
+	return &report, err
+}
 
-		webpPath := path[:len(path)-len(ext)] + ".webp"
-		outFile, err := os.Create(webpPath)
-		if err != nil {
-			fmt.Printf("❌ Error creating WebP file %s: %v\n", webpPath, err)
-			return err
+// decodeOriginal decodes the original of a file from in, read from bakPath.
+// Animated GIFs, with --enable-gif, come with all their frames, and what was
+// repaired to read them, see repairGIF. Images using features the decoders
+// lack go to --external-decoder, when there is one.
+func decodeOriginal(in io.Reader, bakPath, ext string, external bool, opts options) (img image.Image, frames *gif.GIF, repairs []string, err error) {
+	switch {
+	case ext == ".gif" && opts.enableGif:
+		if frames, repairs, err = decodeGIFFrames(in); err == nil {
+			img = frames.Image[0]
 		}
-		defer outFile.Close()
+	case external:
+		img, err = decodeExternal(opts.externalDecoder, bakPath, opts.hookTimeout)
+	default:
+		img, err = decodeSized(in, ext, opts)
+	}
+	if reason := unsupportedReason(err); reason != "" && opts.externalDecoder != "" && !external {
+		img, err = decodeExternal(opts.externalDecoder, bakPath, opts.hookTimeout)
+	}
+	return img, frames, repairs, err
+}
 
-		if err := webp.Encode(outFile, img, &webp.Options{Quality: 80}); err != nil {
-			fmt.Printf("❌ Error encoding WebP for %s: %v\n", bakPath, err)
-			return err
+// encodeAnimation encodes the frames of g to an animated WebP at animPath,
+// working in cacheDir. It returns the animation as encoded, whose frames are
+// nil for a palette animation written as it is, and which encoding was used.
+// Errors have been logged to out, but for a crash on frames the checks let
+// through, which gives a malformedGIFError.
+func encodeAnimation(out *fileLog, g *gif.GIF, cacheDir, animPath string, opts options, thr *throttle) (anim gifAnimation, encoding string, err error) {
+	defer func() {
+		if p := recover(); p != nil {
+			err = &malformedGIFError{fmt.Errorf("crashed on its frames: %v", p)}
+		}
+	}()
+	encoding = lossyEncoding
+	if opts.exact || !opts.enc.lossy() {
+		encoding = losslessEncoding
+	}
+	anim = gifAnimation{width: g.Config.Width, height: g.Config.Height}
+	if paletteAnimation(g, opts) {
+		if err := buildPaletteWebp(g, animPath, opts.enc); err != nil {
+			out.printf("❌ Error build animated WebP: %v\n", err)
+			return anim, "", err
 		}
+		return anim, paletteEncoding, nil
+	}
+	anim = prepareGIF(g, opts)
+	if err := anim.writeFrames(cacheDir); err != nil {
+		out.printf("❌ Error extracting GIF frame: %v\n", err)
+		return anim, "", err
+	}
+	for i := range anim.frames {
+		pngPath := filepath.Join(cacheDir, fmt.Sprintf("frame_%02d.png", i))
+		webpPath := filepath.Join(cacheDir, fmt.Sprintf("frame_%02d.webp", i))
+		if err := frameCompress(pngPath, webpPath, 60, opts); err != nil {
+			out.printf("❌ Error compressing frame to WebP (frame %d): %v\n", i, err)
+			return anim, "", err
+		}
+		thr.pause()
+	}
+	err = buildAnimatedWebp(
+		cacheDir,
+		animPath,
+		anim.delays,
+		anim.disposals,
+		uint16(g.LoopCount),
+		0xffffffff,
+		opts.enc,
+	)
+	if err != nil {
+		out.printf("❌ Error build animated WebP: %v\n", err)
+		return anim, "", err
+	}
+	return anim, encoding, nil
+}
 
-		fmt.Printf("✅ Converted: %s -> %s\n", relPath, filepath.Base(webpPath))
-		return nil
-	})
+// revertResult is what a revert did, by slash-separated original path.
+type revertResult struct {
+	Restored      int      // From the backup or rebuilt
+	Reconstructed []string // Rebuilt from their WebP with revertFromWebP
+	NoBackup      []string // WebP files left in place, with no backup
+	Trashed       []string // Moved to the trash by --trash
 }
 
+// revertMode is what revert does with the WebP files whose original has no
+// backup.
+type revertMode int
+
+const (
+	revertFromBackup revertMode = iota // Leave them, restoring from the backup only
+	revertFromWebP                     // Rebuild their originals from them, see reconstructOriginal
+)
+
+// revertImages reverts the images under root from the backup, see runRevert.
 func revertImages(root string) error {
+	_, err := runRevert(root, revertFromBackup)
+	return err
+}
+
+// runRevert restores every original from the backup and deletes the WebP
+// files. WebP files with no backup are left as they are, or have their
+// originals rebuilt from them with revertFromWebP.
+func runRevert(root string, mode revertMode) (res revertResult, err error) {
+	defer func() { appendHistory(root, historyRecord{Command: "revert", Files: res.Restored}, err) }()
+
+	outputs, err := loadMapping(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", mapFileName, err)
+		return res, err
+	}
 	backupRoot := filepath.Join(root, ".webpcon_backup")
-	return filepath.Walk(backupRoot, func(bakPath string, info os.FileInfo, err error) error {
+	backedUp := map[string]bool{} // Restored from the backup, by pathKey
+	err = filepath.Walk(backupRoot, func(bakPath string, info os.FileInfo, err error) error {
 		if err != nil {
 			return nil
 		}
 		if info.IsDir() {
+			// Later originals of the same file; the oldest one is restored
+			if bakPath == filepath.Join(backupRoot, runsDir) || bakPath == filepath.Join(backupRoot, supersededDir) {
+				return filepath.SkipDir
+			}
 			return nil
 		}
 
 		ext := strings.ToLower(filepath.Ext(info.Name()))
-		if !imageExt[ext] {
+		if !imageExt[ext] && !refFileExt[ext] {
 			return nil
 		}
 
 		relPath, err := filepath.Rel(backupRoot, bakPath)
 		if err != nil {
-			fmt.Printf("❌ Error getting relative path for %s: %v\n", bakPath, err)
+			fmt.Fprintf(stdout, "❌ Error getting relative path for %s: %v\n", bakPath, err)
 			return err
 		}
 		origPath := filepath.Join(root, relPath)
-		webpPath := origPath[:len(origPath)-len(ext)] + ".webp"
 
-		if _, err := os.Stat(webpPath); err == nil {
-			if err := os.Remove(webpPath); err != nil {
-				fmt.Printf("❌ Failed to delete %s: %v\n", webpPath, err)
+		// Source files changed by --rewrite-refs. Their backup is dropped once
+		// restored so a later run backs up the file as it is then.
+		if refFileExt[ext] {
+			if err := copyFileWith(bakPath, origPath, copyOptions{sync: true}); err != nil {
+				fmt.Fprintf(stdout, "❌ Error restoring %s: %v\n", origPath, err)
 				return err
 			}
-			fmt.Printf("🗑️  Deleted: %s\n", webpPath)
-		}
-
-		origDir := filepath.Dir(origPath)
-		if err := os.MkdirAll(origDir, 0755); err != nil {
-			fmt.Printf("❌ Error creating directory %s: %v\n", origDir, err)
-			return err
+			os.Remove(longPath(bakPath))
+			fmt.Fprintf(stdout, "✅ Restored: %s\n", relPath)
+			return nil
 		}
-		if err := copyFile(bakPath, origPath); err != nil {
-			fmt.Printf("❌ Error restoring %s: %v\n", origPath, err)
+		if err := restoreImage(root, relPath, bakPath, webpFor(root, relPath, outputs)); err != nil {
 			return err
 		}
-		fmt.Printf("✅ Restored: %s\n", relPath)
+		backedUp[pathKey(relPath)] = true
+		res.Restored++
 		return nil
 	})
-}
-
-// Helpers
-func gifExtractor(gifPath, cacheDir string) error {
-	f, err := os.Open(gifPath)
 	if err != nil {
-		return err
+		return res, err
 	}
-	defer f.Close()
-
-	gifFrames, err := gif.DecodeAll(f)
-	if err != nil {
-		return err
+	os.RemoveAll(longPath(filepath.Join(backupRoot, runsDir)))
+	os.Remove(longPath(filepath.Join(backupRoot, runLogName)))
+
+	// Originals sent to the trash by --trash have no backup. Their entries are
+	// kept in the map as the record of what happened to them, as are those of
+	// WebP files --from-webp couldn't rebuild.
+	kept := outputs.trashed()
+	for _, key := range outputs.keys() {
+		e := outputs.entries[key]
+		if backedUp[key] || e.Trashed || !fileExists(filepath.Join(root, filepath.FromSlash(e.WebP))) {
+			continue
+		}
+		if e.ExtensionFixed {
+			skip, err := renameBack(root, key, e)
+			if err != nil {
+				return res, err
+			}
+			if skip != "" {
+				fmt.Fprintf(stdout, "⏭️ Skipping %s (%s), %s stays\n", key, skip, e.WebP)
+				kept.entries[key] = e
+				continue
+			}
+			res.Restored++
+			continue
+		}
+		if mode != revertFromWebP {
+			res.NoBackup = append(res.NoBackup, key)
+			continue
+		}
+		skip, err := reconstructOriginal(root, filepath.FromSlash(key), e)
+		if err != nil {
+			fmt.Fprintf(stdout, "❌ Error rebuilding %s from %s: %v\n", key, e.WebP, err)
+			return res, err
+		}
+		if skip != "" {
+			fmt.Fprintf(stdout, "⏭️ Skipping %s (%s), %s stays\n", key, skip, e.WebP)
+			kept.entries[key] = e
+			continue
+		}
+		fmt.Fprintf(stdout, "✅ Rebuilt from %s (lossy reconstruction): %s\n", e.WebP, key)
+		res.Reconstructed = append(res.Reconstructed, key)
+		res.Restored++
 	}
-
-	if err := os.MkdirAll(cacheDir, 0755); err != nil {
-		return err
+	if len(res.Reconstructed) > 0 {
+		fmt.Fprintf(stdout, "⚠️  %d file(s) had no backup and were rebuilt from their WebP. They are lossy reconstructions, not the originals, which are gone:\n", len(res.Reconstructed))
+		for _, rel := range res.Reconstructed {
+			fmt.Fprintf(stdout, "   %s\n", rel)
+		}
+	}
+	if len(res.NoBackup) > 0 {
+		fmt.Fprintf(stdout, "⚠️  %d WebP file(s) have no backup of their original and were left as they are:\n", len(res.NoBackup))
+		for _, rel := range res.NoBackup {
+			fmt.Fprintf(stdout, "   %s\n", rel)
+		}
+	}
+	if res.Trashed = outputs.trashed().keys(); len(res.Trashed) > 0 {
+		fmt.Fprintf(stdout, "⚠️  %d file(s) were moved to the system trash with --trash and can't be reverted. Restore them from the trash and delete their WebP files by hand:\n", len(res.Trashed))
+		for _, rel := range res.Trashed {
+			fmt.Fprintf(stdout, "   %s\n", rel)
+		}
 	}
+	if len(kept.entries) > 0 {
+		if err := kept.save(); err != nil {
+			fmt.Fprintf(stdout, "❌ Error writing %s: %v\n", mapFileName, err)
+			return res, err
+		}
+		return res, nil
+	}
+	mapPath := filepath.Join(root, mapFileName)
+	if fileExists(mapPath) {
+		if err := os.Remove(longPath(mapPath)); err != nil {
+			fmt.Fprintf(stdout, "❌ Failed to delete %s: %v\n", mapPath, err)
+			return res, err
+		}
+		fmt.Fprintf(stdout, "🗑️  Deleted: %s\n", mapPath)
+	}
+	return res, nil
+}
 
-	for i, frame := range gifFrames.Image {
-		rgba := image.NewRGBA(frame.Bounds())
-		draw.Draw(rgba, frame.Bounds(), frame, image.Point{}, draw.Over)
-		framePath := filepath.Join(cacheDir, fmt.Sprintf("frame_%02d.png", i))
-		out, err := os.Create(framePath)
-		if err != nil {
+// restoreImage deletes webpPath, the WebP made from relPath (see webpFor),
+// with its placeholder, and copies the original back from bakPath.
+func restoreImage(root, relPath, bakPath, webpPath string) error {
+	origPath := filepath.Join(root, relPath)
+
+	if _, err := os.Stat(longPath(webpPath)); err == nil {
+		if err := os.Remove(longPath(webpPath)); err != nil {
+			fmt.Fprintf(stdout, "❌ Failed to delete %s: %v\n", webpPath, err)
 			return err
 		}
-		err = png.Encode(out, rgba)
-		out.Close()
-		if err != nil {
+		fmt.Fprintf(stdout, "🗑️  Deleted: %s\n", webpPath)
+	}
+	if thumb := placeholderPath(webpPath); fileExists(thumb) {
+		if err := os.Remove(longPath(thumb)); err != nil {
+			fmt.Fprintf(stdout, "❌ Failed to delete %s: %v\n", thumb, err)
 			return err
 		}
+		fmt.Fprintf(stdout, "🗑️  Deleted: %s\n", thumb)
 	}
+
+	origDir := filepath.Dir(origPath)
+	if err := os.MkdirAll(longPath(origDir), 0755); err != nil {
+		fmt.Fprintf(stdout, "❌ Error creating directory %s: %v\n", origDir, err)
+		return err
+	}
+	// The backup is removed with the run, so the restored file must be on disk
+	if err := copyFileWith(bakPath, origPath, copyOptions{sync: true}); err != nil {
+		fmt.Fprintf(stdout, "❌ Error restoring %s: %v\n", origPath, err)
+		return err
+	}
+	fmt.Fprintf(stdout, "✅ Restored: %s\n", relPath)
 	return nil
 }
 
-func frameCompress(pngPath, webpPath string, quality float32) error {
-	f, err := os.Open(pngPath)
+// Helpers
+func frameCompress(pngPath, webpPath string, quality float32, opts options) error {
+	f, err := os.Open(longPath(pngPath))
 	if err != nil {
 		return err
 	}
@@ -366,45 +797,194 @@ func frameCompress(pngPath, webpPath string, quality float32) error {
 	if err != nil {
 		return err
 	}
-	out, err := os.Create(webpPath)
+	out, err := os.Create(longPath(webpPath))
 	if err != nil {
 		return err
 	}
 	defer out.Close()
-	return webp.Encode(out, img, &webp.Options{Quality: quality})
+	if opts.grayscale {
+		img = toGrayscale(img)
+	}
+	if opts.exact {
+		return opts.enc.encode(out, straightNRGBA(img), encodeOptions{lossless: true, exact: true, effort: opts.effort})
+	}
+	return opts.enc.encode(out, img, encodeOptions{lossless: !opts.enc.lossy(), quality: quality, effort: opts.effort})
 }
 
-func buildAnimatedWebp(framesDir, outPath string, durations []uint, disposals []uint, loopCount uint16, bgColor uint32) error {
+func buildAnimatedWebp(framesDir, outPath string, durations []uint, disposals []uint, loopCount uint16, bgColor uint32, enc encoder) error {
 	frameCount := len(durations)
 	var images []image.Image
 	for i := 0; i < frameCount; i++ {
 		webpPath := filepath.Join(framesDir, fmt.Sprintf("frame_%02d.webp", i))
-		f, err := os.Open(webpPath)
+		f, err := os.Open(longPath(webpPath))
 		if err != nil {
 			return err
 		}
-		img, err := webp.Decode(f)
+		img, err := decodeWebP(f)
 		f.Close()
 		if err != nil {
 			return err
 		}
-		images = append(images, img)
+		images = append(images, toNRGBA(img))
 	}
-	ani := nativewebp.Animation{
-		Images:          images,
-		Durations:       durations,
-		Disposals:       disposals,
-		LoopCount:       loopCount,
-		BackgroundColor: bgColor,
-	}
-	out, err := os.Create(outPath)
+	out, err := os.Create(longPath(outPath))
 	if err != nil {
 		return err
 	}
 	defer out.Close()
-	return nativewebp.EncodeAll(out, &ani, nil)
+	return animationEncoderFor(enc).encodeAnimation(out, animation{
+		frames:     images,
+		durations:  durations,
+		disposals:  disposals,
+		loopCount:  loopCount,
+		background: bgColor,
+	})
 }
 
 func deleteCache(cacheDir string) error {
-	return os.RemoveAll(cacheDir)
+	return os.RemoveAll(longPath(cacheDir))
+}
+
+// prepareEncode decides how a static image is encoded. It returns the pixels to
+// hand to the encoder, the encoder settings and a short label of the mode used.
+func prepareEncode(img image.Image, opts options) (image.Image, encodeOptions, string) {
+	var steps []string
+	if opts.flatten != nil && !isOpaque(img) {
+		img = flattenOnto(img, *opts.flatten)
+		steps = append(steps, "flattened onto "+formatHexColor(*opts.flatten))
+	}
+	if opts.grayscale {
+		img = toGrayscale(img)
+		steps = append(steps, "grayscale")
+	}
+	px, encOpts, mode := chooseEncoding(img, opts)
+	return px, encOpts, strings.Join(append(steps, mode), ", ")
+}
+
+func chooseEncoding(img image.Image, opts options) (image.Image, encodeOptions, string) {
+	if opts.quantize != 0 {
+		if px, mode, ok := quantizeImage(img, opts); ok {
+			return px, encodeOptions{lossless: true, exact: opts.exact, effort: opts.effort}, mode
+		}
+	}
+	if opts.nearLossless >= 0 {
+		px := straightNRGBA(img)
+		applyNearLossless(px, opts.nearLossless)
+		return px, encodeOptions{lossless: true, exact: opts.exact, effort: opts.effort}, fmt.Sprintf("near-lossless %d", opts.nearLossless)
+	}
+	// A sidecar can turn lossless off again, but a lossless-only encoder can't follow
+	if opts.lossless || !opts.enc.lossy() {
+		if opts.exact {
+			return straightNRGBA(img), encodeOptions{lossless: true, exact: true, effort: opts.effort}, "lossless (exact)"
+		}
+		return straightNRGBA(img), encodeOptions{lossless: true, effort: opts.effort}, "lossless"
+	}
+	// libwebp only honours Exact for lossless encodes (lossy always cleans up
+	// transparent areas), so exact mode switches such images to lossless
+	if opts.exact && hasTransparentPixels(img) {
+		return straightNRGBA(img), encodeOptions{lossless: true, exact: true, effort: opts.effort}, "lossless (exact)"
+	}
+
+	mode := fmt.Sprintf("lossy q%g", opts.quality)
+	quantize := opts.alphaQuality < 100 && !isOpaque(img)
+	if !quantize && !opts.sharpYUV {
+		return img, encodeOptions{quality: opts.quality, effort: opts.effort}, mode
+	}
+	px := straightNRGBA(img)
+	if quantize {
+		quantizeAlpha(px, opts.alphaQuality)
+		mode += fmt.Sprintf(", alpha q%d", opts.alphaQuality)
+	}
+	if opts.sharpYUV {
+		applySharpYUV(px)
+		mode += ", sharp-yuv"
+	}
+	return px, encodeOptions{quality: opts.quality, effort: opts.effort}, mode
+}
+
+// flattenOnto composites img over a solid background color.
+func flattenOnto(img image.Image, bg color.NRGBA) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	draw.Draw(out, b, image.NewUniform(bg), image.Point{}, draw.Src)
+	draw.Draw(out, b, img, b.Min, draw.Over)
+	return out
+}
+
+// toGrayscale replaces each pixel with its Rec. 709 luma, keeping alpha.
+func toGrayscale(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			l := uint8(math.Round(0.2126*float64(c.R) + 0.7152*float64(c.G) + 0.0722*float64(c.B)))
+			out.SetNRGBA(x, y, color.NRGBA{l, l, l, c.A})
+		}
+	}
+	return out
+}
+
+func isOpaque(img image.Image) bool {
+	o, ok := img.(interface{ Opaque() bool })
+	return ok && o.Opaque()
+}
+
+// quantizeAlpha reduces the alpha channel to the number of levels libwebp uses
+// for the given alpha quality. The alpha plane is stored losslessly next to the
+// lossy RGB, so fewer levels directly means a smaller file.
+func quantizeAlpha(img *image.NRGBA, quality int) {
+	levels := 16 + (quality-70)*8
+	if quality <= 70 {
+		levels = 2 + quality/5
+	}
+	if levels >= 256 {
+		return
+	}
+	step := 255.0 / float64(levels-1)
+	for i := 3; i < len(img.Pix); i += 4 {
+		a := img.Pix[i]
+		if a == 0 || a == 255 {
+			continue
+		}
+		img.Pix[i] = uint8(math.Round(math.Round(float64(a)/step) * step))
+	}
+}
+
+func hasTransparentPixels(img image.Image) bool {
+	if isOpaque(img) {
+		return false
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a == 0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// straightNRGBA copies img into a new *image.NRGBA, which the helpers editing
+// samples in place work on. Converting through color.RGBA would zero the RGB
+// of every fully transparent pixel.
+func straightNRGBA(img image.Image) *image.NRGBA {
+	b := img.Bounds()
+	out := image.NewNRGBA(b)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			out.SetNRGBA(x, y, color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA))
+		}
+	}
+	return out
+}
+
+// toNRGBA returns img as *image.NRGBA, the only layout nativewebp accepts,
+// converting it unless it already is one.
+func toNRGBA(img image.Image) *image.NRGBA {
+	if m, ok := img.(*image.NRGBA); ok {
+		return m
+	}
+	return straightNRGBA(img)
 }
@@ -0,0 +1,392 @@
+package webpcon
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io/fs"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// quietly sends the log to the buffer returned until the test ends.
+func quietly(tb testing.TB) *bytes.Buffer {
+	tb.Helper()
+	var log bytes.Buffer
+	saved, savedTTY := stdout, stdoutTTY
+	stdout, stdoutTTY = &log, false
+	tb.Cleanup(func() { stdout, stdoutTTY = saved, savedTTY })
+	return &log
+}
+
+// treeFiles returns the contents of the files under root, by slash-separated
+// relative path.
+func treeFiles(tb testing.TB, root string) map[string][]byte {
+	tb.Helper()
+	files := map[string][]byte{}
+	err := filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() {
+			return err
+		}
+		data, err := os.ReadFile(path)
+		rel, _ := filepath.Rel(root, path)
+		files[filepath.ToSlash(rel)] = data
+		return err
+	})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return files
+}
+
+// convertTree converts root with opts, failing the test on an error.
+func convertTree(tb testing.TB, root string, opts options) *summaryJSON {
+	tb.Helper()
+	sum, err := runConvert(root, opts)
+	if err != nil {
+		tb.Fatalf("convert %+v: %v", opts, err)
+	}
+	return sum
+}
+
+// testOptions parses args as the command line would.
+func testOptions(tb testing.TB, args ...string) options {
+	tb.Helper()
+	opts, err := parseOptions(args)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return opts
+}
+
+// readMapFile reads the map file under root.
+func readMapFile(tb testing.TB, root string) map[string]*mapEntry {
+	tb.Helper()
+	m, err := loadMapping(root)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return m.entries
+}
+
+// checkReverted checks that the files under root are those of before, byte
+// for byte, besides the backup folder.
+func checkReverted(t *testing.T, root string, before map[string][]byte) {
+	t.Helper()
+	after := treeFiles(t, root)
+	for rel, data := range before {
+		if got, ok := after[rel]; !ok {
+			t.Errorf("%s is gone after revert", rel)
+		} else if !bytes.Equal(got, data) {
+			t.Errorf("%s changed after revert", rel)
+		}
+	}
+	for rel := range after {
+		if _, ok := before[rel]; !ok && !strings.HasPrefix(rel, ".webpcon_backup/") {
+			t.Errorf("%s is left after revert", rel)
+		}
+	}
+}
+
+// goldenReport renders what a conversion left: the files, the map file
+// entries without what changes from run to run, and the summary.
+func goldenReport(tb testing.TB, root string, sum *summaryJSON) []byte {
+	tb.Helper()
+	var b bytes.Buffer
+	fmt.Fprintln(&b, "# files")
+	files := treeFiles(tb, root)
+	for _, rel := range slices.Sorted(maps.Keys(files)) {
+		fmt.Fprintln(&b, rel)
+	}
+	fmt.Fprintln(&b, "# map")
+	entries := readMapFile(tb, root)
+	for _, key := range slices.Sorted(maps.Keys(entries)) {
+		e := entries[key]
+		fmt.Fprintf(&b, "%s -> %s %dx%d", key, e.WebP, e.Width, e.Height)
+		if e.Renamed {
+			fmt.Fprint(&b, " renamed")
+		}
+		if e.Preset != "" {
+			fmt.Fprintf(&b, " preset=%s", e.Preset)
+		}
+		fmt.Fprintln(&b)
+	}
+	fmt.Fprintln(&b, "# summary")
+	data, err := json.MarshalIndent(sum, "", "  ")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	b.Write(data)
+	b.WriteByte('\n')
+	return b.Bytes()
+}
+
+// checkGolden compares got with testdata/name, or rewrites it with -update.
+func checkGolden(t *testing.T, name string, got []byte) {
+	t.Helper()
+	path := filepath.Join("testdata", name)
+	if *update {
+		if err := os.MkdirAll("testdata", 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, got, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	want, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("%v (go test -update writes it)", err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("%s differs, go test -update rewrites it:\n--- got\n%s\n--- want\n%s", path, got, want)
+	}
+}
+
+func TestConvertStatusRevert(t *testing.T) {
+	log := quietly(t)
+	root := writeFixtureTree(t, fixtureTree(t))
+	before := treeFiles(t, root)
+
+	sum := convertTree(t, root, testOptions(t, "--encoder", "native"))
+	checkGolden(t, "convert.golden", goldenReport(t, root, sum))
+
+	log.Reset()
+	if err := showStatus(root); err != nil {
+		t.Fatal(err)
+	}
+	if want := fmt.Sprintf("📋 %d converted image(s)", sum.Converted); !strings.Contains(log.String(), want) {
+		t.Errorf("status printed %q, want it to start with %q", log.String(), want)
+	}
+	outputs, _ := loadMapping(root)
+	runs, _ := loadRunLog(root)
+	if check := checkBackups(root, outputs, runs); len(check.stranded) > 0 || len(check.unrecoverable) > 0 {
+		t.Errorf("status found stranded backups %v and unrecoverable outputs %v", check.stranded, check.unrecoverable)
+	}
+
+	res, err := runRevert(root, revertFromBackup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Restored != sum.Converted || len(res.NoBackup) > 0 {
+		t.Errorf("revert restored %d of %d, %d without a backup", res.Restored, sum.Converted, len(res.NoBackup))
+	}
+	checkReverted(t, root, before)
+}
+
+func TestConvertTwice(t *testing.T) {
+	quietly(t)
+	root := writeFixtureTree(t, fixtureTree(t))
+	first := convertTree(t, root, testOptions(t, "--encoder", "native"))
+	entries := readMapFile(t, root)
+	second := convertTree(t, root, testOptions(t, "--encoder", "native"))
+	if second.Converted != 0 {
+		t.Errorf("second run converted %d file(s), want 0", second.Converted)
+	}
+	if got := readMapFile(t, root); len(got) != len(entries) || len(got) != first.Converted {
+		t.Errorf("map has %d entries after two runs, %d after one, %d converted", len(got), len(entries), first.Converted)
+	}
+}
+
+// TestExcludeRegex converts a small tree with each set of --exclude-regex
+// patterns and checks which files are left as they were.
+func TestExcludeRegex(t *testing.T) {
+	files := []fixtureFile{
+		{"a.png", encodeFixture(t, ".png", 8, 8)},
+		{"build/app.a1b2c3d4.png", encodeFixture(t, ".png", 8, 8)},
+		{"img/old.jpg", encodeFixture(t, ".jpg", 8, 8)},
+		{"img/sub/b.png", encodeFixture(t, ".png", 8, 8)},
+	}
+	for _, tt := range []struct {
+		name     string
+		patterns []string
+		left     []string // Sources left unconverted
+	}{
+		{"none", nil, nil},
+		{"hashed build output", []string{`\.[0-9a-f]{8}\.png$`}, []string{"build/app.a1b2c3d4.png"}},
+		{"folder", []string{`^img/`}, []string{"img/old.jpg", "img/sub/b.png"}},
+		{"repeated", []string{`^build/`, `(^|/)old\.jpg$`}, []string{"build/app.a1b2c3d4.png", "img/old.jpg"}},
+		{"no match", []string{`^docs/`}, nil},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			quietly(t)
+			root := writeFixtureTree(t, files)
+			var args []string
+			for _, p := range tt.patterns {
+				args = append(args, "--exclude-regex", p)
+			}
+			convertTree(t, root, testOptions(t, append(args, "--encoder", "native")...))
+			after := treeFiles(t, root)
+			for _, f := range files {
+				left := slices.Contains(tt.left, f.rel)
+				if _, ok := after[f.rel]; ok != left {
+					t.Errorf("%s left in place: %v, want %v", f.rel, ok, left)
+				}
+			}
+		})
+	}
+
+	if _, err := parseOptions([]string{"--exclude-regex", "("}); err == nil {
+		t.Error("an invalid --exclude-regex accepted")
+	}
+}
+
+// TestExcludeRegexOrder checks where --exclude-regex applies: after the
+// folders the walk always skips, before every other filter, so an excluded
+// file is neither counted by them nor part of a collision.
+func TestExcludeRegexOrder(t *testing.T) {
+	files := []fixtureFile{
+		{"img/logo.png", encodeFixture(t, ".png", 8, 8)},
+		{"img/old.jpeg", encodeFixture(t, ".jpg", 8, 8)},
+		{"tiny/dot.png", encodeFixture(t, ".png", 2, 2)},
+		{"node_modules/pkg/icon.png", encodeFixture(t, ".png", 8, 8)},
+		{"collide/pic.jpg", encodeFixture(t, ".jpg", 8, 8)},
+		{"collide/pic.png", encodeFixture(t, ".png", 8, 8)},
+		{"collide/Case.png", encodeFixture(t, ".png", 8, 8)},
+		{"collide/case.png", encodeFixture(t, ".png", 8, 8)},
+	}
+	convert := func(patterns ...string) (root, log string) {
+		buf := quietly(t)
+		root = writeFixtureTree(t, files)
+		old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+		if err := os.Chtimes(filepath.Join(root, "img", "old.jpeg"), old, old); err != nil {
+			t.Fatal(err)
+		}
+		args := []string{"--encoder", "native", "--since", "2024-01-01", "--min-width", "4"}
+		for _, p := range patterns {
+			args = append(args, "--exclude-regex", p)
+		}
+		convertTree(t, root, testOptions(t, args...))
+		return root, buf.String()
+	}
+
+	// Without the patterns, each file is caught by its own filter
+	_, log := convert()
+	for _, want := range []string{
+		"1 file(s) skipped as too small",
+		"1 file(s) left untouched as modified before --since",
+		"2 group(s) of files would share a WebP file",
+	} {
+		if !strings.Contains(log, want) {
+			t.Errorf("without --exclude-regex, the log doesn't say %q:\n%s", want, log)
+		}
+	}
+
+	root, log := convert(`^tiny/`, `(^|/)old\.jpeg$`, `^collide/pic\.png$`)
+	for _, counted := range []string{"too small", "before --since"} {
+		if strings.Contains(log, counted) {
+			t.Errorf("excluded files counted as %s:\n%s", counted, log)
+		}
+	}
+	if !strings.Contains(log, "1 group(s) of files would share a WebP file") {
+		t.Errorf("want only Case.png and case.png to collide:\n%s", log)
+	}
+	entries := readMapFile(t, root)
+	if entries["collide/pic.jpg"] == nil {
+		t.Error("collide/pic.jpg not converted once the other pic was excluded")
+	}
+	for _, rel := range []string{"collide/pic.png", "img/old.jpeg", "node_modules/pkg/icon.png"} {
+		if entries[rel] != nil {
+			t.Errorf("%s converted", rel)
+		}
+	}
+}
+
+// TestConvertJPEGNames converts JPEGs under every name webpcon takes for
+// them, in any case: the WebP names cut off the whole extension, whatever
+// its length, and revert puts back the original names.
+func TestConvertJPEGNames(t *testing.T) {
+	quietly(t)
+	jpg := encodeFixture(t, ".jpg", 16, 12)
+	root := writeFixtureTree(t, []fixtureFile{
+		{"a.jpg", jpg},
+		{"b.jpeg", jpg},
+		{"c.jpe", jpg},
+		{"d.jfif", jpg},
+		{"sub/E.JPE", jpg},
+		{"sub/F.JFIF", jpg},
+		{"sub/h.jfi", jpg},
+	})
+	before := treeFiles(t, root)
+	convertTree(t, root, testOptions(t, "--encoder", "native"))
+	entries := readMapFile(t, root)
+	want := map[string]string{
+		"a.jpg": "a.webp", "b.jpeg": "b.webp", "c.jpe": "c.webp", "d.jfif": "d.webp",
+		"sub/E.JPE": "sub/E.webp", "sub/F.JFIF": "sub/F.webp",
+	}
+	if len(entries) != len(want) {
+		t.Errorf("%d file(s) converted, want %d", len(entries), len(want))
+	}
+	for src, webp := range want {
+		if e := entries[src]; e == nil || e.WebP != webp {
+			t.Errorf("%s converted to %+v, want %s", src, e, webp)
+		}
+	}
+	if err := revertImages(root); err != nil {
+		t.Fatal(err)
+	}
+	checkReverted(t, root, before)
+}
+
+// TestRevertFromWebP deletes the backup after converting: a plain revert
+// leaves the WebP files, and revert --from-webp rebuilds the originals from
+// them, in their own format and size.
+func TestRevertFromWebP(t *testing.T) {
+	quietly(t)
+	var files []fixtureFile
+	for _, ext := range []string{".png", ".jpg", ".gif", ".bmp", ".tiff"} {
+		files = append(files, fixtureFile{"img/" + ext[1:] + ext, encodeFixture(t, ext, 20, 10)})
+	}
+	root := writeFixtureTree(t, files)
+	convertTree(t, root, testOptions(t, "--encoder", "native"))
+	if err := os.RemoveAll(filepath.Join(root, ".webpcon_backup")); err != nil {
+		t.Fatal(err)
+	}
+
+	plain := t.TempDir()
+	if err := os.CopyFS(plain, os.DirFS(root)); err != nil {
+		t.Fatal(err)
+	}
+	res, err := runRevert(plain, revertFromBackup)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.NoBackup) != len(files) {
+		t.Errorf("plain revert listed %q with no backup, want all %d", res.NoBackup, len(files))
+	}
+	for _, f := range files {
+		if !fileExists(filepath.Join(plain, strings.TrimSuffix(f.rel, filepath.Ext(f.rel))+".webp")) {
+			t.Errorf("plain revert deleted the WebP of %s, which has no backup", f.rel)
+		}
+	}
+
+	if res, err = runRevert(root, revertFromWebP); err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Reconstructed) != len(files) {
+		t.Errorf("rebuilt %q, want all %d", res.Reconstructed, len(files))
+	}
+	after := treeFiles(t, root)
+	for _, f := range files {
+		if _, ok := after[strings.TrimSuffix(f.rel, filepath.Ext(f.rel))+".webp"]; ok {
+			t.Errorf("WebP of %s left after --from-webp", f.rel)
+		}
+		img, err := decodeImage(bytes.NewReader(after[f.rel]), filepath.Ext(f.rel))
+		if err != nil {
+			t.Errorf("%s: %v", f.rel, err)
+		} else if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 10 {
+			t.Errorf("%s rebuilt at %v, want 20x10", f.rel, b)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, mapFileName)); !os.IsNotExist(err) {
+		t.Errorf("map file left after rebuilding every original: %v", err)
+	}
+}
@@ -0,0 +1,197 @@
+package webpcon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io/fs"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// mapFileName is the JSON file at the project root recording every converted
+// image, keyed by its original path relative to the root (see pathKey), so build tooling can look up outputs and their metadata.
+const mapFileName = "webpcon-map.json"
+
+// pathKey is how a relative path is compared and stored in the map: forward
+// slashes and Unicode NFC. macOS keeps accented names decomposed (NFD) on disk
+// while editors write them composed, so both forms must find the same entry.
+// File operations keep using the name as found on disk.
+func pathKey(relPath string) string {
+	return norm.NFC.String(filepath.ToSlash(relPath))
+}
+
+// mapEntry describes the output of one converted source image.
+type mapEntry struct {
+	WebP             string   `json:"webp"`
+	Width            int      `json:"width,omitempty"` // Of the WebP, after any resizing
+	Height           int      `json:"height,omitempty"`
+	AspectRatio      float64  `json:"aspectRatio,omitempty"` // Width / height, rounded to 4 decimals
+	BlurHash         string   `json:"blurhash,omitempty"`
+	Placeholder      string   `json:"placeholder,omitempty"` // data: URI of a tiny WebP thumbnail
+	Trashed          bool     `json:"trashed,omitempty"`     // Original went to the system trash (--trash), not the backup
+	Run              string   `json:"run,omitempty"`         // ID of the run that converted it, see runLog
+	ConvertedAt      string   `json:"convertedAt,omitempty"` // RFC 3339
+	PSNR             float64  `json:"psnr,omitempty"`        // Against the source, in dB (--metrics)
+	SSIM             float64  `json:"ssim,omitempty"`
+	SHA256           string   `json:"sha256,omitempty"`           // Of the WebP file, hex
+	Fallback         string   `json:"fallback,omitempty"`         // Downsized copy in the original format, written in its place (--fallback)
+	SupersededBackup string   `json:"supersededBackup,omitempty"` // An earlier backup of a different version, see supersededDir
+	Options          string   `json:"options,omitempty"`          // The settings it was encoded with, see encodeKey
+	Preset           string   `json:"preset,omitempty"`           // The preset they were filled from, by --preset or an override
+	Renamed          bool     `json:"renamed,omitempty"`          // Named photo.jpg.webp by --on-conflict rename, see webpRef
+	Trim             *trimBox `json:"trim,omitempty"`             // Border cropped off by --trim, in source pixels
+	ExtensionFixed   bool     `json:"extensionFixed,omitempty"`   // WebP content only renamed to .webp, see misnamedWebP
+}
+
+// mapping is the in-memory copy of the map file. Entries from earlier runs
+// are kept so converting in several passes builds up one complete map.
+type mapping struct {
+	path    string
+	entries map[string]*mapEntry
+	keepRef func(relPath string) bool // References to these images aren't rewritten, see resolveRef
+	picture bool                      // HTML gets <picture> tags instead, see rewritePicture
+	onDisk  map[*mapEntry]bool        // Whether each entry's WebP exists, see written
+}
+
+func loadMapping(root string) (*mapping, error) {
+	return loadMappingFile(filepath.Join(root, mapFileName))
+}
+
+// loadMappingFile reads a map file from anywhere, like an older copy kept
+// from a previous deploy. A missing file reads as an empty map.
+func loadMappingFile(path string) (*mapping, error) {
+	data, err := os.ReadFile(longPath(path))
+	return readMapping(path, data, err)
+}
+
+// loadMappingFS reads the map file at the root of fsys, as loadMappingFile.
+func loadMappingFS(fsys fs.FS) (*mapping, error) {
+	data, err := fs.ReadFile(fsys, mapFileName)
+	return readMapping(mapFileName, data, err)
+}
+
+// readMapping makes the mapping of the map file at path from data, read
+// with err.
+func readMapping(path string, data []byte, err error) (*mapping, error) {
+	m := &mapping{path: path, entries: map[string]*mapEntry{}}
+	if errors.Is(err, fs.ErrNotExist) {
+		return m, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &m.entries); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// add records a conversion and returns its entry for filling in metadata.
+func (m *mapping) add(relPath, webpRel string) *mapEntry {
+	e := &mapEntry{WebP: filepath.ToSlash(webpRel)}
+	m.entries[pathKey(relPath)] = e
+	return e
+}
+
+// webpRef turns ref, a reference to e's source, into one to its WebP. Only
+// the extension changes, unless --on-conflict rename added it after the
+// source's own.
+func (e *mapEntry) webpRef(ref string) string {
+	if e.Renamed {
+		return ref + filepath.Ext(e.WebP)
+	}
+	return ref[:len(ref)-len(filepath.Ext(ref))] + filepath.Ext(e.WebP)
+}
+
+// setSize records the output dimensions.
+func (e *mapEntry) setSize(w, h int) {
+	e.Width, e.Height = w, h
+	if h > 0 {
+		e.AspectRatio = math.Round(float64(w)/float64(h)*1e4) / 1e4
+	}
+}
+
+// setQuality records the --metrics scores, rounded so reruns diff cleanly.
+func (e *mapEntry) setQuality(q *qualityScore) {
+	if q != nil {
+		e.PSNR = math.Round(q.psnr*100) / 100
+		e.SSIM = math.Round(q.ssim*1e4) / 1e4
+	}
+}
+
+func (m *mapping) get(relPath string) *mapEntry {
+	return m.entries[pathKey(relPath)]
+}
+
+// remove drops the entry of relPath, for a conversion rolled back.
+func (m *mapping) remove(relPath string) {
+	delete(m.entries, pathKey(relPath))
+}
+
+// written reports whether the WebP of e is on disk, looking once per entry.
+func (m *mapping) written(root string, e *mapEntry) bool {
+	if m.onDisk == nil {
+		m.onDisk = map[*mapEntry]bool{}
+	}
+	ok, seen := m.onDisk[e]
+	if !seen {
+		ok = fileExists(filepath.Join(root, filepath.FromSlash(e.WebP)))
+		m.onDisk[e] = ok
+	}
+	return ok
+}
+
+func (m *mapping) save() error {
+	if len(m.entries) == 0 {
+		return nil
+	}
+	data, err := m.marshal()
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(longPath(m.path), data, 0644)
+}
+
+// saveTo writes the map file to the root of t.
+func (m *mapping) saveTo(t Writer) error {
+	if len(m.entries) == 0 {
+		return nil
+	}
+	data, err := m.marshal()
+	if err != nil {
+		return err
+	}
+	return writeTreeFile(t, mapFileName, bytes.NewReader(data))
+}
+
+// marshal returns the map file's contents.
+func (m *mapping) marshal() ([]byte, error) {
+	data, err := json.MarshalIndent(m.entries, "", "  ")
+	return append(data, '\n'), err
+}
+
+// trashed returns a mapping holding only the entries whose original went to
+// the system trash.
+func (m *mapping) trashed() *mapping {
+	t := &mapping{path: m.path, entries: map[string]*mapEntry{}}
+	for k, e := range m.entries {
+		if e.Trashed {
+			t.entries[k] = e
+		}
+	}
+	return t
+}
+
+func (m *mapping) keys() []string {
+	keys := make([]string, 0, len(m.entries))
+	for k := range m.entries {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,66 @@
+package webpcon
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The two Unicode forms of café: composed, as editors write it, and
+// decomposed, as macOS keeps it on disk.
+const (
+	cafeNFC = "caf\u00e9"
+	cafeNFD = "cafe\u0301"
+)
+
+func TestPathKey(t *testing.T) {
+	for _, tt := range []struct{ rel, want string }{
+		{"img/" + cafeNFC + ".png", "img/" + cafeNFC + ".png"},
+		{"img/" + cafeNFD + ".png", "img/" + cafeNFC + ".png"},
+		{filepath.Join("img", cafeNFD, "logo.png"), "img/" + cafeNFC + "/logo.png"},
+		{"img/logo.png", "img/logo.png"},
+	} {
+		if got := pathKey(tt.rel); got != tt.want {
+			t.Errorf("pathKey(%+q) = %+q, want %+q", tt.rel, got, tt.want)
+		}
+	}
+}
+
+func TestMappingNormalForms(t *testing.T) {
+	for _, forms := range [][2]string{{cafeNFD, cafeNFC}, {cafeNFC, cafeNFD}} {
+		m := &mapping{entries: map[string]*mapEntry{}}
+		e := m.add("img/"+forms[0]+".png", "img/"+forms[0]+".webp")
+		if got := m.get("img/" + forms[1] + ".png"); got != e {
+			t.Errorf("added as %+q, not found as %+q", forms[0], forms[1])
+		}
+	}
+}
+
+// TestConvertNormalForms converts a decomposed name on disk referenced by
+// its composed form, as on macOS: the map key is composed, the files keep
+// the name found on disk, and the reference is rewritten.
+func TestConvertNormalForms(t *testing.T) {
+	root := writeFixtureTree(t, []fixtureFile{
+		{"img/" + cafeNFD + ".png", encodeFixture(t, ".png", 12, 10)},
+		{"index.html", []byte(`<img src="img/` + cafeNFC + `.png">` + "\n")},
+	})
+	before := treeFiles(t, root)
+	convertTree(t, root, testOptions(t, "--rewrite-refs"))
+
+	e := readMapFile(t, root)["img/"+cafeNFC+".png"]
+	if e == nil || e.WebP != "img/"+cafeNFD+".webp" {
+		t.Fatalf("map entry %+v, want the WebP under the name on disk", e)
+	}
+	files := treeFiles(t, root)
+	if _, ok := files["img/"+cafeNFD+".webp"]; !ok {
+		t.Error("no WebP under the decomposed name")
+	}
+	if html := string(files["index.html"]); !strings.Contains(html, ".webp") {
+		t.Errorf("composed reference not rewritten: %s", html)
+	}
+
+	if err := revertImages(root); err != nil {
+		t.Fatal(err)
+	}
+	checkReverted(t, root, before)
+}
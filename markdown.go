@@ -0,0 +1,163 @@
+package webpcon
+
+import (
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// markdownExt lists the files rewritten with rewriteMarkdown.
+var markdownExt = map[string]bool{".md": true, ".mdx": true, ".markdown": true}
+
+var (
+	// mdFence opens or closes a fenced code block.
+	mdFence = regexp.MustCompile("(?m)^ {0,3}(`{3,}|~{3,})")
+	// mdInline matches the start of an inline image or link up to its
+	// destination: ![alt](dest "title") or [text](<dest>).
+	mdInline = regexp.MustCompile(`(!?\[(?:[^\[\]\x00]|\[[^\[\]\x00]*\])*\]\(\s*)(<[^<>\n\x00]*>|[^\s()<>\x00]+)`)
+	// mdRefDef matches a reference definition up to its destination: [id]: dest
+	mdRefDef = regexp.MustCompile(`(?m)^( {0,3}\[[^\]\x00]+\]:[ \t]*\n?[ \t]*)(<[^<>\n\x00]*>|[^\s\x00]+)`)
+	// mdMasked is a placeholder for a code block or span taken out of the text.
+	mdMasked = regexp.MustCompile(`\x00(\d+)\x00`)
+)
+
+// rewriteMarkdown rewrites image references in Markdown (and MDX): inline
+// images and links, reference definitions and <img> tags. Only destinations
+// are touched, so alt text and titles stay as they are, and code blocks and
+// code spans are left alone.
+func (m *mapping) rewriteMarkdown(root, dir, text string, addDims bool) (string, int) {
+	text, code := maskMarkdownCode(text)
+
+	n := 0
+	dest := func(d string) string {
+		inner, angle := strings.CutPrefix(d, "<")
+		if angle {
+			inner = strings.TrimSuffix(inner, ">")
+		}
+		path, suffix := inner, ""
+		if i := strings.IndexAny(inner, "?#"); i >= 0 {
+			path, suffix = inner[:i], inner[i:]
+		}
+		ext := filepath.Ext(path)
+		if !imageExt[strings.ToLower(ext)] {
+			return d
+		}
+		e := m.resolveRef(root, dir, inner)
+		if e == nil {
+			return d
+		}
+		n++
+		out := e.webpRef(path) + suffix
+		if angle {
+			return "<" + out + ">"
+		}
+		return out
+	}
+	// The text of a link can hold an image, as linked badges do, so
+	// inline destinations are rewritten there too
+	var rewriteInline func(s string) string
+	rewriteInline = func(s string) string {
+		return mdInline.ReplaceAllStringFunc(s, func(match string) string {
+			sub := mdInline.FindStringSubmatch(match)
+			return rewriteInline(sub[1]) + dest(sub[2])
+		})
+	}
+	text = rewriteInline(text)
+	text = mdRefDef.ReplaceAllStringFunc(text, func(match string) string {
+		sub := mdRefDef.FindStringSubmatch(match)
+		return sub[1] + dest(sub[2])
+	})
+
+	if addDims {
+		text = m.addDimensions(root, dir, text)
+	}
+	text = imgTag.ReplaceAllStringFunc(text, func(tag string) string {
+		return srcAttr.ReplaceAllStringFunc(tag, func(attr string) string {
+			src := srcAttr.FindStringSubmatch(attr)[1]
+			return strings.Replace(attr, src, dest(src), 1)
+		})
+	})
+
+	return mdMasked.ReplaceAllStringFunc(text, func(p string) string {
+		i, _ := strconv.Atoi(p[1 : len(p)-1])
+		return code[i]
+	}), n
+}
+
+// maskMarkdownCode swaps fenced code blocks and code spans for placeholders,
+// so nothing inside them is rewritten, and returns them for putting back.
+func maskMarkdownCode(text string) (string, []string) {
+	var code []string
+	mask := func(s string) string {
+		code = append(code, s)
+		return "\x00" + strconv.Itoa(len(code)-1) + "\x00"
+	}
+
+	// Fenced blocks run to a closing fence of the same character that is at
+	// least as long, or to the end of the document
+	var b strings.Builder
+	for {
+		open := mdFence.FindStringSubmatchIndex(text)
+		if open == nil {
+			break
+		}
+		fence := text[open[2]:open[3]]
+		rest := open[1] + strings.IndexByte(text[open[1]:]+"\n", '\n')
+		end := len(text)
+		for _, c := range mdFence.FindAllStringSubmatchIndex(text[min(rest, len(text)):], -1) {
+			close := text[rest+c[2] : rest+c[3]]
+			if close[0] == fence[0] && len(close) >= len(fence) && strings.TrimSpace(lineAt(text, rest+c[3])) == "" {
+				end = rest + c[1] + len(lineAt(text, rest+c[1]))
+				break
+			}
+		}
+		b.WriteString(text[:open[0]])
+		b.WriteString(mask(text[open[0]:end]))
+		text = text[end:]
+	}
+	b.WriteString(text)
+	text = b.String()
+
+	// Code spans open and close with backtick runs of the same length
+	b.Reset()
+	for {
+		i := strings.IndexByte(text, '`')
+		if i < 0 {
+			break
+		}
+		run := len(text[i:]) - len(strings.TrimLeft(text[i:], "`"))
+		end := -1
+		for j := i + run; j < len(text); {
+			k := strings.IndexByte(text[j:], '`')
+			if k < 0 {
+				break
+			}
+			k += j
+			r := len(text[k:]) - len(strings.TrimLeft(text[k:], "`"))
+			if r == run {
+				end = k + r
+				break
+			}
+			j = k + r
+		}
+		if end < 0 {
+			b.WriteString(text[:i+run])
+			text = text[i+run:]
+			continue
+		}
+		b.WriteString(text[:i])
+		b.WriteString(mask(text[i:end]))
+		text = text[end:]
+	}
+	b.WriteString(text)
+	return b.String(), code
+}
+
+// lineAt returns the rest of the line starting at i, without the newline.
+func lineAt(text string, i int) string {
+	if j := strings.IndexByte(text[i:], '\n'); j >= 0 {
+		return text[i : i+j]
+	}
+	return text[i:]
+}
@@ -0,0 +1,138 @@
+package webpcon
+
+import "testing"
+
+// guideMarkdown has a reference of each kind Markdown has to the images of
+// the fixture, and fake paths in code the rewrite must leave alone.
+const guideMarkdown = "# Guide\n" +
+	"\n" +
+	"![Diagram](./img/diagram.png \"The diagram\") and ![](<img/with space.png>)\n" +
+	"[See the chart](img/chart.jpg?v=2#top), [![nested](img/diagram.png)](https://example.com/)\n" +
+	"![Reference][diagram] and ![missing](img/missing.png)\n" +
+	"\n" +
+	"[diagram]: img/diagram.png \"Title\"\n" +
+	"[chart]:\n" +
+	"    <img/chart.jpg>\n" +
+	"\n" +
+	"<img src=\"img/chart.jpg\" alt=\"img/diagram.png\">\n" +
+	"\n" +
+	"Inline `![code](img/diagram.png)` and ``a `tick` img/chart.jpg``.\n" +
+	"\n" +
+	"````md\n" +
+	"![fake](img/diagram.png)\n" +
+	"[fake]: img/chart.jpg\n" +
+	"```\n" +
+	"still code, neither fence closes it: ![fake](img/diagram.png)\n" +
+	"~~~~\n" +
+	"`````\n" +
+	"\n" +
+	"~~~\n" +
+	"<img src=\"img/chart.jpg\">\n" +
+	"~~~\n" +
+	"\n" +
+	"Plain text mentioning img/diagram.png stays.\n"
+
+const guideRewritten = "# Guide\n" +
+	"\n" +
+	"![Diagram](./img/diagram.webp \"The diagram\") and ![](<img/with space.webp>)\n" +
+	"[See the chart](img/chart.webp?v=2#top), [![nested](img/diagram.webp)](https://example.com/)\n" +
+	"![Reference][diagram] and ![missing](img/missing.png)\n" +
+	"\n" +
+	"[diagram]: img/diagram.webp \"Title\"\n" +
+	"[chart]:\n" +
+	"    <img/chart.webp>\n" +
+	"\n" +
+	"<img src=\"img/chart.webp\" alt=\"img/diagram.png\">\n" +
+	"\n" +
+	"Inline `![code](img/diagram.png)` and ``a `tick` img/chart.jpg``.\n" +
+	"\n" +
+	"````md\n" +
+	"![fake](img/diagram.png)\n" +
+	"[fake]: img/chart.jpg\n" +
+	"```\n" +
+	"still code, neither fence closes it: ![fake](img/diagram.png)\n" +
+	"~~~~\n" +
+	"`````\n" +
+	"\n" +
+	"~~~\n" +
+	"<img src=\"img/chart.jpg\">\n" +
+	"~~~\n" +
+	"\n" +
+	"Plain text mentioning img/diagram.png stays.\n"
+
+// An unclosed fence runs to the end of the document.
+const unclosedFence = "![Diagram](img/diagram.png)\n" +
+	"~~~~\n" +
+	"![fake](img/diagram.png)\n" +
+	"~~~\n"
+
+func TestMaskMarkdownCode(t *testing.T) {
+	for _, tt := range []struct {
+		text, masked string
+		code         []string
+	}{
+		{"a `b` c", "a \x000\x00 c", []string{"`b`"}},
+		{"a ``b ` c`` d", "a \x000\x00 d", []string{"``b ` c``"}},
+		{"a `b c", "a `b c", nil},
+		{"x\n```\ny\n```\nz", "x\n\x000\x00\nz", []string{"```\ny\n```"}},
+		{"x\n   ~~~\ny\n~~~~\nz", "x\n\x000\x00\nz", []string{"   ~~~\ny\n~~~~"}},
+		{"x\n    ```\ny", "x\n    ```\ny", nil}, // Indented too far for a fence
+		{unclosedFence, "![Diagram](img/diagram.png)\n\x000\x00", []string{unclosedFence[len("![Diagram](img/diagram.png)\n"):]}},
+	} {
+		masked, code := maskMarkdownCode(tt.text)
+		if masked != tt.masked || len(code) != len(tt.code) {
+			t.Errorf("%q: masked %q, %q, want %q, %q", tt.text, masked, code, tt.masked, tt.code)
+			continue
+		}
+		for i := range code {
+			if code[i] != tt.code[i] {
+				t.Errorf("%q: code %d is %q, want %q", tt.text, i, code[i], tt.code[i])
+			}
+		}
+	}
+}
+
+// TestRewriteMarkdown converts the images a Markdown and an MDX file point
+// to with --rewrite-refs, compares the rewrite, and reverts: both files are
+// backed up before the rewrite and put back as they were.
+func TestRewriteMarkdown(t *testing.T) {
+	mdx := "import Chart from './Chart'\n\n<Chart />\n<img src='img/diagram.png' />\n\n" + unclosedFence
+	root := writeFixtureTree(t, []fixtureFile{
+		{"docs/guide.md", []byte(guideMarkdown)},
+		{"docs/page.mdx", []byte(mdx)},
+		{"docs/img/diagram.png", encodeFixture(t, ".png", 24, 16)},
+		{"docs/img/with space.png", encodeFixture(t, ".png", 16, 24)},
+		{"docs/img/chart.jpg", encodeFixture(t, ".jpg", 20, 20)},
+	})
+	before := treeFiles(t, root)
+	convertTree(t, root, testOptions(t, "--encoder", "native", "--rewrite-refs"))
+
+	files := treeFiles(t, root)
+	if got := string(files["docs/guide.md"]); got != guideRewritten {
+		t.Errorf("guide.md rewritten to:\n%s\nwant:\n%s", got, guideRewritten)
+	}
+	wantMDX := "import Chart from './Chart'\n\n<Chart />\n<img src='img/diagram.webp' />\n\n" +
+		"![Diagram](img/diagram.webp)\n" + unclosedFence[len("![Diagram](img/diagram.png)\n"):]
+	if got := string(files["docs/page.mdx"]); got != wantMDX {
+		t.Errorf("page.mdx rewritten to:\n%s\nwant:\n%s", got, wantMDX)
+	}
+	for _, rel := range []string{"docs/guide.md", "docs/page.mdx"} {
+		if string(files[".webpcon_backup/"+rel]) != string(before[rel]) {
+			t.Errorf("%s not backed up as it was", rel)
+		}
+	}
+
+	// A second run finds nothing left to rewrite and keeps the first backup
+	convertTree(t, root, testOptions(t, "--encoder", "native", "--rewrite-refs"))
+	again := treeFiles(t, root)
+	for _, rel := range []string{"docs/guide.md", "docs/page.mdx"} {
+		if string(again[rel]) != string(files[rel]) || string(again[".webpcon_backup/"+rel]) != string(before[rel]) {
+			t.Errorf("%s or its backup changed on a second run", rel)
+		}
+	}
+
+	if err := revertImages(root); err != nil {
+		t.Fatal(err)
+	}
+	checkReverted(t, root, before)
+}
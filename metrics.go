@@ -0,0 +1,93 @@
+package webpcon
+
+import (
+	"image"
+	"math"
+)
+
+// maxPSNR stands in for the infinite PSNR of identical images.
+const maxPSNR = 99
+
+// SSIM window size and step, and the stabilizing constants for 8-bit samples.
+const (
+	ssimWindow = 8
+	ssimStep   = 4
+	ssimC1     = (0.01 * 255) * (0.01 * 255)
+	ssimC2     = (0.03 * 255) * (0.03 * 255)
+)
+
+// psnr returns the peak signal-to-noise ratio of b against a in dB, over the
+// RGB channels of the premultiplied pixels, so differences under fully
+// transparent pixels don't count. The images must have the same size.
+func psnr(a, b image.Image) float64 {
+	ab, bb := a.Bounds(), b.Bounds()
+	var sum float64
+	for y := 0; y < ab.Dy(); y++ {
+		for x := 0; x < ab.Dx(); x++ {
+			r1, g1, b1, _ := a.At(ab.Min.X+x, ab.Min.Y+y).RGBA()
+			r2, g2, b2, _ := b.At(bb.Min.X+x, bb.Min.Y+y).RGBA()
+			for _, d := range [3]float64{
+				float64(r1>>8) - float64(r2>>8),
+				float64(g1>>8) - float64(g2>>8),
+				float64(b1>>8) - float64(b2>>8),
+			} {
+				sum += d * d
+			}
+		}
+	}
+	mse := sum / float64(3*ab.Dx()*ab.Dy())
+	if mse == 0 {
+		return maxPSNR
+	}
+	return min(10*math.Log10(255*255/mse), maxPSNR)
+}
+
+// ssim returns the mean structural similarity of b against a, computed on
+// luma over overlapping square windows. 1 means identical. The images must
+// have the same size.
+func ssim(a, b image.Image) float64 {
+	la, lb := luma(a), luma(b)
+	w, h := a.Bounds().Dx(), a.Bounds().Dy()
+	win := min(ssimWindow, w, h)
+	if win == 0 {
+		return 1
+	}
+
+	var total float64
+	count := 0
+	for y0 := 0; y0+win <= h; y0 += max(1, min(ssimStep, win)) {
+		for x0 := 0; x0+win <= w; x0 += max(1, min(ssimStep, win)) {
+			var sa, sb, saa, sbb, sab float64
+			for y := y0; y < y0+win; y++ {
+				for x := x0; x < x0+win; x++ {
+					va, vb := la[y*w+x], lb[y*w+x]
+					sa += va
+					sb += vb
+					saa += va * va
+					sbb += vb * vb
+					sab += va * vb
+				}
+			}
+			n := float64(win * win)
+			ma, mb := sa/n, sb/n
+			vara, varb := saa/n-ma*ma, sbb/n-mb*mb
+			cov := sab/n - ma*mb
+			total += (2*ma*mb + ssimC1) * (2*cov + ssimC2) / ((ma*ma + mb*mb + ssimC1) * (vara + varb + ssimC2))
+			count++
+		}
+	}
+	return total / float64(count)
+}
+
+// luma returns the Rec. 709 luma of img's premultiplied pixels, row by row.
+func luma(img image.Image) []float64 {
+	b := img.Bounds()
+	out := make([]float64, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			r, g, bl, _ := img.At(x, y).RGBA()
+			out = append(out, (0.2126*float64(r)+0.7152*float64(g)+0.0722*float64(bl))/257)
+		}
+	}
+	return out
+}
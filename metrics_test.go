@@ -0,0 +1,243 @@
+package webpcon
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"maps"
+	"math"
+	"math/rand"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+// offset returns img with d added to each colour channel, clamped.
+func offset(img *image.NRGBA, d int) *image.NRGBA {
+	out := image.NewNRGBA(img.Rect)
+	for i, v := range img.Pix {
+		if i%4 == 3 {
+			out.Pix[i] = v
+			continue
+		}
+		out.Pix[i] = uint8(min(max(int(v)+d, 0), 255))
+	}
+	return out
+}
+
+// noisy returns img with uniform noise of up to amount added to each colour
+// channel, the same for a given seed.
+func noisy(img *image.NRGBA, amount int, seed int64) *image.NRGBA {
+	r := rand.New(rand.NewSource(seed))
+	out := image.NewNRGBA(img.Rect)
+	for i, v := range img.Pix {
+		if i%4 == 3 {
+			out.Pix[i] = v
+			continue
+		}
+		out.Pix[i] = uint8(min(max(int(v)+r.Intn(2*amount+1)-amount, 0), 255))
+	}
+	return out
+}
+
+// opaque returns a w x h fixtureImage with every pixel opaque.
+func opaque(w, h int) *image.NRGBA {
+	img := fixtureImage(w, h)
+	for i := 3; i < len(img.Pix); i += 4 {
+		img.Pix[i] = 0xff
+	}
+	return img
+}
+
+func TestPSNR(t *testing.T) {
+	img := opaque(64, 48)
+	if got := psnr(img, img); got != maxPSNR {
+		t.Errorf("identical images: %g dB, want %d", got, maxPSNR)
+	}
+	// A uniform difference of d gives an MSE of d², away from clamping
+	mid := image.NewNRGBA(img.Rect)
+	for i := range mid.Pix {
+		mid.Pix[i] = 128
+		if i%4 == 3 {
+			mid.Pix[i] = 0xff
+		}
+	}
+	for _, d := range []int{1, 4, 16} {
+		want := 10 * math.Log10(255*255/float64(d*d))
+		if got := psnr(mid, offset(mid, d)); math.Abs(got-want) > 1e-9 {
+			t.Errorf("offset %d: %g dB, want %g", d, got, want)
+		}
+		if got := psnr(offset(mid, d), mid); math.Abs(got-want) > 1e-9 {
+			t.Errorf("offset %d, swapped: %g dB, want %g", d, got, want)
+		}
+	}
+
+	// Colours under fully transparent pixels don't count
+	a, b := fixtureImage(32, 32), fixtureImage(32, 32)
+	for i := 0; i < len(b.Pix); i += 4 {
+		if b.Pix[i+3] == 0 {
+			b.Pix[i], b.Pix[i+1], b.Pix[i+2] = 0xff, 0, 0xff
+		}
+	}
+	if got := psnr(a, b); got != maxPSNR {
+		t.Errorf("differences under transparent pixels: %g dB, want %d", got, maxPSNR)
+	}
+
+	// Sub-images are compared from their own origins
+	sub := img.SubImage(image.Rect(10, 10, 30, 30))
+	copied := image.NewNRGBA(image.Rect(0, 0, 20, 20))
+	for y := range 20 {
+		for x := range 20 {
+			copied.Set(x, y, sub.At(10+x, 10+y))
+		}
+	}
+	if got := psnr(sub, copied); got != maxPSNR {
+		t.Errorf("sub-image against its copy: %g dB", got)
+	}
+}
+
+func TestSSIM(t *testing.T) {
+	img := opaque(64, 48)
+	if got := ssim(img, img); got != 1 {
+		t.Errorf("identical images: %g, want 1", got)
+	}
+
+	// More noise scores lower, on both metrics, whichever way round
+	prevSSIM, prevPSNR := 1.0, float64(maxPSNR)
+	for _, amount := range []int{2, 8, 32, 96} {
+		n := noisy(img, amount, 1)
+		s, p := ssim(img, n), psnr(img, n)
+		if s >= prevSSIM || p >= prevPSNR {
+			t.Errorf("noise %d: SSIM %g, PSNR %g, not below %g, %g", amount, s, p, prevSSIM, prevPSNR)
+		}
+		if back := ssim(n, img); math.Abs(back-s) > 1e-9 {
+			t.Errorf("noise %d: SSIM %g one way, %g the other", amount, s, back)
+		}
+		prevSSIM, prevPSNR = s, p
+	}
+
+	// A small brightness shift keeps the structure, which noise of the same
+	// PSNR doesn't
+	if shifted, n := ssim(img, offset(img, 8)), ssim(img, noisy(img, 14, 1)); shifted <= n {
+		t.Errorf("shift by 8: SSIM %g, not above noise: %g", shifted, n)
+	}
+
+	// An inverted image has the opposite structure
+	inverted := image.NewNRGBA(img.Rect)
+	for i, v := range img.Pix {
+		inverted.Pix[i] = 255 - v
+		if i%4 == 3 {
+			inverted.Pix[i] = v
+		}
+	}
+	if got := ssim(img, inverted); got > 0 {
+		t.Errorf("inverted image: SSIM %g, want at most 0", got)
+	}
+
+	// Images smaller than a window are one window of their own size
+	for _, size := range []image.Point{{3, 3}, {5, 2}, {1, 40}} {
+		small := opaque(size.X, size.Y)
+		if got := ssim(small, small); math.Abs(got-1) > 1e-9 {
+			t.Errorf("%v: identical images: %g, want 1", size, got)
+		}
+		if got := ssim(small, offset(small, 64)); got >= 1 || math.IsNaN(got) {
+			t.Errorf("%v: offset image: %g, want below 1", size, got)
+		}
+	}
+	if got := ssim(image.NewNRGBA(image.Rectangle{}), image.NewNRGBA(image.Rectangle{})); got != 1 {
+		t.Errorf("empty images: %g, want 1", got)
+	}
+}
+
+func TestLuma(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 5, 1))
+	for x, c := range []color.NRGBA{
+		{0xff, 0xff, 0xff, 0xff}, {0xff, 0, 0, 0xff}, {0, 0xff, 0, 0xff}, {0, 0, 0xff, 0xff}, {0xff, 0xff, 0xff, 0},
+	} {
+		img.SetNRGBA(x, 0, c)
+	}
+	for i, want := range []float64{255, 0.2126 * 255, 0.7152 * 255, 0.0722 * 255, 0} {
+		if got := luma(img)[i]; math.Abs(got-want) > 1e-9 {
+			t.Errorf("pixel %d: luma %g, want %g", i, got, want)
+		}
+	}
+}
+
+func TestParseQualities(t *testing.T) {
+	for _, tt := range []struct {
+		v    string
+		want []int // nil for an error
+	}{
+		{"80", []int{80}},
+		{"60,70,80,90", []int{60, 70, 80, 90}},
+		{"0, 100", []int{0, 100}},
+		{"", nil},
+		{"60,,80", nil},
+		{"60,101", nil},
+		{"-1", nil},
+		{"high", nil},
+	} {
+		got, err := parseQualities("--qualities", tt.v)
+		switch {
+		case tt.want == nil && err == nil:
+			t.Errorf("%q accepted as %v", tt.v, got)
+		case tt.want != nil && !slices.Equal(got, tt.want):
+			t.Errorf("%q: %v, %v, want %v", tt.v, got, err, tt.want)
+		}
+	}
+}
+
+// TestBench runs bench on a small tree: every file stays as it was, and the
+// output grows and gets closer to the source as the quality goes up.
+func TestBench(t *testing.T) {
+	testEncoder(t, "cgo")
+	var files []fixtureFile
+	for i, ext := range []string{".png", ".jpg", ".bmp"} {
+		files = append(files, fixtureFile{fmt.Sprintf("img%d%s", i, ext), encodeFixture(t, ext, 48+8*i, 40)})
+	}
+	root := writeFixtureTree(t, files)
+	before := treeFiles(t, root)
+
+	opts := testOptions(t, "--encoder", "cgo", "--qualities", "30,60,90", "--sample", "100", "--seed", "7", "--json")
+	if err := benchQualities(root, opts); err != nil {
+		t.Fatal(err)
+	}
+	after := treeFiles(t, root)
+	if !maps.EqualFunc(before, after, func(a, b []byte) bool { return string(a) == string(b) }) {
+		t.Errorf("bench changed the tree: %q, was %q", slices.Sorted(maps.Keys(after)), slices.Sorted(maps.Keys(before)))
+	}
+
+	results := []*benchResult{{Quality: 30}, {Quality: 60}, {Quality: 90}}
+	sources := scanSources(root, opts)
+	if len(sources) != len(files) {
+		t.Fatalf("%d source(s), want %d", len(sources), len(files))
+	}
+	for _, src := range sources {
+		if err := benchFile(filepath.Join(root, src.rel), src, newOverrideLoader(root), opts, results); err != nil {
+			t.Fatalf("%s: %v", src.rel, err)
+		}
+	}
+	for i, r := range results {
+		r.PSNR /= float64(len(sources))
+		r.SSIM /= float64(len(sources))
+		if r.PSNR <= 0 || r.PSNR > maxPSNR || r.SSIM <= 0 || r.SSIM > 1 {
+			t.Errorf("q%d: PSNR %g, SSIM %g", r.Quality, r.PSNR, r.SSIM)
+		}
+		if i == 0 {
+			continue
+		}
+		prev := results[i-1]
+		if r.Size <= prev.Size || r.PSNR <= prev.PSNR || r.SSIM < prev.SSIM {
+			t.Errorf("q%d: %d bytes, %.2f dB, SSIM %.4f, not above q%d: %d bytes, %.2f dB, SSIM %.4f",
+				r.Quality, r.Size, r.PSNR, r.SSIM, prev.Quality, prev.Size, prev.PSNR, prev.SSIM)
+		}
+	}
+}
+
+func BenchmarkSSIM(b *testing.B) {
+	img := opaque(256, 256)
+	n := noisy(img, 8, 1)
+	for range b.N {
+		ssim(img, n)
+	}
+}
@@ -0,0 +1,60 @@
+package webpcon
+
+import (
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+// misnamedWebPReason is why a file of WebP content under another extension,
+// as some CDNs save them, isn't converted.
+const misnamedWebPReason = "already WebP, extension mismatch"
+
+// misnamedWebP deals with relPath, a file whose content is WebP already.
+// It is never converted again or moved to the backup. It is skipped, or with
+// fix renamed to .webp and added to the map marked ExtensionFixed, so
+// --rewrite-refs points references at the new name and revert renames it
+// back. A file of that name already there leaves it skipped. move puts the
+// file under its new name, both relative to the project root.
+func (s *summary) misnamedWebP(out *fileLog, relPath string, sel *selector, fix bool, move func(oldRel, newRel string) error) error {
+	newRel := relPath[:len(relPath)-len(filepath.Ext(relPath))] + ".webp"
+	if !fix {
+		out.printf("⏭️ Skipping %s (%s, --fix-extensions renames it)\n", relPath, misnamedWebPReason)
+		s.misnamed = append(s.misnamed, filepath.ToSlash(relPath))
+		return nil
+	}
+	if treeHas(sel.dst, newRel) {
+		out.printf("⏭️ Skipping %s (%s, not renamed as %s exists)\n", relPath, misnamedWebPReason, filepath.Base(newRel))
+		s.misnamed = append(s.misnamed, filepath.ToSlash(relPath))
+		return nil
+	}
+	if err := move(relPath, newRel); err != nil {
+		out.printf("❌ Error renaming %s: %v\n", relPath, err)
+		return err
+	}
+	sel.wrote(newRel)
+	e := sel.outputs.add(relPath, newRel)
+	e.ExtensionFixed = true
+	e.ConvertedAt = time.Now().Format(time.RFC3339)
+	out.printf("✏️  Renamed %s to %s, its content is WebP already\n", relPath, filepath.Base(newRel))
+	s.extensionFixed = append(s.extensionFixed, fmt.Sprintf("%s -> %s", filepath.ToSlash(relPath), filepath.Base(newRel)))
+	return nil
+}
+
+// renameBack undoes misnamedWebP for revert, giving the file at e.WebP its
+// name key back. It returns why not if that name is taken.
+func renameBack(root, key string, e *mapEntry) (skip string, err error) {
+	webpPath := filepath.Join(root, filepath.FromSlash(e.WebP))
+	origPath := filepath.Join(root, filepath.FromSlash(key))
+	if fileExists(origPath) {
+		return "a file of its original name exists", nil
+	}
+	if err := os.Rename(longPath(webpPath), longPath(origPath)); err != nil {
+		fmt.Fprintf(stdout, "❌ Error renaming %s: %v\n", e.WebP, err)
+		return "", err
+	}
+	fmt.Fprintf(stdout, "↩️  Renamed %s back to %s\n", e.WebP, path.Base(key))
+	return "", nil
+}
@@ -0,0 +1,51 @@
+package webpcon
+
+import (
+	"bytes"
+	"slices"
+	"testing"
+)
+
+// TestMisnamedWebP converts a tree holding WebP content saved as .png and
+// .jpg, one next to a WebP of its name: they are skipped, or renamed with
+// --fix-extensions unless the name is taken, and revert gives them their
+// names back.
+func TestMisnamedWebP(t *testing.T) {
+	quietly(t)
+	var webp bytes.Buffer
+	if _, err := convertStream(bytes.NewReader(encodeFixture(t, ".png", 8, 8)), &webp, streamOptions(t)); err != nil {
+		t.Fatal(err)
+	}
+	tree := []fixtureFile{
+		{"cdn/a.png", webp.Bytes()},
+		{"cdn/b.jpg", webp.Bytes()},
+		{"cdn/c.png", webp.Bytes()},
+		{"cdn/c.webp", webp.Bytes()},
+	}
+	tests := []struct {
+		args     []string
+		misnamed []string
+		fixed    []string
+	}{
+		{nil, []string{"cdn/a.png", "cdn/b.jpg"}, nil},
+		{[]string{"--fix-extensions", "--on-conflict", "overwrite"}, []string{"cdn/c.png"}, []string{"cdn/a.png -> a.webp", "cdn/b.jpg -> b.webp"}},
+	}
+	for _, tt := range tests {
+		root := writeFixtureTree(t, tree)
+		before := treeFiles(t, root)
+		sum := convertTree(t, root, testOptions(t, append([]string{"--encoder", "native"}, tt.args...)...))
+		slices.Sort(sum.MisnamedWebP)
+		slices.Sort(sum.ExtensionFixed)
+		if sum.Converted != 0 || !slices.Equal(sum.MisnamedWebP, tt.misnamed) || !slices.Equal(sum.ExtensionFixed, tt.fixed) {
+			t.Errorf("%v: converted %d, skipped %q, renamed %q, want none, %q and %q",
+				tt.args, sum.Converted, sum.MisnamedWebP, sum.ExtensionFixed, tt.misnamed, tt.fixed)
+		}
+		if _, ok := treeFiles(t, root)[".webpcon_backup/cdn/a.png"]; ok {
+			t.Errorf("%v: WebP content moved to the backup", tt.args)
+		}
+		if err := revertImages(root); err != nil {
+			t.Fatal(err)
+		}
+		checkReverted(t, root, before)
+	}
+}
@@ -0,0 +1,87 @@
+package webpcon
+
+import "image"
+
+// Port of libwebp's near-lossless preprocessing (src/enc/near_lossless_enc.c),
+// which chai2010/webp doesn't expose. Pixels that differ noticeably from their
+// 4-connected neighbours get their channels snapped to a coarser grid, where
+// the error is hard to see but the lossless encoder gains a lot. Smooth areas
+// are left untouched.
+
+const minDimForNearLossless = 64
+
+// nearLosslessBits maps a 0 ~ 100 level to the number of low bits that may be
+// dropped. 100 means no preprocessing at all.
+func nearLosslessBits(level int) int {
+	return 5 - level/20
+}
+
+// applyNearLossless preprocesses the samples of img in place.
+func applyNearLossless(img *image.NRGBA, level int) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	// Same as libwebp: small icons and very short images aren't worth it
+	if (w < minDimForNearLossless && h < minDimForNearLossless) || h < 3 {
+		return
+	}
+
+	limitBits := nearLosslessBits(level)
+	for bits := limitBits; bits > 0; bits-- {
+		nearLosslessPass(img, bits)
+	}
+}
+
+func nearLosslessPass(img *image.NRGBA, bits int) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	limit := 1 << bits
+	rowLen := w * 4
+
+	// The pass reads unmodified neighbours, so keep copies of the rows around y
+	prev := make([]uint8, rowLen)
+	curr := make([]uint8, rowLen)
+	next := make([]uint8, rowLen)
+	row := func(y int) []uint8 {
+		i := img.PixOffset(b.Min.X, b.Min.Y+y)
+		return img.Pix[i : i+rowLen]
+	}
+	copy(curr, row(0))
+	copy(next, row(1))
+
+	for y := 1; y < h-1; y++ {
+		prev, curr, next = curr, next, prev
+		copy(next, row(y+1))
+		dst := row(y)
+		for x := 1; x < w-1; x++ {
+			p := x * 4
+			if isNear(curr, p, curr, p-4, limit) && isNear(curr, p, curr, p+4, limit) &&
+				isNear(curr, p, prev, p, limit) && isNear(curr, p, next, p, limit) {
+				continue
+			}
+			for k := 0; k < 4; k++ {
+				dst[p+k] = closestDiscretized(curr[p+k], bits)
+			}
+		}
+	}
+}
+
+func isNear(a []uint8, i int, b []uint8, j int, limit int) bool {
+	for k := 0; k < 4; k++ {
+		d := int(a[i+k]) - int(b[j+k])
+		if d >= limit || d <= -limit {
+			return false
+		}
+	}
+	return true
+}
+
+// closestDiscretized rounds v to a multiple of 1<<bits (or 255), resolving
+// ties with banker's rounding.
+func closestDiscretized(v uint8, bits int) uint8 {
+	mask := uint32(1)<<bits - 1
+	biased := uint32(v) + mask>>1 + (uint32(v)>>bits)&1
+	if biased > 0xff {
+		return 0xff
+	}
+	return uint8(biased &^ mask)
+}
@@ -0,0 +1,262 @@
+package webpcon
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// optimizeImages recompresses the project's JPEG and PNG files in place for
+// clients that can't take WebP: JPEGs are re-encoded at --quality, PNGs get
+// the strongest compression and a palette when that loses nothing. A file is
+// only replaced when the result is smaller. Originals go to the backup and
+// the run log like a conversion, so revert undoes it.
+func optimizeImages(root string, opts options) (err error) {
+	sum := newSummary()
+	sum.verb = "optimized"
+	runs, err := loadRunLog(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", runLogName, err)
+		return err
+	}
+	run := runs.start(time.Now())
+	defer func() {
+		h := historyRecord{Command: "optimize", Options: opts.flags, Files: sum.converted,
+			SourceSize: sum.sourceSize, OutputSize: sum.outputSize, Savings: sum.sourceSize - sum.outputSize}
+		if sum.converted > 0 {
+			h.Run = run.ID
+		}
+		appendHistory(root, h, err)
+	}()
+
+	con := newConsole(stdout, stdoutTTY)
+	for _, src := range scanSources(root, opts) {
+		if !isJPEG(src.ext) && src.ext != ".png" {
+			continue
+		}
+		if !opts.since.IsZero() && src.modTime.Before(opts.since) {
+			sum.beforeSince++
+			continue
+		}
+		if opts.interrupted() {
+			err = errInterrupted
+			break
+		}
+		out := con.file(src.rel)
+		err = optimizeFile(out, root, src, opts, runs, run, sum)
+		out.done()
+		if err != nil {
+			break
+		}
+	}
+	con.close()
+
+	if serr := runs.save(); serr != nil {
+		fmt.Fprintf(stdout, "❌ Error writing %s: %v\n", runLogName, serr)
+		if err == nil {
+			err = serr
+		}
+	}
+	sum.print()
+	return err
+}
+
+func optimizeFile(out *fileLog, root string, src source, opts options, runs *runLog, run *runRecord, sum *summary) error {
+	relPath := src.rel
+	path := filepath.Join(root, relPath)
+	key := pathKey(relPath)
+	for _, r := range runs.runs {
+		for _, f := range r.Files {
+			if f.Source == key {
+				out.printf("⏭️ Skipping %s (already handled by run %s)\n", relPath, r.ID)
+				return nil
+			}
+		}
+	}
+	// Revert deletes the WebP next to a restored original
+	if webp := filepath.Join(root, webpRel(relPath, src.ext)); fileExists(webp) {
+		out.printf("⏭️ Skipping %s (%s exists and a revert would delete it)\n", relPath, filepath.Base(webp))
+		return nil
+	}
+	if isLFSPointer(osTree(root), treeName(relPath), src.size) {
+		sum.skipLFSPointer(out, relPath)
+		return nil
+	}
+	if err := checkSupported(osTree(root), treeName(relPath), src.ext); err != nil {
+		if sum.permissionDenied(out, relPath, err) {
+			return nil
+		}
+		sum.skipUnsupported(out, relPath, unsupportedReason(err), err)
+		return nil
+	}
+
+	data, err := os.ReadFile(longPath(path))
+	if sum.permissionDenied(out, relPath, err) {
+		return nil
+	}
+	if err != nil {
+		out.printf("❌ Error reading %s: %v\n", path, err)
+		return err
+	}
+	// Nothing has been moved yet, so a file that can't be decoded is only
+	// listed and the run goes on
+	img, err := decodeImage(bytes.NewReader(data), src.ext)
+	if err != nil {
+		sum.skipUnsupported(out, relPath, unsupportedReason(err), err)
+		return nil
+	}
+
+	var buf bytes.Buffer
+	var mode string
+	if src.ext == ".png" {
+		mode = "png"
+		if p := toPaletted(img); p != nil {
+			img, mode = p, "png palette"
+		}
+		err = (&png.Encoder{CompressionLevel: png.BestCompression}).Encode(&buf, img)
+	} else {
+		mode = fmt.Sprintf("jpeg q%d", int(opts.quality))
+		err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: int(opts.quality)})
+	}
+	if err != nil {
+		out.printf("❌ Error encoding %s: %v\n", relPath, err)
+		return err
+	}
+	// A CMYK JPEG comes out as YCbCr, which its CMYK profile doesn't describe
+	_, cmyk := img.(*image.CMYK)
+	result := keepMetadata(data, buf.Bytes(), src.ext, !cmyk)
+	if int64(len(result)) >= src.size {
+		out.printf("⏭️ Skipping %s (%s, not smaller than %s)\n", relPath, formatSize(int64(len(result))), formatSize(src.size))
+		return nil
+	}
+
+	bakPath := filepath.Join(root, ".webpcon_backup", relPath)
+	if runs.backedUp(root, bakPath) || fileExists(bakPath) {
+		bakPath = filepath.Join(root, ".webpcon_backup", runsDir, run.ID, relPath)
+	}
+	if err := os.MkdirAll(longPath(filepath.Dir(bakPath)), 0755); err != nil {
+		out.printf("❌ Error creating backup directory %s: %v\n", filepath.Dir(bakPath), err)
+		return err
+	}
+	if err := os.Rename(longPath(path), longPath(bakPath)); err != nil {
+		if sum.permissionDenied(out, relPath, err) {
+			return nil
+		}
+		out.printf("❌ Error moving %s to backup: %v\n", path, err)
+		return err
+	}
+	info, err := os.Stat(longPath(bakPath))
+	perm := os.FileMode(0644)
+	if err == nil {
+		perm = info.Mode().Perm()
+	}
+	if err := os.WriteFile(longPath(path), result, perm); err != nil {
+		os.Remove(longPath(path))
+		if os.Rename(longPath(bakPath), longPath(path)) == nil {
+			out.printf("❌ Error writing %s, kept the original: %v\n", relPath, err)
+		} else {
+			out.printf("❌ Error writing %s, the original is in %s: %v\n", relPath, bakPath, err)
+		}
+		return err
+	}
+
+	run.add(root, relPath, bakPath)
+	sum.add(mode)
+	sum.sourceSize += src.size
+	sum.outputSize += int64(len(result))
+	out.printf("✅ Optimized (%s): %s, %s -> %s\n", mode, relPath, formatSize(src.size), formatSize(int64(len(result))))
+	return nil
+}
+
+// toPaletted returns img as a paletted image when it has at most 256
+// distinct colors, alpha included, so storing it with a palette loses
+// nothing. Otherwise it returns nil.
+func toPaletted(img image.Image) *image.Paletted {
+	if p, ok := img.(*image.Paletted); ok {
+		return p
+	}
+	b := img.Bounds()
+	index := map[color.NRGBA]uint8{}
+	var palette color.Palette
+	pix := make([]uint8, 0, b.Dx()*b.Dy())
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			// 16-bit images can't be stored in 8 bits without loss
+			if r, g, bl, a := img.At(x, y).RGBA(); r%0x101 != 0 || g%0x101 != 0 || bl%0x101 != 0 || a%0x101 != 0 {
+				return nil
+			}
+			i, ok := index[c]
+			if !ok {
+				if len(palette) == 256 {
+					return nil
+				}
+				i = uint8(len(palette))
+				index[c] = i
+				palette = append(palette, c)
+			}
+			pix = append(pix, i)
+		}
+	}
+	p := image.NewPaletted(b, palette)
+	copy(p.Pix, pix)
+	return p
+}
+
+// keepMetadata carries the color and orientation information of the original
+// over to the re-encoded file, which Go's encoders don't write: EXIF and ICC
+// segments of a JPEG, and the color chunks of a PNG. Without keepICC a JPEG's
+// ICC profile is dropped, for a file whose color model changed.
+func keepMetadata(orig, encoded []byte, ext string, keepICC bool) []byte {
+	var keep []byte
+	if ext == ".png" {
+		const sig = "\x89PNG\r\n\x1a\n"
+		if !bytes.HasPrefix(orig, []byte(sig)) || len(encoded) < len(sig)+25 {
+			return encoded
+		}
+		for p := len(sig); p+8 <= len(orig); {
+			n := int(binary.BigEndian.Uint32(orig[p:]))
+			if n < 0 || p+12+n > len(orig) {
+				break
+			}
+			typ := string(orig[p+4 : p+8])
+			if typ == "PLTE" || typ == "IDAT" {
+				break // Color chunks must come before these
+			}
+			if typ == "iCCP" || typ == "sRGB" || typ == "gAMA" || typ == "cHRM" || typ == "pHYs" {
+				keep = append(keep, orig[p:p+12+n]...)
+			}
+			p += 12 + n
+		}
+		// Right after the signature and IHDR
+		at := len(sig) + 25
+		return append(append(append([]byte{}, encoded[:at]...), keep...), encoded[at:]...)
+	}
+
+	for p := 2; p+4 <= len(orig) && orig[p] == 0xff; {
+		marker := orig[p+1]
+		if marker == 0xda || marker == 0xd9 {
+			break
+		}
+		n := int(binary.BigEndian.Uint16(orig[p+2:]))
+		if n < 2 || p+2+n > len(orig) {
+			break
+		}
+		icc := marker == 0xe2 && bytes.HasPrefix(orig[p+4:p+2+n], []byte("ICC_PROFILE\x00"))
+		if marker == 0xe1 || (marker == 0xe2 && (keepICC || !icc)) { // APP1 (EXIF, XMP), APP2 (ICC and others)
+			keep = append(keep, orig[p:p+2+n]...)
+		}
+		p += 2 + n
+	}
+	if len(encoded) < 2 {
+		return encoded
+	}
+	return append(append(append([]byte{}, encoded[:2]...), keep...), encoded[2:]...)
+}
@@ -0,0 +1,106 @@
+package webpcon
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+)
+
+// AVIF and JPEG XL sources. Neither the standard library nor x/image decodes
+// them, so they go through a decoder compiled into the build (inputDecoders)
+// or else the reference command line decoder found in PATH. Both are opt-in
+// with --enable-avif-input and --enable-jxl-input, as such files are often
+// smaller than any WebP already.
+
+// optInFormat is an input format converted only when enabled.
+type optInFormat struct {
+	name string // For messages
+	tool string // Command line decoder, run as: tool <input> <output.png>
+}
+
+var optInFormats = map[string]optInFormat{
+	".avif": {"AVIF", "avifdec"},
+	".jxl":  {"JPEG XL", "djxl"},
+}
+
+// inputDecoders holds the decoders compiled into the build, by extension. A
+// file adding one behind a build tag registers it from its init function.
+var inputDecoders = map[string]func(io.Reader) (image.Image, error){}
+
+// inputEnabled reports whether images with ext are converted at all.
+func (o options) inputEnabled(ext string) bool {
+	switch ext {
+	case ".avif":
+		return o.enableAVIF
+	case ".jxl":
+		return o.enableJXL
+	}
+	return true
+}
+
+// checkOptIn makes sure there is a decoder for an opt-in format, see
+// checkSupported.
+func checkOptIn(ext string) error {
+	if inputDecoders[ext] != nil {
+		return nil
+	}
+	f := optInFormats[ext]
+	if _, err := exec.LookPath(f.tool); err != nil {
+		return &unsupportedError{fmt.Sprintf("%s decoding not compiled in, and %s not found", f.name, f.tool)}
+	}
+	return nil
+}
+
+// decodeOptIn decodes an AVIF or JPEG XL image.
+func decodeOptIn(r io.Reader, ext string) (image.Image, error) {
+	if decode := inputDecoders[ext]; decode != nil {
+		return decode(r)
+	}
+	if err := checkOptIn(ext); err != nil {
+		return nil, err
+	}
+	f := optInFormats[ext]
+
+	dir, err := os.MkdirTemp("", "webpcon-decode-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+
+	in, out := filepath.Join(dir, "in"+ext), filepath.Join(dir, "out.png")
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.WriteFile(in, data, 0644); err != nil {
+		return nil, err
+	}
+	var stderr bytes.Buffer
+	cmd := exec.Command(f.tool, in, out)
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return nil, fmt.Errorf("%s: %v: %s", f.tool, err, bytes.TrimSpace(stderr.Bytes()))
+	}
+	decoded, err := os.Open(out)
+	if err != nil {
+		return nil, err
+	}
+	defer decoded.Close()
+	return png.Decode(decoded)
+}
+
+// decodeOptInConfig gets the dimensions of an AVIF or JPEG XL image, which
+// takes decoding all of it.
+func decodeOptInConfig(r io.Reader, ext string) (image.Config, error) {
+	img, err := decodeOptIn(r, ext)
+	if err != nil {
+		return image.Config{}, err
+	}
+	b := img.Bounds()
+	return image.Config{ColorModel: img.ColorModel(), Width: b.Dx(), Height: b.Dy()}, nil
+}
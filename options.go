@@ -0,0 +1,783 @@
+package webpcon
+
+import (
+	"fmt"
+	"image/color"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// options holds the conversion settings collected from the command line.
+type options struct {
+	enableGif     bool
+	gifFlatten    bool    // Convert animated GIFs to their first frame
+	exact         bool    // Keep RGB values under fully transparent pixels
+	quality       float32 // Lossy quality, 0 ~ 100
+	alphaQuality  int     // Lossy alpha quality, 0 ~ 100. 100 keeps alpha lossless
+	lossless      bool
+	sharpYUV      bool // Slower RGB -> YUV conversion that avoids chroma bleeding
+	grayscale     bool
+	toSRGB        bool         // Convert pixels from an embedded ICC profile to sRGB
+	flatten       *color.NRGBA // Composite transparent images onto this background
+	nearLossless  int          // Near-lossless preprocessing level, 0 ~ 100. -1 = disabled
+	quantize      int          // Colors to reduce to before a lossless encode, 2 ~ 256, or quantizeAuto. 0 = disabled
+	dither        bool         // Floyd–Steinberg dithering when quantizing
+	targetSize    int64        // Search quality so each output fits in this many bytes. 0 = disabled
+	maxWidth      int          // Downscale images wider than this many pixels. 0 = no limit
+	maxHeight     int          // Downscale images taller than this many pixels. 0 = no limit
+	enableAVIF    bool         // Convert .avif sources, see optInFormats
+	enableJXL     bool         // Convert .jxl sources
+	fastResize    bool         // Resample in gamma space with a bilinear filter instead
+	preset        string       // Name of the preset the settings were filled from, if any
+	extension     string       // The extension the settings were resolved for, see withExtensionDefaults
+	encoder       string       // Encoder backend name given with --encoder, see selectEncoder
+	effort        int          // Compression effort, 0 ~ 6. Only the cwebp backend uses it
+	enc           encoder      // The backend selected from encoder
+	deterministic bool         // Only use backends whose output is fixed by the webpcon build, see deterministicEncoder
+	warnings      []string     // Settings parseOptions had to ignore, see printWarnings
+
+	watermarkPath    string     // Overlay image stamped onto each still image
+	watermarkPos     string     // One of watermarkPositions
+	watermarkOpacity float64    // 0 ~ 1
+	watermarkScale   float64    // Overlay width as a fraction of the image's
+	watermark        *watermark // Loaded from watermarkPath, nil without one
+	trim             *trimSpec  // Border cropped off before resizing, nil for none
+
+	hardlinkDupes bool // Hard link duplicate sources' outputs instead of copying
+	minWidth      int  // Skip images narrower than this many pixels
+	minHeight     int  // Skip images shorter than this many pixels
+
+	placeholders     string         // "blurhash" or "thumb" to record a placeholder in the map file
+	placeholderFiles bool           // Also write thumb placeholders as name.placeholder.webp
+	fallback         map[string]int // --fallback formats, "jpeg" or "png", with the JPEG quality
+	rewriteRefs      bool           // Point references in source files at the converted images
+	addDimensions    bool           // Add width/height to <img> tags the rewriter touches
+	emitPicture      bool           // Wrap <img> tags in HTML in <picture> instead of rewriting them
+	convertDataURIs  bool           // Re-encode base64 image data URIs in CSS/HTML as WebP
+	noManifestDetect bool           // Don't leave icons listed in the web app manifest alone
+	convertIcons     bool           // Don't leave icons alone at all, see projectIcons
+	onlyReferenced   bool           // Only convert images referenced from the project's source files
+	gitSince         string         // Only convert images added or modified in git since this ref
+	since            time.Time      // Only convert images modified after this (--since)
+	framework        string         // --framework: a name from frameworks, "auto" or ""
+	fw               *framework     // The framework selected, see selectFramework
+	jsonOutput       bool           // Print reports as JSON
+	progressNDJSON   bool           // Write progress events as JSON lines to stdout
+	noEmoji          bool           // Plain [tag] prefixes instead of emoji
+	color            string         // auto, always or never, see useColor
+	metrics          bool           // Decode each output again and record its PSNR and SSIM
+	minSSIM          float64        // Flag outputs with a lower SSIM and fail the run. 0 = disabled
+	keepLowSSIM      bool           // Keep the original instead of a WebP below --min-ssim
+	verifyFull       bool           // Fully decode each output after writing it, not just its header
+
+	breakLock       bool             // Remove a lock left behind by a run that no longer exists
+	force           bool             // Convert even when a safety check says otherwise
+	projectFiles    []string         // Extra file names that mark a folder as a project, see isSafePath
+	excludeRegex    []*regexp.Regexp // Relative paths, with forward slashes, to leave alone
+	vendoredDirs    map[string]bool  // Folders of vendored code to leave alone, by pathKey
+	includeVendored map[string]bool  // Folders to convert even though they look vendored
+	safeDepth       int              // Folders deeper than this need a project file or confirmation
+	chmodReadonly   bool             // Lift the read-only attribute to move originals into the backup
+	ignoreDiskCheck bool             // Skip the free disk space check
+	noPauseOnENOSPC bool             // Stop the run when the disk fills up instead of waiting for space
+	checkLocks      bool             // Leave files alone that another process holds a flock on (Unix)
+	streamingWalk   bool             // Read folders in parallel and convert while the tree is still being read
+	diskFullTimeout time.Duration    // How long to wait for space when the disk fills up
+	spaceFactor     float64          // Share of the source size the outputs are assumed to need
+	trash           bool             // Send originals to the system trash instead of the backup directory
+	yes             bool             // Add webpcon's files to .gitignore without asking
+	throttle        int              // Percentage of the machine to use, see throttle. 0 = no limit
+	limit           int              // Stop after converting this many files. 0 = no limit
+	maxDuration     time.Duration    // Stop starting new files after this long. 0 = no limit
+	sample          int              // estimate: number of files to encode
+	seed            int64            // estimate, --spot-check: seed for picking the sample
+	spotCheck       int              // Copy this many originals and their WebP files to spotCheckDir. 0 = none
+	spotCheckDir    string           // Where --spot-check copies to, relative to the working directory
+	qualities       []int            // bench: lossy qualities to compare
+	selftestFolders []string         // selftest: folders to copy whole instead of a sample
+	decodeTo        string           // decode: "png" or "jpg"
+	repairMode      string           // repair: "restore" or "convert"
+	requality       bool             // Re-encode images converted with other settings from their backups
+	onConflict      string           // conflictSkip, conflictOverwrite or conflictRename; "" to follow --force
+	groupByDir      int              // Summary table by the first this many path components, 0 for none
+	filesFrom       string           // File listing the paths to convert instead of walking, "-" for stdin
+	onlyConverted   bool             // decode: only WebP files listed in the map file
+	lastRun         bool             // revert: only the most recent run
+	revertRun       string           // revert: only the run with this ID
+	fromWebP        bool             // revert: rebuild originals with no backup from their WebP
+	sinceMap        string           // changed: the older map file to compare with
+	fixExtensions   bool             // lint: rename files to the extension of their content; convert: WebP content only
+	bufferSize      int64            // Read size for hashing, copying and verifying files
+	minSavings      int              // Percent an animated GIF, AVIF or JPEG XL file must shrink by to be replaced
+	gifMaxFPS       float64          // Frames per second animations are cut down to, 0 for all
+	gifScale        float64          // Factor animations are resized by, 0 for none
+	maxMegapixels   float64          // Largest image read from stdin or by ConvertFS, 0 for defaultMaxMegapixels
+	listen          string           // serve: address to listen on
+	serveCache      int64            // serve: bytes of WebP kept in memory
+
+	filterHook  string        // Command deciding per file whether to convert it, see filterHook
+	postHook    string        // Command run after each converted file, with {src} {dst} {backup}
+	postRunHook string        // Command run once at the end with the summary JSON on stdin
+	hookStrict  bool          // Fail the run when a hook fails
+	hookTimeout time.Duration // Time limit for each hook run and the external decoder
+
+	heartbeat   time.Duration // Interval of "still working" lines for slow files, 0 for none
+	fileTimeout time.Duration // Time after which a file's encode is abandoned, 0 for no limit
+	timings     bool          // Record where the time of each file went, see fileTiming
+	timingsCSV  string        // File to write the timings to as CSV
+
+	externalDecoder string // Command writing a PNG of {src} to stdout, for images the decoders don't support
+
+	set       map[string]bool // Flags given explicitly, keyed by long name without dashes
+	progress  *progress       // Set by main for --progress-ndjson
+	interrupt <-chan struct{} // Closed on SIGINT or SIGTERM, see runLock
+	flags     []string        // Flags as given, with their values, for the history
+}
+
+// interrupted tells whether the run was interrupted, see runLock.
+func (o options) interrupted() bool {
+	select {
+	case <-o.interrupt:
+		return true
+	default:
+		return false
+	}
+}
+
+func defaultOptions() options {
+	return options{
+		quality:          80,
+		alphaQuality:     100,
+		nearLossless:     -1,
+		encoder:          "auto",
+		color:            "auto",
+		effort:           4,
+		spaceFactor:      defaultSpaceFactor,
+		diskFullTimeout:  defaultDiskFullTimeout,
+		sample:           defaultSample,
+		spotCheckDir:     defaultSpotCheckDir,
+		bufferSize:       defaultBufferSize,
+		decodeTo:         "png",
+		repairMode:       "restore",
+		watermarkPos:     "bottom-right",
+		watermarkOpacity: 1,
+		watermarkScale:   0.1,
+		hookTimeout:      defaultHookTimeout,
+		heartbeat:        defaultHeartbeat,
+		listen:           "localhost:8080",
+		serveCache:       64 << 20,
+		safeDepth:        defaultSafeDepth,
+		set:              map[string]bool{},
+
+		vendoredDirs:    map[string]bool{},
+		includeVendored: map[string]bool{},
+	}
+}
+
+// encodeKey identifies the settings that affect the encoded bytes, so identical
+// sources only share an output when they'd be encoded the same way.
+func (o options) encodeKey() string {
+	flatten := ""
+	if o.flatten != nil {
+		flatten = formatHexColor(*o.flatten)
+	}
+	key := fmt.Sprintf("|gif=%t|fps=%g|scale=%g|q=%g|aq=%d|ll=%t|nl=%d|exact=%t|sharp=%t|target=%d|gray=%t|srgb=%t|flatten=%s|max=%dx%d|fast=%t|enc=%s|effort=%d",
+		o.enableGif, o.gifMaxFPS, o.gifScale, o.quality, o.alphaQuality, o.lossless, o.nearLossless, o.exact, o.sharpYUV, o.targetSize, o.grayscale, o.toSRGB, flatten,
+		o.maxWidth, o.maxHeight, o.fastResize, o.enc.name(), o.effort)
+	// Only when set, so map entries from before these settings still match
+	if o.watermark != nil {
+		key += "|wm=" + o.watermark.key()
+	}
+	if o.trim != nil {
+		key += "|trim=" + o.trim.key()
+	}
+	if o.quantize != 0 {
+		key += fmt.Sprintf("|quant=%d,%t", o.quantize, o.dither)
+	}
+	return key
+}
+
+// parseOptions reads the flags, as split off by parseCommandLine. Flags taking
+// a value accept both "--flag value" and "--flag=value".
+func parseOptions(args []string) (options, error) {
+	opts := defaultOptions()
+	trimTolerance := 0 // --trim-tolerance, whichever order it comes in with --trim
+	for i := 0; i < len(args); i++ {
+		name, v, hasValue := strings.Cut(args[i], "=")
+		if valueFlags[name] && !hasValue {
+			if i+1 >= len(args) {
+				return opts, fmt.Errorf("%s requires a value", name)
+			}
+			i++
+			v = args[i]
+		}
+
+		var err error
+		switch name {
+		case "--enable-gif", "--gif":
+			opts.enableGif = true
+		case "--gif-flatten":
+			opts.gifFlatten = true
+		case "--exact":
+			opts.exact = true
+		case "--lossless":
+			opts.lossless = true
+		case "--sharp-yuv":
+			opts.sharpYUV = true
+		case "--grayscale":
+			opts.grayscale = true
+		case "--convert-to-srgb":
+			opts.toSRGB = true
+		case "--flatten":
+			var c color.NRGBA
+			c, err = parseHexColor(v)
+			opts.flatten = &c
+		case "--hardlink-dupes":
+			opts.hardlinkDupes = true
+		case "--placeholders":
+			opts.placeholders, err = parsePlaceholderKind(v)
+		case "--fallback":
+			opts.fallback, err = parseFallback(v)
+		case "--placeholder-files":
+			opts.placeholderFiles = true
+		case "--rewrite-refs":
+			opts.rewriteRefs = true
+		case "--exclude-converted":
+			// What --rewrite-refs always does, see mapping.written
+		case "--emit-picture-codemod":
+			opts.emitPicture = true
+		case "--add-dimensions":
+			opts.addDimensions = true
+		case "--convert-data-uris":
+			opts.convertDataURIs = true
+		case "--no-manifest-detect":
+			opts.noManifestDetect = true
+		case "--convert-icons":
+			opts.convertIcons = true
+		case "--only-referenced":
+			opts.onlyReferenced = true
+		case "--since":
+			opts.since, err = parseSince(v, time.Now())
+		case "--exclude-regex":
+			var re *regexp.Regexp
+			if re, err = regexp.Compile(v); err != nil {
+				err = fmt.Errorf("--exclude-regex %q: %v", v, err)
+			}
+			opts.excludeRegex = append(opts.excludeRegex, re)
+		case "--vendored-dirs":
+			parseDirList(v, opts.vendoredDirs)
+		case "--include-vendored":
+			parseDirList(v, opts.includeVendored)
+		case "--git-since":
+			opts.gitSince = v
+		case "--framework":
+			opts.framework, err = parseFramework(v)
+		case "--json":
+			opts.jsonOutput = true
+		case "--progress-ndjson":
+			opts.progressNDJSON = true
+		case "--no-emoji":
+			opts.noEmoji = true
+		case "--color":
+			if v != "auto" && v != "always" && v != "never" {
+				err = fmt.Errorf("%s expects auto, always or never, got %q", name, v)
+			}
+			opts.color = v
+		case "--break-lock":
+			opts.breakLock = true
+		case "--force":
+			opts.force = true
+		case "--require-project-file":
+			opts.projectFiles = append(opts.projectFiles, v)
+		case "--safe-depth":
+			if opts.safeDepth, err = strconv.Atoi(v); err != nil || opts.safeDepth < 0 {
+				err = fmt.Errorf("%s expects a number of path levels, got %q", name, v)
+			}
+		case "--chmod-readonly":
+			opts.chmodReadonly = true
+		case "--ignore-disk-check":
+			opts.ignoreDiskCheck = true
+		case "--no-pause-on-enospc":
+			opts.noPauseOnENOSPC = true
+		case "--folders":
+			for _, d := range strings.Split(v, ",") {
+				if d = strings.TrimSpace(d); d != "" {
+					opts.selftestFolders = append(opts.selftestFolders, filepath.Clean(filepath.FromSlash(d)))
+				}
+			}
+		case "--check-locks":
+			opts.checkLocks = true
+		case "--streaming-walk":
+			opts.streamingWalk = true
+		case "--disk-full-timeout":
+			if opts.diskFullTimeout, err = time.ParseDuration(v); err != nil || opts.diskFullTimeout <= 0 {
+				err = fmt.Errorf("%s expects a duration like 10m or 1h30m, got %q", name, v)
+			}
+		case "--nice":
+			opts.throttle = niceThrottle
+		case "--throttle":
+			opts.throttle, err = parsePercent(name, v)
+		case "--limit":
+			if opts.limit, err = strconv.Atoi(v); err != nil || opts.limit <= 0 {
+				err = fmt.Errorf("%s expects a positive number of files, got %q", name, v)
+			}
+		case "--max-duration":
+			if opts.maxDuration, err = time.ParseDuration(v); err != nil || opts.maxDuration <= 0 {
+				err = fmt.Errorf("%s expects a duration like 10m or 1h30m, got %q", name, v)
+			}
+		case "--sample":
+			if opts.sample, err = strconv.Atoi(v); err != nil || opts.sample <= 0 {
+				err = fmt.Errorf("%s expects a positive number of files, got %q", name, v)
+			}
+		case "--spot-check":
+			if opts.spotCheck, err = strconv.Atoi(v); err != nil || opts.spotCheck <= 0 {
+				err = fmt.Errorf("%s expects a positive number of files, got %q", name, v)
+			}
+		case "--spot-check-dir":
+			opts.spotCheckDir = v
+		case "--timings":
+			opts.timings = true
+		case "--timings-csv":
+			opts.timings, opts.timingsCSV = true, v
+		case "--seed":
+			if opts.seed, err = strconv.ParseInt(v, 10, 64); err != nil {
+				err = fmt.Errorf("%s expects an integer, got %q", name, v)
+			}
+		case "--qualities":
+			opts.qualities, err = parseQualities(name, v)
+		case "--metrics":
+			opts.metrics = true
+		case "--min-ssim":
+			if opts.minSSIM, err = strconv.ParseFloat(v, 64); err != nil || opts.minSSIM <= 0 || opts.minSSIM > 1 {
+				err = fmt.Errorf("%s expects a number between 0 and 1 like 0.95, got %q", name, v)
+			}
+			opts.metrics = true
+		case "--keep-low-ssim":
+			opts.keepLowSSIM = true
+		case "--verify-full":
+			opts.verifyFull = true
+		case "--to":
+			opts.decodeTo, err = parseDecodeFormat(v)
+		case "--requality":
+			opts.requality = true
+		case "--watermark":
+			opts.watermarkPath = v
+		case "--quantize":
+			opts.quantize, err = parseQuantize(name, v)
+		case "--dither":
+			opts.dither = true
+		case "--trim":
+			opts.trim, err = parseTrim(v)
+		case "--trim-tolerance":
+			if trimTolerance, err = strconv.Atoi(v); err != nil || trimTolerance < 0 || trimTolerance > 255 {
+				err = fmt.Errorf("%s expects a number from 0 to 255, got %q", name, v)
+			}
+		case "--watermark-pos":
+			if !watermarkPositions[v] {
+				err = fmt.Errorf("%s expects top-left, top-right, bottom-left, bottom-right or center, got %q", name, v)
+			}
+			opts.watermarkPos = v
+		case "--watermark-opacity":
+			if opts.watermarkOpacity, err = strconv.ParseFloat(v, 64); err != nil || opts.watermarkOpacity <= 0 || opts.watermarkOpacity > 1 {
+				err = fmt.Errorf("%s expects a number above 0, up to 1, got %q", name, v)
+			}
+		case "--watermark-scale":
+			if opts.watermarkScale, err = strconv.ParseFloat(v, 64); err != nil || opts.watermarkScale <= 0 || opts.watermarkScale > 1 {
+				err = fmt.Errorf("%s expects a fraction of the image width above 0, up to 1, got %q", name, v)
+			}
+		case "--on-conflict":
+			if v != conflictSkip && v != conflictOverwrite && v != conflictRename {
+				err = fmt.Errorf("%s expects skip, overwrite or rename, got %q", name, v)
+			}
+			opts.onConflict = v
+		case "--group-by-dir":
+			if opts.groupByDir, err = strconv.Atoi(v); err != nil || opts.groupByDir < 1 {
+				err = fmt.Errorf("%s expects a number of path components, 1 or more, got %q", name, v)
+			}
+		case "--files-from":
+			opts.filesFrom = v
+		case "--repair-mode":
+			if v != "restore" && v != "convert" {
+				err = fmt.Errorf("%s expects restore or convert, got %q", name, v)
+			}
+			opts.repairMode = v
+		case "--only-converted":
+			opts.onlyConverted = true
+		case "--last-run":
+			opts.lastRun = true
+		case "--from-webp":
+			opts.fromWebP = true
+		case "--run":
+			opts.revertRun = v
+		case "--since-map":
+			opts.sinceMap = v
+		case "--buffer-size":
+			if opts.bufferSize, err = parseSize(v); err != nil || opts.bufferSize < 4<<10 || opts.bufferSize > 64<<20 {
+				err = fmt.Errorf("%s expects a size between 4KB and 64MB, like 1MB, got %q", name, v)
+			}
+		case "--fix-extensions":
+			opts.fixExtensions = true
+		case "--yes", "-y":
+			opts.yes = true
+		case "--trash":
+			opts.trash = true
+		case "--post-hook":
+			opts.postHook = v
+			_, err = splitArgs(v)
+		case "--filter-hook":
+			opts.filterHook = v
+			_, err = splitArgs(v)
+		case "--post-run-hook":
+			opts.postRunHook = v
+			_, err = splitArgs(v)
+		case "--external-decoder":
+			opts.externalDecoder = v
+			_, err = splitArgs(v)
+		case "--hook-strict":
+			opts.hookStrict = true
+		case "--hook-timeout":
+			if opts.hookTimeout, err = time.ParseDuration(v); err != nil || opts.hookTimeout <= 0 {
+				err = fmt.Errorf("%s expects a duration like 30s or 2m, got %q", name, v)
+			}
+		case "--gif-max-fps":
+			if opts.gifMaxFPS, err = strconv.ParseFloat(v, 64); err != nil || opts.gifMaxFPS <= 0 {
+				err = fmt.Errorf("%s expects a positive number of frames per second, got %q", name, v)
+			}
+		case "--gif-scale":
+			if opts.gifScale, err = strconv.ParseFloat(v, 64); err != nil || opts.gifScale <= 0 || opts.gifScale > 1 {
+				err = fmt.Errorf("%s expects a factor above 0 and up to 1, like 0.5, got %q", name, v)
+			}
+			if opts.gifScale == 1 {
+				opts.gifScale = 0
+			}
+		case "--listen":
+			opts.listen = v
+		case "--cache-size":
+			if opts.serveCache, err = parseSize(v); err != nil || opts.serveCache <= 0 {
+				err = fmt.Errorf("%s expects a size like 256MB, got %q", name, v)
+			}
+		case "--max-megapixels":
+			if opts.maxMegapixels, err = strconv.ParseFloat(v, 64); err != nil || opts.maxMegapixels <= 0 {
+				err = fmt.Errorf("%s expects a positive number of megapixels, got %q", name, v)
+			}
+		case "--min-savings":
+			if opts.minSavings, err = strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(v), "%")); err != nil || opts.minSavings < 0 || opts.minSavings > 99 {
+				err = fmt.Errorf("%s expects a percentage between 0%% and 99%%, got %q", name, v)
+			}
+		case "--heartbeat":
+			if opts.heartbeat, err = time.ParseDuration(v); err != nil || opts.heartbeat < 0 {
+				err = fmt.Errorf("%s expects a duration like 30s, or 0 to turn it off, got %q", name, v)
+			}
+		case "--file-timeout":
+			if opts.fileTimeout, err = time.ParseDuration(v); err != nil || opts.fileTimeout <= 0 {
+				err = fmt.Errorf("%s expects a duration like 5m, got %q", name, v)
+			}
+		case "--space-factor":
+			if opts.spaceFactor, err = strconv.ParseFloat(v, 64); err != nil || opts.spaceFactor <= 0 {
+				err = fmt.Errorf("%s expects a positive number like 0.5, got %q", name, v)
+			}
+		case "--quality", "-q":
+			var q int
+			q, err = parseLevel(name, v)
+			opts.quality = float32(q)
+			name = "--quality"
+		case "--alpha-quality":
+			opts.alphaQuality, err = parseLevel(name, v)
+		case "--near-lossless":
+			opts.nearLossless, err = parseLevel(name, v)
+		case "--target-size":
+			if opts.targetSize, err = parseSize(v); err != nil || opts.targetSize <= 0 {
+				err = fmt.Errorf("%s expects a size like 200KB or 1.5MB, got %q", name, v)
+			}
+		case "--min-dimension":
+			var n int
+			n, err = parsePixels(name, v)
+			opts.minWidth, opts.minHeight = n, n
+		case "--min-width":
+			opts.minWidth, err = parsePixels(name, v)
+		case "--min-height":
+			opts.minHeight, err = parsePixels(name, v)
+		case "--max-width":
+			opts.maxWidth, err = parsePixels(name, v)
+		case "--max-height":
+			opts.maxHeight, err = parsePixels(name, v)
+		case "--fast-resize":
+			opts.fastResize = true
+		case "--enable-avif-input":
+			opts.enableAVIF = true
+		case "--enable-jxl-input":
+			opts.enableJXL = true
+		case "--encoder":
+			opts.encoder = v
+		case "--deterministic":
+			opts.deterministic = true
+		case "--effort":
+			if opts.effort, err = strconv.Atoi(v); err != nil || opts.effort < 0 || opts.effort > 6 {
+				err = fmt.Errorf("%s expects a number between 0 and 6, got %q", name, v)
+			}
+		case "--preset":
+			if _, ok := presets[v]; !ok {
+				err = fmt.Errorf("unknown preset %q (available: %s)", v, strings.Join(presetNames(), ", "))
+			}
+			opts.preset = v
+		default:
+			return opts, fmt.Errorf("unknown flag %s", name)
+		}
+		if err != nil {
+			return opts, err
+		}
+		opts.set[strings.TrimLeft(name, "-")] = true
+		if valueFlags[name] {
+			opts.flags = append(opts.flags, name+"="+v)
+		} else {
+			opts.flags = append(opts.flags, name)
+		}
+	}
+
+	// The preset first, so the checks below see the settings it fills in
+	if opts.preset != "" {
+		presets[opts.preset].apply(&opts)
+	}
+	if opts.set["quality"] && opts.set["near-lossless"] {
+		return opts, fmt.Errorf("--near-lossless and --quality cannot be used together")
+	}
+	if opts.set["quality"] && opts.set["target-size"] {
+		return opts, fmt.Errorf("--target-size picks the quality itself and cannot be used with --quality")
+	}
+	if opts.keepLowSSIM && opts.minSSIM == 0 {
+		return opts, fmt.Errorf("--keep-low-ssim only works together with --min-ssim")
+	}
+	if opts.lastRun && opts.revertRun != "" {
+		return opts, fmt.Errorf("--last-run and --run cannot be used together")
+	}
+	if opts.fromWebP && (opts.lastRun || opts.revertRun != "") {
+		return opts, fmt.Errorf("--from-webp works with a plain revert, not --last-run or --run")
+	}
+	if opts.fallback != nil && opts.trash {
+		return opts, fmt.Errorf("--fallback writes in place of the original and cannot be used with --trash")
+	}
+	if opts.set["spot-check-dir"] && opts.spotCheck == 0 {
+		return opts, fmt.Errorf("--spot-check-dir only works together with --spot-check")
+	}
+	if opts.spotCheck > 0 && opts.trash {
+		return opts, fmt.Errorf("--spot-check copies originals from the backup and cannot be used with --trash")
+	}
+	if opts.emitPicture && opts.fallback == nil {
+		return opts, fmt.Errorf("--emit-picture-codemod keeps the original's URL for browsers without WebP and needs --fallback")
+	}
+	if opts.emitPicture && !opts.rewriteRefs && !opts.set["framework"] {
+		return opts, fmt.Errorf("--emit-picture-codemod changes how references are rewritten and needs --rewrite-refs")
+	}
+	if opts.gifFlatten && opts.enableGif {
+		return opts, fmt.Errorf("--gif-flatten and --enable-gif ask for different things; pick one")
+	}
+	if (opts.gifMaxFPS > 0 || opts.set["gif-scale"]) && !opts.enableGif {
+		return opts, fmt.Errorf("--gif-max-fps and --gif-scale only work together with --enable-gif")
+	}
+	if opts.addDimensions && !opts.rewriteRefs {
+		return opts, fmt.Errorf("--add-dimensions only works together with --rewrite-refs")
+	}
+	if opts.quantize != 0 && opts.set["near-lossless"] {
+		return opts, fmt.Errorf("--quantize and --near-lossless cannot be used together")
+	}
+	if opts.dither && opts.quantize == 0 {
+		return opts, fmt.Errorf("--dither only works together with --quantize")
+	}
+	if opts.streamingWalk && opts.filesFrom != "" {
+		return opts, fmt.Errorf("--streaming-walk reads the tree, which --files-from replaces; pick one")
+	}
+	if opts.noPauseOnENOSPC && opts.set["disk-full-timeout"] {
+		return opts, fmt.Errorf("--disk-full-timeout is how long to pause, which --no-pause-on-enospc turns off")
+	}
+	if opts.set["trim-tolerance"] && opts.trim == nil {
+		return opts, fmt.Errorf("--trim-tolerance only works together with --trim")
+	}
+	if opts.trim != nil {
+		opts.trim.tolerance = trimTolerance
+	}
+	if (opts.set["watermark-pos"] || opts.set["watermark-opacity"] || opts.set["watermark-scale"]) && opts.watermarkPath == "" {
+		return opts, fmt.Errorf("--watermark-pos, --watermark-opacity and --watermark-scale only work together with --watermark")
+	}
+	if opts.watermarkPath != "" {
+		wm, err := loadWatermark(opts.watermarkPath, opts.watermarkPos, opts.watermarkOpacity, opts.watermarkScale)
+		if err != nil {
+			return opts, err
+		}
+		opts.watermark = wm
+	}
+	if opts.deterministic {
+		switch opts.encoder {
+		case "auto":
+			opts.encoder = deterministicEncoder()
+		case "cwebp":
+			return opts, fmt.Errorf("--deterministic can't use cwebp, whose output depends on the libwebp installed; use --encoder cgo or native")
+		}
+	}
+
+	var err error
+	if opts.enc, err = selectEncoder(opts.encoder); err != nil {
+		return opts, err
+	}
+	if opts.set["effort"] && !opts.enc.effort() {
+		opts.warnings = append(opts.warnings, fmt.Sprintf("--effort has no effect with the %s encoder", opts.enc.name()))
+	} else if p, ok := presets[opts.preset]; ok && !opts.enc.effort() && p.effort != defaultOptions().effort {
+		opts.warnings = append(opts.warnings, fmt.Sprintf("The %s preset's effort %d has no effect with the %s encoder, only cwebp takes it", opts.preset, p.effort, opts.enc.name()))
+	}
+	if !opts.enc.lossy() && !opts.lossless {
+		opts.warnings = append(opts.warnings, fmt.Sprintf("The %s encoder only writes lossless WebP, lossy settings are ignored", opts.enc.name()))
+		opts.lossless = true
+	}
+	return opts, nil
+}
+
+// printWarnings prints what parseOptions found wrong with the settings. It's
+// left to the caller so they go wherever logs go once that's decided: stderr
+// when stdout carries a WebP file or NDJSON events.
+func (o options) printWarnings() {
+	for _, w := range o.warnings {
+		fmt.Fprintf(stdout, "⚠️ %s\n", w)
+	}
+}
+
+// parseLevel parses a 0 ~ 100 integer setting.
+func parseLevel(name, v string) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 || n > 100 {
+		return 0, fmt.Errorf("%s expects a number between 0 and 100, got %q", name, v)
+	}
+	return n, nil
+}
+
+// parseQuantize reads a --quantize value: a color count from 2 to 256, or auto.
+func parseQuantize(name, v string) (int, error) {
+	if v == "auto" {
+		return quantizeAuto, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 2 || n > 256 {
+		return 0, fmt.Errorf("%s expects a number of colors from 2 to 256 or auto, got %q", name, v)
+	}
+	return n, nil
+}
+
+// parseHexColor parses #rgb, #rgba, #rrggbb or #rrggbbaa (the # is optional).
+func parseHexColor(v string) (color.NRGBA, error) {
+	h := strings.TrimPrefix(strings.TrimSpace(v), "#")
+	if len(h) == 3 || len(h) == 4 {
+		var long strings.Builder
+		for _, r := range h {
+			long.WriteRune(r)
+			long.WriteRune(r)
+		}
+		h = long.String()
+	}
+	if len(h) == 6 {
+		h += "ff"
+	}
+	n, err := strconv.ParseUint(h, 16, 32)
+	if len(h) != 8 || err != nil {
+		return color.NRGBA{}, fmt.Errorf("invalid color %q, expected a hex color like #ffffff or #ffffff80", v)
+	}
+	return color.NRGBA{uint8(n >> 24), uint8(n >> 16), uint8(n >> 8), uint8(n)}, nil
+}
+
+func formatHexColor(c color.NRGBA) string {
+	if c.A == 0xff {
+		return fmt.Sprintf("#%02x%02x%02x", c.R, c.G, c.B)
+	}
+	return fmt.Sprintf("#%02x%02x%02x%02x", c.R, c.G, c.B, c.A)
+}
+
+// parsePixels parses a non-negative pixel count.
+func parsePixels(name, v string) (int, error) {
+	n, err := strconv.Atoi(v)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s expects a pixel count, got %q", name, v)
+	}
+	return n, nil
+}
+
+// saves tells whether a WebP of size webp saves enough over its source of
+// size src to replace it: it must be smaller by at least --min-savings.
+func (o options) saves(webp, src int64) bool {
+	return webp < src && (src-webp)*100 >= src*int64(o.minSavings)
+}
+
+// excluded reports whether an --exclude-regex pattern matches relPath.
+func (o options) excluded(relPath string) bool {
+	p := filepath.ToSlash(relPath)
+	for _, re := range o.excludeRegex {
+		if re.MatchString(p) {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedDir reports whether --exclude-regex leaves alone the files under
+// the folder relPath, so it needn't be read: a pattern matches its path with
+// a trailing slash, as `^static/raw/` does.
+func (o options) excludedDir(relPath string) bool {
+	return o.excluded(relPath + string(filepath.Separator))
+}
+
+// parseSince reads a --since value: a date like 2024-05-01 (local midnight),
+// an RFC 3339 time, or a duration like 72h counted back from now.
+func parseSince(v string, now time.Time) (time.Time, error) {
+	if d, err := time.ParseDuration(v); err == nil && d > 0 {
+		return now.Add(-d), nil
+	}
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	if t, err := time.ParseInLocation(time.DateOnly, v, time.Local); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("--since expects a date like 2024-05-01, an RFC 3339 time or a duration like 72h, got %q", v)
+}
+
+var sizeUnits = []struct {
+	suffix string
+	mult   float64
+}{
+	{"GB", 1 << 30}, {"MB", 1 << 20}, {"KB", 1 << 10},
+	{"G", 1 << 30}, {"M", 1 << 20}, {"K", 1 << 10},
+	{"B", 1},
+}
+
+// parseSize parses a byte count such as "200KB", "1.5MB" or "4096".
+// Units are binary (1KB = 1024 bytes) and case-insensitive.
+func parseSize(v string) (int64, error) {
+	s := strings.ToUpper(strings.TrimSpace(v))
+	mult := 1.0
+	for _, u := range sizeUnits {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			mult = u.mult
+			break
+		}
+	}
+	n, err := strconv.ParseFloat(s, 64)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("invalid size %q", v)
+	}
+	return int64(n * mult), nil
+}
+
+// formatSize renders a byte count the way parseSize reads it.
+func formatSize(n int64) string {
+	switch {
+	case n < 0:
+		return "-" + formatSize(-n)
+	case n >= 1<<30:
+		return fmt.Sprintf("%.1fGB", float64(n)/(1<<30))
+	case n >= 1<<20:
+		return fmt.Sprintf("%.1fMB", float64(n)/(1<<20))
+	case n >= 1<<10:
+		return fmt.Sprintf("%.1fKB", float64(n)/(1<<10))
+	}
+	return fmt.Sprintf("%dB", n)
+}
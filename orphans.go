@@ -0,0 +1,85 @@
+package webpcon
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type orphan struct {
+	Path string `json:"path"`
+	Size int64  `json:"size"`
+}
+
+type orphanReport struct {
+	Orphans    []orphan `json:"orphans"`
+	TotalSize  int64    `json:"totalSize"`
+	DynamicRef []string `json:"dynamicRefs"` // Files whose runtime-built paths may use some of the orphans
+}
+
+// listOrphans reports images, WebP included, that no source file in the
+// project references. It only reads.
+func listOrphans(root string, asJSON bool) error {
+	refs, err := scanRefs(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error scanning for image references: %v\n", err)
+		return err
+	}
+	pwaIcons, err := manifestIcons(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading web app manifest: %v\n", err)
+		return err
+	}
+
+	report := orphanReport{Orphans: []orphan{}, DynamicRef: refs.dynamic}
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if skipDirs[info.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		ext := strings.ToLower(filepath.Ext(info.Name()))
+		if skipFiles[info.Name()] || (!imageExt[ext] && ext != ".webp") {
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		if key := pathKey(rel); refs.images[key] || pwaIcons[key] != "" {
+			return nil
+		}
+		report.Orphans = append(report.Orphans, orphan{filepath.ToSlash(rel), info.Size()})
+		report.TotalSize += info.Size()
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		if report.DynamicRef == nil {
+			report.DynamicRef = []string{}
+		}
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, string(data))
+		return nil
+	}
+
+	width := 0
+	for _, o := range report.Orphans {
+		width = max(width, len(o.Path))
+	}
+	for _, o := range report.Orphans {
+		fmt.Fprintf(stdout, "   %-*s  %s\n", width, o.Path, formatSize(o.Size))
+	}
+	fmt.Fprintf(stdout, "🗑️  %d unreferenced image(s), %s in total\n", len(report.Orphans), formatSize(report.TotalSize))
+	refs.warnDynamic()
+	return nil
+}
@@ -0,0 +1,278 @@
+package webpcon
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// stdout is where everything meant for people is written. main points it
+// at stderr for --progress-ndjson and swaps emoji for tags with --no-emoji,
+// so nothing should write to os.Stdout directly.
+var (
+	stdout    io.Writer = os.Stdout
+	stdoutTTY           = isTerminal(os.Stdout)
+)
+
+// plainTags stand in for the emoji that start log lines with --no-emoji.
+var plainTags = []struct{ emoji, tag string }{
+	{"🔄", "[convert]"}, {"✅", "[ok]"}, {"❌", "[error]"}, {"⏭", "[skip]"}, {"⚠", "[warn]"},
+	{"💾", "[save]"}, {"🗑", "[delete]"}, {"🔎", "[info]"}, {"📊", "[summary]"}, {"📐", "[sample]"},
+	{"📋", "[list]"}, {"✏", "[edit]"}, {"⏸", "[stop]"}, {"⏳", "[busy]"}, {"⏪", "[revert]"},
+	{"↩", "[kept]"}, {"♻", "[dupe]"}, {"🔒", "[locked]"}, {"🔓", "[unlocked]"}, {"💽", "[disk]"},
+	{"⛔", "[refused]"}, {"…", "..."},
+}
+
+// plainReplacer swaps each emoji, with or without the emoji presentation
+// selector, and the padding after it for its tag and a single space, so
+// that nothing webpcon writes itself is outside ASCII.
+var plainReplacer = func() *strings.Replacer {
+	var pairs []string
+	for _, t := range plainTags {
+		for _, e := range []string{t.emoji + "\uFE0F", t.emoji} {
+			pairs = append(pairs, e+"  ", t.tag+" ", e+" ", t.tag+" ", e, t.tag)
+		}
+	}
+	// Left once the emoji are gone: a stray selector, and the µ of durations
+	pairs = append(pairs, "\uFE0F", "", "µ", "u")
+	return strings.NewReplacer(pairs...)
+}()
+
+// plainWriter writes through plainReplacer. Every write is a whole message,
+// so no emoji is ever split between writes.
+type plainWriter struct {
+	w io.Writer
+}
+
+func (p plainWriter) Write(b []byte) (int, error) {
+	if _, err := io.WriteString(p.w, plainReplacer.Replace(string(b))); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// ANSI styles. Everything colored goes through colorWriter or paint, which
+// both depend on colorOn, so JSON and NDJSON output never holds escape codes.
+const (
+	ansiReset  = "\x1b[0m"
+	ansiRed    = "\x1b[31m"
+	ansiGreen  = "\x1b[32m"
+	ansiYellow = "\x1b[33m"
+)
+
+// colorOn is set by main, see useColor.
+var colorOn bool
+
+// useColor tells whether to color the output for a --color value. auto
+// colors a terminal, unless NO_COLOR is set or TERM=dumb.
+func useColor(mode string, tty bool) bool {
+	switch mode {
+	case "always":
+		return true
+	case "never":
+		return false
+	}
+	return tty && os.Getenv("NO_COLOR") == "" && os.Getenv("TERM") != "dumb"
+}
+
+// lineColors color whole log lines by the emoji they start with.
+var lineColors = []struct{ emoji, color string }{
+	{"✅", ansiGreen}, {"❌", ansiRed}, {"⛔", ansiRed}, {"⏭", ansiYellow}, {"⚠", ansiYellow},
+}
+
+// colorWriter colors the lines written through it by their status: done,
+// skipped or failed. Other lines pass as they are. It wraps plainWriter, so
+// it sees the emoji even with --no-emoji.
+type colorWriter struct {
+	w io.Writer
+}
+
+func (c colorWriter) Write(b []byte) (int, error) {
+	lines := strings.SplitAfter(string(b), "\n")
+	for i, line := range lines {
+		for _, lc := range lineColors {
+			if strings.HasPrefix(line, lc.emoji) {
+				text := strings.TrimSuffix(line, "\n")
+				lines[i] = lc.color + text + ansiReset + line[len(text):]
+				break
+			}
+		}
+	}
+	if _, err := io.WriteString(c.w, strings.Join(lines, "")); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// setupOutput points stdout where opts say the log goes. With
+// --progress-ndjson the events get os.Stdout to themselves and everything
+// else, down to the warnings parseOptions collected, goes to stderr.
+func setupOutput(opts *options) {
+	if opts.progressNDJSON {
+		opts.progress = newProgress(os.Stdout)
+		stdout, stdoutTTY = os.Stderr, isTerminal(os.Stderr)
+	}
+	if opts.noEmoji || (!opts.set["no-emoji"] && !emojiSupported()) {
+		stdout = plainWriter{stdout}
+	}
+	if colorOn = useColor(opts.color, stdoutTTY); colorOn {
+		stdout = colorWriter{stdout}
+	}
+}
+
+// logsToStderr sends the log to stderr while a command's report has stdout
+// to itself. --no-emoji still applies, colors don't. It returns the function
+// putting stdout back.
+func logsToStderr() (restore func()) {
+	prev := stdout
+	w := prev
+	if c, ok := w.(colorWriter); ok {
+		w = c.w
+	}
+	if _, plain := w.(plainWriter); plain {
+		stdout = plainWriter{os.Stderr}
+	} else {
+		stdout = os.Stderr
+	}
+	return func() { stdout = prev }
+}
+
+// paint colors s when colors are on.
+func paint(color, s string) string {
+	if !colorOn {
+		return s
+	}
+	return color + s + ansiReset
+}
+
+// emojiSupported guesses whether the output can show emoji. NO_COLOR and
+// TERM=dumb ask for plain output, and so does a locale or console code page
+// that isn't UTF-8.
+func emojiSupported() bool {
+	if os.Getenv("NO_COLOR") != "" || os.Getenv("TERM") == "dumb" {
+		return false
+	}
+	return outputUTF8()
+}
+
+// statusWidth caps the live status line so it never wraps.
+const statusWidth = 72
+
+// console is where a conversion run's output goes. Every line passes through
+// one goroutine, and a file's lines are held back until the file is done and
+// then written together, so files converted side by side never interleave.
+// On a terminal, a status line shows the file being worked on.
+type console struct {
+	w      io.Writer
+	tty    bool
+	events chan consoleEvent
+	closed chan struct{}
+}
+
+// consoleEvent is one message to the console goroutine.
+type consoleEvent struct {
+	file string // "" for lines about the run as a whole
+	line string
+	done bool // The file is finished; write its lines
+}
+
+// fileLog collects the output about one file.
+type fileLog struct {
+	c    *console
+	file string
+}
+
+func newConsole(w io.Writer, tty bool) *console {
+	c := &console{w: w, tty: tty, events: make(chan consoleEvent, 64), closed: make(chan struct{})}
+	go c.run()
+	return c
+}
+
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+func (c *console) run() {
+	pending := map[string][]string{}
+	var active []string // Files with output held back, oldest first
+	status := ""        // The status line on screen
+	clearStatus := func() {
+		if status != "" {
+			fmt.Fprint(c.w, "\r"+strings.Repeat(" ", len([]rune(status))+1)+"\r")
+			status = ""
+		}
+	}
+
+	for ev := range c.events {
+		switch {
+		case ev.file == "":
+			clearStatus()
+			fmt.Fprint(c.w, ev.line)
+		case ev.done:
+			clearStatus()
+			for _, line := range pending[ev.file] {
+				fmt.Fprint(c.w, line)
+			}
+			delete(pending, ev.file)
+			for i, f := range active {
+				if f == ev.file {
+					active = append(active[:i], active[i+1:]...)
+					break
+				}
+			}
+		default:
+			if _, ok := pending[ev.file]; !ok {
+				active = append(active, ev.file)
+			}
+			pending[ev.file] = append(pending[ev.file], ev.line)
+		}
+
+		if c.tty && len(active) > 0 {
+			line := "⏳ " + active[0]
+			if len(active) > 1 {
+				line += fmt.Sprintf(" (+%d)", len(active)-1)
+			}
+			if r := []rune(line); len(r) > statusWidth {
+				line = "⏳ …" + string(r[len(r)-statusWidth+3:])
+			}
+			if line != status {
+				clearStatus()
+				fmt.Fprint(c.w, line)
+				status = line
+			}
+		}
+	}
+	clearStatus()
+	close(c.closed)
+}
+
+// file returns the log for one file. Its lines show up once done is called.
+func (c *console) file(name string) *fileLog {
+	return &fileLog{c: c, file: name}
+}
+
+// printf writes a line about the run as a whole right away.
+func (c *console) printf(format string, a ...any) {
+	c.events <- consoleEvent{line: fmt.Sprintf(format, a...)}
+}
+
+// close writes what is left and waits for the console goroutine to finish.
+func (c *console) close() {
+	close(c.events)
+	<-c.closed
+}
+
+func (l *fileLog) printf(format string, a ...any) {
+	l.c.events <- consoleEvent{file: l.file, line: fmt.Sprintf(format, a...)}
+}
+
+func (l *fileLog) println(a ...any) {
+	l.c.events <- consoleEvent{file: l.file, line: fmt.Sprintln(a...)}
+}
+
+// done writes the file's lines together.
+func (l *fileLog) done() {
+	l.c.events <- consoleEvent{file: l.file, done: true}
+}
@@ -0,0 +1,157 @@
+package webpcon
+
+import (
+	"bytes"
+	"encoding/json"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// nonASCII returns the first rune of s outside ASCII, or -1.
+func nonASCII(s string) rune {
+	for _, r := range s {
+		if r >= utf8.RuneSelf {
+			return r
+		}
+	}
+	return -1
+}
+
+// swapStdio points os.Stdin, os.Stdout and os.Stderr at the files in, out
+// and err in a new folder, which it returns, until the test ends.
+func swapStdio(tb testing.TB) string {
+	tb.Helper()
+	dir := tb.TempDir()
+	files := map[string]**os.File{"in": &os.Stdin, "out": &os.Stdout, "err": &os.Stderr}
+	for name, f := range files {
+		saved := *f
+		var err error
+		if *f, err = os.OpenFile(filepath.Join(dir, name), os.O_RDWR|os.O_CREATE, 0644); err != nil {
+			tb.Fatal(err)
+		}
+		tb.Cleanup(func() { (*f).Close(); *f = saved })
+	}
+	return dir
+}
+
+// TestPlainLiterals passes every string literal in the source through
+// plainReplacer, so a message with a glyph plainTags doesn't know fails here
+// rather than in someone's CI log. Literals that aren't UTF-8 are file
+// signatures and the like, never printed.
+func TestPlainLiterals(t *testing.T) {
+	files, err := filepath.Glob("*.go")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fset := token.NewFileSet()
+	for _, name := range files {
+		if strings.HasSuffix(name, "_test.go") {
+			continue
+		}
+		f, err := parser.ParseFile(fset, name, nil, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ast.Inspect(f, func(n ast.Node) bool {
+			lit, ok := n.(*ast.BasicLit)
+			if !ok || lit.Kind != token.STRING {
+				return true
+			}
+			s, err := strconv.Unquote(lit.Value)
+			if err != nil || !utf8.ValidString(s) {
+				return true
+			}
+			if r := nonASCII(plainReplacer.Replace(s)); r >= 0 {
+				t.Errorf("%s: %q keeps %q (%U) with --no-emoji", fset.Position(lit.Pos()), s, r, r)
+			}
+			return true
+		})
+	}
+}
+
+func TestPlainWriter(t *testing.T) {
+	var b bytes.Buffer
+	w := plainWriter{&b}
+	for _, msg := range []string{
+		"✅ Converted (lossless): a.png -> a.webp\n",
+		"⚠️  Post-hook failed for a.png\n",
+		"⏭️ Skipping a.gif (animated)\n",
+		"↩️️ kept\n",
+		"took " + (350 * time.Microsecond).String() + "\n",
+	} {
+		w.Write([]byte(msg))
+	}
+	want := "[ok] Converted (lossless): a.png -> a.webp\n[warn] Post-hook failed for a.png\n[skip] Skipping a.gif (animated)\n[kept] kept\ntook 350us\n"
+	if b.String() != want {
+		t.Errorf("plainWriter wrote\n%s\nwant\n%s", &b, want)
+	}
+}
+
+// TestNoEmojiRun checks a whole run, with images skipped, converted and
+// failing, and the commands after it, writes nothing outside ASCII. File
+// names are printed as they are, so the fixtures here are all ASCII.
+func TestNoEmojiRun(t *testing.T) {
+	log := quietly(t)
+	stdout = plainWriter{log}
+	var files []fixtureFile
+	for _, ext := range fixtureFormats {
+		files = append(files, fixtureFile{"img/" + ext[1:] + ext, encodeFixture(t, ext, 16, 12)})
+	}
+	files = append(files, fixtureFile{"tiny.png", encodeFixture(t, ".png", 4, 4)})
+	root := writeFixtureTree(t, files)
+
+	convertTree(t, root, testOptions(t, "--encoder", "native", "--min-width", "8"))
+	if err := listRuns(root, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "broken.png"), []byte("not an image"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := convertImages(root, testOptions(t, "--encoder", "native")); err == nil {
+		t.Fatal("broken.png converted")
+	}
+	if err := revertImages(root); err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"[error]", "[ok]", "[skip]"} {
+		if !strings.Contains(log.String(), tag) {
+			t.Errorf("no %s line", tag)
+		}
+	}
+	for i, line := range strings.Split(log.String(), "\n") {
+		if r := nonASCII(line); r >= 0 {
+			t.Errorf("line %d has %q: %s", i+1, r, line)
+		}
+	}
+}
+
+// TestNDJSONWarnings checks --progress-ndjson leaves stdout to the events,
+// down to the warnings about ignored settings.
+func TestNDJSONWarnings(t *testing.T) {
+	quietly(t)
+	savedColor := colorOn
+	t.Cleanup(func() { colorOn = savedColor })
+	dir := swapStdio(t)
+	opts := testOptions(t, "--progress-ndjson", "--encoder", "native", "--quality", "60")
+	setupOutput(&opts)
+	opts.printWarnings()
+	opts.progress.runStarted(1)
+
+	out, _ := os.ReadFile(filepath.Join(dir, "out"))
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		if !json.Valid([]byte(line)) {
+			t.Errorf("stdout line %q isn't JSON", line)
+		}
+	}
+	if log, _ := os.ReadFile(filepath.Join(dir, "err")); !bytes.Contains(log, []byte("only writes lossless WebP")) {
+		t.Errorf("stderr = %q, want the lossless-only warning", log)
+	}
+}
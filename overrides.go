@@ -0,0 +1,322 @@
+package webpcon
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	sidecarExt    = ".webpcon"      // hero.png.webpcon applies to hero.png only
+	dirConfigName = ".webpcon.json" // Applies to everything beneath its directory
+)
+
+// fileOverrides are the settings a sidecar or directory config may change.
+// Pointers tell "not set" apart from zero values.
+type fileOverrides struct {
+	Preset       *string  `json:"preset"`
+	Quality      *float32 `json:"quality"`
+	AlphaQuality *int     `json:"alphaQuality"`
+	Lossless     *bool    `json:"lossless"`
+	NearLossless *int     `json:"nearLossless"`
+	Exact        *bool    `json:"exact"`
+	SharpYUV     *bool    `json:"sharpYuv"`
+	Grayscale    *bool    `json:"grayscale"`
+	ConvertSRGB  *bool    `json:"convertToSrgb"`
+	Flatten      *string  `json:"flatten"` // Hex color, or "" to turn flattening off
+	TargetSize   *string  `json:"targetSize"`
+	MaxWidth     *int     `json:"maxWidth"`
+	MaxHeight    *int     `json:"maxHeight"`
+
+	// Settings for the files of one extension, by lower-case extension like
+	// ".jpg". Only directory configs have them.
+	Extensions map[string]*fileOverrides `json:"extensions"`
+}
+
+// extensionDefaults are "extensions" settings that hold unless a directory
+// config or sidecar says otherwise. JPEG sources are already lossy, so
+// near-lossless would only inflate them: they stay lossy.
+var extensionDefaults = func() map[string]*fileOverrides {
+	off := -1
+	jpeg := &fileOverrides{NearLossless: &off}
+	return map[string]*fileOverrides{".jpg": jpeg, ".jpeg": jpeg, ".jpe": jpeg, ".jfif": jpeg}
+}()
+
+// resolveOptions computes the settings for one file with extension ext: the
+// command line first, then each directory config from the root down, then
+// the extensionDefaults for ext and each directory config's section for it,
+// again from the root down, then the sidecar, so the nearest and most
+// specific setting wins. It touches nothing on disk.
+func resolveOptions(global options, ext string, dirChain []*fileOverrides, sidecar *fileOverrides) (options, error) {
+	opts := global
+	opts.set = make(map[string]bool, len(global.set))
+	for k, v := range global.set {
+		opts.set[k] = v
+	}
+	for _, o := range dirChain {
+		if o == nil {
+			continue
+		}
+		if err := o.apply(&opts); err != nil {
+			return global, err
+		}
+	}
+	opts = opts.withExtensionDefaults(ext)
+	for _, o := range dirChain {
+		if o == nil || o.Extensions[ext] == nil {
+			continue
+		}
+		if err := o.Extensions[ext].apply(&opts); err != nil {
+			return global, fmt.Errorf("extensions %s: %v", ext, err)
+		}
+	}
+	if sidecar != nil {
+		if err := sidecar.apply(&opts); err != nil {
+			return global, err
+		}
+	}
+	return opts, nil
+}
+
+// withExtensionDefaults applies the extensionDefaults for ext to opts, unless
+// they were already resolved for an extension, so the settings of a
+// directory config's section stand. They are defaults, so they don't count
+// as set: a preset applied after them still fills in what they leave.
+func (o options) withExtensionDefaults(ext string) options {
+	if o.extension != "" {
+		return o
+	}
+	o.extension = strings.ToLower(ext)
+	d := extensionDefaults[o.extension]
+	if d == nil {
+		return o
+	}
+	set := o.set
+	o.set = map[string]bool{}
+	d.apply(&o)
+	o.set = set
+	return o
+}
+
+func (o *fileOverrides) apply(opts *options) error {
+	if o.Preset != nil {
+		p, ok := presets[*o.Preset]
+		if !ok {
+			return fmt.Errorf("unknown preset %q", *o.Preset)
+		}
+		opts.preset = *o.Preset
+		p.apply(opts)
+	}
+	// Each of quality, lossless and nearLossless picks the encoding mode, so the
+	// one set nearest to the file replaces whatever mode was inherited
+	if o.Quality != nil {
+		if *o.Quality < 0 || *o.Quality > 100 {
+			return fmt.Errorf("quality must be between 0 and 100")
+		}
+		opts.quality, opts.lossless, opts.nearLossless = *o.Quality, false, -1
+		opts.set["quality"] = true
+	}
+	if o.Lossless != nil {
+		opts.lossless = *o.Lossless
+		if opts.lossless {
+			opts.nearLossless = -1
+		}
+		opts.set["lossless"] = true
+	}
+	if o.NearLossless != nil {
+		if *o.NearLossless < -1 || *o.NearLossless > 100 {
+			return fmt.Errorf("nearLossless must be between 0 and 100 (or -1 to turn it off)")
+		}
+		// -1 only turns near-lossless off, and leaves lossless as it was
+		opts.nearLossless = *o.NearLossless
+		if opts.nearLossless >= 0 {
+			opts.lossless = false
+		}
+		opts.set["near-lossless"] = true
+	}
+	if o.AlphaQuality != nil {
+		if *o.AlphaQuality < 0 || *o.AlphaQuality > 100 {
+			return fmt.Errorf("alphaQuality must be between 0 and 100")
+		}
+		opts.alphaQuality = *o.AlphaQuality
+		opts.set["alpha-quality"] = true
+	}
+	if o.MaxWidth != nil {
+		if *o.MaxWidth < 0 {
+			return fmt.Errorf("maxWidth must not be negative")
+		}
+		opts.maxWidth = *o.MaxWidth
+		opts.set["max-width"] = true
+	}
+	if o.MaxHeight != nil {
+		if *o.MaxHeight < 0 {
+			return fmt.Errorf("maxHeight must not be negative")
+		}
+		opts.maxHeight = *o.MaxHeight
+		opts.set["max-height"] = true
+	}
+	if o.Exact != nil {
+		opts.exact = *o.Exact
+		opts.set["exact"] = true
+	}
+	if o.SharpYUV != nil {
+		opts.sharpYUV = *o.SharpYUV
+		opts.set["sharp-yuv"] = true
+	}
+	if o.Grayscale != nil {
+		opts.grayscale = *o.Grayscale
+		opts.set["grayscale"] = true
+	}
+	if o.ConvertSRGB != nil {
+		opts.toSRGB = *o.ConvertSRGB
+		opts.set["convert-to-srgb"] = true
+	}
+	if o.Flatten != nil {
+		opts.flatten = nil
+		if *o.Flatten != "" {
+			c, err := parseHexColor(*o.Flatten)
+			if err != nil {
+				return err
+			}
+			opts.flatten = &c
+		}
+		opts.set["flatten"] = true
+	}
+	if o.TargetSize != nil {
+		n, err := parseSize(*o.TargetSize)
+		if err != nil {
+			return fmt.Errorf("targetSize: %v", err)
+		}
+		opts.targetSize = n
+		opts.set["target-size"] = true
+	}
+	return nil
+}
+
+// overrideLoader reads sidecars and directory configs, caching the latter
+// since every file in a directory needs them.
+type overrideLoader struct {
+	root string
+	fsys fs.FS // The project under root, where the settings are read
+	dirs map[string]*fileOverrides
+}
+
+func newOverrideLoader(root string) *overrideLoader {
+	return newOverrideLoaderFS(root, osTree(root))
+}
+
+// newOverrideLoaderFS is newOverrideLoader for a project read through fsys.
+// Paths given to it still start with root.
+func newOverrideLoaderFS(root string, fsys fs.FS) *overrideLoader {
+	return &overrideLoader{root: root, fsys: fsys, dirs: map[string]*fileOverrides{}}
+}
+
+// optionsFor returns the effective settings for the image at path.
+func (l *overrideLoader) optionsFor(path string, global options) (options, error) {
+	var chain []*fileOverrides
+	rel, err := filepath.Rel(l.root, filepath.Dir(path))
+	if err != nil {
+		return global, err
+	}
+	dir := l.root
+	for _, part := range append([]string{""}, splitPath(rel)...) {
+		dir = filepath.Join(dir, part)
+		o, err := l.dirConfig(dir)
+		if err != nil {
+			return global, err
+		}
+		chain = append(chain, o)
+	}
+
+	sidecarPath := path + sidecarExt
+	sidecar, err := l.read(sidecarPath)
+	if err != nil {
+		return global, err
+	}
+	if sidecar != nil && sidecar.Extensions != nil {
+		return global, fmt.Errorf("%s: extensions only apply in %s", sidecarPath, dirConfigName)
+	}
+	opts, err := resolveOptions(global, strings.ToLower(filepath.Ext(path)), chain, sidecar)
+	if err != nil {
+		return global, fmt.Errorf("invalid overrides for %s: %v", path, err)
+	}
+	return opts, nil
+}
+
+func (l *overrideLoader) dirConfig(dir string) (*fileOverrides, error) {
+	if o, ok := l.dirs[dir]; ok {
+		return o, nil
+	}
+	o, err := l.read(filepath.Join(dir, dirConfigName))
+	if err != nil {
+		return nil, err
+	}
+	l.dirs[dir] = o
+	return o, nil
+}
+
+// read reads the settings at path, under l.root. It returns nil when the file
+// doesn't exist. Unknown keys are an error so a typo doesn't silently fall
+// back to the defaults.
+func (l *overrideLoader) read(path string) (*fileOverrides, error) {
+	rel, err := filepath.Rel(l.root, path)
+	if err != nil {
+		return nil, err
+	}
+	data, err := fs.ReadFile(l.fsys, treeName(rel))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	o, err := parseOverrides(data)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %v", path, err)
+	}
+	return o, nil
+}
+
+// parseOverrides reads override settings from JSON, rejecting unknown keys
+// so typos don't go unnoticed.
+func parseOverrides(data []byte) (*fileOverrides, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	var o fileOverrides
+	if err := dec.Decode(&o); err != nil {
+		return nil, err
+	}
+	// Keys are matched in lower case, with or without the dot
+	if o.Extensions != nil {
+		exts := make(map[string]*fileOverrides, len(o.Extensions))
+		for ext, section := range o.Extensions {
+			key := strings.ToLower(ext)
+			if !strings.HasPrefix(key, ".") {
+				key = "." + key
+			}
+			if key == "." || strings.ContainsAny(key[1:], "./\\") {
+				return nil, fmt.Errorf("extensions: %q is not a file extension", ext)
+			}
+			if section == nil || section.Extensions != nil {
+				return nil, fmt.Errorf("extensions %s: expected settings, without extensions of their own", ext)
+			}
+			if exts[key] != nil {
+				return nil, fmt.Errorf("extensions: %s given twice", key)
+			}
+			exts[key] = section
+		}
+		o.Extensions = exts
+	}
+	return &o, nil
+}
+
+func splitPath(rel string) []string {
+	if rel == "." || rel == "" {
+		return nil
+	}
+	return strings.Split(filepath.ToSlash(rel), "/")
+}
@@ -0,0 +1,233 @@
+package webpcon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// resolved is what the option tests compare of the effective options.
+type resolved struct {
+	quality      float32
+	lossless     bool
+	nearLossless int
+	alphaQuality int
+	maxWidth     int
+	exact        bool
+	preset       string
+}
+
+func resolvedOf(o options) resolved {
+	return resolved{o.quality, o.lossless, o.nearLossless, o.alphaQuality, o.maxWidth, o.exact, o.preset}
+}
+
+func TestResolveOptions(t *testing.T) {
+	tests := []struct {
+		name    string
+		args    []string // The command line
+		dirs    []string // Directory configs, from the root down, "" for none
+		sidecar string   // "" for none
+		want    resolved
+		wantErr bool
+	}{
+		{"command line only", []string{"--quality", "70"}, nil, "",
+			resolved{70, false, -1, 100, 0, false, ""}, false},
+		{"directory", nil, []string{`{"lossless": true}`}, "",
+			resolved{80, true, -1, 100, 0, false, ""}, false},
+		{"sidecar beats directory", nil, []string{`{"lossless": true}`}, `{"quality": 60}`,
+			resolved{60, false, -1, 100, 0, false, ""}, false},
+		{"nearest directory wins", nil, []string{`{"quality": 50, "maxWidth": 800, "exact": true}`, "", `{"quality": 70}`}, "",
+			resolved{70, false, -1, 100, 800, true, ""}, false},
+		{"directory beats command line", []string{"--lossless", "--max-width", "640"}, []string{`{"quality": 75}`}, `{"maxWidth": 1280}`,
+			resolved{75, false, -1, 100, 1280, false, ""}, false},
+		{"near-lossless replaces lossless", nil, []string{`{"lossless": true}`}, `{"nearLossless": 60}`,
+			resolved{80, false, 60, 100, 0, false, ""}, false},
+		{"lossless replaces near-lossless", []string{"--near-lossless", "40"}, nil, `{"lossless": true}`,
+			resolved{80, true, -1, 100, 0, false, ""}, false},
+		{"maxWidth 0 turns resizing off", []string{"--max-width", "640"}, nil, `{"maxWidth": 0}`,
+			resolved{80, false, -1, 100, 0, false, ""}, false},
+		{"preset", nil, []string{`{"preset": "icon"}`}, "",
+			resolved{80, true, -1, 100, 0, true, "icon"}, false},
+		{"explicit quality beats a preset", []string{"--quality", "90"}, []string{`{"preset": "photo"}`}, "",
+			resolved{90, false, -1, 90, 0, false, "photo"}, false},
+		{"preset then setting", nil, []string{`{"preset": "icon"}`}, `{"exact": false, "alphaQuality": 50}`,
+			resolved{80, true, -1, 50, 0, false, "icon"}, false},
+		{"quality out of range", nil, nil, `{"quality": 101}`, resolved{}, true},
+		{"near-lossless out of range", nil, []string{`{"nearLossless": -2}`}, "", resolved{}, true},
+		{"negative maxWidth", nil, []string{`{"maxWidth": -1}`}, "", resolved{}, true},
+		{"unknown preset", nil, []string{`{"preset": "poster"}`}, "", resolved{}, true},
+		{"bad flatten colour", nil, nil, `{"flatten": "#12"}`, resolved{}, true},
+		{"bad target size", nil, nil, `{"targetSize": "big"}`, resolved{}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			global := testOptions(t, tt.args...)
+			setBefore := len(global.set)
+			var chain []*fileOverrides
+			for _, d := range tt.dirs {
+				chain = append(chain, overridesOf(t, d))
+			}
+			got, err := resolveOptions(global, ".png", chain, overridesOf(t, tt.sidecar))
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("no error, resolved %+v", resolvedOf(got))
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r := resolvedOf(got); r != tt.want {
+				t.Errorf("resolved %+v, want %+v", r, tt.want)
+			}
+			if len(global.set) != setBefore {
+				t.Error("resolveOptions changed the command line options")
+			}
+		})
+	}
+}
+
+// TestResolveExtensions checks the "extensions" sections of directory
+// configs, and the built-in defaults they replace.
+func TestResolveExtensions(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		args    []string
+		ext     string
+		dirs    []string
+		sidecar string
+		want    resolved
+	}{
+		{"jpeg stays lossy", []string{"--near-lossless", "60"}, ".jpg", nil, "",
+			resolved{80, false, -1, 100, 0, false, ""}},
+		{"png takes near-lossless", []string{"--near-lossless", "60"}, ".png", nil, "",
+			resolved{80, false, 60, 100, 0, false, ""}},
+		{"jpeg under a screenshot preset", []string{"--preset", "screenshot"}, ".jpeg", nil, "",
+			resolved{90, false, -1, 100, 0, false, "screenshot"}},
+		{"jpeg under a directory's near-lossless", nil, ".jpg", []string{`{"nearLossless": 60}`}, "",
+			resolved{80, false, -1, 100, 0, false, ""}},
+		{"section turns near-lossless on for jpeg", []string{"--near-lossless", "60"}, ".jpg",
+			[]string{`{"extensions": {".jpg": {"nearLossless": 80}}}`}, "",
+			resolved{80, false, 80, 100, 0, false, ""}},
+		{"section beats the directory's settings", nil, ".png",
+			[]string{`{"lossless": true, "extensions": {"PNG": {"quality": 70}}}`}, "",
+			resolved{70, false, -1, 100, 0, false, ""}},
+		{"section of another extension", nil, ".png",
+			[]string{`{"extensions": {".gif": {"quality": 70}}}`}, "",
+			resolved{80, false, -1, 100, 0, false, ""}},
+		{"nearest section wins", nil, ".png",
+			[]string{`{"extensions": {".png": {"quality": 70, "maxWidth": 800}}}`, `{"quality": 50, "extensions": {".png": {"quality": 60}}}`}, "",
+			resolved{60, false, -1, 100, 800, false, ""}},
+		{"sidecar beats a section", nil, ".jpg",
+			[]string{`{"extensions": {".jpg": {"nearLossless": 80}}}`}, `{"nearLossless": 20}`,
+			resolved{80, false, 20, 100, 0, false, ""}},
+		{"turning near-lossless off keeps lossless", []string{"--lossless"}, ".png",
+			[]string{`{"extensions": {".png": {"nearLossless": -1}}}`}, "",
+			resolved{80, true, -1, 100, 0, false, ""}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var chain []*fileOverrides
+			for _, d := range tt.dirs {
+				chain = append(chain, overridesOf(t, d))
+			}
+			got, err := resolveOptions(testOptions(t, tt.args...), tt.ext, chain, overridesOf(t, tt.sidecar))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if r := resolvedOf(got); r != tt.want {
+				t.Errorf("resolved %+v, want %+v", r, tt.want)
+			}
+			// Resolved options keep their settings through the stream path
+			if r := resolvedOf(got.withExtensionDefaults(".jpg")); r != tt.want {
+				t.Errorf("after the defaults again: %+v, want %+v", r, tt.want)
+			}
+		})
+	}
+}
+
+// overridesOf parses s, or returns nil for "".
+func overridesOf(tb testing.TB, s string) *fileOverrides {
+	tb.Helper()
+	if s == "" {
+		return nil
+	}
+	o, err := parseOverrides([]byte(s))
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return o
+}
+
+func TestParseOverrides(t *testing.T) {
+	if _, err := parseOverrides([]byte(`{"lossles": true}`)); err == nil {
+		t.Error("a misspelt key was accepted")
+	}
+	if _, err := parseOverrides([]byte(`{"quality": "high"}`)); err == nil {
+		t.Error("a string quality was accepted")
+	}
+	o, err := parseOverrides([]byte(`{"extensions": {"JPG": {"quality": 70}, ".Png": {"lossless": true}}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if o.Extensions[".jpg"] == nil || o.Extensions[".png"] == nil || len(o.Extensions) != 2 {
+		t.Errorf("extensions read as %v, want .jpg and .png", o.Extensions)
+	}
+	for _, bad := range []string{
+		`{"extensions": {".": {}}}`,
+		`{"extensions": {"a/b": {}}}`,
+		`{"extensions": {".tar.gz": {}}}`,
+		`{"extensions": {".jpg": null}}`,
+		`{"extensions": {".jpg": {"extensions": {}}}}`,
+		`{"extensions": {"jpg": {}, ".JPG": {}}}`,
+		`{"extensions": {".jpg": {"qualty": 70}}}`,
+	} {
+		if _, err := parseOverrides([]byte(bad)); err == nil {
+			t.Errorf("%s was accepted", bad)
+		}
+	}
+}
+
+// TestOptionsFor reads the configs of a tree on disk.
+func TestOptionsFor(t *testing.T) {
+	root := t.TempDir()
+	files := map[string]string{
+		dirConfigName:                        `{"quality": 50, "extensions": {".jpg": {"quality": 85}}}`,
+		"a/b/" + dirConfigName:               `{"maxWidth": 1280}`,
+		"a/b/hero.png" + sidecarExt:          `{"lossless": true}`,
+		"typo/" + dirConfigName:              `{"maxWidht": 1280}`,
+		"a/b/c/ignored.png" + ".webpcon.bak": `{"quality": 10}`,
+		"sections/photo.jpg" + sidecarExt:    `{"extensions": {".jpg": {"quality": 70}}}`,
+	}
+	for rel, data := range files {
+		path := filepath.Join(root, filepath.FromSlash(rel))
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	l := newOverrideLoader(root)
+	global := testOptions(t, "--max-width", "640")
+	for rel, want := range map[string]resolved{
+		"top.png":           {50, false, -1, 100, 640, false, ""},
+		"a/b/hero.png":      {50, true, -1, 100, 1280, false, ""},
+		"a/b/other.png":     {50, false, -1, 100, 1280, false, ""},
+		"a/b/c/ignored.png": {50, false, -1, 100, 1280, false, ""},
+		"a/b/photo.JPG":     {85, false, -1, 100, 1280, false, ""},
+	} {
+		got, err := l.optionsFor(filepath.Join(root, filepath.FromSlash(rel)), global)
+		if err != nil {
+			t.Fatalf("%s: %v", rel, err)
+		}
+		if r := resolvedOf(got); r != want {
+			t.Errorf("%s: resolved %+v, want %+v", rel, r, want)
+		}
+	}
+	if _, err := l.optionsFor(filepath.Join(root, "typo", "pic.png"), global); err == nil {
+		t.Error("a misspelt key in a directory config was accepted")
+	}
+	if _, err := l.optionsFor(filepath.Join(root, "sections", "photo.jpg"), global); err == nil {
+		t.Error("a sidecar with extensions was accepted")
+	}
+}
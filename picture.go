@@ -0,0 +1,95 @@
+package webpcon
+
+import (
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+// htmlTag is a start or end tag found by scanTags, at doc[start:stop].
+type htmlTag struct {
+	name        string // Lower case
+	end         bool
+	start, stop int
+	attrs       map[string]string // Lower case names, unescaped values
+}
+
+// scanTags lists the tags of an HTML document in order, as the x/net/html
+// tokenizer reads them, so comments, doctypes and the content of script,
+// style and the like don't count. It only reads the document: callers change
+// it by splicing at the tags' offsets, so everything else comes out byte for
+// byte as it was.
+func scanTags(doc string) []htmlTag {
+	var tags []htmlTag
+	z := html.NewTokenizer(strings.NewReader(doc))
+	pos := 0
+	for {
+		tt := z.Next()
+		if tt == html.ErrorToken {
+			return tags
+		}
+		start := pos
+		pos += len(z.Raw())
+		if tt != html.StartTagToken && tt != html.SelfClosingTagToken && tt != html.EndTagToken {
+			continue
+		}
+		name, more := z.TagName()
+		tag := htmlTag{name: string(name), end: tt == html.EndTagToken, start: start, stop: pos, attrs: map[string]string{}}
+		for more {
+			var k, v []byte
+			k, v, more = z.TagAttr()
+			if _, ok := tag.attrs[string(k)]; !ok {
+				tag.attrs[string(k)] = string(v) // The first one counts, as in browsers
+			}
+		}
+		tags = append(tags, tag)
+	}
+}
+
+// rewritePicture wraps each <img> pointing at a converted image in a
+// <picture> offering the WebP, for browsers to pick without content
+// negotiation:
+//
+//	<picture><source type="image/webp" srcset="x.webp"><img src="x.png"></picture>
+//
+// The <img> is left exactly as it was and keeps loading the original's
+// --fallback copy where WebP isn't supported. Tags already in a <picture>,
+// and tags with a srcset of their own, are left alone. Nothing else in the
+// file changes. It returns the new text with the number of tags wrapped.
+func (m *mapping) rewritePicture(root, dir, text string, _ bool) (string, int) {
+	var b strings.Builder
+	last, depth, n := 0, 0, 0
+	for _, tag := range scanTags(text) {
+		switch {
+		case tag.name == "picture" && tag.end:
+			depth = max(depth-1, 0)
+		case tag.name == "picture":
+			depth++
+		case tag.name == "img" && !tag.end && depth == 0:
+			src, ok := tag.attrs["src"]
+			if _, srcset := tag.attrs["srcset"]; !ok || srcset {
+				continue
+			}
+			e := m.resolveRef(root, dir, src)
+			if e == nil || e.Fallback == "" {
+				continue
+			}
+			path := src
+			if i := strings.IndexAny(path, "?#"); i >= 0 {
+				path = path[:i]
+			}
+			webp := html.EscapeString(e.webpRef(path) + src[len(path):])
+			b.WriteString(text[last:tag.start])
+			b.WriteString(`<picture><source type="image/webp" srcset="` + webp + `">`)
+			b.WriteString(text[tag.start:tag.stop])
+			b.WriteString("</picture>")
+			last = tag.stop
+			n++
+		}
+	}
+	if n == 0 {
+		return text, 0
+	}
+	b.WriteString(text[last:])
+	return b.String(), n
+}
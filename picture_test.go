@@ -0,0 +1,77 @@
+package webpcon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// pictureMapping returns a map with img/a.png converted to img/a.webp, which
+// exists under root, and a fallback kept for it.
+func pictureMapping(t *testing.T) (m *mapping, root string) {
+	t.Helper()
+	root = t.TempDir()
+	if err := os.MkdirAll(filepath.Join(root, "img"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "img", "a.webp"), []byte("RIFF"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	m = &mapping{entries: map[string]*mapEntry{
+		pathKey("img/a.png"): {WebP: "img/a.webp", Fallback: "img/a.png"},
+	}, picture: true}
+	return m, root
+}
+
+func TestRewritePictureUnchanged(t *testing.T) {
+	m, root := pictureMapping(t)
+	for _, doc := range []string{
+		"",
+		"<!DOCTYPE html>\r\n<html><body><p>No images <b>here</b></p></body></html>\r\n",
+		`<img src="img/other.png">`,
+		`<img src="https://example.com/img/a.png">`,
+		`<img src="img/a.png" srcset="img/a.png 2x">`,
+		`<picture><source srcset="x.avif"><IMG SRC="img/a.png"></picture>`,
+		`<!-- <img src="img/a.png"> -->`,
+		`<script>document.write('<img src="img/a.png">')</script>`,
+		`<style>/* <img src="img/a.png"> */</style>`,
+		`<textarea><img src="img/a.png"></textarea>`,
+		"<p a='1' b=2 c>\tOdd   spacing\n< not a tag &amp; <3</p>",
+		`<img src="img/a.png"`,
+	} {
+		got, n := m.rewritePicture(root, root, doc, false)
+		if n != 0 || got != doc {
+			t.Errorf("rewritePicture(%q) = %q, %d; want it unchanged", doc, got, n)
+		}
+	}
+}
+
+func TestRewritePictureWraps(t *testing.T) {
+	m, root := pictureMapping(t)
+	tests := []struct {
+		doc, want string
+		n         int
+	}{
+		{
+			`<img src="img/a.png" alt="A">`,
+			`<picture><source type="image/webp" srcset="img/a.webp"><img src="img/a.png" alt="A"></picture>`,
+			1,
+		},
+		{
+			"<p>\r\n  <IMG\n SRC='img/a.png?v=1&amp;x=2' />\r\n</p><!-- <img src=\"img/a.png\"> -->",
+			"<p>\r\n  <picture><source type=\"image/webp\" srcset=\"img/a.webp?v=1&amp;x=2\"><IMG\n SRC='img/a.png?v=1&amp;x=2' /></picture>\r\n</p><!-- <img src=\"img/a.png\"> -->",
+			1,
+		},
+		{
+			`<picture><img src="img/a.png"></picture><img src=img/a.png>`,
+			`<picture><img src="img/a.png"></picture><picture><source type="image/webp" srcset="img/a.webp"><img src=img/a.png></picture>`,
+			1,
+		},
+	}
+	for _, tt := range tests {
+		got, n := m.rewritePicture(root, root, tt.doc, false)
+		if got != tt.want || n != tt.n {
+			t.Errorf("rewritePicture(%q) = %q, %d; want %q, %d", tt.doc, got, n, tt.want, tt.n)
+		}
+	}
+}
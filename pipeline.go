@@ -0,0 +1,222 @@
+package webpcon
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"golang.org/x/image/tiff"
+)
+
+// decodeImage decodes a still image. GIFs give their first frame.
+func decodeImage(r io.Reader, ext string) (img image.Image, err error) {
+	defer recoverDecode(&err)
+	ext, r = sniffReader(r, ext)
+	switch ext {
+	case ".jpg", ".jpeg", ".jpe", ".jfif":
+		return jpeg.Decode(r)
+	case ".png":
+		return png.Decode(r)
+	case ".bmp":
+		return decodeBMP(r)
+	case ".gif":
+		return decodeGIFStill(r)
+	case ".tiff":
+		return tiff.Decode(r)
+	case ".avif", ".jxl":
+		return decodeOptIn(r, ext)
+	case ".webp":
+		return decodeWebP(r)
+	}
+	return nil, fmt.Errorf("unsupported image type %s", ext)
+}
+
+// recoverDecode turns a decoder panic into *err, deferred around each call
+// into a decoder. They are fed whatever files a project holds, and one that
+// trips a decoder bug must fail on its own like any corrupt file, its
+// original put back from the backup, rather than end the run.
+func recoverDecode(err *error) {
+	if p := recover(); p != nil {
+		*err = fmt.Errorf("decoder crashed on malformed data: %v", p)
+	}
+}
+
+// decodeSized is decodeImage for an image that encodeStatic will fit within
+// --max-width and --max-height. Builds with scaled JPEG decoding decode large
+// JPEGs at 1/2, 1/4 or 1/8 of their size, the smallest that still fits down
+// to exactly the dimensions the full image would, and skip most of the
+// decoding work. Other images, and JPEGs libjpeg can't take, are decoded in
+// full.
+func decodeSized(r io.Reader, ext string, opts options) (image.Image, error) {
+	if !scaledJPEG || (opts.maxWidth == 0 && opts.maxHeight == 0) {
+		return decodeImage(r, ext)
+	}
+	ext, r = sniffReader(r, ext)
+	if !isJPEG(ext) {
+		return decodeImage(r, ext)
+	}
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	cfg, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if w, h, resize := fitSize(cfg.Width, cfg.Height, opts.maxWidth, opts.maxHeight); err == nil && resize {
+		for denom := 8; denom > 1; denom /= 2 {
+			sw, sh := (cfg.Width+denom-1)/denom, (cfg.Height+denom-1)/denom
+			// A scale that lands on the size itself needs no resize after
+			if fw, fh, _ := fitSize(sw, sh, opts.maxWidth, opts.maxHeight); fw != w || fh != h {
+				continue
+			}
+			if img, err := decodeJPEGScaled(data, denom); err == nil {
+				return img, nil
+			}
+			break
+		}
+	}
+	return decodeImage(bytes.NewReader(data), ext)
+}
+
+// staticResult describes one encoded still image.
+type staticResult struct {
+	img        image.Image // The pixels after color conversion and resizing
+	encoded    image.Image // The pixels handed to the encoder
+	width      int
+	height     int
+	size       int64    // Bytes written
+	mode       string   // Short label for the summary
+	detail     string   // Longer label for the per-file line
+	overTarget bool     // Still larger than --target-size at the lowest quality
+	trim       *trimBox // What --trim cropped off, nil for nothing
+	warning    string   // Something to tell about the file that didn't stop it
+}
+
+// encodeStatic runs a decoded still image through the conversion pipeline
+// (color conversion, resizing, the watermark, the encoding mode chosen from
+// opts) and writes the WebP to w. It touches no files, so it serves estimates
+// as well as conversions. src is only read for its ICC profile.
+func encodeStatic(w io.Writer, img image.Image, src srcFile, ext, relPath string, opts options) (staticResult, error) {
+	var notes []string
+	warning := ""
+	if opts.toSRGB {
+		var note string
+		if img, note = convertProfile(img, src, ext, relPath); note != "" {
+			notes = append(notes, note)
+		}
+	}
+	var trim *trimBox
+	if opts.trim != nil {
+		var err error
+		if img, trim, err = trimImage(img, opts.trim); err != nil {
+			warning = err.Error()
+		} else if trim != nil {
+			notes = append(notes, fmt.Sprintf("trimmed to %dx%d", img.Bounds().Dx(), img.Bounds().Dy()))
+		}
+	}
+	if w, h, ok := fitSize(img.Bounds().Dx(), img.Bounds().Dy(), opts.maxWidth, opts.maxHeight); ok {
+		img = resizeImage(img, w, h, opts.fastResize)
+		notes = append(notes, fmt.Sprintf("resized to %dx%d", w, h))
+	}
+	if opts.watermark != nil {
+		if stamped, ok := opts.watermark.stamp(img); ok {
+			img = stamped
+			notes = append(notes, "watermarked")
+		}
+	}
+
+	px, encOpts, mode := prepareEncode(img, opts)
+	res := staticResult{img: img, encoded: px, width: px.Bounds().Dx(), height: px.Bounds().Dy(), mode: mode, detail: mode, trim: trim, warning: warning}
+	cw := &countingWriter{w: w}
+	if opts.targetSize > 0 && !encOpts.lossless {
+		data, q, met, err := searchQuality(px, opts.targetSize, opts.enc, opts.effort)
+		if err != nil {
+			return res, err
+		}
+		if _, err := cw.Write(data); err != nil {
+			return res, err
+		}
+		res.mode = fmt.Sprintf("lossy, target %s", formatSize(opts.targetSize))
+		res.detail = fmt.Sprintf("lossy q%d, target %s", q, formatSize(opts.targetSize))
+		res.overTarget = !met
+	} else if err := opts.enc.encode(cw, px, encOpts); err != nil {
+		return res, err
+	}
+	res.size = cw.n
+
+	if len(notes) > 0 {
+		res.detail = strings.Join(notes, ", ") + ", " + res.detail
+	}
+	if opts.preset != "" {
+		res.mode, res.detail = opts.preset+": "+res.mode, opts.preset+": "+res.detail
+	}
+	return res, nil
+}
+
+// countingWriter counts the bytes passed through to w.
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// qualityScore is how close a WebP came to the pixels it was encoded from.
+type qualityScore struct {
+	psnr float64
+	ssim float64
+}
+
+// label formats q for the per-file line; "" without a score.
+func (q *qualityScore) label() string {
+	if q == nil {
+		return ""
+	}
+	return fmt.Sprintf(", PSNR %.2fdB, SSIM %.4f", q.psnr, q.ssim)
+}
+
+// compareOutput decodes the WebP in data and scores it against src, the pixels
+// handed to the encoder. Both are read as straight RGBA the way the encoders
+// read them.
+func compareOutput(src image.Image, data io.Reader) (*qualityScore, error) {
+	decoded, err := decodeWebP(data)
+	if err != nil {
+		return nil, err
+	}
+	a, b := toNRGBA(src), toNRGBA(decoded)
+	if a.Bounds().Size() != b.Bounds().Size() {
+		return nil, fmt.Errorf("output is %v, expected %v", b.Bounds().Size(), a.Bounds().Size())
+	}
+	return &qualityScore{psnr(a, b), ssim(a, b)}, nil
+}
+
+// compareFrame scores one frame of an animated conversion, from the PNG and
+// WebP files left in the frame cache.
+func compareFrame(cacheDir string, i int, opts options) (*qualityScore, error) {
+	f, err := os.Open(longPath(filepath.Join(cacheDir, fmt.Sprintf("frame_%02d.png", i))))
+	if err != nil {
+		return nil, err
+	}
+	src, err := png.Decode(f)
+	f.Close()
+	if err != nil {
+		return nil, err
+	}
+	if opts.grayscale {
+		src = toGrayscale(src)
+	}
+	data, err := os.Open(longPath(filepath.Join(cacheDir, fmt.Sprintf("frame_%02d.webp", i))))
+	if err != nil {
+		return nil, err
+	}
+	defer data.Close()
+	return compareOutput(src, data)
+}
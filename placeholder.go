@@ -0,0 +1,131 @@
+package webpcon
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"image"
+	"math"
+	"os"
+)
+
+// Low-quality image placeholders for lazy loading (--placeholders).
+
+const (
+	blurHashX      = 4  // Horizontal BlurHash components
+	blurHashY      = 3  // Vertical BlurHash components
+	blurHashSample = 64 // Images are shrunk to this size before hashing
+	thumbSize      = 20 // Longest side of the placeholder thumbnail
+	thumbQuality   = 40
+)
+
+// addPlaceholder computes the requested placeholder for img and stores it in
+// the map entry. With files set, thumbnails are also written next to the
+// output as name.placeholder.webp.
+func addPlaceholder(e *mapEntry, img image.Image, enc encoder, kind, webpPath string, files bool) error {
+	switch kind {
+	case "blurhash":
+		b := img.Bounds()
+		if w, h, ok := fitSize(b.Dx(), b.Dy(), blurHashSample, blurHashSample); ok {
+			img = resizeImage(img, w, h, false)
+		}
+		e.BlurHash = blurHash(img, blurHashX, blurHashY)
+	case "thumb":
+		b := img.Bounds()
+		w, h, _ := fitSize(b.Dx(), b.Dy(), thumbSize, thumbSize)
+		var buf bytes.Buffer
+		if err := enc.encode(&buf, resizeImage(img, w, h, false), encodeOptions{lossless: !enc.lossy(), quality: thumbQuality}); err != nil {
+			return err
+		}
+		e.Placeholder = "data:image/webp;base64," + base64.StdEncoding.EncodeToString(buf.Bytes())
+		if files {
+			return os.WriteFile(longPath(placeholderPath(webpPath)), buf.Bytes(), 0644)
+		}
+	}
+	return nil
+}
+
+// placeholderPath is where the thumbnail for an output is written.
+func placeholderPath(webpPath string) string {
+	return webpPath[:len(webpPath)-len(".webp")] + ".placeholder.webp"
+}
+
+const base83Chars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz#$%*+,-.:;=?@[]^_{|}~"
+
+func base83(v, length int) string {
+	out := make([]byte, length)
+	for i := length - 1; i >= 0; i-- {
+		out[i] = base83Chars[v%83]
+		v /= 83
+	}
+	return string(out)
+}
+
+// blurHash encodes img following the reference BlurHash algorithm
+// (https://github.com/woltapp/blurhash). Alpha is ignored.
+func blurHash(img image.Image, cx, cy int) string {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	var linear [256]float64
+	for i := range linear {
+		linear[i] = srgbToLinear(float64(i) / 255)
+	}
+
+	factors := make([][3]float64, 0, cx*cy)
+	for j := 0; j < cy; j++ {
+		for i := 0; i < cx; i++ {
+			norm := 2.0
+			if i == 0 && j == 0 {
+				norm = 1
+			}
+			var f [3]float64
+			for y := 0; y < h; y++ {
+				by := math.Cos(math.Pi * float64(j) * float64(y) / float64(h))
+				for x := 0; x < w; x++ {
+					basis := norm * math.Cos(math.Pi*float64(i)*float64(x)/float64(w)) * by
+					r, g, bl, _ := img.At(b.Min.X+x, b.Min.Y+y).RGBA()
+					f[0] += basis * linear[r>>8]
+					f[1] += basis * linear[g>>8]
+					f[2] += basis * linear[bl>>8]
+				}
+			}
+			scale := 1 / float64(w*h)
+			factors = append(factors, [3]float64{f[0] * scale, f[1] * scale, f[2] * scale})
+		}
+	}
+
+	hash := base83((cx-1)+(cy-1)*9, 1)
+	maxValue := 1.0
+	if ac := factors[1:]; len(ac) > 0 {
+		actualMax := 0.0
+		for _, f := range ac {
+			actualMax = max(actualMax, math.Abs(f[0]), math.Abs(f[1]), math.Abs(f[2]))
+		}
+		quantised := int(max(0, min(82, math.Floor(actualMax*166-0.5))))
+		maxValue = float64(quantised+1) / 166
+		hash += base83(quantised, 1)
+	} else {
+		hash += base83(0, 1)
+	}
+
+	toSRGB := func(v float64) int { return int(math.Round(clamp255(linearToSRGB(v) * 255))) }
+	dc := factors[0]
+	hash += base83(toSRGB(dc[0])<<16+toSRGB(dc[1])<<8+toSRGB(dc[2]), 4)
+
+	quant := func(v float64) int {
+		signPow := math.Copysign(math.Pow(math.Abs(v/maxValue), 0.5), v)
+		return int(max(0, min(18, math.Floor(signPow*9+9.5))))
+	}
+	for _, f := range factors[1:] {
+		hash += base83(quant(f[0])*19*19+quant(f[1])*19+quant(f[2]), 2)
+	}
+	return hash
+}
+
+// parsePlaceholderKind validates a --placeholders value.
+func parsePlaceholderKind(v string) (string, error) {
+	if v != "blurhash" && v != "thumb" {
+		return "", fmt.Errorf("--placeholders expects blurhash or thumb, got %q", v)
+	}
+	return v, nil
+}
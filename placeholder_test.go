@@ -0,0 +1,97 @@
+package webpcon
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"strings"
+	"testing"
+)
+
+// blurHashImage fills a w x h image with columns of cols, left to right,
+// repeating.
+func blurHashImage(w, h int, cols ...color.Color) image.Image {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			img.Set(x, y, cols[x%len(cols)])
+		}
+	}
+	return img
+}
+
+// TestBlurHash checks hashes worked out from the reference algorithm by hand.
+func TestBlurHash(t *testing.T) {
+	black, white := color.Black, color.White
+	tests := []struct {
+		name   string
+		img    image.Image
+		cx, cy int
+		want   string
+	}{
+		// One DC term, no AC: the size flag and the colour, 0xFFFFFF in base 83.
+		{"white 1x1", blurHashImage(8, 8, white), 1, 1, "00TSUA"},
+		// The hash of any black image: all 11 AC terms quantise to 9*19²+9*19+9.
+		{"black 4x3", blurHashImage(8, 8, black), 4, 3, "L00000" + strings.Repeat("fQ", 11)},
+		// Linear mean 0.5 is sRGB 188, 0xBCBCBC; the AC term, -0.354, quantises to 0 under a maximum of 58.
+		{"black white 2x1", blurHashImage(4, 2, black, black, white, white), 2, 1, "1wLqe900"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := blurHash(tt.img, tt.cx, tt.cy); got != tt.want {
+				t.Errorf("blurHash = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPlaceholders(t *testing.T) {
+	var files []fixtureFile
+	for _, ext := range fixtureFormats {
+		files = append(files, fixtureFile{"img/" + ext[1:] + ext, encodeFixture(t, ext, 40, 30)})
+	}
+	for _, tt := range []struct {
+		args  []string
+		check func(e *mapEntry, files map[string][]byte) string // What is wrong with e
+	}{
+		{[]string{"--placeholders", "thumb", "--placeholder-files"}, func(e *mapEntry, files map[string][]byte) string {
+			if !strings.HasPrefix(e.Placeholder, "data:image/webp;base64,") {
+				return fmt.Sprintf("placeholder %.40q", e.Placeholder)
+			}
+			if _, ok := files[placeholderPath(e.WebP)]; !ok {
+				return "no " + placeholderPath(e.WebP)
+			}
+			return ""
+		}},
+		{[]string{"--placeholders", "thumb"}, func(e *mapEntry, files map[string][]byte) string {
+			if _, ok := files[placeholderPath(e.WebP)]; ok {
+				return "a placeholder file without --placeholder-files"
+			}
+			return ""
+		}},
+		{[]string{"--placeholders", "blurhash"}, func(e *mapEntry, files map[string][]byte) string {
+			if len(e.BlurHash) != 4+2*blurHashX*blurHashY {
+				return fmt.Sprintf("blurhash %q", e.BlurHash)
+			}
+			return ""
+		}},
+	} {
+		root := writeFixtureTree(t, files)
+		before := treeFiles(t, root)
+		convertTree(t, root, testOptions(t, tt.args...))
+		after := treeFiles(t, root)
+		entries := readMapFile(t, root)
+		if len(entries) != len(files) {
+			t.Errorf("%v: %d map entries, want %d", tt.args, len(entries), len(files))
+		}
+		for key, e := range entries {
+			if msg := tt.check(e, after); msg != "" {
+				t.Errorf("%v %s: %s", tt.args, key, msg)
+			}
+		}
+		if err := revertImages(root); err != nil {
+			t.Fatal(err)
+		}
+		checkReverted(t, root, before)
+	}
+}
@@ -0,0 +1,63 @@
+package webpcon
+
+import "sort"
+
+// preset is a curated combination of encoder settings for one kind of content.
+// Flags given explicitly on the command line always win over the preset.
+type preset struct {
+	quality      float32
+	alphaQuality int
+	lossless     bool
+	exact        bool
+	sharpYUV     bool
+	nearLossless int // -1 = off
+	effort       int // 0 ~ 6, for the encoders that take it
+}
+
+var presets = map[string]preset{
+	// Camera shots and renders: lossy, slightly softer alpha
+	"photo": {quality: 80, alphaQuality: 90, nearLossless: -1, effort: 4},
+	// UI captures and diagrams: near-lossless for PNG-like sources, high-quality lossy for JPEGs
+	"screenshot": {quality: 90, alphaQuality: 100, sharpYUV: true, nearLossless: 60, effort: 5},
+	// Icons and sprites: pixel exact, including RGB under transparent areas
+	"icon": {alphaQuality: 100, lossless: true, exact: true, nearLossless: -1, effort: 6},
+	// Long-term storage: visually lossless but still smaller than the source
+	"archive": {quality: 95, alphaQuality: 100, sharpYUV: true, nearLossless: -1, effort: 6},
+}
+
+func presetNames() []string {
+	names := make([]string, 0, len(presets))
+	for n := range presets {
+		names = append(names, n)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// apply fills every setting the user didn't pass explicitly. An explicit
+// --quality or --target-size asks for lossy encoding, so the preset's
+// lossless and near-lossless modes don't apply then either.
+func (p preset) apply(opts *options) {
+	lossy := opts.set["quality"] || opts.set["target-size"]
+	if !lossy && p.quality > 0 {
+		opts.quality = p.quality
+	}
+	if !opts.set["alpha-quality"] {
+		opts.alphaQuality = p.alphaQuality
+	}
+	if !opts.set["lossless"] && !opts.set["near-lossless"] && !lossy {
+		opts.lossless = p.lossless
+	}
+	if !opts.set["sharp-yuv"] {
+		opts.sharpYUV = p.sharpYUV
+	}
+	if !opts.set["exact"] {
+		opts.exact = p.exact
+	}
+	if !opts.set["near-lossless"] && !opts.set["lossless"] && !lossy && !opts.set["quantize"] {
+		opts.nearLossless = p.nearLossless
+	}
+	if !opts.set["effort"] {
+		opts.effort = p.effort
+	}
+}
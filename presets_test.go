@@ -0,0 +1,116 @@
+package webpcon
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestPresetGolden converts the fixture tree with each preset and compares
+// the output sizes with testdata/preset-<name>.golden. Sizes follow libwebp,
+// so a new version may need go test -update.
+func TestPresetGolden(t *testing.T) {
+	testEncoder(t, "cgo")
+	for _, name := range presetNames() {
+		t.Run(name, func(t *testing.T) {
+			quietly(t)
+			root := writeFixtureTree(t, fixtureTree(t))
+			sum := convertTree(t, root, testOptions(t, "--encoder", "cgo", "--preset", name))
+			report := goldenReport(t, root, sum)
+			report = append(report, "# sizes\n"...)
+			files := treeFiles(t, root)
+			entries := readMapFile(t, root)
+			for _, key := range slices.Sorted(maps.Keys(entries)) {
+				e := entries[key]
+				if e.Preset != name {
+					t.Errorf("%s records preset %q", key, e.Preset)
+				}
+				report = fmt.Appendf(report, "%s %d\n", e.WebP, len(files[e.WebP]))
+			}
+			checkGolden(t, "preset-"+name+".golden", report)
+		})
+	}
+}
+
+func TestPresetFlags(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want resolved
+	}{
+		{[]string{"--preset", "photo"}, resolved{80, false, -1, 90, 0, false, "photo"}},
+		{[]string{"--preset", "screenshot"}, resolved{90, false, 60, 100, 0, false, "screenshot"}},
+		{[]string{"--preset", "icon"}, resolved{80, true, -1, 100, 0, true, "icon"}},
+		{[]string{"--preset", "archive"}, resolved{95, false, -1, 100, 0, false, "archive"}},
+		// Explicit flags win, whichever side of --preset they are on
+		{[]string{"--alpha-quality", "70", "--preset", "photo"}, resolved{80, false, -1, 70, 0, false, "photo"}},
+		{[]string{"--preset", "icon", "--quality", "70"}, resolved{70, false, -1, 100, 0, true, "icon"}},
+		{[]string{"--preset", "icon", "--target-size", "10kb"}, resolved{80, false, -1, 100, 0, true, "icon"}},
+		{[]string{"--preset", "screenshot", "--lossless"}, resolved{90, true, -1, 100, 0, false, "screenshot"}},
+		{[]string{"--preset", "icon", "--near-lossless", "40"}, resolved{80, false, 40, 100, 0, true, "icon"}},
+	} {
+		if got := resolvedOf(testOptions(t, tt.args...)); got != tt.want {
+			t.Errorf("%q: %+v, want %+v", tt.args, got, tt.want)
+		}
+	}
+	for _, tt := range []struct {
+		args   []string
+		effort int
+	}{
+		{[]string{"--preset", "photo"}, 4},
+		{[]string{"--preset", "archive"}, 6},
+		{[]string{"--effort", "2", "--preset", "archive"}, 2},
+	} {
+		if got := testOptions(t, tt.args...).effort; got != tt.effort {
+			t.Errorf("%q: effort %d, want %d", tt.args, got, tt.effort)
+		}
+	}
+	if _, err := parseOptions([]string{"--preset", "poster"}); err == nil {
+		t.Error("an unknown preset was accepted")
+	}
+}
+
+// TestPresetEffortWarning checks a preset whose effort the encoder ignores
+// says so, unless the effort is the default anyway or set explicitly.
+func TestPresetEffortWarning(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want string // "" for no warning about effort
+	}{
+		{[]string{"--encoder", "native", "--preset", "archive"}, "archive preset's effort 6"},
+		{[]string{"--encoder", "native", "--preset", "icon"}, "icon preset's effort 6"},
+		{[]string{"--encoder", "native", "--preset", "photo"}, ""},
+		{[]string{"--encoder", "native", "--preset", "archive", "--effort", "6"}, "--effort has no effect"},
+	} {
+		var got string
+		for _, w := range testOptions(t, tt.args...).warnings {
+			if strings.Contains(w, "effort") {
+				got = w
+			}
+		}
+		if !strings.Contains(got, tt.want) || (tt.want == "") != (got == "") {
+			t.Errorf("%q: warned %q, want %q", tt.args, got, tt.want)
+		}
+	}
+}
+
+// TestPresetRecorded checks that a preset from an override is the one the map
+// records for that file.
+func TestPresetRecorded(t *testing.T) {
+	testEncoder(t, "cgo")
+	quietly(t)
+	files := fixtureTree(t)
+	files = append(files, fixtureFile{"img/logo.png" + sidecarExt, []byte(`{"preset": "icon"}`)})
+	root := writeFixtureTree(t, files)
+	convertTree(t, root, testOptions(t, "--encoder", "cgo", "--preset", "photo"))
+	for key, e := range readMapFile(t, root) {
+		want := "photo"
+		if key == "img/logo.png" {
+			want = "icon"
+		}
+		if e.Preset != want {
+			t.Errorf("%s records preset %q, want %q", key, e.Preset, want)
+		}
+	}
+}
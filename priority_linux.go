@@ -0,0 +1,33 @@
+package webpcon
+
+import (
+	"errors"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+// lowerPriority gives every thread of the process the lowest CPU and I/O
+// priority. On Linux both belong to a thread, and setting them for PID 0
+// only changes the calling one, while most encoding runs on the others.
+// Threads started later take them from the thread starting them.
+func lowerPriority() error {
+	tasks, err := os.ReadDir("/proc/self/task")
+	if err != nil {
+		return err
+	}
+	for _, t := range tasks {
+		tid, err := strconv.Atoi(t.Name())
+		if err != nil {
+			continue
+		}
+		// A thread that exited since the listing is fine
+		if err := syscall.Setpriority(syscall.PRIO_PROCESS, tid, 19); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+		if err := lowerIOPriority(tid); err != nil && !errors.Is(err, syscall.ESRCH) {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,14 @@
+//go:build !windows && !linux
+
+package webpcon
+
+import "syscall"
+
+// lowerPriority gives the process the lowest CPU priority and, where the
+// platform has one, a low I/O priority.
+func lowerPriority() error {
+	if err := syscall.Setpriority(syscall.PRIO_PROCESS, 0, 19); err != nil {
+		return err
+	}
+	return lowerIOPriority()
+}
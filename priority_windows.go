@@ -0,0 +1,30 @@
+//go:build windows
+
+package webpcon
+
+import "syscall"
+
+var procSetPriorityClass = syscall.NewLazyDLL("kernel32.dll").NewProc("SetPriorityClass")
+
+// Process priority classes, see SetPriorityClass. Background mode also
+// lowers the I/O and memory priority.
+const (
+	belowNormalPriorityClass   = 0x00004000
+	processModeBackgroundBegin = 0x00100000
+)
+
+// lowerPriority puts the process in background mode, falling back to below
+// normal CPU priority.
+func lowerPriority() error {
+	h, err := syscall.GetCurrentProcess()
+	if err != nil {
+		return err
+	}
+	if r, _, _ := procSetPriorityClass.Call(uintptr(h), processModeBackgroundBegin); r != 0 {
+		return nil
+	}
+	if r, _, err := procSetPriorityClass.Call(uintptr(h), belowNormalPriorityClass); r == 0 {
+		return err
+	}
+	return nil
+}
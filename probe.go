@@ -0,0 +1,98 @@
+package webpcon
+
+import (
+	"encoding/binary"
+	"image/color"
+	"io"
+	"os"
+)
+
+// imageProbe is what the headers of an image tell without decoding pixels.
+type imageProbe struct {
+	format   string // By content, as sniffFormat names it
+	width    int
+	height   int
+	frames   int // More than 1 for an animated GIF or WebP
+	bitDepth int // Bits per channel the decoder delivers, 8 or 16
+}
+
+func (p imageProbe) animated() bool { return p.frames > 1 }
+
+// probeImage reads the header of the image at path, and walks the blocks of a
+// GIF or the chunks of a WebP to count their frames. Guards that only need
+// dimensions or a frame count use it, so a walk over thousands of images
+// never decodes one just to leave it alone.
+func probeImage(path, ext string) (imageProbe, error) {
+	f, err := os.Open(longPath(path))
+	if err != nil {
+		return imageProbe{}, err
+	}
+	defer f.Close()
+	return probeFrom(f, ext)
+}
+
+// probeFrom is probeImage for an image read from r, which it reads twice for
+// GIF and WebP.
+func probeFrom(r io.ReadSeeker, ext string) (imageProbe, error) {
+	p := imageProbe{format: formatExt(ext), frames: 1}
+	var head [sniffLen]byte
+	n, _ := io.ReadFull(r, head[:])
+	if f := sniffFormat(head[:n]); f != "" {
+		p.format = f
+	}
+	if _, err := r.Seek(0, io.SeekStart); err != nil {
+		return p, err
+	}
+	cfg, err := decodeConfigFrom(r, p.format)
+	if err != nil {
+		return p, err
+	}
+	p.width, p.height, p.bitDepth = cfg.Width, cfg.Height, bitDepth(cfg.ColorModel)
+
+	switch p.format {
+	case ".gif":
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return p, err
+		}
+		p.frames = max(gifFrameCount(r, 0), 1)
+	case ".webp":
+		if _, err := r.Seek(0, io.SeekStart); err != nil {
+			return p, err
+		}
+		p.frames = max(webpFrameCount(r), 1)
+	}
+	return p, nil
+}
+
+// bitDepth tells the bits per channel of images in model.
+func bitDepth(model color.Model) int {
+	switch model {
+	case color.RGBA64Model, color.NRGBA64Model, color.Gray16Model, color.Alpha16Model:
+		return 16
+	}
+	return 8
+}
+
+// webpFrameCount counts the ANMF chunks of a WebP read from r, seeking past
+// their payloads. A still WebP counts 0, as does one cut short before its
+// first frame.
+func webpFrameCount(r io.ReadSeeker) int {
+	if _, err := r.Seek(12, io.SeekStart); err != nil {
+		return 0
+	}
+	frames := 0
+	var chunk [8]byte
+	for {
+		if _, err := io.ReadFull(r, chunk[:]); err != nil {
+			return frames
+		}
+		if string(chunk[:4]) == "ANMF" {
+			frames++
+		}
+		// Payloads are padded to an even length
+		size := int64(binary.LittleEndian.Uint32(chunk[4:]))
+		if _, err := r.Seek(size+size&1, io.SeekCurrent); err != nil {
+			return frames
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package webpcon
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/png"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// webpFixture returns a w x h fixtureImage as a lossless WebP, animated with
+// the given number of frames if more than 1.
+func webpFixture(tb testing.TB, w, h, frames int) []byte {
+	tb.Helper()
+	var buf bytes.Buffer
+	var err error
+	if frames > 1 {
+		a := animation{}
+		for range frames {
+			a.frames = append(a.frames, fixtureImage(w, h))
+			a.durations = append(a.durations, 100)
+			a.disposals = append(a.disposals, 0)
+		}
+		err = nativeEncoder{}.encodeAnimation(&buf, a)
+	} else {
+		err = nativeEncoder{}.encode(&buf, fixtureImage(w, h), encodeOptions{lossless: true})
+	}
+	if err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// png16Fixture returns a w x h fixtureImage as a 16-bit PNG.
+func png16Fixture(tb testing.TB, w, h int) []byte {
+	tb.Helper()
+	src := fixtureImage(w, h)
+	img := image.NewNRGBA64(src.Rect)
+	for y := range h {
+		for x := range w {
+			img.Set(x, y, src.At(x, y))
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		tb.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestProbeFrom(t *testing.T) {
+	for _, tt := range []struct {
+		name, ext string
+		data      []byte
+		want      imageProbe
+	}{
+		{"jpeg", ".jpg", encodeFixture(t, ".jpg", 31, 17), imageProbe{".jpg", 31, 17, 1, 8}},
+		{"png", ".png", encodeFixture(t, ".png", 31, 17), imageProbe{".png", 31, 17, 1, 8}},
+		{"16-bit png", ".png", png16Fixture(t, 31, 17), imageProbe{".png", 31, 17, 1, 16}},
+		{"bmp", ".bmp", encodeFixture(t, ".bmp", 31, 17), imageProbe{".bmp", 31, 17, 1, 8}},
+		{"tiff", ".tiff", encodeFixture(t, ".tiff", 31, 17), imageProbe{".tiff", 31, 17, 1, 8}},
+		{"gif", ".gif", encodeFixture(t, ".gif", 31, 17), imageProbe{".gif", 31, 17, 1, 8}},
+		{"animated gif", ".gif", animatedGIFFixture(t, 31, 17, 4), imageProbe{".gif", 31, 17, 4, 8}},
+		{"webp", ".webp", webpFixture(t, 31, 17, 1), imageProbe{".webp", 31, 17, 1, 8}},
+		{"animated webp", ".webp", webpFixture(t, 31, 17, 3), imageProbe{".webp", 31, 17, 3, 8}},
+		// The content decides, not the extension
+		{"png named jpg", ".jpg", encodeFixture(t, ".png", 31, 17), imageProbe{".png", 31, 17, 1, 8}},
+		{"animated gif named png", ".png", animatedGIFFixture(t, 31, 17, 2), imageProbe{".gif", 31, 17, 2, 8}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p, err := probeFrom(bytes.NewReader(tt.data), tt.ext)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if p != tt.want {
+				t.Errorf("probed %+v, want %+v", p, tt.want)
+			}
+			if p.animated() != (tt.want.frames > 1) {
+				t.Errorf("animated %t with %d frames", p.animated(), p.frames)
+			}
+
+			// Cut short within the header, the dimensions aren't known
+			for _, n := range []int{0, 4, 10, 12} {
+				if _, err := probeFrom(bytes.NewReader(tt.data[:n]), tt.ext); err == nil {
+					t.Errorf("cut to %d bytes: no error", n)
+				}
+			}
+		})
+	}
+}
+
+// TestProbeTruncatedFrames cuts animations past the header: the frames before
+// the cut count, and the dimensions are still known.
+func TestProbeTruncatedFrames(t *testing.T) {
+	for _, tt := range []struct {
+		ext  string
+		data []byte
+	}{
+		{".gif", animatedGIFFixture(t, 31, 17, 4)},
+		{".webp", webpFixture(t, 31, 17, 4)},
+	} {
+		p, err := probeFrom(bytes.NewReader(tt.data[:len(tt.data)/2]), tt.ext)
+		if err != nil {
+			t.Fatalf("%s cut in half: %v", tt.ext, err)
+		}
+		if p.width != 31 || p.height != 17 || p.frames < 1 || p.frames >= 4 {
+			t.Errorf("%s cut in half: probed %+v, want 31x17 with 1 to 3 frames", tt.ext, p)
+		}
+	}
+	if n := webpFrameCount(bytes.NewReader([]byte("RIFF"))); n != 0 {
+		t.Errorf("a bare RIFF header has %d frames", n)
+	}
+}
+
+func TestProbeImage(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spinner.gif")
+	if err := os.WriteFile(path, animatedGIFFixture(t, 16, 16, 3), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if p, err := probeImage(path, ".gif"); err != nil || !p.animated() || p.frames != 3 {
+		t.Errorf("probed %+v, %v, want 3 frames", p, err)
+	}
+	if _, err := probeImage(filepath.Join(t.TempDir(), "missing.png"), ".png"); !os.IsNotExist(err) {
+		t.Errorf("missing file: %v", err)
+	}
+}
+
+// BenchmarkProbe compares probing the images of a tree of photos and
+// screenshots with decoding them, as the guards did before.
+func BenchmarkProbe(b *testing.B) {
+	var files []fixtureFile
+	for i := range 4 {
+		files = append(files,
+			fixtureFile{fmt.Sprintf("photos/%d.jpg", i), encodeFixture(b, ".jpg", 1600, 1200)},
+			fixtureFile{fmt.Sprintf("shots/%d.png", i), encodeFixture(b, ".png", 1280, 800)},
+			fixtureFile{fmt.Sprintf("anim/%d.gif", i), animatedGIFFixture(b, 320, 240, 8)},
+		)
+	}
+	root := writeFixtureTree(b, files)
+
+	b.Run("probe", func(b *testing.B) {
+		for range b.N {
+			for _, f := range files {
+				if _, err := probeImage(filepath.Join(root, f.rel), filepath.Ext(f.rel)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("decode", func(b *testing.B) {
+		for range b.N {
+			for _, f := range files {
+				data, err := os.ReadFile(filepath.Join(root, f.rel))
+				if err != nil {
+					b.Fatal(err)
+				}
+				if _, err := decodeImage(bytes.NewReader(data), filepath.Ext(f.rel)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+}
@@ -0,0 +1,204 @@
+package webpcon
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// profileVersion is the schema version profile export writes. A profile of a
+// higher version comes from a newer webpcon and is refused rather than read
+// in part.
+const profileVersion = 1
+
+// profile is a settings file written by profile export and read with
+// --profile, for sharing settings between projects.
+type profile struct {
+	Version int `json:"version"`
+	// By long flag name without the dashes: true for a switch, the value for
+	// a flag taking one, and a list for flags given more than once
+	Settings map[string]any `json:"settings"`
+}
+
+// profileFlags are the flags a profile carries: how images are encoded,
+// picked and named, but not what limits or hooks this one run.
+var profileFlags = func() map[string]bool {
+	set := map[string]bool{}
+	for _, name := range concat(encodingFlags, selectionFlags, []string{"--hardlink-dupes", "--placeholders", "--placeholder-files",
+		"--fallback", "--rewrite-refs", "--add-dimensions", "--emit-picture-codemod", "--convert-data-uris", "--metrics", "--min-ssim",
+		"--keep-low-ssim", "--verify-full", "--gif-max-fps", "--gif-scale", "--max-megapixels", "--on-conflict", "--min-savings"}) {
+		set[name] = true
+	}
+	// Run-specific, or the profile itself
+	delete(set, "--since")
+	delete(set, "--git-since")
+	delete(set, "--profile")
+	return set
+}()
+
+// repeatableFlags add to what they were given before instead of replacing it.
+var repeatableFlags = map[string]bool{"--exclude-regex": true, "--vendored-dirs": true, "--include-vendored": true}
+
+// exportProfile writes the settings the flags in args give as a profile to w.
+// Flags are checked and resolved as convert would, and --profile in args
+// layers them over an existing profile. Only settings given explicitly are
+// written, so the defaults of the webpcon reading it, and any preset, fill
+// in the rest.
+func exportProfile(w io.Writer, args []string) error {
+	if len(args) == 0 || args[0] != "export" {
+		return fmt.Errorf("usage: webpcon profile export [flags] > profile.json")
+	}
+	var flags []string
+	for i := 1; i < len(args); i++ {
+		name, _, hasValue := strings.Cut(args[i], "=")
+		f := findFlag(name)
+		if f == nil || (!profileFlags[f.names[0]] && f.names[0] != "--profile") {
+			return fmt.Errorf("webpcon profile export doesn't take %s", args[i])
+		}
+		flags = append(flags, args[i])
+		if valueFlags[name] && !hasValue && i+1 < len(args) {
+			i++
+			flags = append(flags, args[i])
+		}
+	}
+	flags, err := withProfile(flags, nil)
+	if err != nil {
+		return err
+	}
+	opts, err := parseOptions(flags)
+	if err != nil {
+		return err
+	}
+
+	p := profile{Version: profileVersion, Settings: map[string]any{}}
+	for _, flag := range opts.flags {
+		name, v, hasValue := strings.Cut(flag, "=")
+		key := strings.TrimPrefix(findFlag(name).names[0], "--")
+		var value any = true
+		if hasValue {
+			value = v
+			if _, err := strconv.ParseFloat(v, 64); err == nil {
+				value = json.Number(v)
+			}
+		}
+		prev, seen := p.Settings[key]
+		switch list, isList := prev.([]any); {
+		case !seen || !repeatableFlags["--"+key]:
+			p.Settings[key] = value // The last one given wins
+		case isList:
+			p.Settings[key] = append(list, value)
+		default:
+			p.Settings[key] = []any{prev, value}
+		}
+	}
+	data, err := json.MarshalIndent(p, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// loadProfile reads the profile at path.
+func loadProfile(path string) (*profile, error) {
+	data, err := os.ReadFile(longPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("--profile: %v", err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+	var p profile
+	if err := dec.Decode(&p); err != nil {
+		return nil, fmt.Errorf("--profile: %s: %v", path, err)
+	}
+	if p.Version > profileVersion {
+		return nil, fmt.Errorf("--profile: %s is a version %d profile, from a newer webpcon than this one, which reads up to version %d. Update webpcon to use it",
+			path, p.Version, profileVersion)
+	}
+	if p.Version < 1 {
+		return nil, fmt.Errorf("--profile: %s is not a webpcon profile, write one with webpcon profile export", path)
+	}
+	return &p, nil
+}
+
+// args turns the profile back into flags, in name order. Those cmd doesn't
+// take are left out, so one profile serves convert and estimate alike; with
+// cmd nil all are kept.
+func (p *profile) args(cmd *command) ([]string, error) {
+	keys := make([]string, 0, len(p.Settings))
+	for k := range p.Settings {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	var args []string
+	for _, k := range keys {
+		name := "--" + k
+		if !profileFlags[name] {
+			return nil, fmt.Errorf("--profile: unknown setting %q", k)
+		}
+		if cmd != nil && !cmd.accepts(name) {
+			continue
+		}
+		values, ok := p.Settings[k].([]any)
+		if !ok {
+			values = []any{p.Settings[k]}
+		}
+		for _, v := range values {
+			switch v := v.(type) {
+			case bool:
+				if v {
+					args = append(args, name)
+				}
+			case string:
+				args = append(args, name+"="+v)
+			case json.Number:
+				args = append(args, name+"="+v.String())
+			default:
+				return nil, fmt.Errorf("--profile: setting %q has a value of the wrong type", k)
+			}
+		}
+	}
+	return args, nil
+}
+
+// withProfile replaces --profile in flags, as split off by parseCommandLine,
+// with the settings of the profile it names. They go first, so the flags
+// given alongside override them; flags that may be given more than once,
+// like --exclude-regex, add to the profile's.
+func withProfile(flags []string, cmd *command) ([]string, error) {
+	path := ""
+	var rest []string
+	for i := 0; i < len(flags); i++ {
+		name, v, hasValue := strings.Cut(flags[i], "=")
+		if name != "--profile" {
+			rest = append(rest, flags[i])
+			continue
+		}
+		if !hasValue {
+			if i+1 >= len(flags) {
+				return nil, fmt.Errorf("--profile requires a value")
+			}
+			i++
+			v = flags[i]
+		}
+		path = v
+	}
+	if path == "" {
+		return flags, nil
+	}
+	p, err := loadProfile(path)
+	if err != nil {
+		return nil, err
+	}
+	args, err := p.args(cmd)
+	if err != nil {
+		return nil, err
+	}
+	return slices.Concat(args, rest), nil
+}
@@ -0,0 +1,79 @@
+package webpcon
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestLoadProfile reads profiles of each version and shape: only versions 1
+// up to profileVersion are read, and a newer one is refused rather than read
+// in part.
+func TestLoadProfile(t *testing.T) {
+	dir := t.TempDir()
+	for _, tt := range []struct {
+		name string
+		data string
+		args []string
+		err  string // "" for success
+	}{
+		{"current", `{"version": 1, "settings": {"quality": 70, "lossless": true, "exclude-regex": ["^a/", "^b/"]}}`,
+			[]string{"--exclude-regex=^a/", "--exclude-regex=^b/", "--lossless", "--quality=70"}, ""},
+		{"newer", `{"version": 2, "settings": {"quality": 70}}`, nil, "version 2 profile, from a newer webpcon"},
+		{"no version", `{"settings": {"quality": 70}}`, nil, "not a webpcon profile"},
+		{"not JSON", `quality=70`, nil, "invalid character"},
+		{"unknown setting", `{"version": 1, "settings": {"colour": "red"}}`, nil, `unknown setting "colour"`},
+		{"run-specific setting", `{"version": 1, "settings": {"since": "2024-01-01"}}`, nil, `unknown setting "since"`},
+		{"wrong type", `{"version": 1, "settings": {"quality": {"value": 70}}}`, nil, `setting "quality" has a value of the wrong type`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(dir, strings.ReplaceAll(tt.name, " ", ".")+".json")
+			if err := os.WriteFile(path, []byte(tt.data), 0644); err != nil {
+				t.Fatal(err)
+			}
+			args, err := withProfile([]string{"--profile", path}, nil)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Errorf("got %q, %v, want an error with %q", args, err, tt.err)
+				}
+				return
+			}
+			if err != nil || !slices.Equal(args, tt.args) {
+				t.Errorf("got %q, %v, want %q", args, err, tt.args)
+			}
+		})
+	}
+}
+
+// TestProfileRoundTrip exports a profile and converts with it: flags given
+// alongside --profile override its settings, or add to them for those given
+// more than once.
+func TestProfileRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	if err := exportProfile(&buf, []string{"export", "--quality", "70", "--sharp-yuv", "--exclude-regex", "^a/", "--max-duration", "1h"}); err == nil {
+		t.Error("exported --max-duration, which only limits one run")
+	}
+	buf.Reset()
+	if err := exportProfile(&buf, []string{"export", "--quality", "70", "--sharp-yuv", "--exclude-regex", "^a/"}); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte(`"version": 1`)) {
+		t.Errorf("exported profile has no version 1:\n%s", buf.Bytes())
+	}
+	path := filepath.Join(t.TempDir(), "team.json")
+	if err := os.WriteFile(path, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	flags, err := withProfile([]string{"--profile=" + path, "--quality", "60", "--exclude-regex", "^b/"}, findCommand("convert"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := testOptions(t, flags...)
+	if opts.quality != 60 || !opts.sharpYUV || !opts.excluded("a/x.png") || !opts.excluded("b/x.png") {
+		t.Errorf("%q: quality %g, sharp YUV %t, excludes a/ %t and b/ %t",
+			flags, opts.quality, opts.sharpYUV, opts.excluded("a/x.png"), opts.excluded("b/x.png"))
+	}
+}
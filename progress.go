@@ -0,0 +1,83 @@
+package webpcon
+
+import (
+	"encoding/json"
+	"io"
+	"sync"
+)
+
+// progressVersion is sent with every --progress-ndjson event. It goes up when
+// an event changes in a way that breaks readers; new fields don't count.
+const progressVersion = 1
+
+// progressEvent is one line of --progress-ndjson output. Events are, in order:
+// run_started with the number of images found, then per image an optional
+// file_started once its conversion begins and a file_finished with its status
+// (converted, skipped or failed), and last run_finished with the summary.
+// With --streaming-walk images are converted while they are being found, so
+// run_started comes without a total, and scan_finished brings it once the
+// walk is done.
+type progressEvent struct {
+	V          int             `json:"v"`
+	Event      string          `json:"event"`
+	Total      int             `json:"total,omitempty"`
+	File       string          `json:"file,omitempty"`
+	Status     string          `json:"status,omitempty"`
+	Reason     string          `json:"reason,omitempty"` // Why a file was skipped, see shouldConvert
+	SourceSize int64           `json:"sourceSize,omitempty"`
+	OutputSize int64           `json:"outputSize,omitempty"`
+	Error      string          `json:"error,omitempty"`
+	Summary    json.RawMessage `json:"summary,omitempty"`
+}
+
+// progress writes --progress-ndjson events. A nil progress writes nothing.
+type progress struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func newProgress(w io.Writer) *progress {
+	return &progress{w: w}
+}
+
+func (p *progress) send(ev progressEvent) {
+	if p == nil {
+		return
+	}
+	ev.V = progressVersion
+	data, err := json.Marshal(ev)
+	if err != nil {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.w.Write(append(data, '\n'))
+}
+
+func (p *progress) runStarted(total int) {
+	p.send(progressEvent{Event: "run_started", Total: total})
+}
+
+func (p *progress) scanFinished(total int) {
+	p.send(progressEvent{Event: "scan_finished", Total: total})
+}
+
+func (p *progress) fileStarted(relPath string) {
+	p.send(progressEvent{Event: "file_started", File: pathKey(relPath)})
+}
+
+func (p *progress) fileFinished(relPath, status, reason string, sourceSize, outputSize int64, err error) {
+	ev := progressEvent{Event: "file_finished", File: pathKey(relPath), Status: status, Reason: reason, SourceSize: sourceSize, OutputSize: outputSize}
+	if err != nil {
+		ev.Status, ev.Error = "failed", err.Error()
+	}
+	p.send(ev)
+}
+
+func (p *progress) runFinished(summary []byte, err error) {
+	ev := progressEvent{Event: "run_finished", Summary: summary}
+	if err != nil {
+		ev.Error = err.Error()
+	}
+	p.send(ev)
+}
@@ -0,0 +1,83 @@
+package webpcon
+
+import (
+	"bytes"
+	"encoding/json"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestProgressNDJSON converts the fixture tree with --progress-ndjson and
+// checks the shape of every line: an object with v 1 and only the fields
+// progressEvent has, run_started first with the number of images, one
+// file_finished per image after its file_started, and run_finished last
+// with the summary.
+func TestProgressNDJSON(t *testing.T) {
+	quietly(t)
+	root := writeFixtureTree(t, fixtureTree(t))
+	opts := testOptions(t, "--encoder", "native")
+	var buf bytes.Buffer
+	opts.progress = newProgress(&buf)
+	sum := convertTree(t, root, opts)
+
+	fields := []string{"v", "event", "total", "file", "status", "reason", "sourceSize", "outputSize", "error", "summary"}
+	var events []map[string]json.RawMessage
+	for i, line := range strings.Split(strings.TrimSuffix(buf.String(), "\n"), "\n") {
+		var ev map[string]json.RawMessage
+		if err := json.Unmarshal([]byte(line), &ev); err != nil {
+			t.Fatalf("line %d isn't a JSON object: %s", i+1, line)
+		}
+		if v := string(ev["v"]); v != "1" {
+			t.Errorf("line %d has v %s, want 1: %s", i+1, v, line)
+		}
+		for name := range ev {
+			if !slices.Contains(fields, name) {
+				t.Errorf("line %d has field %q: %s", i+1, name, line)
+			}
+		}
+		events = append(events, ev)
+	}
+	str := func(ev map[string]json.RawMessage, name string) string {
+		var s string
+		json.Unmarshal(ev[name], &s)
+		return s
+	}
+
+	first, last := events[0], events[len(events)-1]
+	var total int
+	json.Unmarshal(first["total"], &total)
+	if str(first, "event") != "run_started" || total == 0 {
+		t.Errorf("first event %v, want run_started with a total", first)
+	}
+	var summary summaryJSON
+	if err := json.Unmarshal(last["summary"], &summary); str(last, "event") != "run_finished" || err != nil || summary.Converted != sum.Converted {
+		t.Errorf("last event %v, want run_finished with the summary", last)
+	}
+	started := map[string]bool{}
+	finished, converted := 0, 0
+	for _, ev := range events[1 : len(events)-1] {
+		file := str(ev, "file")
+		switch str(ev, "event") {
+		case "file_started":
+			started[file] = true
+		case "file_finished":
+			finished++
+			status := str(ev, "status")
+			if !slices.Contains([]string{"converted", "skipped", "failed"}, status) || file == "" {
+				t.Errorf("file_finished with file %q, status %q", file, status)
+			}
+			if status == "converted" {
+				converted++
+				if !started[file] {
+					t.Errorf("%s finished without file_started", file)
+				}
+			}
+		default:
+			t.Errorf("unexpected event %v", ev)
+		}
+	}
+	if finished != total || converted != sum.Converted {
+		t.Errorf("%d file_finished, %d converted, want %d and %d", finished, converted, total, sum.Converted)
+	}
+}
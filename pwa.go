@@ -0,0 +1,161 @@
+package webpcon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// manifestNames are the web app manifests looked for at the project root.
+var manifestNames = []string{"manifest.json", "site.webmanifest", "manifest.webmanifest"}
+
+type manifestIcon struct {
+	Src string `json:"src"`
+}
+
+type webManifest struct {
+	Icons     []manifestIcon `json:"icons"`
+	Shortcuts []struct {
+		Icons []manifestIcon `json:"icons"`
+	} `json:"shortcuts"`
+}
+
+// manifestIcons returns the images referenced as icons by the project's web
+// app manifests, keyed by pathKey, with the manifest naming
+// them. Launchers can't always load WebP icons, so these stay as they are.
+func manifestIcons(root string) (map[string]string, error) {
+	icons := map[string]string{}
+	for _, name := range manifestNames {
+		data, err := os.ReadFile(filepath.Join(root, name))
+		if errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		var m webManifest
+		if err := json.Unmarshal(data, &m); err != nil {
+			// manifest.json is a common name for unrelated files, so a file
+			// that doesn't parse as a web manifest is not an error
+			continue
+		}
+		list := m.Icons
+		for _, s := range m.Shortcuts {
+			list = append(list, s.Icons...)
+		}
+		for _, icon := range list {
+			src := icon.Src
+			if i := strings.IndexAny(src, "?#"); i >= 0 {
+				src = src[:i]
+			}
+			if src == "" || strings.Contains(src, "://") || strings.HasPrefix(src, "//") {
+				continue
+			}
+			rel := filepath.Clean(filepath.FromSlash(strings.TrimPrefix(src, "/")))
+			icons[pathKey(rel)] = name
+		}
+	}
+	return icons, nil
+}
+
+var (
+	linkTag  = regexp.MustCompile(`(?is)<link\b[^>]*>`)
+	relAttr  = regexp.MustCompile(`(?i)\brel\s*=\s*["']([^"']+)["']`)
+	hrefAttr = regexp.MustCompile(`(?i)\bhref\s*=\s*["']([^"']+)["']`)
+)
+
+// iconRels are the <link rel> values naming an icon. "shortcut icon" has
+// icon among its words.
+var iconRels = map[string]bool{"icon": true, "apple-touch-icon": true, "apple-touch-icon-precomposed": true, "mask-icon": true}
+
+// linkIcons returns the images declared as icons by <link> tags in the
+// project's root index.html, keyed by pathKey, with the rel naming them.
+func linkIcons(root string) (map[string]string, error) {
+	icons := map[string]string{}
+	data, err := os.ReadFile(filepath.Join(root, "index.html"))
+	if errors.Is(err, os.ErrNotExist) {
+		return icons, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, tag := range linkTag.FindAll(data, -1) {
+		rel, href := relAttr.FindSubmatch(tag), hrefAttr.FindSubmatch(tag)
+		if rel == nil || href == nil {
+			continue
+		}
+		for _, r := range strings.Fields(strings.ToLower(string(rel[1]))) {
+			if !iconRels[r] {
+				continue
+			}
+			if p, ok := resolveRefPath(root, root, string(href[1])); ok {
+				icons[pathKey(p)] = r
+			}
+			break
+		}
+	}
+	return icons, nil
+}
+
+// projectIcons returns the images the icon policy leaves alone, keyed by
+// pathKey, with why: icons of the web app manifest (unless
+// --no-manifest-detect) and of <link> tags in index.html. Browsers and
+// launchers don't all load WebP icons. --convert-icons turns the policy off.
+func projectIcons(root string, opts options) (map[string]string, error) {
+	icons := map[string]string{}
+	if opts.convertIcons {
+		return icons, nil
+	}
+	if !opts.noManifestDetect {
+		manifest, err := manifestIcons(root)
+		if err != nil {
+			return nil, fmt.Errorf("reading web app manifest: %v", err)
+		}
+		for key, name := range manifest {
+			icons[key] = "icon in " + name
+		}
+	}
+	links, err := linkIcons(root)
+	if err != nil {
+		return nil, fmt.Errorf("reading index.html: %v", err)
+	}
+	for key, rel := range links {
+		icons[key] = fmt.Sprintf(`<link rel="%s"> in index.html`, rel)
+	}
+	return icons, nil
+}
+
+// iconDirs are the folder names in which iconSized looks for icons.
+var iconDirs = map[string]bool{"icons": true, "favicons": true}
+
+// iconSizes are the widths of common favicons, Apple touch icons, Windows
+// tiles and PWA icons.
+var iconSizes = map[int]bool{16: true, 32: true, 48: true, 57: true, 60: true, 64: true, 70: true, 72: true, 76: true,
+	96: true, 114: true, 120: true, 128: true, 144: true, 150: true, 152: true, 167: true, 180: true, 192: true,
+	256: true, 310: true, 384: true, 512: true}
+
+// iconSized tells why an image no page declares is still taken for an icon:
+// a square PNG of a common icon size in an icons/ or favicons/ folder. It
+// returns "" for anything else, or with --convert-icons. relPath is the
+// image's path in fsys, in the form of the OS.
+func iconSized(fsys fs.FS, relPath, ext string, opts options) string {
+	dir := filepath.Base(filepath.Dir(relPath))
+	if opts.convertIcons || ext != ".png" || !iconDirs[strings.ToLower(dir)] {
+		return ""
+	}
+	f, err := fsys.Open(treeName(relPath))
+	if err != nil {
+		return ""
+	}
+	defer f.Close()
+	cfg, err := decodeConfigFrom(f, ext)
+	if err != nil || cfg.Width != cfg.Height || !iconSizes[cfg.Width] {
+		return ""
+	}
+	return fmt.Sprintf("%dx%d PNG in %s/", cfg.Width, cfg.Height, dir)
+}
@@ -0,0 +1,206 @@
+package webpcon
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"sort"
+)
+
+// With --quantize auto, images of at most quantizeAutoMaxColors distinct
+// colors, flat artwork with some antialiasing, are quantized to
+// quantizeAutoColors. Photos run to tens of thousands and are left alone.
+const (
+	quantizeAutoMaxColors = 4096
+	quantizeAutoColors    = 256
+)
+
+// quantizeAuto is the --quantize value of "auto".
+const quantizeAuto = -1
+
+// quantizeImage reduces img to the colors --quantize asks for. ok is false
+// when auto leaves it alone as too colorful, and the usual encoding applies.
+// An image already within the count is encoded losslessly as it is.
+func quantizeImage(img image.Image, opts options) (px *image.NRGBA, mode string, ok bool) {
+	px = straightNRGBA(img)
+	n := opts.quantize
+	if n == quantizeAuto {
+		if len(countColors(px, quantizeAutoMaxColors)) > quantizeAutoMaxColors {
+			return nil, "", false
+		}
+		n = quantizeAutoColors
+	}
+	if _, changed := quantizeColors(px, n, opts.dither); !changed {
+		return px, fmt.Sprintf("lossless, already %d colors or fewer", n), true
+	}
+	mode = fmt.Sprintf("lossless, quantized to %d colors", n)
+	if opts.dither {
+		mode += ", dithered"
+	}
+	return px, mode, true
+}
+
+// colorCount is a distinct color of an image and how many pixels have it.
+type colorCount struct {
+	c [4]uint8 // Straight RGBA
+	n int
+}
+
+// countColors counts the distinct colors of px, as straightNRGBA gives it.
+// It stops once there are more than limit.
+func countColors(px *image.NRGBA, limit int) map[[4]uint8]int {
+	counts := map[[4]uint8]int{}
+	b := px.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		row := px.Pix[px.PixOffset(b.Min.X, y):px.PixOffset(b.Max.X, y)]
+		for i := 0; i < len(row); i += 4 {
+			counts[[4]uint8(row[i:i+4])]++
+		}
+		if len(counts) > limit {
+			return counts
+		}
+	}
+	return counts
+}
+
+// quantizeColors reduces px to at most n colors chosen by median cut, in
+// place, diffusing the error Floyd–Steinberg style when dither is set. It
+// returns the number of colors px had, and false when that was already n or
+// fewer and px is left as it is.
+func quantizeColors(px *image.NRGBA, n int, dither bool) (int, bool) {
+	counts := countColors(px, math.MaxInt)
+	if len(counts) <= n {
+		return len(counts), false
+	}
+	colors := make([]colorCount, 0, len(counts))
+	for c, k := range counts {
+		colors = append(colors, colorCount{c, k})
+	}
+	palette := medianCut(colors, n)
+
+	// Without dithering each distinct color maps to one entry, found once
+	nearest := map[[4]uint8][4]uint8{}
+	b := px.Bounds()
+	w := b.Dx()
+	var errCur, errNext []float32
+	if dither {
+		errCur, errNext = make([]float32, (w+2)*4), make([]float32, (w+2)*4)
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := 0; x < w; x++ {
+			i := px.PixOffset(b.Min.X+x, y)
+			p := [4]uint8(px.Pix[i : i+4])
+			if !dither {
+				q, ok := nearest[p]
+				if !ok {
+					q = closest(palette, [4]float32{float32(p[0]), float32(p[1]), float32(p[2]), float32(p[3])})
+					nearest[p] = q
+				}
+				copy(px.Pix[i:i+4], q[:])
+				continue
+			}
+			var want [4]float32
+			for ch := range 4 {
+				want[ch] = min(max(float32(p[ch])+errCur[(x+1)*4+ch], 0), 255)
+			}
+			q := closest(palette, want)
+			copy(px.Pix[i:i+4], q[:])
+			for ch := range 4 {
+				e := want[ch] - float32(q[ch])
+				errCur[(x+2)*4+ch] += e * 7 / 16
+				errNext[x*4+ch] += e * 3 / 16
+				errNext[(x+1)*4+ch] += e * 5 / 16
+				errNext[(x+2)*4+ch] += e * 1 / 16
+			}
+		}
+		if dither {
+			errCur, errNext = errNext, errCur
+			clear(errNext)
+		}
+	}
+	return len(counts), true
+}
+
+// medianCut splits colors into at most n boxes, each time halving the box
+// with the widest channel at the pixel-weighted median of that channel, and
+// returns the pixel-weighted mean color of each box.
+func medianCut(colors []colorCount, n int) [][4]uint8 {
+	boxes := [][]colorCount{colors}
+	for len(boxes) < n {
+		best, bestCh, bestRange := -1, 0, 0
+		for i, box := range boxes {
+			if len(box) < 2 {
+				continue
+			}
+			if ch, r := widestChannel(box); r > bestRange {
+				best, bestCh, bestRange = i, ch, r
+			}
+		}
+		if best < 0 {
+			break // Every box is down to one color
+		}
+		box := boxes[best]
+		sort.Slice(box, func(i, j int) bool { return box[i].c[bestCh] < box[j].c[bestCh] })
+		total := 0
+		for _, c := range box {
+			total += c.n
+		}
+		// When the last color holds more than half the pixels, it goes alone
+		split, seen := len(box)-1, 0
+		for i, c := range box[:len(box)-1] {
+			if seen += c.n; seen*2 >= total {
+				split = i + 1
+				break
+			}
+		}
+		boxes[best] = box[:split]
+		boxes = append(boxes, box[split:])
+	}
+
+	palette := make([][4]uint8, len(boxes))
+	for i, box := range boxes {
+		var sum [4]float64
+		total := 0
+		for _, c := range box {
+			for ch := range 4 {
+				sum[ch] += float64(c.c[ch]) * float64(c.n)
+			}
+			total += c.n
+		}
+		for ch := range 4 {
+			palette[i][ch] = uint8(math.Round(sum[ch] / float64(total)))
+		}
+	}
+	return palette
+}
+
+// widestChannel returns the channel whose values spread furthest in box, and
+// that spread.
+func widestChannel(box []colorCount) (ch, spread int) {
+	for c := range 4 {
+		lo, hi := 255, 0
+		for _, cc := range box {
+			lo, hi = min(lo, int(cc.c[c])), max(hi, int(cc.c[c]))
+		}
+		if hi-lo > spread {
+			ch, spread = c, hi-lo
+		}
+	}
+	return ch, spread
+}
+
+// closest returns the palette entry nearest to c.
+func closest(palette [][4]uint8, c [4]float32) [4]uint8 {
+	best, bestDist := palette[0], float32(math.MaxFloat32)
+	for _, p := range palette {
+		var d float32
+		for ch := range 4 {
+			diff := c[ch] - float32(p[ch])
+			d += diff * diff
+		}
+		if d < bestDist {
+			best, bestDist = p, d
+		}
+	}
+	return best
+}
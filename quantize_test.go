@@ -0,0 +1,212 @@
+package webpcon
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+// artwork returns a w x h flat-colour illustration: a red disc and a
+// half-transparent blue bar on white, antialiased, as icons and diagrams are.
+func artwork(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	cx, cy, r := float64(w)/3, float64(h)/2, float64(min(w, h))/3
+	for y := range h {
+		for x := range w {
+			c := [4]float64{255, 255, 255, 255}
+			// Coverage of the disc over a pixel, from its distance to the edge
+			d := math.Hypot(float64(x)+0.5-cx, float64(y)+0.5-cy)
+			if cover := min(max(r-d+0.5, 0), 1); cover > 0 {
+				c = [4]float64{255 - 35*cover, 255 - 215*cover, 255 - 215*cover, 255}
+			}
+			if x >= w/2 && y >= h/4 && y < h/4+h/8 {
+				c = [4]float64{c[0] / 2, c[1] / 2, (c[2] + 200) / 2, 255}
+			}
+			img.SetNRGBA(x, y, color.NRGBA{uint8(c[0]), uint8(c[1]), uint8(c[2]), uint8(c[3])})
+		}
+	}
+	return img
+}
+
+// gradient returns a w x h horizontal gray ramp, opaque.
+func gradient(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			v := uint8(x * 255 / (w - 1))
+			img.SetNRGBA(x, y, color.NRGBA{v, v, v, 0xff})
+		}
+	}
+	return img
+}
+
+// meanChannels is the average of each channel of img.
+func meanChannels(img *image.NRGBA) [4]float64 {
+	var sum [4]float64
+	for i, v := range img.Pix {
+		sum[i%4] += float64(v)
+	}
+	for ch := range sum {
+		sum[ch] /= float64(len(img.Pix) / 4)
+	}
+	return sum
+}
+
+func TestQuantizeColors(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		img     *image.NRGBA
+		n       int
+		dither  bool
+		minPSNR float64
+	}{
+		{"artwork to 16", artwork(96, 64), 16, false, 35},
+		{"artwork to 4", artwork(96, 64), 4, false, 30},
+		{"artwork to 16, dithered", artwork(96, 64), 16, true, 30},
+		{"gradient to 16", gradient(256, 8), 16, false, 30},
+		{"gradient to 2", gradient(256, 8), 2, false, 10},
+		{"gradient to 16, dithered", gradient(256, 8), 16, true, 25},
+		{"fixture to 64", straightNRGBA(fixtureImage(64, 48)), 64, false, 25},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			px := cloneNRGBA(tt.img)
+			had, changed := quantizeColors(px, tt.n, tt.dither)
+			if want := len(countColors(tt.img, math.MaxInt)); had != want || !changed {
+				t.Fatalf("had %d colors, changed %t, want %d and changed", had, changed, want)
+			}
+			if n := len(countColors(px, math.MaxInt)); n > tt.n {
+				t.Errorf("%d colors left, want at most %d", n, tt.n)
+			}
+			if p := psnr(tt.img, px); p < tt.minPSNR {
+				t.Errorf("%.1f dB off the source, want at least %.0f", p, tt.minPSNR)
+			}
+		})
+	}
+}
+
+// TestQuantizeDither quantizes a ramp to a few levels: dithering keeps the
+// average of every column closer to the source than banding does.
+func TestQuantizeDither(t *testing.T) {
+	src := gradient(256, 32)
+	columnError := func(px *image.NRGBA) float64 {
+		total := 0.0
+		for x := range 256 {
+			sum := 0.0
+			for y := range 32 {
+				sum += float64(px.NRGBAAt(x, y).R)
+			}
+			total += math.Abs(sum/32 - float64(src.NRGBAAt(x, 0).R))
+		}
+		return total / 256
+	}
+	banded, dithered := cloneNRGBA(src), cloneNRGBA(src)
+	quantizeColors(banded, 4, false)
+	quantizeColors(dithered, 4, true)
+	if b, d := columnError(banded), columnError(dithered); d >= b/2 {
+		t.Errorf("columns average %.1f off dithered, %.1f banded, want under half", d, b)
+	}
+	if m, want := meanChannels(dithered), meanChannels(src); math.Abs(m[0]-want[0]) > 2 {
+		t.Errorf("dithered ramp averages %.1f, want %.1f", m[0], want[0])
+	}
+	if n := len(countColors(dithered, math.MaxInt)); n > 4 {
+		t.Errorf("%d colors dithered, want at most 4", n)
+	}
+}
+
+func TestQuantizeFewColors(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(0, 0, 8, 8))
+	for i := range img.Pix {
+		img.Pix[i] = uint8(i / 4 % 3 * 100)
+	}
+	px := cloneNRGBA(img)
+	if had, changed := quantizeColors(px, 3, true); had != 3 || changed {
+		t.Errorf("had %d colors, changed %t, want 3 unchanged", had, changed)
+	}
+	if !bytes.Equal(px.Pix, img.Pix) {
+		t.Error("an image within the count was changed")
+	}
+
+	// Median cut never makes up colors, nor more boxes than colors
+	colors := []colorCount{{[4]uint8{1, 2, 3, 255}, 5}, {[4]uint8{200, 2, 3, 255}, 1}}
+	if p := medianCut(colors, 8); len(p) != 2 {
+		t.Errorf("medianCut made %d colors of 2: %v", len(p), p)
+	}
+	// A color holding most of a box's pixels is split off on its own, from
+	// either end
+	for _, colors := range [][]colorCount{
+		{{[4]uint8{0, 0, 0, 255}, 1}, {[4]uint8{50, 0, 0, 255}, 1}, {[4]uint8{100, 0, 0, 255}, 10}},
+		{{[4]uint8{100, 0, 0, 255}, 1}, {[4]uint8{50, 0, 0, 255}, 1}, {[4]uint8{0, 0, 0, 255}, 10}},
+	} {
+		dominant := colors[2].c
+		if p := medianCut(colors, 2); !slices.Contains(p, dominant) {
+			t.Errorf("medianCut to 2 colors: %v, want %v kept", p, dominant)
+		}
+	}
+	// The mean is weighted by pixels
+	if p := medianCut([]colorCount{{[4]uint8{0, 0, 0, 255}, 3}, {[4]uint8{100, 0, 0, 255}, 1}}, 1); p[0] != [4]uint8{25, 0, 0, 255} {
+		t.Errorf("medianCut to 1 color: %v, want the weighted mean", p)
+	}
+}
+
+func TestQuantizeImage(t *testing.T) {
+	photo := noisy(opaque(96, 96), 32, 1)
+	for _, tt := range []struct {
+		name string
+		img  image.Image
+		args []string
+		mode string // "" when the image is left to the usual encoding
+	}{
+		{"artwork", artwork(96, 64), []string{"--quantize", "16"}, "lossless, quantized to 16 colors"},
+		{"artwork dithered", artwork(96, 64), []string{"--quantize", "16", "--dither"}, "lossless, quantized to 16 colors, dithered"},
+		{"artwork auto", artwork(96, 64), []string{"--quantize", "auto"}, "lossless, already 256 colors or fewer"},
+		{"photo", photo, []string{"--quantize", "16"}, "lossless, quantized to 16 colors"},
+		{"photo auto", photo, []string{"--quantize", "auto"}, ""},
+	} {
+		px, mode, ok := quantizeImage(tt.img, testOptions(t, tt.args...))
+		if ok != (tt.mode != "") || mode != tt.mode {
+			t.Errorf("%s: %q, %t, want %q", tt.name, mode, ok, tt.mode)
+		}
+		if ok && px.Bounds() != tt.img.Bounds() {
+			t.Errorf("%s: quantized to %v", tt.name, px.Bounds())
+		}
+	}
+}
+
+// TestConvertQuantize converts artwork with --quantize and checks the WebP
+// is lossless within the palette, and the report says it was quantized.
+func TestConvertQuantize(t *testing.T) {
+	log := quietly(t)
+	var data bytes.Buffer
+	if err := png.Encode(&data, artwork(96, 64)); err != nil {
+		t.Fatal(err)
+	}
+	root := writeFixtureTree(t, []fixtureFile{{"badge.png", data.Bytes()}})
+	convertTree(t, root, testOptions(t, "--encoder", "native", "--quantize", "8"))
+
+	img, err := xwebp.Decode(bytes.NewReader(treeFiles(t, root)["badge.webp"]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(countColors(straightNRGBA(img), math.MaxInt)); n > 8 {
+		t.Errorf("%d colors in the WebP, want at most 8", n)
+	}
+	if p := psnr(artwork(96, 64), img); p < 35 {
+		t.Errorf("WebP is %.1f dB off the source", p)
+	}
+	var converted string
+	for _, line := range strings.Split(log.String(), "\n") {
+		if strings.Contains(line, "Converted") {
+			converted = line
+		}
+	}
+	if !strings.Contains(converted, "quantized to 8 colors") {
+		t.Errorf("report doesn't say the image was quantized: %q", converted)
+	}
+}
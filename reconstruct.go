@@ -0,0 +1,121 @@
+package webpcon
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// reconstructQuality is the JPEG quality revert --from-webp writes at.
+const reconstructQuality = defaultDecodeQuality
+
+// reconstructOriginal writes the original of relPath, whose map entry is e,
+// back from its WebP for revert --from-webp, in the format its extension
+// names, and deletes the WebP. The WebP is all that is left of the image, so
+// the result is a lossy copy at the WebP's size, without the metadata or
+// any border --trim cut off. skip says why a file was left alone instead:
+// animated WebP, formats there is no encoder for here, and originals that
+// are back already.
+func reconstructOriginal(root, relPath string, e *mapEntry) (skip string, err error) {
+	origPath := filepath.Join(root, relPath)
+	webpPath := filepath.Join(root, filepath.FromSlash(e.WebP))
+	if fileExists(origPath) && e.Fallback == "" {
+		return "a file of that name is there already", nil
+	}
+	ext := strings.ToLower(filepath.Ext(relPath))
+	if !isJPEG(ext) && ext != ".png" && ext != ".gif" && ext != ".bmp" && ext != ".tiff" {
+		return fmt.Sprintf("webpcon can't write %s", formatNames[ext]), nil
+	}
+	data, err := os.ReadFile(longPath(webpPath))
+	if err != nil {
+		return "", err
+	}
+	if isAnimatedWebP(data) {
+		return "animated WebP, rebuilding the GIF isn't supported", nil
+	}
+	img, err := decodeImage(bytes.NewReader(data), ".webp")
+	if err != nil {
+		return "", fmt.Errorf("decoding %s: %v", e.WebP, err)
+	}
+
+	if err := os.MkdirAll(longPath(filepath.Dir(origPath)), 0755); err != nil {
+		return "", err
+	}
+	out, err := os.Create(longPath(origPath))
+	if err != nil {
+		return "", err
+	}
+	err = encodeOriginal(out, img, ext)
+	if serr := out.Sync(); err == nil {
+		err = serr
+	}
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(longPath(origPath))
+		return "", err
+	}
+	os.Remove(longPath(webpPath))
+	os.Remove(longPath(placeholderPath(webpPath)))
+	return "", nil
+}
+
+// encodeOriginal writes img to w in the format of ext, one reconstructOriginal
+// takes.
+func encodeOriginal(w io.Writer, img image.Image, ext string) error {
+	switch {
+	case isJPEG(ext):
+		return encodeDecoded(w, toNRGBA(img), "jpg", reconstructQuality, color.NRGBA{0xff, 0xff, 0xff, 0xff})
+	case ext == ".gif":
+		return gif.Encode(w, palettedGIF(img), nil)
+	case ext == ".bmp":
+		return bmp.Encode(w, img)
+	case ext == ".tiff":
+		return tiff.Encode(w, img, &tiff.Options{Compression: tiff.Deflate, Predictor: true})
+	}
+	return png.Encode(w, img)
+}
+
+// palettedGIF reduces img to a GIF's 256 colors by median cut, see
+// quantizeColors, and its alpha to GIF's one transparent color.
+func palettedGIF(img image.Image) *image.Paletted {
+	px := straightNRGBA(img)
+	for i := 0; i < len(px.Pix); i += 4 {
+		if px.Pix[i+3] < 128 {
+			copy(px.Pix[i:i+4], []uint8{0, 0, 0, 0})
+		} else {
+			px.Pix[i+3] = 0xff
+		}
+	}
+	quantizeColors(px, 256, false)
+	colors := slices.SortedFunc(maps.Keys(countColors(px, math.MaxInt)), func(a, b [4]uint8) int { return bytes.Compare(a[:], b[:]) })
+	palette := make(color.Palette, 0, len(colors))
+	index := map[[4]uint8]uint8{}
+	for _, c := range colors {
+		index[c] = uint8(len(palette))
+		palette = append(palette, color.NRGBA{c[0], c[1], c[2], c[3]})
+	}
+	b := px.Bounds()
+	out := image.NewPaletted(b, palette)
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := px.PixOffset(x, y)
+			out.SetColorIndex(x, y, index[[4]uint8(px.Pix[i:i+4])])
+		}
+	}
+	return out
+}
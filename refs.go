@@ -0,0 +1,92 @@
+package webpcon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+var (
+	// imageRef matches image paths in url(), src=, srcset, imports and plain strings.
+	imageRef = regexp.MustCompile(`(?i)[\pL\pN\pM_./~@%+-]+\.(?:jpe?g|jpe|jfif|png|bmp|gif|tiff|avif|jxl|webp)\b`)
+	// dynamicRef matches image paths built at runtime, which can't be resolved:
+	// template literals (`img/${name}.png`) and concatenation ("img/" + name + ".png").
+	dynamicRef = regexp.MustCompile("(?i)(?:\\$\\{[^}]*\\}[\\pL\\pN\\pM_./~@%+-]*|\\+\\s*[\"'`][\\pL\\pN\\pM_./~@%+-]*)\\.(?:jpe?g|jpe|jfif|png|bmp|gif|tiff|avif|jxl|webp)\\b")
+)
+
+// resolveRefPath turns a reference found in a file under dir into a path
+// relative to root. Paths starting with "/" are taken relative to the
+// project root. URLs and paths outside the project are not resolved.
+func resolveRefPath(root, dir, ref string) (string, bool) {
+	if i := strings.IndexAny(ref, "?#"); i >= 0 {
+		ref = ref[:i]
+	}
+	if strings.HasPrefix(ref, "//") || strings.Contains(ref, "://") {
+		return "", false
+	}
+	target := filepath.Join(dir, filepath.FromSlash(ref))
+	if strings.HasPrefix(ref, "/") {
+		target = filepath.Join(root, filepath.FromSlash(ref))
+	}
+	relPath, err := filepath.Rel(root, target)
+	if err != nil || strings.HasPrefix(relPath, "..") {
+		return "", false
+	}
+	return relPath, true
+}
+
+// projectRefs is the result of scanning the project's source files.
+type projectRefs struct {
+	images  map[string]bool // Referenced images, by pathKey
+	dynamic []string        // Files with image paths built at runtime
+}
+
+// scanRefs collects the images referenced from the project's source files.
+func scanRefs(root string) (*projectRefs, error) {
+	refs := &projectRefs{images: map[string]bool{}}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if skipDirs[info.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !refFileExt[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		data, err := os.ReadFile(longPath(path))
+		if err != nil {
+			return err
+		}
+		dir := filepath.Dir(path)
+		for _, ref := range imageRef.FindAllString(string(data), -1) {
+			if rel, ok := resolveRefPath(root, dir, ref); ok {
+				refs.images[pathKey(rel)] = true
+			}
+		}
+		if dynamicRef.Match(data) {
+			rel, _ := filepath.Rel(root, path)
+			refs.dynamic = append(refs.dynamic, rel)
+		}
+		return nil
+	})
+	sort.Strings(refs.dynamic)
+	return refs, err
+}
+
+// warnDynamic lists the files whose image references couldn't be resolved.
+func (r *projectRefs) warnDynamic() {
+	if len(r.dynamic) == 0 {
+		return
+	}
+	fmt.Fprintf(stdout, "⚠️  %d file(s) build image paths at runtime, images used there may not be detected:\n", len(r.dynamic))
+	for _, f := range r.dynamic {
+		fmt.Fprintf(stdout, "   %s\n", f)
+	}
+}
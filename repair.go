@@ -0,0 +1,271 @@
+package webpcon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// backupCheck is what checkBackups found wrong after an interrupted run.
+type backupCheck struct {
+	stranded      []backupFile // Only in the backup: no original, no WebP
+	unrecoverable []string     // WebPs in the map file with no backup of their original
+}
+
+// backupFile is the backup of a source.
+type backupFile struct {
+	rel    string // Source, relative to the project root
+	backup string // Path of the backup
+	run    string // Run that backed it up, "" for backups from before runs
+}
+
+// checkBackups compares the backups with the project. A backup whose
+// original is gone and whose WebP was never written is stranded: a run
+// stopped between moving the original and encoding it. A map file entry with
+// no backup, other than one for an original sent to the trash, can't be
+// reverted. Only the oldest backup of a source counts, as with revert.
+func checkBackups(root string, outputs *mapping, runs *runLog) backupCheck {
+	var check backupCheck
+	backups := backupIndex(root, runs)
+
+	for key, b := range backups {
+		if fileExists(filepath.Join(root, b.rel)) || fileExists(webpFor(root, b.rel, outputs)) {
+			continue
+		}
+		check.stranded = append(check.stranded, backups[key])
+	}
+	sort.Slice(check.stranded, func(i, j int) bool { return check.stranded[i].rel < check.stranded[j].rel })
+
+	for _, key := range outputs.keys() {
+		e := outputs.entries[key]
+		if _, ok := backups[key]; !ok && !e.Trashed && !e.ExtensionFixed && fileExists(filepath.Join(root, filepath.FromSlash(e.WebP))) {
+			check.unrecoverable = append(check.unrecoverable, e.WebP)
+		}
+	}
+	return check
+}
+
+// backupIndex finds the oldest backup of each source, by its pathKey: the
+// one directly in the backup directory, or else the first a run recorded.
+func backupIndex(root string, runs *runLog) map[string]backupFile {
+	backups := map[string]backupFile{}
+	backupRoot := filepath.Join(root, ".webpcon_backup")
+	filepath.Walk(backupRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if path == filepath.Join(backupRoot, runsDir) || path == filepath.Join(backupRoot, supersededDir) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !imageExt[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+		rel, _ := filepath.Rel(backupRoot, path)
+		backups[pathKey(rel)] = backupFile{rel: rel, backup: path}
+		return nil
+	})
+	for _, r := range runs.runs {
+		for _, f := range r.Files {
+			if f.Backup == "" {
+				continue
+			}
+			if b, ok := backups[f.Source]; ok {
+				if b.run == "" && samePath(b.backup, filepath.Join(root, filepath.FromSlash(f.Backup))) {
+					b.run = r.ID
+					backups[f.Source] = b
+				}
+				continue
+			}
+			path := filepath.Join(root, filepath.FromSlash(f.Backup))
+			if fileExists(path) {
+				backups[f.Source] = backupFile{rel: filepath.FromSlash(f.Source), backup: path, run: r.ID}
+			}
+		}
+	}
+	return backups
+}
+
+// webpFor returns where the WebP of the source rel is, by the map file or
+// else next to it.
+func webpFor(root, rel string, outputs *mapping) string {
+	if e := outputs.get(rel); e != nil {
+		return filepath.Join(root, filepath.FromSlash(e.WebP))
+	}
+	return filepath.Join(root, strings.TrimSuffix(rel, filepath.Ext(rel))+".webp")
+}
+
+// report prints what c found, for status and repair.
+func (c backupCheck) report() {
+	if len(c.stranded) > 0 {
+		fmt.Fprintf(stdout, "⚠️  %d file(s) exist only in the backup, with no original and no WebP. webpcon repair restores or converts them:\n", len(c.stranded))
+		for _, s := range c.stranded {
+			fmt.Fprintf(stdout, "   %s\n", filepath.ToSlash(s.rel))
+		}
+	}
+	if len(c.unrecoverable) > 0 {
+		fmt.Fprintf(stdout, "⚠️  %d WebP file(s) have no backup of their original and can't be reverted:\n", len(c.unrecoverable))
+		for _, w := range c.unrecoverable {
+			fmt.Fprintf(stdout, "   %s\n", w)
+		}
+	}
+}
+
+// repairBackups puts right the files an interrupted run stranded in the
+// backup: --repair-mode restore copies the originals back and forgets their
+// conversion, convert finishes it by writing the WebP from the backup.
+// Unrecoverable WebPs are only reported; nothing can bring their originals
+// back.
+func repairBackups(root string, opts options) (err error) {
+	outputs, err := loadMapping(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", mapFileName, err)
+		return err
+	}
+	runs, err := loadRunLog(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", runLogName, err)
+		return err
+	}
+	check := checkBackups(root, outputs, runs)
+	check.report()
+	if len(check.stranded) == 0 {
+		fmt.Fprintln(stdout, "✅ No files stranded in the backup")
+		return nil
+	}
+
+	repaired := 0
+	defer func() { appendHistory(root, historyRecord{Command: "repair", Files: repaired}, err) }()
+	for _, s := range check.stranded {
+		if opts.interrupted() {
+			err = errInterrupted
+			break
+		}
+		if opts.repairMode == "convert" {
+			err = finishConversion(root, s, outputs, runs, opts)
+		} else {
+			err = restoreStranded(root, s, outputs, runs)
+		}
+		if err != nil {
+			break
+		}
+		repaired++
+	}
+
+	if serr := runs.save(); serr != nil {
+		fmt.Fprintf(stdout, "❌ Error writing %s: %v\n", runLogName, serr)
+		return serr
+	}
+	if len(outputs.entries) == 0 {
+		os.Remove(longPath(outputs.path))
+	} else if serr := outputs.save(); serr != nil {
+		fmt.Fprintf(stdout, "❌ Error writing %s: %v\n", mapFileName, serr)
+		return serr
+	}
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(stdout, "📊 %d file(s) repaired\n", repaired)
+	return nil
+}
+
+// restoreStranded copies s back into the project and drops it from the runs
+// and the map file, as reverting its run would.
+func restoreStranded(root string, s backupFile, outputs *mapping, runs *runLog) error {
+	if err := restoreImage(root, s.rel, s.backup, webpFor(root, s.rel, outputs)); err != nil {
+		return err
+	}
+	os.Remove(longPath(s.backup))
+	key := pathKey(s.rel)
+	delete(outputs.entries, key)
+	for _, r := range runs.runs {
+		files := r.Files[:0]
+		for _, f := range r.Files {
+			if f.Source != key {
+				files = append(files, f)
+			}
+		}
+		r.Files = files
+	}
+	return nil
+}
+
+// finishConversion encodes the backup of s to its WebP and records it in the
+// map file. The backup stays, to revert the conversion like any other.
+func finishConversion(root string, s backupFile, outputs *mapping, runs *runLog, opts options) error {
+	ext := strings.ToLower(filepath.Ext(s.rel))
+	fopts, err := newOverrideLoader(root).optionsFor(filepath.Join(root, s.rel), opts)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading option overrides for %s: %v\n", s.rel, err)
+		return err
+	}
+	if ext == ".gif" && isAnimatedGIF(s.backup) {
+		// Animations take the conversion walk; a still frame would lose them
+		fmt.Fprintf(stdout, "⏭️ %s is an animated GIF, restoring it instead\n", s.rel)
+		return restoreStranded(root, s, outputs, runs)
+	}
+
+	webp := webpRel(s.rel, ext)
+	res, err := encodeFromBackup(root, s, webp, fopts)
+	if err != nil {
+		return err
+	}
+
+	e := outputs.add(s.rel, webp)
+	e.setSize(res.width, res.height)
+	e.Trim = res.trim
+	e.Run, e.ConvertedAt, e.Options, e.Preset = s.run, time.Now().Format(time.RFC3339), fopts.encodeKey(), fopts.preset
+	if sum, err := hashFile(filepath.Join(root, webp)); err == nil {
+		e.SHA256 = sum
+	}
+	fmt.Fprintf(stdout, "✅ Converted (%s): %s -> %s\n", res.detail, filepath.ToSlash(s.rel), filepath.ToSlash(webp))
+	return nil
+}
+
+// encodeFromBackup encodes the still image backed up at b to webpRel, from
+// the project root, through a temporary file so a WebP already there stays
+// whole until the new one replaces it. Pixels always come from the backup,
+// never from an earlier WebP, which would compound the losses.
+func encodeFromBackup(root string, b backupFile, webpRel string, opts options) (staticResult, error) {
+	ext := strings.ToLower(filepath.Ext(b.rel))
+	in, err := os.Open(longPath(b.backup))
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", b.backup, err)
+		return staticResult{}, err
+	}
+	img, err := decodeSized(in, ext, opts)
+	in.Close()
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error decoding %s: %v\n", b.backup, err)
+		return staticResult{}, err
+	}
+
+	webpPath := filepath.Join(root, webpRel)
+	if err := os.MkdirAll(longPath(filepath.Dir(webpPath)), 0755); err != nil {
+		return staticResult{}, err
+	}
+	tmp := webpPath + ".tmp"
+	out, err := os.Create(longPath(tmp))
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error creating %s: %v\n", tmp, err)
+		return staticResult{}, err
+	}
+	res, err := encodeStatic(out, img, osFile(b.backup), ext, b.rel, opts)
+	if cerr := out.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(longPath(tmp), longPath(webpPath))
+	}
+	if err != nil {
+		os.Remove(longPath(tmp))
+		fmt.Fprintf(stdout, "❌ Error encoding %s: %v\n", b.rel, err)
+		return res, err
+	}
+	return res, nil
+}
@@ -0,0 +1,134 @@
+package webpcon
+
+import (
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// staleOutput is a converted image whose map file entry records other
+// encoding settings than the ones it would get now.
+type staleOutput struct {
+	backup  backupFile
+	entry   *mapEntry
+	opts    options // Its effective options now
+	changes string  // The settings that differ, like "q=80 -> q=60"
+}
+
+// encodingSettingsGiven tells whether the command line sets any encoding
+// flag. Without one, a run keeps to whatever earlier runs used.
+func encodingSettingsGiven(opts options) bool {
+	for _, name := range encodingFlags {
+		for _, n := range findFlag(name).names {
+			if opts.set[strings.TrimLeft(n, "-")] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// staleOutputs lists the converted images whose recorded settings differ
+// from their effective options now. Entries from before settings were
+// recorded, originals sent to the trash, --fallback copies and animated GIFs
+// aren't compared: they can't simply be encoded again from a backup.
+func staleOutputs(root string, outputs *mapping, runs *runLog, overrides *overrideLoader, opts options) ([]staleOutput, error) {
+	backups := backupIndex(root, runs)
+	var stale []staleOutput
+	for _, key := range outputs.keys() {
+		e := outputs.entries[key]
+		b, ok := backups[key]
+		if e.Options == "" || e.Trashed || e.Fallback != "" || !ok {
+			continue
+		}
+		fopts, err := overrides.optionsFor(filepath.Join(root, b.rel), opts)
+		if err != nil {
+			return nil, err
+		}
+		if now := fopts.encodeKey(); now != e.Options {
+			if strings.EqualFold(filepath.Ext(b.rel), ".gif") && isAnimatedGIF(b.backup) {
+				continue
+			}
+			stale = append(stale, staleOutput{b, e, fopts, settingChanges(e.Options, now)})
+		}
+	}
+	sort.Slice(stale, func(i, j int) bool { return stale[i].backup.rel < stale[j].backup.rel })
+	return stale, nil
+}
+
+// settingChanges describes how two encodeKeys differ. A setting only one of
+// them has, like wm for --watermark, is "none" in the other.
+func settingChanges(old, now string) string {
+	fields := func(key string) ([]string, map[string]string) {
+		byName := map[string]string{}
+		list := strings.Split(strings.Trim(key, "|"), "|")
+		for _, f := range list {
+			k, _, _ := strings.Cut(f, "=")
+			byName[k] = f
+		}
+		return list, byName
+	}
+	oldList, before := fields(old)
+	nowList, after := fields(now)
+	var changes []string
+	for _, f := range nowList {
+		k, _, _ := strings.Cut(f, "=")
+		if b, ok := before[k]; !ok {
+			changes = append(changes, "none -> "+f)
+		} else if b != f {
+			changes = append(changes, b+" -> "+f)
+		}
+	}
+	for _, f := range oldList {
+		if k, _, _ := strings.Cut(f, "="); after[k] == "" {
+			changes = append(changes, f+" -> none")
+		}
+	}
+	return strings.Join(changes, ", ")
+}
+
+// checkSettings stops a run whose encoding flags differ from those of images
+// converted before, unless --requality or --force says to re-encode them.
+// Those are then encoded again from their backups, never from their lossy
+// WebP, before the walk converts new files.
+func checkSettings(root string, outputs *mapping, runs *runLog, overrides *overrideLoader, opts options, sum *summary) error {
+	if !encodingSettingsGiven(opts) {
+		return nil
+	}
+	stale, err := staleOutputs(root, outputs, runs, overrides, opts)
+	if err != nil || len(stale) == 0 {
+		return err
+	}
+	if !opts.requality && !opts.force {
+		fmt.Fprintf(stdout, "⛔ %d converted image(s) were encoded with other settings:\n", len(stale))
+		for i, s := range stale {
+			if i == 10 {
+				fmt.Fprintf(stdout, "   … and %d more\n", len(stale)-i)
+				break
+			}
+			fmt.Fprintf(stdout, "   %s (%s)\n", filepath.ToSlash(s.backup.rel), s.changes)
+		}
+		fmt.Fprintln(stdout, "⛔ --requality re-encodes them from their backups with the new settings. Leave out the changed flags to convert only new images as before.")
+		return fmt.Errorf("encoding settings differ from %d converted image(s)", len(stale))
+	}
+
+	for _, s := range stale {
+		res, err := encodeFromBackup(root, s.backup, filepath.FromSlash(s.entry.WebP), s.opts)
+		if err != nil {
+			return err
+		}
+		e := s.entry
+		e.setSize(res.width, res.height)
+		e.Trim = res.trim
+		e.Options, e.Preset, e.ConvertedAt = s.opts.encodeKey(), s.opts.preset, time.Now().Format(time.RFC3339)
+		e.PSNR, e.SSIM = 0, 0
+		if sum, err := hashFile(filepath.Join(root, filepath.FromSlash(e.WebP))); err == nil {
+			e.SHA256 = sum
+		}
+		sum.requalified = append(sum.requalified, filepath.ToSlash(s.backup.rel))
+		fmt.Fprintf(stdout, "✅ Re-encoded from backup (%s): %s, %s\n", res.detail, filepath.ToSlash(s.backup.rel), s.changes)
+	}
+	return nil
+}
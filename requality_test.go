@@ -0,0 +1,101 @@
+package webpcon
+
+import (
+	"bytes"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestRequality converts a tree at one quality, then asks for another: the
+// run stops, touching nothing, until --requality or --force re-encodes the
+// converted images from their backups.
+func TestRequality(t *testing.T) {
+	testEncoder(t, "cgo")
+	log := quietly(t)
+	root := writeFixtureTree(t, []fixtureFile{
+		{"photos/beach.jpg", encodeFixture(t, ".jpg", 40, 30)},
+		{"img/logo.png", encodeFixture(t, ".png", 24, 24)},
+	})
+	convertTree(t, root, testOptions(t, "--encoder", "cgo", "--quality", "80"))
+	converted := treeFiles(t, root)
+	keys := slices.Sorted(maps.Keys(readMapFile(t, root)))
+
+	log.Reset()
+	if err := convertImages(root, testOptions(t, "--encoder", "cgo", "--quality", "60")); err == nil {
+		t.Fatal("a run with another --quality went ahead")
+	}
+	if !strings.Contains(log.String(), "photos/beach.jpg (q=80 -> q=60)") {
+		t.Errorf("the refusal doesn't list what changed:\n%s", log)
+	}
+	unchanged := func(what string) {
+		t.Helper()
+		after := treeFiles(t, root)
+		for rel, data := range converted {
+			if !bytes.Equal(after[rel], data) && !strings.HasPrefix(rel, ".webpcon_backup/") {
+				t.Errorf("%s changed %s", what, rel)
+			}
+		}
+	}
+	unchanged("the refused run")
+
+	// The same settings, or none at all, keep to what was converted
+	for _, args := range [][]string{{"--encoder", "cgo", "--quality", "80"}, nil} {
+		log.Reset()
+		convertTree(t, root, testOptions(t, args...))
+		if strings.Contains(log.String(), "Re-encoded") {
+			t.Errorf("convert %q re-encoded:\n%s", args, log)
+		}
+		unchanged("convert " + strings.Join(args, " "))
+	}
+
+	for _, flag := range []string{"--requality", "--force"} {
+		t.Run(flag, func(t *testing.T) {
+			quality := map[string]string{"--requality": "60", "--force": "70"}[flag]
+			log.Reset()
+			convertTree(t, root, testOptions(t, "--encoder", "cgo", "--quality", quality, flag))
+			for _, key := range keys {
+				if !strings.Contains(log.String(), "): "+key+", q=") {
+					t.Errorf("%s not re-encoded:\n%s", key, log)
+				}
+			}
+			opts := testOptions(t, "--encoder", "cgo", "--quality", quality)
+			for key, e := range readMapFile(t, root) {
+				if e.Options != opts.encodeKey() {
+					t.Errorf("%s records %s", key, e.Options)
+				}
+			}
+
+			// From the backup, the output is what the original encodes to now;
+			// from the lossy WebP it would differ
+			orig, err := os.ReadFile(filepath.Join(root, ".webpcon_backup", "photos", "beach.jpg"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			var want bytes.Buffer
+			if _, err := convertStream(bytes.NewReader(orig), &want, opts); err != nil {
+				t.Fatal(err)
+			}
+			got, _ := os.ReadFile(filepath.Join(root, "photos", "beach.webp"))
+			if !bytes.Equal(got, want.Bytes()) {
+				t.Errorf("photos/beach.webp has %d bytes, encoding the backup gives %d", len(got), want.Len())
+			}
+		})
+	}
+}
+
+func TestSettingChanges(t *testing.T) {
+	tests := []struct{ old, now, want string }{
+		{"|q=80|ll=false", "|q=80|ll=false", ""},
+		{"|q=80|ll=false", "|q=60|ll=false", "q=80 -> q=60"},
+		{"|q=80|ll=false|max=0x0", "|q=60|ll=true|max=400x0", "q=80 -> q=60, ll=false -> ll=true, max=0x0 -> max=400x0"},
+	}
+	for _, tt := range tests {
+		if got := settingChanges(tt.old, tt.now); got != tt.want {
+			t.Errorf("settingChanges(%q, %q) = %q, want %q", tt.old, tt.now, got, tt.want)
+		}
+	}
+}
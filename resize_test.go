@@ -0,0 +1,163 @@
+package webpcon
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"testing"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+func TestFitSize(t *testing.T) {
+	tests := []struct {
+		w, h, maxW, maxH int
+		wantW, wantH     int
+		ok               bool
+	}{
+		{1600, 900, 0, 0, 1600, 900, false},
+		{1600, 900, 1600, 0, 1600, 900, false},
+		{1600, 900, 800, 0, 800, 450, true},
+		{1600, 900, 0, 300, 533, 300, true},
+		{1600, 900, 800, 300, 533, 300, true},
+		{900, 1600, 800, 800, 450, 800, true},
+		{5000, 1, 100, 0, 100, 1, true},
+	}
+	for _, tt := range tests {
+		w, h, ok := fitSize(tt.w, tt.h, tt.maxW, tt.maxH)
+		if w != tt.wantW || h != tt.wantH || ok != tt.ok {
+			t.Errorf("fitSize(%d, %d, %d, %d) = %d, %d, %t, want %d, %d, %t", tt.w, tt.h, tt.maxW, tt.maxH, w, h, ok, tt.wantW, tt.wantH, tt.ok)
+		}
+	}
+}
+
+func TestSRGBLinear(t *testing.T) {
+	for i := range 256 {
+		v := float64(i) / 255
+		if got := linearToSRGB(srgbToLinear(v)); math.Abs(got-v) > 1e-9 {
+			t.Errorf("%d round trips to %g", i, got*255)
+		}
+	}
+	if l := srgbToLinear(188.0 / 255); math.Abs(l-0.5) > 0.005 {
+		t.Errorf("sRGB 188 is %g linear, want 0.5", l)
+	}
+}
+
+// checkerboard alternates black and white pixels, which average to linear
+// 0.5, sRGB 188, while averaging the sRGB values gives 128.
+func checkerboard(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for y := range h {
+		for x := range w {
+			c := color.NRGBA{0, 0, 0, 255}
+			if (x+y)%2 == 0 {
+				c = color.NRGBA{255, 255, 255, 255}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+// meanGray is the average of the red channel of the pixels of img,
+// leaving out a margin, where the filters see past the edge.
+func meanGray(img image.Image, margin int) float64 {
+	b := img.Bounds().Inset(margin)
+	sum, n := 0.0, 0
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			sum += float64(c.R)
+			n++
+		}
+	}
+	return sum / float64(n)
+}
+
+func TestResizeImage(t *testing.T) {
+	board := checkerboard(64, 64)
+	if m := meanGray(resizeImage(board, 16, 16, false), 1); math.Abs(m-188) > 3 {
+		t.Errorf("checkerboard downscaled in linear light averages %.1f, want 188", m)
+	}
+	if m := meanGray(resizeImage(board, 16, 16, true), 1); math.Abs(m-128) > 3 {
+		t.Errorf("checkerboard downscaled with --fast-resize averages %.1f, want 128", m)
+	}
+
+	// A gradient stays a gradient: the same at both ends, and never going back
+	ramp := image.NewNRGBA(image.Rect(0, 0, 256, 4))
+	for x := range 256 {
+		for y := range 4 {
+			ramp.SetNRGBA(x, y, color.NRGBA{uint8(x), uint8(x), uint8(x), 255})
+		}
+	}
+	small := resizeImage(ramp, 64, 1, false)
+	prev := -1
+	for x := range 64 {
+		v := int(small.NRGBAAt(x, 0).R)
+		if v < prev {
+			t.Errorf("gradient goes back from %d to %d at %d", prev, v, x)
+		}
+		prev = v
+	}
+	if lo, hi := small.NRGBAAt(0, 0).R, small.NRGBAAt(63, 0).R; lo > 4 || hi < 251 {
+		t.Errorf("gradient ends at %d and %d, want 0 and 255", lo, hi)
+	}
+
+	// Transparent pixels don't bleed their colour into opaque ones, and a
+	// solid colour stays what it was
+	edge := image.NewNRGBA(image.Rect(0, 0, 32, 32))
+	for y := range 32 {
+		for x := range 32 {
+			c := color.NRGBA{0, 0, 255, 255}
+			if x < 16 {
+				c = color.NRGBA{255, 0, 0, 0}
+			}
+			edge.SetNRGBA(x, y, c)
+		}
+	}
+	for _, fast := range []bool{false, true} {
+		out := resizeImage(edge, 8, 8, fast)
+		for x := range 8 {
+			if c := out.NRGBAAt(x, 4); c.A > 0 && (c.R > 2 || c.B < 253) {
+				t.Errorf("fast %t: pixel %d next to transparent red is %v", fast, x, c)
+			}
+		}
+		if c := out.NRGBAAt(7, 4); c != (color.NRGBA{0, 0, 255, 255}) {
+			t.Errorf("fast %t: solid blue became %v", fast, c)
+		}
+		if c := out.NRGBAAt(0, 4); c.A != 0 {
+			t.Errorf("fast %t: transparent became %v", fast, c)
+		}
+	}
+}
+
+// TestConvertResizeBrightness converts a checkerboard with --max-width and
+// compares the brightness of the output with the linear light average.
+func TestConvertResizeBrightness(t *testing.T) {
+	var data bytes.Buffer
+	if err := png.Encode(&data, checkerboard(128, 64)); err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		args []string
+		want float64
+	}{
+		{nil, 188},
+		{[]string{"--fast-resize"}, 128},
+	} {
+		root := writeFixtureTree(t, []fixtureFile{{"board.png", data.Bytes()}})
+		convertTree(t, root, testOptions(t, append([]string{"--lossless", "--max-width", "32"}, tt.args...)...))
+		img, err := xwebp.Decode(bytes.NewReader(treeFiles(t, root)["board.webp"]))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 16 {
+			t.Errorf("%v: resized to %v", tt.args, b)
+		}
+		if m := meanGray(img, 1); math.Abs(m-tt.want) > 3 {
+			t.Errorf("%v: averages %.1f, want %.0f", tt.args, m, tt.want)
+		}
+	}
+}
@@ -0,0 +1,156 @@
+package webpcon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// refFileExt lists the source files --rewrite-refs looks for image references in.
+// Markdown has a rewriter of its own, see rewriteMarkdown.
+var refFileExt = map[string]bool{
+	".html": true, ".htm": true, ".css": true, ".scss": true, ".sass": true, ".less": true,
+	".js": true, ".mjs": true, ".jsx": true, ".ts": true, ".tsx": true, ".vue": true, ".svelte": true,
+	".md": true, ".mdx": true, ".markdown": true,
+}
+
+var (
+	imgTag   = regexp.MustCompile(`(?is)<img\b[^>]*>`)
+	srcAttr  = regexp.MustCompile(`(?i)\bsrc\s*=\s*["']([^"']+)["']`)
+	sizeAttr = regexp.MustCompile(`(?i)\s(?:width|height)\s*=`)
+)
+
+// rewriteRefs points references to converted images at their WebP outputs in
+// the project's source files. Each file is backed up before its first rewrite
+// so revert can restore it. With addDims, <img> tags that get rewritten and have
+// neither width nor height also get the output's dimensions.
+//
+// What was converted is taken from the map, this run's files and earlier
+// runs' alike, never from what a run could have converted: after --limit or
+// --git-since most eligible images have no WebP. Entries whose WebP isn't on
+// disk either are left alone too.
+func rewriteRefs(root string, m *mapping, addDims bool) error {
+	var missing []string
+	for _, k := range m.keys() {
+		if !m.written(root, m.entries[k]) {
+			missing = append(missing, k)
+		}
+	}
+	if len(missing) > 0 {
+		fmt.Fprintf(stdout, "⚠️  %d file(s) in %s have no WebP on disk, references to them are left alone:\n", len(missing), mapFileName)
+		for _, k := range missing {
+			fmt.Fprintf(stdout, "   %s -> %s\n", k, m.entries[k].WebP)
+		}
+	}
+	return filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if skipDirs[info.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !refFileExt[strings.ToLower(filepath.Ext(path))] {
+			return nil
+		}
+
+		data, err := os.ReadFile(longPath(path))
+		if err != nil {
+			fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", path, err)
+			return err
+		}
+		relPath, _ := filepath.Rel(root, path)
+		rewrite := m.rewriteText
+		if ext := strings.ToLower(filepath.Ext(path)); markdownExt[ext] {
+			rewrite = m.rewriteMarkdown
+		} else if m.picture && (ext == ".html" || ext == ".htm") {
+			rewrite = m.rewritePicture
+		}
+		text, n := rewrite(root, filepath.Dir(path), string(data), addDims)
+		if n == 0 {
+			return nil
+		}
+
+		if err := writeRefFile(root, relPath, text, info.Mode().Perm()); err != nil {
+			return err
+		}
+		fmt.Fprintf(stdout, "✏️  Rewrote %d reference(s) in %s\n", n, relPath)
+		return nil
+	})
+}
+
+// writeRefFile replaces a source file's contents with text, first backing it
+// up into .webpcon_backup unless an earlier rewrite already did, so revert
+// restores the file as it was before webpcon touched it.
+func writeRefFile(root, relPath, text string, perm os.FileMode) error {
+	path := filepath.Join(root, relPath)
+	bakPath := filepath.Join(root, ".webpcon_backup", relPath)
+	if !fileExists(bakPath) {
+		if err := os.MkdirAll(longPath(filepath.Dir(bakPath)), 0755); err != nil {
+			fmt.Fprintf(stdout, "❌ Error creating backup directory: %v\n", err)
+			return err
+		}
+		if err := copyFile(path, bakPath); err != nil {
+			fmt.Fprintf(stdout, "❌ Error backing up %s: %v\n", relPath, err)
+			return err
+		}
+	}
+	if err := os.WriteFile(longPath(path), []byte(text), perm); err != nil {
+		fmt.Fprintf(stdout, "❌ Error writing %s: %v\n", relPath, err)
+		return err
+	}
+	return nil
+}
+
+// rewriteText rewrites the image references in one file's contents and
+// returns the new text with the number of references changed.
+func (m *mapping) rewriteText(root, dir, text string, addDims bool) (string, int) {
+	if addDims {
+		text = m.addDimensions(root, dir, text)
+	}
+
+	n := 0
+	text = imageRef.ReplaceAllStringFunc(text, func(ref string) string {
+		e := m.resolveRef(root, dir, ref)
+		if e == nil {
+			return ref
+		}
+		n++
+		return e.webpRef(ref)
+	})
+	return text, n
+}
+
+// addDimensions gives <img> tags pointing at converted images the output's
+// width and height, unless they have either already.
+func (m *mapping) addDimensions(root, dir, text string) string {
+	return imgTag.ReplaceAllStringFunc(text, func(tag string) string {
+		src := srcAttr.FindStringSubmatch(tag)
+		if src == nil || sizeAttr.MatchString(tag) {
+			return tag
+		}
+		e := m.resolveRef(root, dir, src[1])
+		if e == nil || e.Width == 0 {
+			return tag
+		}
+		return fmt.Sprintf(`<img width="%d" height="%d"`, e.Width, e.Height) + tag[len("<img"):]
+	})
+}
+
+// resolveRef finds the map entry a reference in a file under dir points to.
+// URLs, references to images that weren't converted or whose WebP is gone,
+// and images m.keepRef keeps return nil.
+func (m *mapping) resolveRef(root, dir, ref string) *mapEntry {
+	relPath, ok := resolveRefPath(root, dir, ref)
+	if !ok || (m.keepRef != nil && m.keepRef(relPath)) {
+		return nil
+	}
+	if e := m.get(relPath); e != nil && m.written(root, e) {
+		return e
+	}
+	return nil
+}
@@ -0,0 +1,299 @@
+package webpcon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// runLogName is the file in the backup directory recording which files each
+// run converted and where their originals were backed up.
+const runLogName = "runs.json"
+
+// runsDir holds the backups of sources that already had one from an earlier
+// run, one subdirectory per run. The oldest original always stays at the
+// usual place, which is what a plain revert restores.
+const runsDir = ".runs"
+
+// supersededDir holds backups a later run found to differ from the file it
+// was converting, as happens when a file is edited after a plain revert, one
+// subdirectory per run. Revert leaves them alone.
+const supersededDir = ".superseded"
+
+// runFile is one source converted in a run.
+type runFile struct {
+	Source string `json:"source"`           // Relative to the project root, see pathKey
+	Backup string `json:"backup,omitempty"` // Relative to the project root. Empty when the original went to the trash
+}
+
+type runRecord struct {
+	ID    string    `json:"id"`
+	Time  time.Time `json:"time"`
+	Root  string    `json:"root,omitempty"` // Absolute path of the project, see nestedBackups
+	Files []runFile `json:"files"`
+}
+
+// runLog is the in-memory copy of the run log.
+type runLog struct {
+	path string
+	runs []*runRecord // Oldest first
+}
+
+func loadRunLog(root string) (*runLog, error) {
+	l := &runLog{path: filepath.Join(root, ".webpcon_backup", runLogName)}
+	data, err := os.ReadFile(longPath(l.path))
+	if errors.Is(err, os.ErrNotExist) {
+		return l, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &l.runs); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// start adds a new run. Its ID is the start time, made unique if needed.
+func (l *runLog) start(now time.Time) *runRecord {
+	id := now.Format("20060102-150405")
+	for n := 2; l.find(id) != nil; n++ {
+		id = fmt.Sprintf("%s-%d", now.Format("20060102-150405"), n)
+	}
+	r := &runRecord{ID: id, Time: now, Files: []runFile{}}
+	l.runs = append(l.runs, r)
+	return r
+}
+
+func (l *runLog) find(id string) *runRecord {
+	for _, r := range l.runs {
+		if r.ID == id {
+			return r
+		}
+	}
+	return nil
+}
+
+func (l *runLog) last() *runRecord {
+	if len(l.runs) == 0 {
+		return nil
+	}
+	return l.runs[len(l.runs)-1]
+}
+
+// backedUp reports whether a run still needs the backup at bakPath.
+func (l *runLog) backedUp(root, bakPath string) bool {
+	rel, err := filepath.Rel(root, bakPath)
+	if err != nil {
+		return false
+	}
+	for _, r := range l.runs {
+		for _, f := range r.Files {
+			if f.Backup == pathKey(rel) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// laterRun returns the first run after r that converted source again, if any.
+func (l *runLog) laterRun(r *runRecord, source string) *runRecord {
+	after := false
+	for _, other := range l.runs {
+		if other == r {
+			after = true
+			continue
+		}
+		if !after {
+			continue
+		}
+		for _, f := range other.Files {
+			if f.Source == source {
+				return other
+			}
+		}
+	}
+	return nil
+}
+
+func (r *runRecord) add(root, relPath, bakPath string) {
+	f := runFile{Source: pathKey(relPath)}
+	if bak, err := filepath.Rel(root, bakPath); err == nil && bakPath != filepath.Join(root, relPath) {
+		f.Backup = pathKey(bak)
+	}
+	r.Files = append(r.Files, f)
+}
+
+// save writes the log, leaving out runs that converted nothing. The file is
+// removed once no run is left.
+func (l *runLog) save() error {
+	runs := l.runs[:0]
+	for _, r := range l.runs {
+		if len(r.Files) > 0 {
+			runs = append(runs, r)
+		}
+	}
+	l.runs = runs
+	if len(runs) == 0 {
+		if err := os.Remove(longPath(l.path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	data, err := json.MarshalIndent(runs, "", "  ")
+	if err != nil {
+		return err
+	}
+	// With --trash nothing else may have created the backup directory
+	if err := os.MkdirAll(longPath(filepath.Dir(l.path)), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(longPath(l.path), append(data, '\n'), 0644)
+}
+
+// listRuns prints the recorded runs, oldest first. It only reads.
+func listRuns(root string, asJSON bool) error {
+	l, err := loadRunLog(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", runLogName, err)
+		return err
+	}
+	if asJSON {
+		runs := l.runs
+		if runs == nil {
+			runs = []*runRecord{}
+		}
+		data, err := json.MarshalIndent(runs, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, string(data))
+		return nil
+	}
+	for _, r := range l.runs {
+		fmt.Fprintf(stdout, "   %s  %s  %d file(s)\n", r.ID, r.Time.Local().Format("2006-01-02 15:04:05"), len(r.Files))
+	}
+	fmt.Fprintf(stdout, "📋 %d run(s) recorded\n", len(l.runs))
+	return nil
+}
+
+// revertRun restores the files converted in one run and leaves earlier
+// conversions in place. A file a later run converted again is skipped, since
+// restoring it would also undo that run; revert the later run first.
+func revertRun(root, id string) (err error) {
+	l, err := loadRunLog(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", runLogName, err)
+		return err
+	}
+	r := l.last()
+	if id != "" {
+		r = l.find(id)
+	}
+	if r == nil {
+		if id == "" {
+			return fmt.Errorf("no runs recorded in %s", filepath.Join(root, ".webpcon_backup", runLogName))
+		}
+		return fmt.Errorf("no run %q recorded, see `webpcon %s runs`", id, root)
+	}
+	restored := 0
+	defer func() { appendHistory(root, historyRecord{Command: "revert", Run: r.ID, Files: restored}, err) }()
+
+	outputs, err := loadMapping(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", mapFileName, err)
+		return err
+	}
+
+	fmt.Fprintf(stdout, "⏪ Reverting run %s (%s)\n", r.ID, r.Time.Local().Format("2006-01-02 15:04:05"))
+	var kept []runFile
+	var trashed []string
+	for i, f := range r.Files {
+		if later := l.laterRun(r, f.Source); later != nil {
+			fmt.Fprintf(stdout, "⏭️  Skipping %s: converted again in run %s, revert that one first\n", f.Source, later.ID)
+			kept = append(kept, f)
+			continue
+		}
+		if f.Backup == "" {
+			trashed = append(trashed, f.Source)
+			kept = append(kept, f)
+			continue
+		}
+		relPath := filepath.FromSlash(f.Source)
+		bakPath := filepath.Join(root, filepath.FromSlash(f.Backup))
+		if err := restoreImage(root, relPath, bakPath, webpFor(root, relPath, outputs)); err != nil {
+			// The files restored so far have lost their backups, so the run
+			// log and the map must stop listing them before giving up
+			r.Files = append(kept, r.Files[i:]...)
+			if serr := saveReverted(l, outputs); serr != nil {
+				fmt.Fprintf(stdout, "❌ Error recording the files restored so far: %v\n", serr)
+			}
+			return err
+		}
+		os.Remove(longPath(bakPath))
+		delete(outputs.entries, f.Source)
+		restored++
+	}
+	if len(trashed) > 0 {
+		fmt.Fprintf(stdout, "⚠️  %d file(s) were moved to the system trash with --trash and can't be reverted. Restore them from the trash and delete their WebP files by hand:\n", len(trashed))
+		for _, rel := range trashed {
+			fmt.Fprintf(stdout, "   %s\n", rel)
+		}
+	}
+	r.Files = kept
+	if len(kept) == 0 {
+		os.RemoveAll(longPath(filepath.Join(root, ".webpcon_backup", runsDir, r.ID)))
+	}
+
+	if err := saveReverted(l, outputs); err != nil {
+		return err
+	}
+	if len(outputs.entries) == 0 {
+		return nil
+	}
+	if rewritten := filepath.Join(root, ".webpcon_backup"); hasRefBackups(rewritten) {
+		fmt.Fprintln(stdout, "⚠️  Source files changed by --rewrite-refs are only restored by a full revert. References to the reverted images may now point at missing WebP files.")
+	}
+	return nil
+}
+
+// saveReverted writes the run log and the map file after a revert took files
+// out of them, deleting the map file once it lists nothing.
+func saveReverted(l *runLog, outputs *mapping) error {
+	if err := l.save(); err != nil {
+		fmt.Fprintf(stdout, "❌ Error writing %s: %v\n", runLogName, err)
+		return err
+	}
+	if len(outputs.entries) == 0 {
+		if err := os.Remove(longPath(outputs.path)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		return nil
+	}
+	if err := outputs.save(); err != nil {
+		fmt.Fprintf(stdout, "❌ Error writing %s: %v\n", mapFileName, err)
+		return err
+	}
+	return nil
+}
+
+// hasRefBackups reports whether the backup directory holds source files saved
+// by --rewrite-refs.
+func hasRefBackups(backupRoot string) bool {
+	found := false
+	filepath.Walk(backupRoot, func(path string, info os.FileInfo, err error) error {
+		if err != nil || found {
+			return filepath.SkipDir
+		}
+		if !info.IsDir() && refFileExt[strings.ToLower(filepath.Ext(info.Name()))] {
+			found = true
+		}
+		return nil
+	})
+	return found
+}
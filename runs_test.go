@@ -0,0 +1,166 @@
+package webpcon
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// TestBackupVersions runs convert, revert, edit, convert: the backup of the
+// first version is moved aside, never overwritten, and revert gives back the
+// edited file.
+func TestBackupVersions(t *testing.T) {
+	quietly(t)
+	first, edited := encodeFixture(t, ".png", 8, 8), encodeFixture(t, ".png", 9, 9)
+	root := writeFixtureTree(t, []fixtureFile{{"img/a.png", first}, {"img/b.png", encodeFixture(t, ".png", 7, 7)}})
+	read := func(rel string) []byte {
+		t.Helper()
+		data, err := os.ReadFile(filepath.Join(root, filepath.FromSlash(rel)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	convertTree(t, root, testOptions(t, "--encoder", "native"))
+	if err := revertImages(root); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "img", "a.png"), edited, 0644); err != nil {
+		t.Fatal(err)
+	}
+	convertTree(t, root, testOptions(t, "--encoder", "native"))
+
+	entries := readMapFile(t, root)
+	a, b := entries["img/a.png"], entries["img/b.png"]
+	if a == nil || b == nil {
+		t.Fatalf("map entries %+v and %+v after the second convert", a, b)
+	}
+	if !bytes.Equal(read(".webpcon_backup/img/a.png"), edited) {
+		t.Error("the backup isn't the edited file")
+	}
+	if !strings.HasPrefix(a.SupersededBackup, ".webpcon_backup/"+supersededDir+"/") || !bytes.Equal(read(a.SupersededBackup), first) {
+		t.Errorf("the first version isn't kept at %q", a.SupersededBackup)
+	}
+	if b.SupersededBackup != "" {
+		t.Errorf("unchanged img/b.png has a superseded backup %s", b.SupersededBackup)
+	}
+
+	if err := revertImages(root); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(read("img/a.png"), edited) {
+		t.Error("revert didn't give back the edited file")
+	}
+	if !bytes.Equal(read(a.SupersededBackup), first) {
+		t.Error("revert touched the superseded backup")
+	}
+}
+
+// overlappingRuns converts a.png and b.png, then an edited a.png and a new
+// c.png, and returns the root, the two versions of a.png and the run IDs.
+func overlappingRuns(t *testing.T) (root string, v1, v2 []byte, runs [2]string) {
+	t.Helper()
+	v1, v2 = encodeFixture(t, ".png", 8, 8), encodeFixture(t, ".png", 9, 9)
+	root = writeFixtureTree(t, []fixtureFile{{"a.png", v1}, {"b.png", encodeFixture(t, ".png", 7, 7)}})
+	convertTree(t, root, testOptions(t, "--encoder", "native"))
+	if err := os.WriteFile(filepath.Join(root, "a.png"), v2, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(root, "c.png"), encodeFixture(t, ".png", 6, 6), 0644); err != nil {
+		t.Fatal(err)
+	}
+	convertTree(t, root, testOptions(t, "--encoder", "native"))
+	l, err := loadRunLog(root)
+	if err != nil || len(l.runs) != 2 {
+		t.Fatalf("%v, %d run(s) recorded, want 2", err, len(l.runs))
+	}
+	return root, v1, v2, [2]string{l.runs[0].ID, l.runs[1].ID}
+}
+
+// TestRevertRuns reverts two runs that both converted a.png, in every order
+// revert allows.
+func TestRevertRuns(t *testing.T) {
+	// What is left of the tree: the sources and WebP files, besides backups
+	left := func(t *testing.T, root string) []string {
+		t.Helper()
+		var names []string
+		for rel := range treeFiles(t, root) {
+			if !strings.HasPrefix(rel, ".webpcon_backup/") {
+				names = append(names, rel)
+			}
+		}
+		slices.Sort(names)
+		return names
+	}
+	const all, last, first, second = "all", "last", "first", "second"
+	for _, tt := range []struct {
+		name    string
+		reverts []string // Each is all, last, first or second
+		left    []string
+		a       int // Which version a.png is, 0 for none
+		runs    int // How many runs are left
+	}{
+		{"all", []string{all}, []string{"a.png", "b.png", "c.png"}, 1, 0},
+		{"last", []string{last}, []string{"a.png", "b.webp", "c.png", mapFileName}, 2, 1},
+		{"second by ID", []string{second}, []string{"a.png", "b.webp", "c.png", mapFileName}, 2, 1},
+		// a.png was converted again later, so it is left alone
+		{"first", []string{first}, []string{"a.webp", "b.png", "c.webp", mapFileName}, 0, 2},
+		{"first then last twice", []string{first, last, last}, []string{"a.png", "b.png", "c.png"}, 1, 0},
+		{"last then first", []string{last, first}, []string{"a.png", "b.png", "c.png"}, 1, 0},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			root, v1, v2, runs := overlappingRuns(t)
+			for _, r := range tt.reverts {
+				var err error
+				switch r {
+				case all:
+					err = revertImages(root)
+				case last:
+					err = revertRun(root, "")
+				case first:
+					err = revertRun(root, runs[0])
+				case second:
+					err = revertRun(root, runs[1])
+				}
+				if err != nil {
+					t.Fatalf("revert %s: %v", r, err)
+				}
+			}
+			if got := left(t, root); !slices.Equal(got, tt.left) {
+				t.Errorf("left %q, want %q", got, tt.left)
+			}
+			if tt.a > 0 {
+				data, _ := os.ReadFile(filepath.Join(root, "a.png"))
+				if want := [][]byte{v1, v2}[tt.a-1]; !bytes.Equal(data, want) {
+					t.Errorf("a.png isn't version %d", tt.a)
+				}
+			}
+			l, err := loadRunLog(root)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(l.runs) != tt.runs {
+				t.Errorf("%d run(s) left, want %d", len(l.runs), tt.runs)
+			}
+			if tt.runs == 0 {
+				if fileExists(filepath.Join(root, ".webpcon_backup", runLogName)) {
+					t.Error("the run log is left with no run in it")
+				}
+				if err := revertRun(root, ""); err == nil {
+					t.Error("reverting with no run left succeeded")
+				}
+			}
+		})
+	}
+
+	if err := revertRun(t.TempDir(), "20200101-000000"); err == nil {
+		t.Error("reverting an unknown run succeeded")
+	}
+	if _, err := parseOptions([]string{"--last-run", "--run", "20200101-000000"}); err == nil {
+		t.Error("--last-run with --run accepted")
+	}
+}
@@ -0,0 +1,196 @@
+package webpcon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// defaultSafeDepth is how deep a folder without project files may be before
+// webpcon asks for confirmation.
+const defaultSafeDepth = 10
+
+// projectFiles mark a folder as a web project. --require-project-file adds to them.
+var projectFiles = []string{"package.json", "vite.config.ts", "vite.config.js", "vite.config.mjs", "next.config.js", "next.config.mjs", "next.config.ts", "tsconfig.json", "vue.config.js", "nuxt.config.ts", "nuxt.config.js", "jsconfig.json", "babel.config.js", "postcss.config.js", "tailwind.config.js", "angular.json", "svelte.config.js", "index.html"}
+
+// isSafePath checks that path looks like something meant to be converted.
+// Home and system directories are always refused. Otherwise --force skips the
+// checks, and a previous run's backup or map file counts as a project file.
+func isSafePath(path string, opts options) bool {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return false
+	}
+
+	if reason := protectedPath(abs); reason != "" {
+		fmt.Fprintf(stdout, "Path is %s (%s) and is never converted.\n", reason, abs)
+		return false
+	}
+	if project := backupOwner(abs); project != "" {
+		fmt.Fprintf(stdout, "Path is inside webpcon's backup directory of %s and is never converted: the backups there are the only untouched originals. Run webpcon on %s instead.\n", project, project)
+		return false
+	}
+	if opts.force {
+		return true
+	}
+
+	if abs == "/" || len(abs) <= 3 {
+		fmt.Fprintln(stdout, "Path appears to be root or drive (", abs, ")")
+		return confirm()
+	}
+
+	found := false
+	for _, f := range append(append([]string{".webpcon_backup", mapFileName}, projectFiles...), opts.projectFiles...) {
+		if _, err := os.Stat(filepath.Join(abs, f)); err == nil {
+			found = true
+			break
+		}
+	}
+
+	relParts := strings.Split(filepath.ToSlash(abs), "/")
+	if len(relParts) > opts.safeDepth && !found {
+		fmt.Fprintf(stdout, "Folder is too deep (%d level) and no project files found.\n", len(relParts))
+		return confirm()
+	}
+
+	return true
+}
+
+// protectedPath reports why abs must never be converted, or "" if it may be.
+// System directories are protected with everything inside them; the home
+// directory only by itself.
+func protectedPath(abs string) string {
+	if home, err := os.UserHomeDir(); err == nil && samePath(abs, home) {
+		return "your home directory"
+	}
+
+	var dirs []string
+	if runtime.GOOS == "windows" {
+		for _, env := range []string{"SystemRoot", "ProgramFiles", "ProgramFiles(x86)", "ProgramW6432", "ProgramData"} {
+			if d := os.Getenv(env); d != "" {
+				dirs = append(dirs, d)
+			}
+		}
+	} else {
+		dirs = []string{"/usr", "/bin", "/sbin", "/lib", "/lib64", "/etc", "/boot", "/dev", "/proc", "/sys", "/System", "/Library", "/Applications"}
+	}
+	for _, d := range dirs {
+		if samePath(abs, d) || isWithin(abs, d) {
+			return "a system directory"
+		}
+	}
+	return ""
+}
+
+// caseInsensitiveFS is true where file names usually ignore case.
+var caseInsensitiveFS = runtime.GOOS == "windows" || runtime.GOOS == "darwin"
+
+// samePath compares paths the way the file system does.
+func samePath(a, b string) bool {
+	a, b = filepath.Clean(a), filepath.Clean(b)
+	if caseInsensitiveFS {
+		return strings.EqualFold(a, b)
+	}
+	return a == b
+}
+
+// isWithin reports whether path lies below dir.
+func isWithin(path, dir string) bool {
+	if caseInsensitiveFS {
+		path, dir = strings.ToLower(path), strings.ToLower(dir)
+	}
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != "." && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// backupDirNames are the folders webpcon keeps its own files in, at the root
+// of each project it converted.
+var backupDirNames = []string{".webpcon_backup", ".webcon_cache"}
+
+// backupOwner returns the project whose backup or cache directory abs is, or
+// lies in, or "" if it isn't in one.
+func backupOwner(abs string) string {
+	for dir := filepath.Clean(abs); ; {
+		for _, name := range backupDirNames {
+			if samePath(filepath.Base(dir), name) {
+				return filepath.Dir(dir)
+			}
+		}
+		parent := filepath.Dir(dir)
+		if parent == dir {
+			return ""
+		}
+		dir = parent
+	}
+}
+
+// nestedBackup is the backup directory of another project found below the
+// root of a conversion.
+type nestedBackup struct {
+	dir   string // Relative to the root
+	owner string // The project its runs were recorded for
+}
+
+// nestedBackups lists the backup directories below root, other than root's
+// own, whose project still has conversions to revert. Each belongs to a
+// project converted on its own: converting root too would back its images up
+// a second time, into root's backups, and neither revert would then give back
+// what the other did. A backup directory a revert left behind, with only the
+// history and hash cache in it, doesn't count.
+func nestedBackups(root string) []nestedBackup {
+	var found []nestedBackup
+	filepath.WalkDir(root, func(path string, d os.DirEntry, err error) error {
+		if err != nil || !d.IsDir() || path == root {
+			return nil
+		}
+		if d.Name() == ".webpcon_backup" {
+			rel, _ := filepath.Rel(root, path)
+			if rel != ".webpcon_backup" && unreverted(filepath.Dir(path)) {
+				found = append(found, nestedBackup{rel, recordedRoot(path)})
+			}
+			return filepath.SkipDir
+		}
+		if skipDirs[d.Name()] {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+	return found
+}
+
+// unreverted reports whether the project at root has conversions a revert
+// would undo: a run in its run log with files left, or an entry in its map
+// file other than one whose original went to the trash. Logs or maps that
+// can't be read count as conversions, to be safe.
+func unreverted(root string) bool {
+	runs, err := loadRunLog(root)
+	if err != nil {
+		return true
+	}
+	for _, r := range runs.runs {
+		if len(r.Files) > 0 {
+			return true
+		}
+	}
+	outputs, err := loadMapping(root)
+	if err != nil {
+		return true
+	}
+	return len(outputs.entries) > len(outputs.trashed().entries)
+}
+
+// recordedRoot returns the project root the run log in backupDir names, or
+// the folder holding backupDir for logs from before roots were recorded.
+func recordedRoot(backupDir string) string {
+	runs, err := loadRunLog(filepath.Dir(backupDir))
+	if err == nil {
+		for i := len(runs.runs) - 1; i >= 0; i-- {
+			if runs.runs[i].Root != "" {
+				return runs.runs[i].Root
+			}
+		}
+	}
+	return filepath.Dir(backupDir)
+}
@@ -0,0 +1,150 @@
+package webpcon
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+func TestIsWithin(t *testing.T) {
+	dir := filepath.FromSlash("/srv/site")
+	for _, tt := range []struct {
+		path string
+		want bool
+	}{
+		{"/srv/site/img", true},
+		{"/srv/site/img/logo.png", true},
+		{"/srv/site/..img", true},
+		{"/srv/site", false},
+		{"/srv/site2", false},
+		{"/srv", false},
+		{"/srv/other/img", false},
+	} {
+		if got := isWithin(filepath.FromSlash(tt.path), dir); got != tt.want {
+			t.Errorf("isWithin(%s, %s) = %t, want %t", tt.path, dir, got, tt.want)
+		}
+	}
+}
+
+func TestProtectedPath(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("system directories come from the environment on Windows")
+	}
+	home := t.TempDir()
+	t.Setenv("HOME", home)
+	for _, tt := range []struct {
+		path      string
+		protected bool
+	}{
+		{home, true},
+		{filepath.Join(home, "site"), false}, // Only the home directory itself
+		{"/usr", true},
+		{"/usr/share/doc", true},
+		{"/usr2", false},
+		{"/srv/site", false},
+	} {
+		if got := protectedPath(tt.path); (got != "") != tt.protected {
+			t.Errorf("protectedPath(%s) = %q, want protected %t", tt.path, got, tt.protected)
+		}
+	}
+}
+
+func TestBackupOwner(t *testing.T) {
+	project := filepath.Join(t.TempDir(), "site")
+	for _, tt := range []struct{ rel, want string }{
+		{".webpcon_backup", project},
+		{".webpcon_backup/img", project},
+		{".webpcon_backup/img/nested/logo.png", project},
+		{".webcon_cache", project},
+		{".webcon_cache/objects", project},
+		// A backup kept inside another project's backups belongs to the inner one
+		{"docs/.webpcon_backup/.webpcon_backup/img", filepath.Join(project, "docs", ".webpcon_backup")},
+		{"", ""},
+		{"img", ""},
+		{"img/.webpcon_backup.old", ""},
+		{"webpcon_backup", ""},
+	} {
+		abs := filepath.Join(project, filepath.FromSlash(tt.rel))
+		if got := backupOwner(abs); got != tt.want {
+			t.Errorf("backupOwner(%s) = %q, want %q", tt.rel, got, tt.want)
+		}
+	}
+}
+
+// TestRefuseBackupDir converts a tree and then points webpcon at its backup
+// directory and a folder inside it: both are refused, even with --force,
+// and the backups stay as they were.
+func TestRefuseBackupDir(t *testing.T) {
+	log := quietly(t)
+	root := writeFixtureTree(t, []fixtureFile{
+		{"img/logo.png", encodeFixture(t, ".png", 12, 10)},
+		{"img/nested/deep/photo.jpg", encodeFixture(t, ".jpg", 16, 12)},
+	})
+	convertTree(t, root, testOptions(t, "--encoder", "native"))
+	before := treeFiles(t, root)
+
+	for _, rel := range []string{".webpcon_backup", ".webpcon_backup/img", ".webpcon_backup/img/nested/deep"} {
+		target := filepath.Join(root, filepath.FromSlash(rel))
+		for _, args := range [][]string{nil, {"--force"}} {
+			log.Reset()
+			if isSafePath(target, testOptions(t, args...)) {
+				t.Errorf("%s %q accepted", rel, args)
+			}
+			if !bytes.Contains(log.Bytes(), []byte("backup directory of "+root)) {
+				t.Errorf("%s %q: refused with %q, want the project named", rel, args, log)
+			}
+		}
+	}
+	if !isSafePath(root, testOptions(t, "--force")) {
+		t.Errorf("the project itself refused:\n%s", log)
+	}
+	checkReverted(t, root, before)
+}
+
+// TestRefuseNestedBackups converts a project below root on its own, directly
+// and a few folders down: converting root is refused, leaving everything
+// alone, until the nested project is reverted.
+func TestRefuseNestedBackups(t *testing.T) {
+	for _, sub := range []string{"site", "clients/acme/site"} {
+		t.Run(sub, func(t *testing.T) {
+			log := quietly(t)
+			root := writeFixtureTree(t, []fixtureFile{
+				{"logo.png", encodeFixture(t, ".png", 12, 10)},
+				{sub + "/img/hero.png", encodeFixture(t, ".png", 10, 12)},
+				{sub + "/photos/beach.jpg", encodeFixture(t, ".jpg", 16, 12)},
+			})
+			project := filepath.Join(root, filepath.FromSlash(sub))
+			convertTree(t, project, testOptions(t, "--encoder", "native"))
+			before := treeFiles(t, root)
+
+			log.Reset()
+			if err := convertImages(root, testOptions(t, "--encoder", "native")); err == nil {
+				t.Fatal("converting the parent succeeded, want it refused")
+			}
+			if !bytes.Contains(log.Bytes(), []byte(filepath.FromSlash(sub)+string(filepath.Separator)+".webpcon_backup holds the backups of "+project)) {
+				t.Errorf("the nested project isn't named:\n%s", log)
+			}
+			checkReverted(t, root, before)
+
+			// Converting the project again is fine: its own backups don't count
+			convertTree(t, project, testOptions(t, "--encoder", "native"))
+
+			// Reverting leaves the backup directory with the history, which no
+			// longer blocks the parent
+			if _, err := runRevert(project, revertFromBackup); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := os.Stat(filepath.Join(project, ".webpcon_backup")); err != nil {
+				t.Fatalf("no backup directory left by the revert: %v", err)
+			}
+			if nested := nestedBackups(root); len(nested) != 0 {
+				t.Errorf("reverted project still blocks the parent: %+v", nested)
+			}
+			if sum := convertTree(t, root, testOptions(t, "--encoder", "native")); sum.Converted != 3 {
+				t.Errorf("converted %d once the nested project was reverted, want 3", sum.Converted)
+			}
+		})
+	}
+}
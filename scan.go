@@ -0,0 +1,210 @@
+package webpcon
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"time"
+)
+
+// hashCacheName is the file in the backup directory remembering the hashes
+// of source images, so unchanged files aren't read again.
+const hashCacheName = "hash-cache.json"
+
+// hashCacheInterval is how often a scan in progress saves what it has, so an
+// interrupted scan picks up where it was.
+const hashCacheInterval = 2 * time.Second
+
+// scanEntry is what a scan learned about one image. A file whose size and
+// modification time still match is taken to have the same content.
+type scanEntry struct {
+	Size    int64  `json:"size"`
+	ModTime int64  `json:"modTime"` // Unix nanoseconds
+	SHA256  string `json:"sha256"`
+	Width   int    `json:"width,omitempty"`
+	Height  int    `json:"height,omitempty"`
+}
+
+// hashCache is the in-memory copy of the hash cache, keyed by pathKey.
+type hashCache struct {
+	path    string
+	entries map[string]scanEntry
+}
+
+// loadHashCache reads the cache for root. A missing or unreadable cache is
+// an empty one: at worst, files are hashed again.
+func loadHashCache(root string) *hashCache {
+	c := &hashCache{path: filepath.Join(root, ".webpcon_backup", hashCacheName), entries: map[string]scanEntry{}}
+	if data, err := os.ReadFile(longPath(c.path)); err == nil {
+		json.Unmarshal(data, &c.entries)
+	}
+	return c
+}
+
+// lookup returns the entry for relPath if the file is unchanged since.
+func (c *hashCache) lookup(relPath string, size int64, modTime time.Time) (scanEntry, bool) {
+	e, ok := c.entries[pathKey(relPath)]
+	return e, ok && e.Size == size && e.ModTime == modTime.UnixNano()
+}
+
+// hash returns the SHA-256 of the file at relPath in fsys, from the cache
+// when the file is unchanged since it was scanned.
+func (c *hashCache) hash(fsys fs.FS, relPath string, info fs.FileInfo) (string, error) {
+	if e, ok := c.lookup(relPath, info.Size(), info.ModTime()); ok {
+		return e.SHA256, nil
+	}
+	return hashFS(fsys, treeName(relPath))
+}
+
+// save writes the cache through a temporary file, so an interrupted save
+// leaves the previous cache in place.
+func (c *hashCache) save() error {
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	tmp := c.path + ".tmp"
+	if err := os.WriteFile(longPath(tmp), data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(longPath(tmp), longPath(c.path))
+}
+
+// prescan brings the hash cache up to date for sources, hashing the files
+// that changed on all CPUs, and with dims reading their dimensions too.
+// Progress goes to stderr when it's a terminal. Files that can't be read are
+// left out of the cache, for the caller to report when it gets to them.
+// With prune, entries of files no longer among sources are dropped.
+func prescan(root string, sources []source, dims, prune bool) (*hashCache, error) {
+	cache := loadHashCache(root)
+	var todo []source
+	for _, src := range sources {
+		e, ok := cache.lookup(src.rel, src.size, src.modTime)
+		if !ok || (dims && e.Width == 0) {
+			todo = append(todo, src)
+		}
+	}
+
+	type result struct {
+		key   string
+		entry scanEntry
+		err   error
+	}
+	jobs := make(chan source)
+	results := make(chan result)
+	for range min(workers(runtime.NumCPU()), max(len(todo), 1)) {
+		go func() {
+			for src := range jobs {
+				path := filepath.Join(root, src.rel)
+				e := scanEntry{Size: src.size, ModTime: src.modTime.UnixNano()}
+				var err error
+				acquireFile()
+				if e.SHA256, err = hashFile(path); err == nil && dims {
+					if cfg, cerr := decodeConfig(path, src.ext); cerr == nil {
+						e.Width, e.Height = cfg.Width, cfg.Height
+					}
+				}
+				releaseFile()
+				results <- result{pathKey(src.rel), e, err}
+			}
+		}()
+	}
+	go func() {
+		for _, src := range todo {
+			jobs <- src
+		}
+		close(jobs)
+	}()
+
+	show := isTerminal(os.Stderr) && len(todo) > 0
+	lastSave := time.Now()
+	for done := 1; done <= len(todo); done++ {
+		r := <-results
+		if r.err == nil {
+			cache.entries[r.key] = r.entry
+		}
+		if show {
+			fmt.Fprintf(os.Stderr, "\rScanning images: %d/%d hashed", done, len(todo))
+		}
+		if time.Since(lastSave) >= hashCacheInterval {
+			cache.save()
+			lastSave = time.Now()
+		}
+	}
+	if show {
+		fmt.Fprintln(os.Stderr)
+	}
+
+	if prune {
+		keep := make(map[string]bool, len(sources))
+		for _, src := range sources {
+			keep[pathKey(src.rel)] = true
+		}
+		for key := range cache.entries {
+			if !keep[key] {
+				delete(cache.entries, key)
+			}
+		}
+	}
+	return cache, cache.save()
+}
+
+// scannedImage is one line of the scan command's inventory.
+type scannedImage struct {
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+}
+
+// scanImages lists the images a conversion would take, with their hashes
+// and dimensions, from the hash cache where files are unchanged.
+func scanImages(root string, opts options) error {
+	// Logs go to stderr while the inventory has stdout
+	restore := func() {}
+	if opts.jsonOutput {
+		restore = logsToStderr()
+	}
+	defer restore()
+	eligible, err := eligibleSources(root, opts)
+	if err != nil {
+		return err
+	}
+	cache, err := prescan(root, eligible, true, true)
+	if err != nil {
+		fmt.Fprintf(stdout, "⚠️  Could not save %s: %v\n", hashCacheName, err)
+	}
+
+	images := []scannedImage{}
+	var total int64
+	for _, src := range eligible {
+		e, ok := cache.lookup(src.rel, src.size, src.modTime)
+		if !ok {
+			fmt.Fprintf(stdout, "⚠️  Could not read %s\n", src.rel)
+			continue
+		}
+		images = append(images, scannedImage{filepath.ToSlash(src.rel), e.Size, e.SHA256, e.Width, e.Height})
+		total += e.Size
+	}
+	sort.Slice(images, func(i, j int) bool { return images[i].File < images[j].File })
+
+	if opts.jsonOutput {
+		data, err := json.MarshalIndent(images, "", "  ")
+		if err != nil {
+			return err
+		}
+		restore()
+		fmt.Fprintln(stdout, string(data))
+		return nil
+	}
+	for _, img := range images {
+		fmt.Fprintf(stdout, "%s  %9s  %5dx%-5d  %s\n", img.SHA256[:12], formatSize(img.Size), img.Width, img.Height, img.File)
+	}
+	fmt.Fprintf(stdout, "📋 %d eligible image(s), %s\n", len(images), formatSize(total))
+	return nil
+}
@@ -0,0 +1,176 @@
+package webpcon
+
+import (
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// selector decides which files the conversion walk takes, from what the run
+// knows before it starts: options, the map file, the project's icons,
+// references and git changes, and the case-insensitive collisions.
+type selector struct {
+	opts       options
+	outputs    *mapping
+	icons      map[string]string   // See projectIcons
+	referenced *projectRefs        // With --only-referenced
+	changed    map[string]bool     // With --git-since
+	collisions map[string][]string // See findCollisions
+	written    map[string]bool     // See writtenOutputs
+	src        fs.FS               // The sources, whose headers some checks read
+	dst        fs.FS               // Where the WebP files go, to find the names taken
+}
+
+// Reasons shouldConvert gives for leaving a file alone. They go to the
+// --progress-ndjson events as they are, so they don't change.
+const (
+	skipNotImage     = "notImage"     // Not an image conversions take, events aren't sent
+	skipExcluded     = "excluded"     // skipFiles or --exclude-regex, events aren't sent
+	skipBeforeSince  = "beforeSince"  // Modified before --since
+	skipConverted    = "converted"    // Listed in the map file, with --since
+	skipFallback     = "fallback"     // Written by --fallback
+	skipIcon         = "icon"         // Declared as an icon, see projectIcons
+	skipIconSized    = "iconSized"    // Looks like an icon, see iconSized
+	skipUnreferenced = "unreferenced" // Not referenced, with --only-referenced
+	skipUnchanged    = "unchanged"    // Unchanged in git, with --git-since
+	skipCollision    = "collision"    // Shares its WebP file with another source, see findCollisions
+	skipConflict     = "webpExists"   // Its WebP name is taken by a file webpcon didn't write
+	skipTooSmall     = "tooSmall"     // Below --min-width or --min-height
+	skipTooLarge     = "tooLarge"     // Over --max-megapixels, with export
+	skipAnimated     = "animatedGif"  // Animated GIF, without --enable-gif or --gif-flatten
+	skipNotAttempted = "notAttempted" // Left for the next run after --limit, --max-duration or a full disk
+	skipInUse        = "inUse"        // Open or locked by another program, still at the end of the run
+	skipMisnamedWebP = "misnamedWebp" // WebP content under another extension, see misnamedWebP
+	skipLFSPointer   = "lfsPointer"   // A git LFS pointer left by a checkout without git lfs pull
+)
+
+// shouldConvert tells whether the file relPath in s.src is to be converted,
+// or why not: one of the skip reasons, with a detail for the log. Checks that
+// only need the name come first, then those reading the image header. err is
+// only set when that header can't be read.
+func (s *selector) shouldConvert(relPath string, info fs.FileInfo) (ok bool, reason, detail string, err error) {
+	ext := strings.ToLower(filepath.Ext(info.Name()))
+	if !imageExt[ext] || ext == ".webp" || !s.opts.inputEnabled(ext) {
+		return false, skipNotImage, "", nil
+	}
+	if skipFiles[info.Name()] || s.opts.excluded(relPath) {
+		return false, skipExcluded, "", nil
+	}
+	// Before anything reads it as an image, let alone moves it
+	if isLFSPointer(s.src, treeName(relPath), info.Size()) {
+		return false, skipLFSPointer, "", nil
+	}
+
+	// --since looks at new files only: an image the map lists was
+	// converted before, however recent its modification time
+	if !s.opts.since.IsZero() {
+		if info.ModTime().Before(s.opts.since) {
+			return false, skipBeforeSince, "", nil
+		}
+		if s.outputs.get(relPath) != nil {
+			return false, skipConverted, "", nil
+		}
+	}
+	key := pathKey(relPath)
+	if e := s.outputs.get(relPath); e != nil && e.Fallback != "" {
+		return false, skipFallback, "", nil
+	}
+	if why := s.icons[key]; why != "" {
+		return false, skipIcon, why, nil
+	}
+	if why := iconSized(s.src, relPath, ext, s.opts); why != "" {
+		return false, skipIconSized, why, nil
+	}
+	if s.referenced != nil && !s.referenced.images[key] {
+		return false, skipUnreferenced, "", nil
+	}
+	if s.changed != nil && !s.changed[key] {
+		return false, skipUnchanged, "", nil
+	}
+	if group := s.collisions[key]; group != nil && !s.opts.force {
+		return false, skipCollision, others(group, relPath), nil
+	}
+	if webp, conflict := s.outputFor(relPath, ext); conflict != "" {
+		if s.opts.conflictPolicy() == conflictSkip {
+			return false, skipConflict, conflict, nil
+		}
+		if webp != conflict && s.taken(webp) {
+			return false, skipConflict, webp, nil // Its other name is taken too
+		}
+	}
+
+	checkFrames := ext == ".gif" && !s.opts.enableGif && !s.opts.gifFlatten
+	checkSize := s.opts.minWidth > 0 || s.opts.minHeight > 0 || s.opts.maxMegapixels > 0
+	if !checkFrames && !checkSize {
+		return true, "", "", nil
+	}
+	p, err := s.probe(relPath, ext)
+	// Converting only the first frame would quietly stop the animation. A GIF
+	// the probe can't read is left for the decoder to report.
+	if checkFrames && err == nil && p.animated() {
+		return false, skipAnimated, "", nil
+	}
+	if checkSize {
+		if err != nil {
+			return false, "", "", err
+		}
+		if p.width < s.opts.minWidth || p.height < s.opts.minHeight {
+			return false, skipTooSmall, fmt.Sprintf("%dx%d", p.width, p.height), nil
+		}
+		if s.opts.maxMegapixels > 0 {
+			if err := checkMegapixels(p.width, p.height, s.opts); err != nil {
+				return false, skipTooLarge, err.Error(), nil
+			}
+		}
+	}
+	return true, "", "", nil
+}
+
+// probe is probeImage for relPath in s.src.
+func (s *selector) probe(relPath, ext string) (imageProbe, error) {
+	f, err := openSeekable(s.src, treeName(relPath))
+	if err != nil {
+		return imageProbe{}, err
+	}
+	defer f.Close()
+	return probeFrom(f, ext)
+}
+
+// logSkip logs a file shouldConvert left alone and counts it in sum.
+func (s *selector) logSkip(out *fileLog, sum *summary, path, relPath, reason, detail string) {
+	switch reason {
+	case skipExcluded:
+		out.println("⏭️ Skipping excluded file:", path)
+	case skipBeforeSince:
+		sum.beforeSince++
+	case skipConverted:
+		out.printf("⏭️ Skipping %s (converted by an earlier run)\n", path)
+	case skipFallback:
+		out.printf("⏭️ Skipping %s (fallback written by --fallback)\n", path)
+	case skipIcon:
+		out.printf("⏭️ Skipping %s (%s, browsers may not load WebP icons; --convert-icons converts it)\n", path, detail)
+	case skipIconSized:
+		out.printf("⏭️ Skipping %s (looks like an icon: %s; --convert-icons converts it)\n", path, detail)
+	case skipUnreferenced:
+		sum.unreferenced++
+	case skipUnchanged:
+		sum.unchanged++
+	case skipCollision:
+		sum.addCollision(s.collisions[pathKey(relPath)])
+		out.printf("⏭️ Skipping %s (%s: %s)\n", path, collisionCause(s.collisions[pathKey(relPath)]), detail)
+	case skipConflict:
+		sum.addConflict(relPath, detail, "skipped", "")
+		out.printf("⚠️  Skipping %s (%s exists and wasn't written by webpcon; --on-conflict overwrite or rename converts it)\n", path, filepath.ToSlash(detail))
+	case skipTooSmall:
+		out.printf("⏭️ Skipping (too small, %s): %s\n", detail, path)
+		sum.tooSmall++
+	case skipTooLarge:
+		sum.skipUnsupported(out, relPath, detail, nil)
+	case skipAnimated:
+		out.printf("⏭️ Skipping %s (animated GIF; re-run with --enable-gif to keep the animation, or --gif-flatten for its first frame)\n", path)
+		sum.animatedSkipped++
+	case skipLFSPointer:
+		sum.skipLFSPointer(out, relPath)
+	}
+}
@@ -0,0 +1,102 @@
+package webpcon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// selectorTree is a project with a file for each reason shouldConvert gives.
+func selectorTree(tb testing.TB) string {
+	tb.Helper()
+	png := encodeFixture(tb, ".png", 40, 30)
+	root := writeFixtureTree(tb, []fixtureFile{
+		{"photo.png", png},
+		{"UPPER.PNG", png},
+		{"notes.txt", []byte("not an image\n")},
+		{"already.webp", []byte("RIFF")},
+		{"photo.avif", []byte("not read")},
+		{"build/app.a1b2c3d4.png", png},
+		{"old.png", png},
+		{"done.png", png},
+		{"fallback.png", png},
+		{"icons/icon-192.png", encodeFixture(tb, ".png", 192, 192)},
+		{"manifest-icon.png", png},
+		{"lfs.png", []byte(lfsPointerPrefix + "\noid sha256:0000\nsize 12345\n")},
+		{"small.png", encodeFixture(tb, ".png", 8, 8)},
+		{"still.gif", encodeFixture(tb, ".gif", 8, 8)},
+		{"collide/Pic.png", png},
+		{"collide/pic.jpg", encodeFixture(tb, ".jpg", 40, 30)},
+	})
+	old := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := os.Chtimes(filepath.Join(root, "old.png"), old, old); err != nil {
+		tb.Fatal(err)
+	}
+	return root
+}
+
+func TestShouldConvert(t *testing.T) {
+	root := selectorTree(t)
+	tests := []struct {
+		rel        string
+		args       []string
+		referenced bool // Only photo.png is referenced
+		changed    bool // Only photo.png changed in git
+		want       string
+	}{
+		{rel: "photo.png", want: ""},
+		{rel: "photo.png", args: []string{"--min-width", "40", "--min-height", "30", "--since", "2024-01-01"}, referenced: true, changed: true, want: ""},
+		{rel: "UPPER.PNG", want: ""},
+		{rel: "notes.txt", want: skipNotImage},
+		{rel: "already.webp", want: skipNotImage},
+		{rel: "photo.avif", want: skipNotImage},
+		{rel: "photo.avif", args: []string{"--enable-avif-input", "--exclude-regex", `\.avif$`}, want: skipExcluded},
+		{rel: "build/app.a1b2c3d4.png", args: []string{"--exclude-regex", `\.[0-9a-f]{8}\.png$`}, want: skipExcluded},
+		{rel: "old.png", args: []string{"--since", "2024-01-01"}, want: skipBeforeSince},
+		{rel: "done.png", args: []string{"--since", "2024-01-01"}, want: skipConverted},
+		{rel: "done.png", want: ""}, // Only --since skips what the map lists
+		{rel: "fallback.png", want: skipFallback},
+		{rel: "manifest-icon.png", want: skipIcon},
+		{rel: "lfs.png", want: skipLFSPointer},
+		{rel: "icons/icon-192.png", want: skipIconSized},
+		{rel: "icons/icon-192.png", args: []string{"--convert-icons"}, want: ""},
+		{rel: "small.png", args: []string{"--min-width", "16"}, want: skipTooSmall},
+		{rel: "small.png", args: []string{"--min-height", "9"}, want: skipTooSmall},
+		{rel: "small.png", args: []string{"--min-dimension", "8"}, want: ""},
+		{rel: "still.gif", want: ""},
+		{rel: "done.png", referenced: true, want: skipUnreferenced},
+		{rel: "done.png", changed: true, want: skipUnchanged},
+		{rel: "collide/Pic.png", want: skipCollision},
+		{rel: "collide/pic.jpg", args: []string{"--force"}, want: ""},
+	}
+	for _, tt := range tests {
+		opts := testOptions(t, tt.args...)
+		outputs := &mapping{entries: map[string]*mapEntry{
+			"done.png":     {WebP: "done.webp"},
+			"fallback.png": {WebP: "fallback.webp", Fallback: "fallback.png"},
+		}}
+		sel := &selector{opts: opts, outputs: outputs,
+			icons:      map[string]string{"manifest-icon.png": "in the web app manifest"},
+			collisions: findCollisions(scanSources(root, opts)), src: osTree(root), dst: osTree(root)}
+		if tt.referenced {
+			sel.referenced = &projectRefs{images: map[string]bool{"photo.png": true}}
+		}
+		if tt.changed {
+			sel.changed = map[string]bool{"photo.png": true}
+		}
+
+		info, err := os.Stat(filepath.Join(root, filepath.FromSlash(tt.rel)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ok, reason, _, err := sel.shouldConvert(filepath.FromSlash(tt.rel), info)
+		if err != nil {
+			t.Errorf("%s %v: %v", tt.rel, tt.args, err)
+			continue
+		}
+		if reason != tt.want || ok != (tt.want == "") {
+			t.Errorf("%s %v: got %v, %q, want %q", tt.rel, tt.args, ok, reason, tt.want)
+		}
+	}
+}
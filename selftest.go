@@ -0,0 +1,233 @@
+package webpcon
+
+import (
+	"bytes"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// selftestFile is what selftest compares of a file before and after.
+type selftestFile struct {
+	sha256  string
+	modTime time.Time
+}
+
+// selftest copies a sample of the project, or the folders given with
+// --folders, to a temporary folder, converts and reverts the copy with the
+// options given, and checks every file came back byte for byte. The project
+// itself is only read. A copy that doesn't come back the same is kept for a
+// look, with the log of both runs next to it.
+func selftest(root string, opts options) error {
+	base, err := os.MkdirTemp("", "webpcon-selftest-")
+	if err != nil {
+		return err
+	}
+	tree := filepath.Join(base, "tree")
+	copied, err := copySelftestTree(root, tree, opts)
+	if err != nil {
+		os.RemoveAll(base)
+		return err
+	}
+	fmt.Fprintf(stdout, "📐 Copied %d file(s) to %s\n", copied, tree)
+
+	before, err := snapshotTree(tree)
+	if err != nil {
+		os.RemoveAll(base)
+		return err
+	}
+
+	// Both runs log to a file, which is kept along with the copy on failure
+	var log bytes.Buffer
+	saved, savedTTY := stdout, stdoutTTY
+	stdout, stdoutTTY = &log, false
+	opts.progress, opts.yes = nil, false
+	conv, convErr := runConvert(tree, opts)
+	rev, revErr := runRevert(tree, revertFromBackup)
+	stdout, stdoutTTY = saved, savedTTY
+	logPath := filepath.Join(base, "selftest.log")
+	if convErr != nil || revErr != nil {
+		os.WriteFile(logPath, log.Bytes(), 0644)
+		if convErr != nil {
+			return fmt.Errorf("convert failed on the copy, see %s: %v", logPath, convErr)
+		}
+		return fmt.Errorf("revert failed on the copy, see %s: %v", logPath, revErr)
+	}
+
+	after, err := snapshotTree(tree)
+	if err != nil {
+		return err
+	}
+	var changed, missing, extra, touched []string
+	for rel, b := range before {
+		a, ok := after[rel]
+		switch {
+		case !ok:
+			missing = append(missing, rel)
+		case a.sha256 != b.sha256:
+			changed = append(changed, rel)
+		case !a.modTime.Equal(b.modTime):
+			touched = append(touched, rel)
+		}
+	}
+	for rel := range after {
+		if _, ok := before[rel]; !ok {
+			extra = append(extra, rel)
+		}
+	}
+
+	list := func(what string, files []string) {
+		if len(files) == 0 {
+			return
+		}
+		sort.Strings(files)
+		fmt.Fprintf(stdout, "❌ %d file(s) %s:\n", len(files), what)
+		for _, f := range files {
+			fmt.Fprintln(stdout, "   -", f)
+		}
+	}
+	list("differ from before", changed)
+	list("are missing", missing)
+	list("were left behind", extra)
+	if len(touched) > 0 {
+		sort.Strings(touched)
+		fmt.Fprintf(stdout, "⚠️  %d file(s) are unchanged but have a new modification time:\n", len(touched))
+		for _, f := range touched {
+			fmt.Fprintln(stdout, "   -", f)
+		}
+	}
+	if n := len(changed) + len(missing) + len(extra); n > 0 {
+		os.WriteFile(logPath, log.Bytes(), 0644)
+		fmt.Fprintf(stdout, "🔎 The copy and the log of both runs are kept in %s\n", base)
+		return fmt.Errorf("%d file(s) didn't survive convert and revert unchanged", n)
+	}
+	os.RemoveAll(base)
+	fmt.Fprintf(stdout, "✅ All %d file(s) are byte-identical after converting %d and restoring %d\n", len(before), conv.Converted, rev.Restored)
+	return nil
+}
+
+// copySelftestTree copies what selftest runs on from root to tree: the
+// folders given with --folders whole, or else a sample of --sample eligible
+// images. The sample is topped up with a group of colliding files, and with
+// --enable-gif an animated GIF, so those paths are taken; with --rewrite-refs
+// or --only-referenced the source files come along too. Per-folder configs
+// and sidecars always do.
+func copySelftestTree(root, tree string, opts options) (int, error) {
+	var rels []string
+	if len(opts.selftestFolders) > 0 {
+		for _, dir := range opts.selftestFolders {
+			err := filepath.Walk(filepath.Join(root, dir), func(path string, info os.FileInfo, err error) error {
+				if err != nil {
+					return err
+				}
+				if info.IsDir() {
+					if skipDirs[info.Name()] {
+						return filepath.SkipDir
+					}
+					return nil
+				}
+				rel, _ := filepath.Rel(root, path)
+				rels = append(rels, rel)
+				return nil
+			})
+			if err != nil {
+				return 0, fmt.Errorf("--folders: %v", err)
+			}
+		}
+	} else {
+		eligible, seed, err := shuffledSources(root, opts)
+		if err != nil {
+			return 0, err
+		}
+		if len(eligible) == 0 {
+			return 0, fmt.Errorf("no eligible images under %s", root)
+		}
+		sample := eligible[:min(opts.sample, len(eligible))]
+		fmt.Fprintf(stdout, "📐 Sampling %d of %d eligible file(s) (seed %d)\n", len(sample), len(eligible), seed)
+		for _, src := range sample {
+			rels = append(rels, src.rel)
+		}
+		if opts.enableGif && !slices.ContainsFunc(sample, func(s source) bool { return s.ext == ".gif" }) {
+			for _, src := range eligible {
+				if p, err := probeImage(filepath.Join(root, src.rel), src.ext); err == nil && p.animated() {
+					rels = append(rels, src.rel)
+					break
+				}
+			}
+		}
+		all := scanSources(root, opts)
+		// Colliding files aren't eligible, so one group is added as it is
+		collisions := findCollisions(all)
+		if keys := slices.Sorted(maps.Keys(collisions)); len(keys) > 0 {
+			for _, rel := range collisions[keys[0]] {
+				rels = append(rels, filepath.FromSlash(rel))
+			}
+		}
+		// Everything else the runs read
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				return nil
+			}
+			rel, _ := filepath.Rel(root, path)
+			if info.IsDir() {
+				if skipDirs[info.Name()] || opts.vendoredReason(osTree(root), rel) != "" {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			ext := strings.ToLower(filepath.Ext(info.Name()))
+			if info.Name() == dirConfigName || ext == sidecarExt || (refFileExt[ext] && (opts.rewriteRefs || opts.onlyReferenced)) {
+				rels = append(rels, rel)
+			}
+			return nil
+		})
+	}
+
+	seen := map[string]bool{}
+	copied := 0
+	for _, rel := range rels {
+		if seen[rel] {
+			continue
+		}
+		seen[rel] = true
+		dst := filepath.Join(tree, rel)
+		if err := os.MkdirAll(longPath(filepath.Dir(dst)), 0755); err != nil {
+			return copied, err
+		}
+		if err := copyFile(filepath.Join(root, rel), dst); err != nil {
+			return copied, err
+		}
+		copied++
+	}
+	return copied, nil
+}
+
+// snapshotTree hashes every file under tree but webpcon's own folders, which
+// keep their history after a revert, by slash-separated relative path.
+func snapshotTree(tree string) (map[string]selftestFile, error) {
+	files := map[string]selftestFile{}
+	err := filepath.Walk(tree, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() {
+			if info.Name() == ".webpcon_backup" || info.Name() == ".webcon_cache" {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		sum, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+		rel, _ := filepath.Rel(tree, path)
+		files[filepath.ToSlash(rel)] = selftestFile{sum, info.ModTime()}
+		return nil
+	})
+	return files, err
+}
@@ -0,0 +1,188 @@
+package webpcon
+
+import (
+	"bytes"
+	"container/list"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"os/signal"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// webpCache keeps the WebPs serve made, up to max bytes, dropping the least
+// recently used first.
+type webpCache struct {
+	mu    sync.Mutex
+	max   int64
+	size  int64
+	order *list.List // Of *cachedWebP, most recently used first
+	items map[string]*list.Element
+}
+
+type cachedWebP struct {
+	key  string
+	data []byte
+}
+
+func newWebPCache(max int64) *webpCache {
+	return &webpCache{max: max, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *webpCache) get(key string) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	return e.Value.(*cachedWebP).data, true
+}
+
+// put adds data under key. A WebP larger than the whole cache isn't kept.
+func (c *webpCache) put(key string, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if int64(len(data)) > c.max {
+		return
+	}
+	if e, ok := c.items[key]; ok {
+		c.size -= int64(len(e.Value.(*cachedWebP).data))
+		c.order.Remove(e)
+	}
+	c.items[key] = c.order.PushFront(&cachedWebP{key, data})
+	c.size += int64(len(data))
+	for c.size > c.max {
+		last := c.order.Back()
+		old := last.Value.(*cachedWebP)
+		c.order.Remove(last)
+		delete(c.items, old.key)
+		c.size -= int64(len(old.data))
+	}
+}
+
+// serveProject serves the project at root over HTTP, converting images to
+// WebP as they are requested, for a look at the site with the current
+// settings without changing a file. Browsers whose Accept header doesn't
+// list image/webp get the originals, as does everyone for images that can't
+// be converted. Conversions go through convertStream with each image's
+// effective options and are cached by path, modification time and options.
+func serveProject(root string, opts options) error {
+	srv := &http.Server{Addr: opts.listen, Handler: serveHandler(root, opts)}
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	done := make(chan error, 1)
+	go func() {
+		<-ctx.Done()
+		shutdown, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		done <- srv.Shutdown(shutdown)
+	}()
+
+	fmt.Fprintf(stdout, "🔎 Serving %s on http://%s with WebP conversion, Ctrl+C stops\n", root, displayAddr(opts.listen))
+	if err := srv.ListenAndServe(); !errors.Is(err, http.ErrServerClosed) {
+		fmt.Fprintf(stdout, "❌ Could not serve: %v\n", err)
+		return err
+	}
+	err := <-done
+	fmt.Fprintln(stdout, "✅ Stopped serving")
+	return err
+}
+
+// serveHandler is the handler of serveProject for the project at root.
+func serveHandler(root string, opts options) http.Handler {
+	cache := newWebPCache(opts.serveCache)
+	files := http.FileServer(http.Dir(root))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rel := filepath.FromSlash(strings.TrimPrefix(path.Clean("/"+r.URL.Path), "/"))
+		ext := strings.ToLower(filepath.Ext(rel))
+		if !imageExt[ext] || ext == ".webp" || (r.Method != http.MethodGet && r.Method != http.MethodHead) {
+			files.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Accept")
+		file := filepath.Join(root, rel)
+		info, err := os.Stat(longPath(file))
+		if err != nil || info.IsDir() || !acceptsWebP(r) {
+			files.ServeHTTP(w, r)
+			return
+		}
+		data, err := serveWebP(cache, root, file, rel, info, opts)
+		if err != nil {
+			fmt.Fprintf(stdout, "⚠️  Serving the original of %s: %v\n", filepath.ToSlash(rel), err)
+			files.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Content-Type", "image/webp")
+		w.Header().Set("Cache-Control", "no-cache")
+		http.ServeContent(w, r, "", info.ModTime(), bytes.NewReader(data))
+	})
+}
+
+// serveWebP returns the WebP for the image at file, from the cache or else
+// converted now.
+func serveWebP(cache *webpCache, root, file, rel string, info os.FileInfo, opts options) ([]byte, error) {
+	// A loader per request, so edits to sidecars show on the next reload
+	fopts, err := newOverrideLoader(root).optionsFor(file, opts)
+	if err != nil {
+		return nil, err
+	}
+	key := fmt.Sprintf("%s|%d|%d|%s", pathKey(rel), info.ModTime().UnixNano(), info.Size(), fopts.encodeKey())
+	if data, ok := cache.get(key); ok {
+		return data, nil
+	}
+	f, err := os.Open(longPath(file))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	start := time.Now()
+	var buf bytes.Buffer
+	res, err := convertStream(f, &buf, fopts)
+	if err != nil {
+		return nil, err
+	}
+	cache.put(key, buf.Bytes())
+	fmt.Fprintf(stdout, "✅ Converted (%s): %s, %s -> %s in %s\n", res.detail, filepath.ToSlash(rel),
+		formatSize(info.Size()), formatSize(res.size), time.Since(start).Round(time.Millisecond))
+	return buf.Bytes(), nil
+}
+
+// acceptsWebP tells whether the client lists image/webp in its Accept
+// header, and doesn't refuse it with q=0.
+func acceptsWebP(r *http.Request) bool {
+	for _, h := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(h, ",") {
+			mime, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+			if !strings.EqualFold(strings.TrimSpace(mime), "image/webp") {
+				continue
+			}
+			for _, p := range strings.Split(params, ";") {
+				if k, v, _ := strings.Cut(strings.TrimSpace(p), "="); k == "q" {
+					if q, err := strconv.ParseFloat(v, 64); err == nil && q == 0 {
+						return false
+					}
+				}
+			}
+			return true
+		}
+	}
+	return false
+}
+
+// displayAddr turns a listen address like ":8080" into one to open.
+func displayAddr(addr string) string {
+	if strings.HasPrefix(addr, ":") {
+		return "localhost" + addr
+	}
+	return addr
+}
@@ -0,0 +1,108 @@
+package webpcon
+
+import (
+	"bytes"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+// TestServeHandler requests the files of a small project: images come as
+// WebP to clients that accept it, and as they are to everyone else and for
+// whatever can't be converted.
+func TestServeHandler(t *testing.T) {
+	log := quietly(t)
+	files := []fixtureFile{
+		{"style.css", []byte(".hero { background: url(img/logo.png); }\n")},
+		{"img/logo.png", encodeFixture(t, ".png", 40, 30)},
+		{"photos/beach.jpg", encodeFixture(t, ".jpg", 64, 48)},
+		{"img/broken.png", []byte("\x89PNG\r\n\x1a\nnot really")},
+	}
+	root := writeFixtureTree(t, files)
+	handler := serveHandler(root, testOptions(t, "--encoder", "native"))
+	original := map[string][]byte{}
+	for _, f := range files {
+		original["/"+f.rel] = f.data
+	}
+
+	const webp, others = "image/webp,*/*", "*/*"
+	for _, tt := range []struct {
+		method, path, accept string
+		status               int
+		webp                 bool // A WebP of the file, or else the file as it is
+	}{
+		{"GET", "/img/logo.png", webp, http.StatusOK, true},
+		{"GET", "/photos/beach.jpg", webp, http.StatusOK, true},
+		{"HEAD", "/img/logo.png", webp, http.StatusOK, true},
+		{"GET", "/img/logo.png", others, http.StatusOK, false},
+		{"GET", "/img/logo.png", "image/webp;q=0,*/*", http.StatusOK, false},
+		{"GET", "/img/broken.png", webp, http.StatusOK, false},
+		{"GET", "/style.css", webp, http.StatusOK, false},
+		{"GET", "/img/missing.png", webp, http.StatusNotFound, false},
+		{"POST", "/img/logo.png", webp, http.StatusOK, false},
+	} {
+		req := httptest.NewRequest(tt.method, tt.path, nil)
+		req.Header.Set("Accept", tt.accept)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		name := tt.method + " " + tt.path + " (" + tt.accept + ")"
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", name, rec.Code, tt.status)
+			continue
+		}
+		if tt.status != http.StatusOK {
+			continue
+		}
+		isWebP := rec.Header().Get("Content-Type") == "image/webp"
+		if isWebP != tt.webp {
+			t.Errorf("%s: Content-Type %q", name, rec.Header().Get("Content-Type"))
+		}
+		switch {
+		case tt.method == "HEAD":
+			if rec.Body.Len() != 0 {
+				t.Errorf("%s: %d byte body", name, rec.Body.Len())
+			}
+		case tt.webp:
+			if _, err := xwebp.DecodeConfig(bytes.NewReader(rec.Body.Bytes())); err != nil {
+				t.Errorf("%s: %v", name, err)
+			}
+		case tt.method == "GET" && !bytes.Equal(rec.Body.Bytes(), original[tt.path]):
+			t.Errorf("%s: got %d bytes, not the original", name, rec.Body.Len())
+		}
+		if strings.HasSuffix(tt.path, ".png") && tt.method != "POST" && rec.Header().Get("Vary") != "Accept" {
+			t.Errorf("%s: Vary %q, want Accept", name, rec.Header().Get("Vary"))
+		}
+	}
+	// img/logo.png was asked for as WebP twice: converted once, then cached
+	if n := strings.Count(log.String(), "img/logo.png, "); n != 1 {
+		t.Errorf("img/logo.png converted %d time(s), want 1:\n%s", n, log)
+	}
+	if !strings.Contains(log.String(), "Serving the original of img/broken.png") {
+		t.Errorf("no warning about img/broken.png:\n%s", log)
+	}
+}
+
+func TestAcceptsWebP(t *testing.T) {
+	for _, tt := range []struct {
+		accept []string
+		want   bool
+	}{
+		{nil, false},
+		{[]string{"*/*"}, false},
+		{[]string{"image/avif,image/webp,*/*;q=0.8"}, true},
+		{[]string{"text/html", "Image/WebP; q=0.5"}, true},
+		{[]string{"image/webp;q=0"}, false},
+		{[]string{"image/webp;q=0.0, */*"}, false},
+	} {
+		req := httptest.NewRequest("GET", "/a.png", nil)
+		for _, a := range tt.accept {
+			req.Header.Add("Accept", a)
+		}
+		if got := acceptsWebP(req); got != tt.want {
+			t.Errorf("Accept %q: %t, want %t", tt.accept, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+package webpcon
+
+import (
+	"image"
+	"math"
+)
+
+// Sharp YUV preprocessing. The lossy encoder keeps luma per pixel but averages
+// chroma over 2x2 blocks, so thin saturated details (red text on white) bleed
+// into their neighbours once the decoder upsamples the chroma again. libwebp
+// can fix this with its sharp YUV conversion, which chai2010/webp doesn't
+// expose, so we do the equivalent on the RGB we hand to the encoder: simulate
+// the encoder's downsampling and the decoder's upsampling, and run a few steps
+// of projected gradient descent on the squared decoding error. Working on
+// clamped RGB keeps the planes libwebp derives from our pixels identical to the
+// ones we optimized.
+
+const sharpYUVIterations = 8
+
+// The image is optimized a band of rows at a time so the work buffers stay
+// small whatever its size: 60 bytes per pixel of a band, not of the image.
+// Each band is simulated with a few rows of its neighbours around it, so the
+// chroma the decoder interpolates across a band edge is accounted for. Both
+// are even, to keep chroma blocks whole.
+const (
+	sharpYUVBand = 64
+	sharpYUVHalo = 4
+)
+
+// BT.601 limited range coefficients, as used by libwebp
+var (
+	yCoef = [3]float32{0.2569, 0.5044, 0.0979}
+	uCoef = [3]float32{-0.1483, -0.2911, 0.4394}
+	vCoef = [3]float32{0.4394, -0.3679, -0.0715}
+	// Contribution of (Y-16), (U-128) and (V-128) to R, G, B when decoding
+	yInv = float32(1.1644)
+	uInv = [3]float32{0, -0.3918, 2.0172}
+	vInv = [3]float32{1.5960, -0.8130, 0}
+)
+
+// sharpYUV holds the simulation state for one band, with its halo. The
+// buffers are sized for the tallest band and reused.
+type sharpYUV struct {
+	w, h, bw, bh int
+	orig         [][3]float32
+	cur, next    [][3]float32
+	grad         [][3]float32
+	count        []float32    // Pixels per chroma block (edge blocks can be smaller)
+	chroma       [][2]float32 // Block chroma without the 128 offset
+	dChroma      [][2]float32
+	err          [][3]float32 // Per pixel source minus decoded
+	halo         [][3]float32 // Source of the rows above the next band, already overwritten in the image
+}
+
+func newSharpYUV(w, rows int) *sharpYUV {
+	blocks := (w + 1) / 2 * ((rows + 1) / 2)
+	return &sharpYUV{
+		w:       w,
+		orig:    make([][3]float32, w*rows),
+		cur:     make([][3]float32, w*rows),
+		next:    make([][3]float32, w*rows),
+		grad:    make([][3]float32, w*rows),
+		err:     make([][3]float32, w*rows),
+		count:   make([]float32, blocks),
+		chroma:  make([][2]float32, blocks),
+		dChroma: make([][2]float32, blocks),
+		halo:    make([][3]float32, w*sharpYUVHalo),
+	}
+}
+
+// applySharpYUV rewrites the RGB of img in place. Alpha is left alone.
+func applySharpYUV(img *image.NRGBA) {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	if w < 2 || h < 2 {
+		return
+	}
+	s := newSharpYUV(w, min(h, sharpYUVBand+2*sharpYUVHalo))
+	for y0 := 0; y0 < h; y0 += sharpYUVBand {
+		y1 := min(y0+sharpYUVBand, h)
+		top, bottom := max(y0-sharpYUVHalo, 0), min(y1+sharpYUVHalo, h)
+		s.load(img, top, y0, bottom)
+		s.optimize()
+		// The rows above the next band are about to be overwritten
+		if y1 < h {
+			copy(s.halo, s.orig[(y1-sharpYUVHalo-top)*w:(y1-top)*w])
+		}
+		for y := y0; y < y1; y++ {
+			for x := 0; x < w; x++ {
+				p := s.cur[(y-top)*w+x]
+				i := img.PixOffset(b.Min.X+x, b.Min.Y+y)
+				img.Pix[i] = uint8(math.Round(float64(p[0])))
+				img.Pix[i+1] = uint8(math.Round(float64(p[1])))
+				img.Pix[i+2] = uint8(math.Round(float64(p[2])))
+			}
+		}
+	}
+}
+
+// load reads rows top to bottom of img into s. Rows above y0 belong to the
+// previous band, which already replaced them, so their source comes from
+// s.halo.
+func (s *sharpYUV) load(img *image.NRGBA, top, y0, bottom int) {
+	b := img.Bounds()
+	s.h, s.bw, s.bh = bottom-top, (s.w+1)/2, (bottom-top+1)/2
+	n := s.w * s.h
+	copy(s.orig, s.halo[len(s.halo)-(y0-top)*s.w:])
+	for y := y0; y < bottom; y++ {
+		for x := 0; x < s.w; x++ {
+			i := img.PixOffset(b.Min.X+x, b.Min.Y+y)
+			s.orig[(y-top)*s.w+x] = [3]float32{float32(img.Pix[i]), float32(img.Pix[i+1]), float32(img.Pix[i+2])}
+		}
+	}
+	clear(s.count[:s.bw*s.bh])
+	for y := 0; y < s.h; y++ {
+		for x := 0; x < s.w; x++ {
+			s.count[s.block(x, y)]++
+		}
+	}
+	copy(s.cur[:n], s.orig[:n])
+}
+
+// optimize runs projected gradient descent on the band, leaving the result in
+// s.cur.
+func (s *sharpYUV) optimize() {
+	n := s.w * s.h
+	cur, next, grad := s.cur[:n], s.next[:n], s.grad[:n]
+	loss := s.loss(cur)
+	step := float32(0.25)
+	for iter := 0; iter < sharpYUVIterations; iter++ {
+		s.gradient(grad)
+		// Backtracking line search, so an iteration never makes things worse
+		improved := false
+		for try := 0; try < 6; try++ {
+			for i := range cur {
+				for c := 0; c < 3; c++ {
+					next[i][c] = min(max(cur[i][c]-step*grad[i][c], 0), 255)
+				}
+			}
+			if l := s.loss(next); l < loss {
+				cur, next, loss = next, cur, l
+				improved = true
+				step *= 1.5
+				break
+			}
+			step /= 2
+		}
+		if !improved {
+			break
+		}
+		s.loss(cur) // Refresh chroma and err for the next gradient
+	}
+	if &cur[0] != &s.cur[0] {
+		copy(s.cur, cur)
+	}
+}
+
+func (s *sharpYUV) block(x, y int) int {
+	return (y/2)*s.bw + x/2
+}
+
+// upsampled returns the weights the decoder's "fancy" 9-3-3-1 upsampling gives
+// the four chroma blocks around pixel (x, y).
+func (s *sharpYUV) upsampled(x, y int) (blocks [4]int, weights [4]float32) {
+	bx, by := x/2, y/2
+	nx, ny := bx-1, by-1
+	if x%2 == 1 {
+		nx = bx + 1
+	}
+	if y%2 == 1 {
+		ny = by + 1
+	}
+	nx = min(max(nx, 0), s.bw-1)
+	ny = min(max(ny, 0), s.bh-1)
+	blocks = [4]int{by*s.bw + bx, by*s.bw + nx, ny*s.bw + bx, ny*s.bw + nx}
+	return blocks, [4]float32{9.0 / 16, 3.0 / 16, 3.0 / 16, 1.0 / 16}
+}
+
+// loss simulates encoding and decoding px, leaving the block chroma and the
+// per-pixel error in s, and returns the summed squared error.
+func (s *sharpYUV) loss(px [][3]float32) float64 {
+	chroma := s.chroma[:s.bw*s.bh]
+	clear(chroma)
+	for y := 0; y < s.h; y++ {
+		for x := 0; x < s.w; x++ {
+			p, k := px[y*s.w+x], s.block(x, y)
+			chroma[k][0] += dot3(uCoef, p) / s.count[k]
+			chroma[k][1] += dot3(vCoef, p) / s.count[k]
+		}
+	}
+
+	total := 0.0
+	for y := 0; y < s.h; y++ {
+		for x := 0; x < s.w; x++ {
+			i := y*s.w + x
+			luma := yInv * dot3(yCoef, px[i])
+			blocks, weights := s.upsampled(x, y)
+			var u, v float32
+			for j, k := range blocks {
+				u += weights[j] * chroma[k][0]
+				v += weights[j] * chroma[k][1]
+			}
+			for c := 0; c < 3; c++ {
+				d := s.orig[i][c] - (luma + uInv[c]*u + vInv[c]*v)
+				s.err[i][c] = d
+				total += float64(d) * float64(d)
+			}
+		}
+	}
+	return total
+}
+
+// gradient writes d(loss)/d(pixel) into grad, based on the err left by loss.
+func (s *sharpYUV) gradient(grad [][3]float32) {
+	// Back through the upsampling: how much each block's chroma should move
+	dChroma := s.dChroma[:s.bw*s.bh]
+	clear(dChroma)
+	for y := 0; y < s.h; y++ {
+		for x := 0; x < s.w; x++ {
+			e := s.err[y*s.w+x]
+			du, dv := -2*dot3(uInv, e), -2*dot3(vInv, e)
+			blocks, weights := s.upsampled(x, y)
+			for j, k := range blocks {
+				dChroma[k][0] += weights[j] * du
+				dChroma[k][1] += weights[j] * dv
+			}
+		}
+	}
+	for y := 0; y < s.h; y++ {
+		for x := 0; x < s.w; x++ {
+			i, k := y*s.w+x, s.block(x, y)
+			e := s.err[i]
+			dLuma := -2 * yInv * (e[0] + e[1] + e[2])
+			for c := 0; c < 3; c++ {
+				grad[i][c] = dLuma*yCoef[c] + (dChroma[k][0]*uCoef[c]+dChroma[k][1]*vCoef[c])/s.count[k]
+			}
+		}
+	}
+}
+
+func dot3(a, b [3]float32) float32 {
+	return a[0]*b[0] + a[1]*b[1] + a[2]*b[2]
+}
+
+func clamp255(v float64) float64 {
+	return min(max(v, 0), 255)
+}
@@ -0,0 +1,127 @@
+package webpcon
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"runtime"
+	"testing"
+)
+
+// redTextFixture is white with thin red strokes, the kind of detail whose
+// chroma bleeds.
+func redTextFixture(w, h int) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	red := color.NRGBA{220, 20, 30, 255}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.SetNRGBA(x, y, color.NRGBA{255, 255, 255, 255})
+			if x%7 == 3 || y%9 == 5 || (x+y)%13 == 0 {
+				img.SetNRGBA(x, y, red)
+			}
+		}
+	}
+	return img
+}
+
+// uniformFixture is w x h of c.
+func uniformFixture(w, h int, c color.NRGBA) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	for i := 0; i < len(img.Pix); i += 4 {
+		img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3] = c.R, c.G, c.B, c.A
+	}
+	return img
+}
+
+// decodeError is the squared error between src and what the decoder gives
+// back from px after chroma subsampling.
+func decodeError(src, px *image.NRGBA) float64 {
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	s := newSharpYUV(w, h)
+	s.load(src, 0, 0, h)
+	cand := newSharpYUV(w, h)
+	cand.load(px, 0, 0, h)
+	return s.loss(cand.orig)
+}
+
+func cloneNRGBA(img *image.NRGBA) *image.NRGBA {
+	c := *img
+	c.Pix = append([]uint8(nil), img.Pix...)
+	return &c
+}
+
+func TestApplySharpYUV(t *testing.T) {
+	for _, tt := range []struct {
+		name      string
+		src       *image.NRGBA
+		unchanged bool
+	}{
+		{"red text", redTextFixture(45, 31), false},
+		{"odd size red text", redTextFixture(13, 7), false},
+		{"red text over bands", redTextFixture(45, 3*sharpYUVBand+11), false},
+		// Nothing to bleed
+		{"uniform", uniformFixture(16, 16, color.NRGBA{200, 30, 40, 255}), true},
+		// Too small to have a chroma block
+		{"one row", redTextFixture(9, 1), true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			px := cloneNRGBA(tt.src)
+			applySharpYUV(px)
+			for i := 3; i < len(px.Pix); i += 4 {
+				if px.Pix[i] != tt.src.Pix[i] {
+					t.Fatalf("alpha changed at byte %d", i)
+				}
+			}
+			if tt.unchanged {
+				if !bytes.Equal(px.Pix, tt.src.Pix) {
+					t.Error("pixels changed")
+				}
+				return
+			}
+			before, after := decodeError(tt.src, tt.src), decodeError(tt.src, px)
+			if after > before*0.95 {
+				t.Errorf("decoding error %.0f with sharp YUV, %.0f without, want at least 5%% less", after, before)
+			}
+		})
+	}
+}
+
+// TestSharpYUVBands checks that optimizing by bands does about as well as
+// optimizing the whole image at once, so band edges don't leave seams.
+func TestSharpYUVBands(t *testing.T) {
+	src := redTextFixture(40, 2*sharpYUVBand+6)
+	w, h := src.Bounds().Dx(), src.Bounds().Dy()
+	banded := cloneNRGBA(src)
+	applySharpYUV(banded)
+
+	s := newSharpYUV(w, h)
+	s.load(src, 0, 0, h)
+	s.optimize()
+	whole := cloneNRGBA(src)
+	for i, p := range s.cur[:w*h] {
+		o := i * 4
+		for c := 0; c < 3; c++ {
+			whole.Pix[o+c] = uint8(p[c] + 0.5)
+		}
+	}
+
+	b, a := decodeError(src, banded), decodeError(src, whole)
+	if b > a*1.05 {
+		t.Errorf("decoding error %.0f by bands, %.0f for the whole image", b, a)
+	}
+}
+
+// TestSharpYUVMemory checks the work buffers are sized to a band, not to the
+// image.
+func TestSharpYUVMemory(t *testing.T) {
+	const w, h = 600, 600
+	img := redTextFixture(w, h)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	applySharpYUV(img)
+	runtime.ReadMemStats(&after)
+	limit := uint64(w*(sharpYUVBand+2*sharpYUVHalo)*64 + 1<<20)
+	if got := after.TotalAlloc - before.TotalAlloc; got > limit {
+		t.Errorf("allocated %s for a %dx%d image, want at most %s", formatSize(int64(got)), w, h, formatSize(int64(limit)))
+	}
+}
@@ -0,0 +1,91 @@
+package webpcon
+
+import (
+	"bufio"
+	"io"
+	"io/fs"
+)
+
+// Images are decoded by what their first bytes say they are, not their
+// extension, so a PNG saved as .jpg still converts. lint reports those.
+
+// sniffLen is how much of a file sniffFormat needs.
+const sniffLen = 32
+
+// formatNames names the formats sniffFormat returns, for messages.
+var formatNames = map[string]string{
+	".jpg": "JPEG", ".png": "PNG", ".gif": "GIF", ".bmp": "BMP", ".tiff": "TIFF",
+	".webp": "WebP", ".avif": "AVIF", ".jxl": "JPEG XL",
+}
+
+// sniffFormat identifies an image format by the first bytes of a file and
+// returns its usual extension, ".jpg" for all JPEGs, or "" when it doesn't
+// recognize them.
+func sniffFormat(head []byte) string {
+	has := func(at int, s string) bool {
+		return len(head) >= at+len(s) && string(head[at:at+len(s)]) == s
+	}
+	switch {
+	case has(0, "\xff\xd8\xff"):
+		return ".jpg"
+	case has(0, "\x89PNG\r\n\x1a\n"):
+		return ".png"
+	case has(0, "GIF87a"), has(0, "GIF89a"):
+		return ".gif"
+	case has(0, "BM"):
+		return ".bmp"
+	case has(0, "II*\x00"), has(0, "MM\x00*"), has(0, "II+\x00"), has(0, "MM\x00+"):
+		return ".tiff"
+	case has(0, "RIFF") && has(8, "WEBP"):
+		return ".webp"
+	case has(0, "\xff\x0a"), has(0, "\x00\x00\x00\x0cJXL \r\n\x87\n"):
+		return ".jxl"
+	case has(4, "ftyp"):
+		// The major brand, or one of the compatible brands after it
+		for at := 8; at+4 <= len(head); at += 4 {
+			if has(at, "avif") || has(at, "avis") {
+				return ".avif"
+			}
+		}
+	}
+	return ""
+}
+
+// formatExt is the extension sniffFormat returns for files of ext's format.
+func formatExt(ext string) string {
+	if isJPEG(ext) {
+		return ".jpg"
+	}
+	return ext
+}
+
+// sniffReader returns the format of the image r reads, by its content when
+// recognized and else by ext, along with a reader that still starts at the
+// beginning.
+func sniffReader(r io.Reader, ext string) (string, io.Reader) {
+	br := bufio.NewReader(r)
+	head, _ := br.Peek(sniffLen)
+	if f := sniffFormat(head); f != "" && f != formatExt(ext) {
+		return f, br
+	}
+	return ext, br
+}
+
+// sniffFile is sniffReader for the file name in fsys. It returns "" with
+// the error when the file can't be read.
+func sniffFile(fsys fs.FS, name, ext string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(f, head)
+	if err != nil && err != io.ErrUnexpectedEOF && err != io.EOF {
+		return "", err
+	}
+	if sf := sniffFormat(head[:n]); sf != "" && sf != formatExt(ext) {
+		return sf, nil
+	}
+	return ext, nil
+}
@@ -0,0 +1,44 @@
+package webpcon
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestSniffReader(t *testing.T) {
+	for _, ext := range fixtureFormats {
+		data := encodeFixture(t, ext, 8, 8)
+		for _, named := range []string{ext, ".png", ".jpg", ".jpe", ".jfif", ".txt"} {
+			got, r := sniffReader(bytes.NewReader(data), named)
+			want := ext
+			if formatExt(named) == formatExt(ext) {
+				want = named // A matching name is kept as given
+			}
+			if got != want {
+				t.Errorf("sniffReader(%s content, %q) = %q, want %q", ext, named, got, want)
+			}
+			if rest, _ := io.ReadAll(r); !bytes.Equal(rest, data) {
+				t.Errorf("sniffReader(%s content, %q) lost bytes: read %d of %d", ext, named, len(rest), len(data))
+			}
+		}
+	}
+}
+
+func FuzzSniffReader(f *testing.F) {
+	for _, ext := range fixtureFormats {
+		f.Add(encodeFixture(f, ext, 4, 4), ext)
+	}
+	f.Add([]byte("RIFF\x00\x00\x00\x00WEBPVP8L"), ".png")
+	f.Add([]byte("\x00\x00\x00\x1cftypavif"), ".jpg")
+	f.Add([]byte{}, "")
+	f.Fuzz(func(t *testing.T, data []byte, ext string) {
+		got, r := sniffReader(bytes.NewReader(data), ext)
+		if f := sniffFormat(data[:min(len(data), sniffLen)]); f != "" && f != formatExt(ext) && got != f {
+			t.Fatalf("sniffReader = %q, content is %q", got, f)
+		}
+		if rest, _ := io.ReadAll(r); !bytes.Equal(rest, data) {
+			t.Fatalf("sniffReader lost bytes: read %d of %d", len(rest), len(data))
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package webpcon
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// defaultSpotCheckDir is where --spot-check copies to unless --spot-check-dir
+// says otherwise. Conversions skip folders of this name.
+const defaultSpotCheckDir = "webpcon-check"
+
+// spotCheckMarker marks a folder as written by --spot-check, so a later run
+// may empty it. Folders without it are only written to when empty.
+const spotCheckMarker = ".webpcon-spot-check"
+
+// spotCheckPair is an original in the backup and the WebP made from it.
+type spotCheckPair struct {
+	rel, backup, webp string
+	ratio             float64 // Original size over WebP size
+}
+
+// spotCheck copies a sample of the run's originals and their WebP files into
+// one flat folder, named so each pair sorts together: a/b/c.png becomes
+// a_b_c.png and a_b_c.webp. Files are picked at random, weighted by their
+// compression ratio, as the most compressed are the likeliest to show
+// artifacts. The seed comes from --seed or else the clock.
+func spotCheck(root string, run *runRecord, outputs *mapping, opts options) error {
+	var pairs []spotCheckPair
+	for _, f := range run.Files {
+		if f.Backup == "" {
+			continue
+		}
+		rel := filepath.FromSlash(f.Source)
+		p := spotCheckPair{
+			rel:    rel,
+			backup: filepath.Join(root, filepath.FromSlash(f.Backup)),
+			webp:   webpFor(root, rel, outputs),
+		}
+		bak, err := os.Stat(longPath(p.backup))
+		if err != nil {
+			continue
+		}
+		webp, err := os.Stat(longPath(p.webp))
+		if err != nil || webp.Size() == 0 {
+			continue
+		}
+		p.ratio = float64(bak.Size()) / float64(webp.Size())
+		pairs = append(pairs, p)
+	}
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	seed := opts.seed
+	if !opts.set["seed"] {
+		seed = time.Now().UnixNano()
+	}
+	// Weighted sampling without replacement: each pair gets the key u^(1/w)
+	// for a uniform u, and the largest keys win
+	rng := rand.New(rand.NewSource(seed))
+	keys := make([]float64, len(pairs))
+	for i, p := range pairs {
+		keys[i] = math.Pow(rng.Float64(), 1/p.ratio)
+	}
+	sort.Sort(byKey{pairs, keys})
+	if len(pairs) > opts.spotCheck {
+		pairs = pairs[:opts.spotCheck]
+	}
+
+	dir := opts.spotCheckDir
+	if err := prepareSpotCheckDir(root, dir); err != nil {
+		fmt.Fprintf(stdout, "❌ Error preparing %s for the spot check: %v\n", dir, err)
+		return err
+	}
+	for _, p := range pairs {
+		name := strings.ReplaceAll(filepath.ToSlash(p.rel), "/", "_")
+		if err := copyFile(p.backup, filepath.Join(dir, name)); err != nil {
+			fmt.Fprintf(stdout, "❌ Error copying %s to %s: %v\n", p.backup, dir, err)
+			return err
+		}
+		if err := copyFile(p.webp, filepath.Join(dir, webpRel(name, filepath.Ext(name)))); err != nil {
+			fmt.Fprintf(stdout, "❌ Error copying %s to %s: %v\n", p.webp, dir, err)
+			return err
+		}
+	}
+	fmt.Fprintf(stdout, "🔎 Copied %d original(s) and their WebP files to %s for a spot check (seed %d)\n", len(pairs), dir, seed)
+	return nil
+}
+
+// byKey sorts spot check pairs by descending key.
+type byKey struct {
+	pairs []spotCheckPair
+	keys  []float64
+}
+
+func (s byKey) Len() int           { return len(s.pairs) }
+func (s byKey) Less(i, j int) bool { return s.keys[i] > s.keys[j] }
+func (s byKey) Swap(i, j int) {
+	s.pairs[i], s.pairs[j] = s.pairs[j], s.pairs[i]
+	s.keys[i], s.keys[j] = s.keys[j], s.keys[i]
+}
+
+// prepareSpotCheckDir empties the spot check folder left by an earlier run,
+// or creates it. A folder that has other content and no spotCheckMarker is
+// left alone, as is one holding the project.
+func prepareSpotCheckDir(root, dir string) error {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return err
+	}
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(absDir, absRoot); err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return fmt.Errorf("it contains the project")
+	}
+
+	entries, err := os.ReadDir(longPath(dir))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		if !fileExists(filepath.Join(dir, spotCheckMarker)) {
+			return fmt.Errorf("the folder isn't empty and wasn't made by --spot-check")
+		}
+		for _, e := range entries {
+			if err := os.RemoveAll(longPath(filepath.Join(dir, e.Name()))); err != nil {
+				return err
+			}
+		}
+	}
+	if err := os.MkdirAll(longPath(dir), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(longPath(filepath.Join(dir, spotCheckMarker)), nil, 0644)
+}
@@ -0,0 +1,48 @@
+package webpcon
+
+import (
+	"fmt"
+	"strings"
+)
+
+// showStatus prints what webpcon has done to the project so far, and warns
+// when its files are kept in git. It only reads.
+func showStatus(root string) error {
+	outputs, err := loadMapping(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", mapFileName, err)
+		return err
+	}
+	l, err := loadRunLog(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", runLogName, err)
+		return err
+	}
+	fmt.Fprintf(stdout, "📋 %d converted image(s) in %s, %d run(s) to revert\n", len(outputs.entries), mapFileName, len(l.runs))
+	if r := l.last(); r != nil {
+		fmt.Fprintf(stdout, "   Last run: %s, %s\n", r.ID, r.Time.Local().Format("2006-01-02 15:04:05"))
+	}
+	checkBackups(root, outputs, l).report()
+
+	if !inGitRepo(root) {
+		return nil
+	}
+	missing, _, err := missingGitignoreEntries(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "⚠️  Could not read .gitignore: %v\n", err)
+	} else if len(missing) > 0 {
+		fmt.Fprintf(stdout, "⚠️  .gitignore doesn't list %s, run a conversion with --yes to add them\n", strings.Join(missing, ", "))
+	}
+	tracked, err := trackedArtifacts(root)
+	if err != nil {
+		fmt.Fprintf(stdout, "⚠️  Could not ask git for tracked files: %v\n", err)
+		return nil
+	}
+	if len(tracked) > 0 {
+		fmt.Fprintf(stdout, "⚠️  %d webpcon file(s) are tracked by git, .gitignore won't stop them being committed. Untrack them with git rm -r --cached:\n", len(tracked))
+		for _, f := range tracked {
+			fmt.Fprintf(stdout, "   %s\n", f)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,112 @@
+package webpcon
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+)
+
+// defaultMaxMegapixels is the largest image convertStream decodes unless
+// --max-megapixels says otherwise. Decoding allocates 4 bytes per pixel, and
+// a few bytes of header can claim any size.
+const defaultMaxMegapixels = 100
+
+// maxStreamSize bounds how much of an input convertStream reads.
+const maxStreamSize = 512 << 20
+
+// streamInfo describes one image converted by convertStream.
+type streamInfo struct {
+	format string // Input format, an extension as sniffFormat returns
+	width  int    // Input dimensions
+	height int
+	size   int64 // Bytes of WebP written
+	detail string
+}
+
+// convertStream converts one still image read from r to WebP written to w,
+// with the same pipeline and encoder as a tree conversion. The format comes
+// from the content, never a name, and nothing is read from or written to
+// disk: it serves input nobody vouches for, like uploads. So AVIF and JPEG
+// XL input, and the cwebp encoder, which go through temporary files, are
+// refused. So are images over --max-megapixels, from their header before
+// decoding, and animated GIFs unless --gif-flatten asks for their first frame.
+func convertStream(r io.Reader, w io.Writer, opts options) (streamInfo, error) {
+	var info streamInfo
+	data, err := io.ReadAll(io.LimitReader(r, maxStreamSize+1))
+	if err != nil {
+		return info, err
+	}
+	if len(data) > maxStreamSize {
+		return info, fmt.Errorf("input is larger than %s", formatSize(maxStreamSize))
+	}
+	info.format = sniffFormat(data)
+	switch info.format {
+	case "":
+		return info, fmt.Errorf("input is not an image format webpcon reads")
+	case ".webp":
+		return info, fmt.Errorf("input is already WebP")
+	case ".avif", ".jxl":
+		return info, fmt.Errorf("%s input needs an external decoder working through temporary files", formatNames[info.format])
+	}
+	if opts.enc.name() == "cwebp" {
+		return info, fmt.Errorf("the cwebp encoder works through temporary files; pick --encoder cgo or native")
+	}
+
+	p, err := probeFrom(bytes.NewReader(data), info.format)
+	if err != nil {
+		return info, fmt.Errorf("invalid %s: %v", formatNames[info.format], err)
+	}
+	if p.animated() && !opts.gifFlatten {
+		return info, fmt.Errorf("input is an animated GIF; --gif-flatten converts its first frame")
+	}
+	info.width, info.height = p.width, p.height
+	if err := checkMegapixels(p.width, p.height, opts); err != nil {
+		return info, err
+	}
+
+	img, err := decodeSized(bytes.NewReader(data), info.format, opts)
+	if err != nil {
+		return info, fmt.Errorf("invalid %s: %v", formatNames[info.format], err)
+	}
+
+	// The profile comes from the bytes in memory, not a source file
+	var notes string
+	if opts.toSRGB {
+		icc, err := iccFrom(bytes.NewReader(data), info.format)
+		img, notes = applyProfile(img, icc, err, "input")
+		opts.toSRGB = false
+	}
+	res, err := encodeStatic(w, img, srcFile{}, info.format, "input", opts.withExtensionDefaults(info.format))
+	info.size, info.detail = res.size, res.detail
+	if notes != "" {
+		info.detail = notes + ", " + info.detail
+	}
+	return info, err
+}
+
+// checkMegapixels refuses images over --max-megapixels.
+func checkMegapixels(width, height int, opts options) error {
+	limit := opts.maxMegapixels
+	if limit == 0 {
+		limit = defaultMaxMegapixels
+	}
+	if mp := float64(width) * float64(height) / 1e6; mp > limit {
+		return fmt.Errorf("image is %dx%d (%.1f megapixels), over the %g megapixel limit; --max-megapixels raises it", width, height, mp, limit)
+	}
+	return nil
+}
+
+// convertStdin is "webpcon -": it converts the image on stdin and writes the
+// WebP to stdout. Messages go to stderr.
+func convertStdin(opts options) error {
+	defer logsToStderr()()
+	opts.printWarnings()
+	info, err := convertStream(os.Stdin, os.Stdout, opts)
+	if err != nil {
+		fmt.Fprintf(stdout, "❌ Could not convert stdin: %v\n", err)
+		return err
+	}
+	fmt.Fprintf(stdout, "✅ Converted (%s): %s %dx%d -> WebP, %s\n", info.detail, formatNames[info.format], info.width, info.height, formatSize(info.size))
+	return nil
+}
@@ -0,0 +1,101 @@
+package webpcon
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// streamOptions are the defaults with an encoder that works in memory, and
+// a limit small enough for fuzzed headers not to allocate much.
+func streamOptions(tb testing.TB) options {
+	tb.Helper()
+	return testOptions(tb, "--deterministic", "--max-megapixels", "1")
+}
+
+func TestConvertStream(t *testing.T) {
+	quietly(t)
+	opts := streamOptions(t)
+	for _, ext := range fixtureFormats {
+		var out bytes.Buffer
+		info, err := convertStream(bytes.NewReader(encodeFixture(t, ext, 16, 9)), &out, opts)
+		if err != nil {
+			t.Errorf("convertStream(%s): %v", ext, err)
+			continue
+		}
+		if info.format != ext || info.width != 16 || info.height != 9 {
+			t.Errorf("convertStream(%s) = %s %dx%d, want %s 16x9", ext, info.format, info.width, info.height, ext)
+		}
+		if info.size != int64(out.Len()) || sniffFormat(out.Bytes()) != ".webp" {
+			t.Errorf("convertStream(%s) wrote %d bytes of %q, reported %d", ext, out.Len(), sniffFormat(out.Bytes()), info.size)
+		}
+	}
+}
+
+func TestConvertStreamRefuses(t *testing.T) {
+	quietly(t)
+	opts := streamOptions(t)
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"text", []byte("hello"), "not an image format"},
+		{"webp", []byte("RIFF\x00\x00\x00\x00WEBPVP8 "), "already WebP"},
+		{"avif", []byte("\x00\x00\x00\x1cftypavif\x00\x00\x00\x00"), "temporary files"},
+		{"animated gif", animatedGIFFixture(t, 4, 4, 3), "animated GIF"},
+		{"too large", encodeFixture(t, ".png", 1200, 1000), "megapixel limit"},
+		{"truncated", encodeFixture(t, ".png", 16, 16)[:40], "invalid PNG"},
+	}
+	for _, tt := range tests {
+		var out bytes.Buffer
+		_, err := convertStream(bytes.NewReader(tt.data), &out, opts)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: convertStream error = %v, want one mentioning %q", tt.name, err, tt.want)
+		}
+	}
+}
+
+func FuzzConvertStream(f *testing.F) {
+	quietly(f)
+	opts := streamOptions(f)
+	for _, ext := range fixtureFormats {
+		f.Add(encodeFixture(f, ext, 8, 8))
+	}
+	f.Add(animatedGIFFixture(f, 4, 4, 2))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var out bytes.Buffer
+		info, err := convertStream(bytes.NewReader(data), &out, opts)
+		if err == nil && (info.size != int64(out.Len()) || sniffFormat(out.Bytes()) != ".webp") {
+			t.Fatalf("convertStream wrote %d bytes of %q, reported %d", out.Len(), sniffFormat(out.Bytes()), info.size)
+		}
+	})
+}
+
+// TestConvertStdinWarnings checks the warnings about ignored settings go to
+// stderr with the other logs, leaving stdout to the WebP file.
+func TestConvertStdinWarnings(t *testing.T) {
+	quietly(t)
+	opts := testOptions(t, "--encoder", "native", "--quality", "60")
+	if len(opts.warnings) != 1 {
+		t.Fatalf("parseOptions warned %q, want the lossless-only warning", opts.warnings)
+	}
+	dir := swapStdio(t)
+	if _, err := os.Stdin.Write(encodeFixture(t, ".png", 16, 9)); err != nil {
+		t.Fatal(err)
+	}
+	os.Stdin.Seek(0, 0)
+
+	if err := convertStdin(opts); err != nil {
+		t.Fatal(err)
+	}
+	out, _ := os.ReadFile(filepath.Join(dir, "out"))
+	if sniffFormat(out) != ".webp" || bytes.Contains(out, []byte("⚠️")) {
+		t.Errorf("stdout holds %q, want only a WebP file", sniffFormat(out))
+	}
+	if log, _ := os.ReadFile(filepath.Join(dir, "err")); !bytes.Contains(log, []byte("only writes lossless WebP")) {
+		t.Errorf("stderr = %q, want the lossless-only warning", log)
+	}
+}
@@ -0,0 +1,425 @@
+package webpcon
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// summary tallies what happened during a conversion run.
+type summary struct {
+	verb      string // What was done to the files, for the summary line
+	converted int
+	modes     map[string]int // Files converted per encoding mode
+
+	overTarget      []string // Files that exceed --target-size even at the lowest quality
+	tooSmall        int      // Files skipped by --min-width / --min-height
+	animatedSkipped int      // Animated GIFs left alone without --enable-gif
+
+	unreferenced   int        // Files left untouched by --only-referenced
+	unchanged      int        // Files left untouched by --git-since
+	beforeSince    int        // Files left untouched by --since
+	collisions     [][]string // Files whose outputs differ only in case
+	collided       map[string]bool
+	conflicts      []webpConflict // Files whose WebP name was taken by a file webpcon didn't write
+	conflictPolicy string         // --on-conflict, see conflictPolicy
+	denied         []string       // Files left untouched because of permission errors
+	inUse          []string       // Files left untouched as another program still had them open
+	hookFailed     []string       // Files whose --post-hook failed
+	filtered       []string       // Files skipped by --filter-hook
+	unsupported    []skippedFile  // Files skipped because they can't be read
+	misnamed       []string       // WebP content under another extension, skipped
+	extensionFixed []string       // WebP content renamed to .webp by --fix-extensions, "from -> to"
+	lfsPointers    []string       // git LFS pointer files standing in for images
+	lowSSIM        []string       // Files below --min-ssim
+	keptSmaller    []string       // Animated GIFs, AVIF and JPEG XL files kept as smaller than their WebP
+	timedOut       []string       // Files abandoned after --file-timeout
+	requalified    []string       // Converted before, encoded again from the backup by --requality
+	vendored       []vendoredDir  // Folders of vendored code left alone
+	animations     []animationReport
+	stopped        string // The limit that ended the run early, if any
+	remaining      int    // Files left for the next run after stopping
+	sourceSize     int64  // Bytes of the converted originals
+	outputSize     int64  // Bytes of their WebP files
+
+	encodeTime map[string]time.Duration
+	timings    []fileTiming        // With --timings, nil without
+	dupes      map[string][]string // First converted file -> identical files that reused its output
+	dupeOrder  []string
+
+	groupDepth int                  // --group-by-dir, 0 for no groups
+	groups     map[string]*dirGroup // By groupKey
+}
+
+func newSummary() *summary {
+	return &summary{
+		verb:       "converted",
+		modes:      map[string]int{},
+		encodeTime: map[string]time.Duration{},
+		dupes:      map[string][]string{},
+		collided:   map[string]bool{},
+		groups:     map[string]*dirGroup{},
+	}
+}
+
+func (s *summary) addDuplicate(first, dup string) {
+	s.converted++
+	if _, ok := s.dupes[first]; !ok {
+		s.dupeOrder = append(s.dupeOrder, first)
+	}
+	s.dupes[first] = append(s.dupes[first], dup)
+}
+
+// permissionDenied records a file that couldn't be read or moved for lack of
+// permissions. Such files are left as they are and the run goes on.
+func (s *summary) permissionDenied(out *fileLog, relPath string, err error) bool {
+	if !errors.Is(err, fs.ErrPermission) {
+		return false
+	}
+	out.printf("🔒 Permission denied, leaving %s untouched: %v\n", relPath, err)
+	s.denied = append(s.denied, filepath.ToSlash(relPath))
+	return true
+}
+
+// skippedFile is a file left untouched because it can't be read, with why.
+type skippedFile struct {
+	File   string `json:"file"`
+	Reason string `json:"reason"`
+}
+
+// skipUnsupported records a file the decoders can't read. reason is set for
+// unsupported features (see unsupportedReason); corrupt files give err instead.
+func (s *summary) skipUnsupported(out *fileLog, relPath, reason string, err error) {
+	if reason == "" {
+		reason = "unreadable: " + err.Error()
+	}
+	out.printf("⏭️ Skipping %s (%s)\n", relPath, reason)
+	s.unsupported = append(s.unsupported, skippedFile{filepath.ToSlash(relPath), reason})
+}
+
+// skipLFSPointer logs and lists relPath, a git LFS pointer left in place of
+// an image.
+func (s *summary) skipLFSPointer(out *fileLog, relPath string) {
+	out.printf("⏭️ Skipping %s (git-lfs pointer, run git lfs pull)\n", relPath)
+	s.lfsPointers = append(s.lfsPointers, filepath.ToSlash(relPath))
+}
+
+// vendoredDir is a folder of vendored code the run left alone, with why.
+type vendoredDir struct {
+	Dir    string `json:"dir"`
+	Reason string `json:"reason"`
+}
+
+// animationReport is an animated GIF converted, with its frames and size
+// before and after --gif-max-fps and --gif-scale, and how it was encoded.
+type animationReport struct {
+	File      string `json:"file"`
+	Frames    int    `json:"frames"`
+	OutFrames int    `json:"outputFrames"`
+	Width     int    `json:"width"`
+	Height    int    `json:"height"`
+	OutWidth  int    `json:"outputWidth"`
+	OutHeight int    `json:"outputHeight"`
+	Encoding  string `json:"encoding"` // paletteEncoding, lossyEncoding or losslessEncoding
+}
+
+// addCollision records a group of colliding files once.
+func (s *summary) addCollision(group []string) {
+	if !s.collided[group[0]] {
+		s.collided[group[0]] = true
+		s.collisions = append(s.collisions, group)
+	}
+}
+
+func (s *summary) add(mode string) {
+	s.converted++
+	s.modes[mode]++
+}
+
+func (s *summary) print() {
+	fmt.Fprintln(stdout)
+	fmt.Fprintf(stdout, "📊 Summary: %d %s\n", s.converted, s.verb)
+
+	modes := make([]string, 0, len(s.modes))
+	for m := range s.modes {
+		modes = append(modes, m)
+	}
+	sort.Strings(modes)
+	width := len("size:")
+	for _, m := range modes {
+		width = max(width, len(m)+1)
+	}
+	for _, m := range modes {
+		fmt.Fprintf(stdout, "   %-*s %d\n", width, m+":", s.modes[m])
+	}
+	if s.sourceSize > 0 {
+		saved := formatSize(s.sourceSize - s.outputSize)
+		if s.outputSize < s.sourceSize {
+			saved = paint(ansiGreen, saved)
+		}
+		fmt.Fprintf(stdout, "   %-*s %s -> %s, saved %s\n", width, "size:", formatSize(s.sourceSize), formatSize(s.outputSize), saved)
+	}
+
+	if len(s.requalified) > 0 {
+		fmt.Fprintf(stdout, "♻️  %d converted file(s) re-encoded from their backups with the new settings\n", len(s.requalified))
+	}
+	if s.tooSmall > 0 {
+		fmt.Fprintf(stdout, "⏭️ %d file(s) skipped as too small\n", s.tooSmall)
+	}
+	if s.unreferenced > 0 {
+		fmt.Fprintf(stdout, "⏭️ %d file(s) left untouched as not referenced\n", s.unreferenced)
+	}
+	if s.unchanged > 0 {
+		fmt.Fprintf(stdout, "⏭️ %d file(s) left untouched as unchanged in git\n", s.unchanged)
+	}
+	if s.animatedSkipped > 0 {
+		fmt.Fprintf(stdout, "⏭️ %d animated GIF(s) skipped\n", s.animatedSkipped)
+	}
+	if s.beforeSince > 0 {
+		fmt.Fprintf(stdout, "⏭️ %d file(s) left untouched as modified before --since\n", s.beforeSince)
+	}
+	if len(s.vendored) > 0 {
+		fmt.Fprintf(stdout, "⏭️ %d vendored folder(s) left alone, --include-vendored converts them:\n", len(s.vendored))
+		for _, v := range s.vendored {
+			fmt.Fprintf(stdout, "   %s (%s)\n", v.Dir, v.Reason)
+		}
+	}
+	if len(s.filtered) > 0 {
+		fmt.Fprintf(stdout, "⏭️ %d file(s) skipped by the filter hook:\n", len(s.filtered))
+		for _, f := range s.filtered {
+			fmt.Fprintf(stdout, "   %s\n", f)
+		}
+	}
+	if len(s.unsupported) > 0 {
+		fmt.Fprintf(stdout, "⏭️ %d file(s) skipped as unsupported or unreadable:\n", len(s.unsupported))
+		byReason := map[string][]string{}
+		var reasons []string
+		for _, f := range s.unsupported {
+			if byReason[f.Reason] == nil {
+				reasons = append(reasons, f.Reason)
+			}
+			byReason[f.Reason] = append(byReason[f.Reason], f.File)
+		}
+		sort.Strings(reasons)
+		for _, r := range reasons {
+			fmt.Fprintf(stdout, "   %s: %d\n", r, len(byReason[r]))
+			for _, f := range byReason[r] {
+				fmt.Fprintln(stdout, "     -", f)
+			}
+		}
+	}
+	if len(s.misnamed) > 0 {
+		fmt.Fprintf(stdout, "⏭️ %d file(s) skipped as WebP already under another extension, --fix-extensions renames them:\n", len(s.misnamed))
+		for _, f := range s.misnamed {
+			fmt.Fprintln(stdout, "   -", f)
+		}
+	}
+	if len(s.lfsPointers) > 0 {
+		fmt.Fprintf(stdout, "⏭️ %d git LFS pointer(s) skipped, run git lfs pull to fetch the images and run again:\n", len(s.lfsPointers))
+		for _, f := range s.lfsPointers {
+			fmt.Fprintln(stdout, "   -", f)
+		}
+	}
+	if len(s.extensionFixed) > 0 {
+		fmt.Fprintf(stdout, "✏️  %d file(s) of WebP content renamed to .webp:\n", len(s.extensionFixed))
+		for _, f := range s.extensionFixed {
+			fmt.Fprintln(stdout, "   -", f)
+		}
+	}
+	if len(s.inUse) > 0 {
+		fmt.Fprintf(stdout, "🔒 %d file(s) left untouched as another program still had them open (close it and run again):\n", len(s.inUse))
+		for _, f := range s.inUse {
+			fmt.Fprintln(stdout, "   -", f)
+		}
+	}
+	if len(s.denied) > 0 {
+		fmt.Fprintf(stdout, "🔒 %d file(s) left untouched due to permission errors (check who owns them and their folders):\n", len(s.denied))
+		for _, f := range s.denied {
+			fmt.Fprintf(stdout, "   %s\n", f)
+		}
+	}
+	if len(s.collisions) > 0 {
+		fmt.Fprintf(stdout, "⚠️  %d group(s) of files would share a WebP file, rename them:\n", len(s.collisions))
+		for _, g := range s.collisions {
+			fmt.Fprintf(stdout, "   %s (%s)\n", strings.Join(g, " / "), collisionCause(g))
+		}
+	}
+	s.printConflicts()
+
+	if len(s.animations) > 0 {
+		fmt.Fprintf(stdout, "📋 %d animation(s):\n", len(s.animations))
+		for _, a := range s.animations {
+			fmt.Fprintf(stdout, "   %s: %d -> %d frames, %dx%d -> %dx%d, %s\n", a.File, a.Frames, a.OutFrames, a.Width, a.Height, a.OutWidth, a.OutHeight, a.Encoding)
+		}
+	}
+	if len(s.dupeOrder) > 0 {
+		n := 0
+		for _, first := range s.dupeOrder {
+			n += len(s.dupes[first])
+		}
+		fmt.Fprintf(stdout, "♻️  %d duplicate(s) in %d group(s) reused an earlier encode:\n", n, len(s.dupeOrder))
+		for _, first := range s.dupeOrder {
+			copies := s.dupes[first]
+			t := s.encodeTime[first]
+			fmt.Fprintf(stdout, "   %s (encoded once in %s, %s per file)\n", first, t.Round(time.Millisecond), (t / time.Duration(len(copies)+1)).Round(time.Millisecond))
+			for _, c := range copies {
+				fmt.Fprintln(stdout, "     =", c)
+			}
+		}
+	}
+
+	if len(s.overTarget) > 0 {
+		fmt.Fprintf(stdout, "⚠️  %d file(s) could not reach the target size:\n", len(s.overTarget))
+		for _, f := range s.overTarget {
+			fmt.Fprintln(stdout, "   -", f)
+		}
+	}
+	if len(s.hookFailed) > 0 {
+		fmt.Fprintf(stdout, "⚠️  The post-hook failed for %d file(s):\n", len(s.hookFailed))
+		for _, f := range s.hookFailed {
+			fmt.Fprintln(stdout, "   -", f)
+		}
+	}
+	if len(s.lowSSIM) > 0 {
+		fmt.Fprintf(stdout, "⚠️  %d file(s) fell below the --min-ssim threshold:\n", len(s.lowSSIM))
+		for _, f := range s.lowSSIM {
+			fmt.Fprintln(stdout, "   -", f)
+		}
+	}
+	if len(s.keptSmaller) > 0 {
+		fmt.Fprintf(stdout, "↩️  %d file(s) kept as they are smaller than their WebP:\n", len(s.keptSmaller))
+		for _, f := range s.keptSmaller {
+			fmt.Fprintln(stdout, "   -", f)
+		}
+	}
+	if len(s.timedOut) > 0 {
+		fmt.Fprintf(stdout, "❌ %d file(s) abandoned after --file-timeout, their originals were kept:\n", len(s.timedOut))
+		for _, f := range s.timedOut {
+			fmt.Fprintln(stdout, "   -", f)
+		}
+	}
+	s.printTimings()
+	s.printGroups()
+	if s.stopped != "" {
+		fmt.Fprintf(stdout, "⏸️  Stopped early (%s): %d eligible file(s) remain, run again to continue\n", s.stopped, s.remaining)
+	}
+}
+
+// summaryJSON is the summary as handed to --post-run-hook on stdin, and as
+// runConvert returns it.
+type summaryJSON struct {
+	Converted           int               `json:"converted"`
+	Modes               map[string]int    `json:"modes"`
+	Duplicates          int               `json:"duplicates"`
+	TooSmall            int               `json:"tooSmall"`
+	AnimatedGIFsSkipped int               `json:"animatedGifsSkipped"`
+	Unreferenced        int               `json:"unreferenced"`
+	Unchanged           int               `json:"unchanged"`
+	BeforeSince         int               `json:"beforeSince"`
+	Vendored            []vendoredDir     `json:"vendored"`
+	Animations          []animationReport `json:"animations"`
+	Filtered            []string          `json:"filtered"`
+	Unsupported         []skippedFile     `json:"unsupported"`
+	MisnamedWebP        []string          `json:"misnamedWebp"`
+	ExtensionFixed      []string          `json:"extensionFixed"`
+	LFSPointers         []string          `json:"lfsPointers"`
+	OverTarget          []string          `json:"overTarget"`
+	Denied              []string          `json:"permissionDenied"`
+	InUse               []string          `json:"inUse"`
+	Collisions          [][]string        `json:"collisions"`
+	Conflicts           []webpConflict    `json:"conflicts"`
+	OnConflict          string            `json:"onConflict"`
+	HookFailed          []string          `json:"hookFailed"`
+	LowSSIM             []string          `json:"lowSsim"`
+	KeptSmaller         []string          `json:"keptSmaller"`
+	TimedOut            []string          `json:"timedOut"`
+	Requalified         []string          `json:"requalified"`
+	Groups              []dirGroup        `json:"groups,omitempty"`  // With --group-by-dir
+	Timings             []fileTimingJSON  `json:"timings,omitempty"` // With --timings
+	Stopped             string            `json:"stoppedBy,omitempty"`
+	Remaining           int               `json:"remaining"`
+}
+
+// report fills in the summary as runConvert returns it.
+func (s *summary) report() summaryJSON {
+	n := 0
+	for _, copies := range s.dupes {
+		n += len(copies)
+	}
+	nonNil := func(l []string) []string {
+		if l == nil {
+			return []string{}
+		}
+		return l
+	}
+	unsupported := s.unsupported
+	if unsupported == nil {
+		unsupported = []skippedFile{}
+	}
+	animations := s.animations
+	if animations == nil {
+		animations = []animationReport{}
+	}
+	vendored := s.vendored
+	if vendored == nil {
+		vendored = []vendoredDir{}
+	}
+	collisions := s.collisions
+	if collisions == nil {
+		collisions = [][]string{}
+	}
+	conflicts := s.conflicts
+	if conflicts == nil {
+		conflicts = []webpConflict{}
+	}
+	var groups []dirGroup
+	if s.groupDepth > 0 {
+		groups = s.sortedGroups()
+	}
+	var timings []fileTimingJSON
+	for _, t := range s.timings {
+		timings = append(timings, t.json())
+	}
+	return summaryJSON{
+		Converted:           s.converted,
+		Modes:               s.modes,
+		Duplicates:          n,
+		TooSmall:            s.tooSmall,
+		AnimatedGIFsSkipped: s.animatedSkipped,
+		Unreferenced:        s.unreferenced,
+		Unchanged:           s.unchanged,
+		BeforeSince:         s.beforeSince,
+		Vendored:            vendored,
+		Animations:          animations,
+		Filtered:            nonNil(s.filtered),
+		Unsupported:         unsupported,
+		MisnamedWebP:        nonNil(s.misnamed),
+		ExtensionFixed:      nonNil(s.extensionFixed),
+		LFSPointers:         nonNil(s.lfsPointers),
+		OverTarget:          nonNil(s.overTarget),
+		Denied:              nonNil(s.denied),
+		InUse:               nonNil(s.inUse),
+		Collisions:          collisions,
+		Conflicts:           conflicts,
+		OnConflict:          s.conflictPolicy,
+		HookFailed:          nonNil(s.hookFailed),
+		LowSSIM:             nonNil(s.lowSSIM),
+		KeptSmaller:         nonNil(s.keptSmaller),
+		TimedOut:            nonNil(s.timedOut),
+		Requalified:         nonNil(s.requalified),
+		Groups:              groups,
+		Timings:             timings,
+		Stopped:             s.stopped,
+		Remaining:           s.remaining,
+	}
+}
+
+func (s *summary) json() []byte {
+	data, _ := json.MarshalIndent(s.report(), "", "  ")
+	return data
+}
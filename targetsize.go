@@ -0,0 +1,50 @@
+package webpcon
+
+import (
+	"bytes"
+	"image"
+)
+
+// Bounds and step count for the --target-size quality search. Five halvings
+// of 30 ~ 95 land within a couple of quality points of the best fit.
+const (
+	targetMinQuality = 30
+	targetMaxQuality = 95
+	targetSearchIter = 5
+)
+
+// searchQuality binary searches the lossy quality so the encoded image fits in
+// target bytes, picking the highest quality that does. Encodes go to memory and
+// reuse the already decoded pixels. When even the lowest quality is too big, that
+// encode is returned anyway with met set to false.
+func searchQuality(img image.Image, target int64, enc encoder, effort int) (data []byte, quality int, met bool, err error) {
+	encode := func(q int) ([]byte, error) {
+		var buf bytes.Buffer
+		err := enc.encode(&buf, img, encodeOptions{quality: float32(q), effort: effort})
+		return buf.Bytes(), err
+	}
+
+	lo, hi := targetMinQuality, targetMaxQuality
+	for i := 0; i < targetSearchIter && lo <= hi; i++ {
+		mid := (lo + hi) / 2
+		out, err := encode(mid)
+		if err != nil {
+			return nil, 0, false, err
+		}
+		if int64(len(out)) <= target {
+			data, quality, met = out, mid, true
+			lo = mid + 1
+		} else {
+			hi = mid - 1
+		}
+	}
+	if met {
+		return data, quality, true, nil
+	}
+
+	data, err = encode(targetMinQuality)
+	if err != nil {
+		return nil, 0, false, err
+	}
+	return data, targetMinQuality, int64(len(data)) <= target, nil
+}
@@ -0,0 +1,93 @@
+package webpcon
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestParseSize(t *testing.T) {
+	for _, tt := range []struct {
+		in   string
+		want int64
+		ok   bool
+	}{
+		{"4096", 4096, true},
+		{"200KB", 200 << 10, true},
+		{"200k", 200 << 10, true},
+		{"1.5MB", 3 << 19, true},
+		{" 2 gb ", 2 << 30, true},
+		{"12B", 12, true},
+		{"", 0, false},
+		{"-1KB", 0, false},
+		{"lots", 0, false},
+	} {
+		got, err := parseSize(tt.in)
+		if (err == nil) != tt.ok || got != tt.want {
+			t.Errorf("parseSize(%q) = %d, %v; want %d, ok %v", tt.in, got, err, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestSearchQuality(t *testing.T) {
+	enc := testEncoder(t, "cgo")
+	img := fixtureImage(96, 64)
+	top, _, _, err := searchQuality(img, 1<<20, enc, 4)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range []struct {
+		name   string
+		target int64
+		check  func(q int, size int64, met bool) bool
+	}{
+		{"room to spare", 1 << 20, func(q int, size int64, met bool) bool {
+			return met && q >= targetMaxQuality-2
+		}},
+		{"three quarters", int64(len(top)) * 3 / 4, func(q int, size int64, met bool) bool {
+			return !met || q > targetMinQuality && q < targetMaxQuality
+		}},
+		{"unreachable", 10, func(q int, size int64, met bool) bool {
+			return !met && q == targetMinQuality && size > 0
+		}},
+	} {
+		data, q, met, err := searchQuality(img, tt.target, enc, 4)
+		if err != nil {
+			t.Fatal(err)
+		}
+		size := int64(len(data))
+		if met && size > tt.target || !tt.check(q, size, met) {
+			t.Errorf("%s: searchQuality to %d bytes = q%d, %d bytes, met %t", tt.name, tt.target, q, size, met)
+		}
+	}
+}
+
+func TestTargetSizeKeepsSmaller(t *testing.T) {
+	testEncoder(t, "cgo")
+	quietly(t)
+	root := writeFixtureTree(t, []fixtureFile{
+		{"big.png", encodeFixture(t, ".png", 64, 64)},
+		{"small.jpg", encodeFixture(t, ".jpg", 64, 64)},
+	})
+	sum := convertTree(t, root, testOptions(t, "--encoder", "cgo", "--target-size", "1MB", "--min-savings", "95%"))
+	if len(sum.KeptSmaller) != 2 || sum.Converted != 0 {
+		t.Errorf("convert kept %v, converted %d; want both originals kept", sum.KeptSmaller, sum.Converted)
+	}
+	for _, name := range []string{"big.png", "small.jpg"} {
+		if !fileExists(filepath.Join(root, name)) {
+			t.Errorf("%s was not put back", name)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(root, "big.webp")); err == nil {
+		t.Error("big.webp was left behind")
+	}
+	if entries := readMapFile(t, root); len(entries) != 0 {
+		t.Errorf("map lists %d kept originals", len(entries))
+	}
+
+	// Without --target-size still images always take their WebP
+	sum = convertTree(t, root, testOptions(t, "--encoder", "cgo", "--min-savings", "95%"))
+	if sum.Converted != 2 {
+		t.Errorf("convert without --target-size converted %d, want 2", sum.Converted)
+	}
+}
@@ -0,0 +1,68 @@
+package webpcon
+
+import (
+	"fmt"
+	"runtime"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// niceThrottle is the share of the machine --nice leaves webpcon.
+const niceThrottle = 50
+
+// throttle keeps a run to a share of the machine: it caps the threads Go runs
+// on and the workers of the parallel steps, lowers the process priority, and sleeps between files (and GIF frames)
+// so work takes up only that share of the time. At 50% a run takes about
+// twice as long, at 25% about four times.
+type throttle struct {
+	percent int
+	since   time.Time // Start of the work since the last pause
+}
+
+// workerLimit caps the goroutines of the run's parallel steps, hashing and
+// --streaming-walk, when --throttle sets it. 0 leaves them alone.
+var workerLimit int
+
+// workers returns n, the goroutines a parallel step would use, capped to
+// workerLimit.
+func workers(n int) int {
+	if workerLimit > 0 {
+		return min(n, workerLimit)
+	}
+	return n
+}
+
+// startThrottle applies the limits for percent and returns the throttle to
+// pause on. A nil throttle (percent 0) never pauses.
+func startThrottle(percent int) *throttle {
+	if percent <= 0 || percent >= 100 {
+		return nil
+	}
+	workerLimit = max(1, runtime.NumCPU()*percent/100)
+	runtime.GOMAXPROCS(workerLimit)
+	if err := lowerPriority(); err != nil {
+		fmt.Fprintf(stdout, "⚠️  Could not lower the process priority: %v\n", err)
+	}
+	return &throttle{percent: percent, since: time.Now()}
+}
+
+// pause sleeps long enough that the work since the previous pause makes up
+// percent of the elapsed time.
+func (t *throttle) pause() {
+	if t == nil {
+		return
+	}
+	work := time.Since(t.since)
+	time.Sleep(work * time.Duration(100-t.percent) / time.Duration(t.percent))
+	t.since = time.Now()
+}
+
+// parsePercent parses a 1 ~ 100 share, with or without a trailing %.
+func parsePercent(name, v string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimSuffix(strings.TrimSpace(v), "%"))
+	if err != nil || n < 1 || n > 100 {
+		return 0, fmt.Errorf("%s expects a percentage between 1%% and 100%%, got %q", name, v)
+	}
+	return n, nil
+}
@@ -0,0 +1,118 @@
+package webpcon
+
+import (
+	"cmp"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// timingsSlowest is how many of the slowest files the summary lists.
+const timingsSlowest = 10
+
+// fileTiming is where the time converting one file went, recorded with
+// --timings. The stages don't add up to total, which also covers checking
+// the file, metrics, placeholders, fallbacks and the post-hook.
+type fileTiming struct {
+	file          string
+	width, height int           // Of the original
+	decode        time.Duration // Reading and decoding the original
+	encode        time.Duration // Encoding the WebP, which is written as it is encoded
+	io            time.Duration // Hashing and moving the original, creating and checking the WebP
+	total         time.Duration
+}
+
+// fileTimingJSON is a fileTiming in the summary JSON, in milliseconds.
+type fileTimingJSON struct {
+	File     string  `json:"file"`
+	Width    int     `json:"width"`
+	Height   int     `json:"height"`
+	DecodeMs float64 `json:"decodeMs"`
+	EncodeMs float64 `json:"encodeMs"`
+	IOMs     float64 `json:"ioMs"`
+	TotalMs  float64 `json:"totalMs"`
+}
+
+func (t fileTiming) json() fileTimingJSON {
+	return fileTimingJSON{t.file, t.width, t.height, millis(t.decode), millis(t.encode), millis(t.io), millis(t.total)}
+}
+
+func millis(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// addTiming records t of a file converted since start, with --timings.
+func (s *summary) addTiming(t fileTiming, start time.Time) {
+	if s.timings == nil {
+		return
+	}
+	t.total = time.Since(start)
+	s.timings = append(s.timings, t)
+}
+
+// percentile returns the p-th percentile of sorted by the nearest rank.
+func percentile(sorted []time.Duration, p int) time.Duration {
+	i := (len(sorted)*p + 99) / 100
+	return sorted[max(i-1, 0)]
+}
+
+// printTimings prints p50, p90 and the maximum of each stage, and the
+// slowest files with their dimensions.
+func (s *summary) printTimings() {
+	if len(s.timings) == 0 {
+		return
+	}
+	fmt.Fprintf(stdout, "📊 Timings of %d encoded file(s):\n", len(s.timings))
+	fmt.Fprintf(stdout, "   %-8s %9s %9s %9s\n", "", "p50", "p90", "max")
+	stages := []struct {
+		name string
+		of   func(fileTiming) time.Duration
+	}{
+		{"decode:", func(t fileTiming) time.Duration { return t.decode }},
+		{"encode:", func(t fileTiming) time.Duration { return t.encode }},
+		{"I/O:", func(t fileTiming) time.Duration { return t.io }},
+		{"total:", func(t fileTiming) time.Duration { return t.total }},
+	}
+	for _, st := range stages {
+		d := make([]time.Duration, len(s.timings))
+		for i, t := range s.timings {
+			d[i] = st.of(t)
+		}
+		slices.Sort(d)
+		fmt.Fprintf(stdout, "   %-8s %9s %9s %9s\n", st.name, percentile(d, 50).Round(time.Millisecond),
+			percentile(d, 90).Round(time.Millisecond), d[len(d)-1].Round(time.Millisecond))
+	}
+
+	slowest := slices.Clone(s.timings)
+	slices.SortStableFunc(slowest, func(a, b fileTiming) int { return cmp.Compare(b.total, a.total) })
+	slowest = slowest[:min(timingsSlowest, len(slowest))]
+	fmt.Fprintf(stdout, "   Slowest %d:\n", len(slowest))
+	for _, t := range slowest {
+		fmt.Fprintf(stdout, "     - %s (%dx%d): %s, decode %s, encode %s, I/O %s\n", t.file, t.width, t.height, t.total.Round(time.Millisecond),
+			t.decode.Round(time.Millisecond), t.encode.Round(time.Millisecond), t.io.Round(time.Millisecond))
+	}
+}
+
+// writeTimingsCSV writes the timings to path for --timings-csv, one row per
+// file in the order they were converted.
+func writeTimingsCSV(path string, timings []fileTiming) error {
+	f, err := os.Create(longPath(path))
+	if err != nil {
+		return err
+	}
+	w := csv.NewWriter(f)
+	w.Write([]string{"file", "width", "height", "decode_ms", "encode_ms", "io_ms", "total_ms"})
+	ms := func(d time.Duration) string { return strconv.FormatFloat(millis(d), 'f', 3, 64) }
+	for _, t := range timings {
+		w.Write([]string{t.file, strconv.Itoa(t.width), strconv.Itoa(t.height), ms(t.decode), ms(t.encode), ms(t.io), ms(t.total)})
+	}
+	w.Flush()
+	if err := w.Error(); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
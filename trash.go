@@ -0,0 +1,38 @@
+package webpcon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// trasher moves files to the desktop's trash, where the user can restore
+// them the usual way. Each platform provides newTrasher.
+type trasher interface {
+	trash(path string) error
+}
+
+// uniqueName returns a file name in dir based on name that isn't taken yet:
+// photo.png, photo.2.png, photo.3.png, ...
+func uniqueName(dir, name string, taken func(string) bool) string {
+	ext := filepath.Ext(name)
+	base := strings.TrimSuffix(name, ext)
+	candidate := name
+	for i := 2; taken(filepath.Join(dir, candidate)); i++ {
+		candidate = fmt.Sprintf("%s.%d%s", base, i, ext)
+	}
+	return candidate
+}
+
+// moveFile renames src to dst, copying across filesystems when needed. The
+// copy is synced before src goes away.
+func moveFile(src, dst string) error {
+	if err := os.Rename(longPath(src), longPath(dst)); err == nil {
+		return nil
+	}
+	if err := copyFileWith(src, dst, copyOptions{sync: true}); err != nil {
+		return err
+	}
+	return os.Remove(longPath(src))
+}
@@ -0,0 +1,26 @@
+//go:build darwin
+
+package webpcon
+
+import (
+	"os"
+	"path/filepath"
+)
+
+// macTrash moves files into ~/.Trash, where Finder picks them up.
+type macTrash struct {
+	dir string
+}
+
+func newTrasher() (trasher, error) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return nil, err
+	}
+	return macTrash{dir: filepath.Join(home, ".Trash")}, nil
+}
+
+func (t macTrash) trash(path string) error {
+	name := uniqueName(t.dir, filepath.Base(path), fileExists)
+	return moveFile(path, filepath.Join(t.dir, name))
+}
@@ -0,0 +1,29 @@
+package webpcon
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestUniqueName(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		taken []string
+		want  string
+	}{
+		{"photo.png", nil, "photo.png"},
+		{"photo.png", []string{"photo.png"}, "photo.2.png"},
+		{"photo.png", []string{"photo.png", "photo.2.png", "photo.3.png"}, "photo.4.png"},
+		{"photo.png", []string{"photo.2.png"}, "photo.png"},
+		{"archive.tar.gz", []string{"archive.tar.gz"}, "archive.tar.2.gz"},
+		{"README", []string{"README"}, "README.2"},
+	} {
+		taken := map[string]bool{}
+		for _, n := range tt.taken {
+			taken[filepath.Join("dir", n)] = true
+		}
+		if got := uniqueName("dir", tt.name, func(p string) bool { return taken[p] }); got != tt.want {
+			t.Errorf("uniqueName(%q) with %q taken = %q, want %q", tt.name, tt.taken, got, tt.want)
+		}
+	}
+}
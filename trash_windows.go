@@ -0,0 +1,64 @@
+//go:build windows
+
+package webpcon
+
+import (
+	"fmt"
+	"path/filepath"
+	"syscall"
+	"unsafe"
+)
+
+var procSHFileOperation = syscall.NewLazyDLL("shell32.dll").NewProc("SHFileOperationW")
+
+const (
+	foDelete          = 0x0003
+	fofSilent         = 0x0004
+	fofNoConfirmation = 0x0010
+	fofAllowUndo      = 0x0040
+	fofNoErrorUI      = 0x0400
+)
+
+// shFileOpStruct mirrors SHFILEOPSTRUCTW.
+type shFileOpStruct struct {
+	hwnd                  uintptr
+	wFunc                 uint32
+	pFrom                 *uint16
+	pTo                   *uint16
+	fFlags                uint16
+	fAnyOperationsAborted int32
+	hNameMappings         uintptr
+	lpszProgressTitle     *uint16
+}
+
+// recycleBin deletes files with undo allowed, which sends them to the Recycle Bin.
+type recycleBin struct{}
+
+func newTrasher() (trasher, error) {
+	return recycleBin{}, procSHFileOperation.Find()
+}
+
+func (recycleBin) trash(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	// pFrom is a list of paths ending with an extra NUL
+	from, err := syscall.UTF16FromString(abs)
+	if err != nil {
+		return err
+	}
+	from = append(from, 0)
+	op := shFileOpStruct{
+		wFunc:  foDelete,
+		pFrom:  &from[0],
+		fFlags: fofAllowUndo | fofNoConfirmation | fofSilent | fofNoErrorUI,
+	}
+	if r, _, _ := procSHFileOperation.Call(uintptr(unsafe.Pointer(&op))); r != 0 {
+		return fmt.Errorf("SHFileOperation failed with code %#x", r)
+	}
+	if op.fAnyOperationsAborted != 0 {
+		return fmt.Errorf("moving %s to the Recycle Bin was aborted", path)
+	}
+	return nil
+}
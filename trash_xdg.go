@@ -0,0 +1,152 @@
+//go:build !windows && !darwin
+
+package webpcon
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// xdgTrash follows the FreeDesktop.org trash specification: the file goes to
+// Trash/files and a .trashinfo in Trash/info records where it came from.
+// Files on the home trash's filesystem go to the home trash; others go to a
+// trash at the top of their own filesystem, so nothing is copied across
+// devices.
+type xdgTrash struct {
+	home    string // $XDG_DATA_HOME/Trash
+	homeDev uint64
+	uid     int
+	topdir  func(path string) string // The top folder of path's filesystem
+}
+
+func newTrasher() (trasher, error) {
+	data := os.Getenv("XDG_DATA_HOME")
+	if data == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, err
+		}
+		data = filepath.Join(home, ".local", "share")
+	}
+	t := xdgTrash{home: filepath.Join(data, "Trash"), uid: os.Getuid(), topdir: mountPoint}
+	if err := makeTrashDir(t.home); err != nil {
+		return nil, err
+	}
+	dev, err := deviceOf(t.home)
+	if err != nil {
+		return nil, err
+	}
+	t.homeDev = dev
+	return t, nil
+}
+
+// makeTrashDir creates the files and info folders of a trash directory.
+func makeTrashDir(dir string) error {
+	for _, sub := range []string{"files", "info"} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0700); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deviceOf returns the ID of the device holding path.
+func deviceOf(path string) (uint64, error) {
+	var st syscall.Stat_t
+	if err := syscall.Lstat(path, &st); err != nil {
+		return 0, err
+	}
+	return uint64(st.Dev), nil
+}
+
+func (t xdgTrash) trash(path string) error {
+	abs, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+	dir, infoPath := t.home, abs
+	if dev, err := deviceOf(abs); err == nil && dev != t.homeDev {
+		// Without a usable trash on its own filesystem, the file is copied
+		// to the home trash, as the specification allows
+		if top := t.topdir(abs); top != "" {
+			if d, err := t.topdirTrash(top); err == nil {
+				// Paths in a top directory trash are relative to it, so they
+				// still hold when the filesystem is mounted elsewhere
+				if rel, err := filepath.Rel(top, abs); err == nil {
+					dir, infoPath = d, rel
+				}
+			}
+		}
+	}
+
+	name, err := reserveTrashInfo(dir, filepath.Base(abs), infoPath)
+	if err != nil {
+		return err
+	}
+	if err := moveFile(abs, filepath.Join(dir, "files", name)); err != nil {
+		os.Remove(filepath.Join(dir, "info", name+".trashinfo"))
+		return err
+	}
+	return nil
+}
+
+// topdirTrash returns the trash directory for files on the filesystem whose
+// top folder is top: $top/.Trash/$uid when an administrator set up $top/.Trash
+// as the specification asks, a real folder with the sticky bit, and
+// $top/.Trash-$uid otherwise.
+func (t xdgTrash) topdirTrash(top string) (string, error) {
+	uid := strconv.Itoa(t.uid)
+	if fi, err := os.Lstat(filepath.Join(top, ".Trash")); err == nil && fi.IsDir() && fi.Mode()&os.ModeSticky != 0 {
+		dir := filepath.Join(top, ".Trash", uid)
+		if err := makeTrashDir(dir); err == nil {
+			return dir, nil
+		}
+	}
+	dir := filepath.Join(top, ".Trash-"+uid)
+	if err := makeTrashDir(dir); err != nil {
+		return "", err
+	}
+	if fi, err := os.Lstat(dir); err != nil || !fi.IsDir() {
+		return "", fmt.Errorf("%s is not a folder", dir)
+	}
+	return dir, nil
+}
+
+// reserveTrashInfo picks a name free in the trash directory dir for a file
+// called base and writes its .trashinfo, recording path, the original
+// location. The info file is created exclusively, so two processes trashing
+// files of the same name at once never share an entry; it comes first, as
+// the specification asks, and the file follows under the name returned.
+func reserveTrashInfo(dir, base, path string) (string, error) {
+	files, info := filepath.Join(dir, "files"), filepath.Join(dir, "info")
+	content := fmt.Sprintf("[Trash Info]\nPath=%s\nDeletionDate=%s\n",
+		(&url.URL{Path: path}).EscapedPath(), time.Now().Format("2006-01-02T15:04:05"))
+	for {
+		name := uniqueName(files, base, func(p string) bool {
+			return fileExists(p) || fileExists(filepath.Join(info, filepath.Base(p)+".trashinfo"))
+		})
+		infoPath := filepath.Join(info, name+".trashinfo")
+		f, err := os.OpenFile(infoPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+		if errors.Is(err, os.ErrExist) {
+			continue // Taken since uniqueName looked
+		}
+		if err != nil {
+			return "", err
+		}
+		_, err = f.WriteString(content)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			os.Remove(infoPath)
+			return "", err
+		}
+		return name, nil
+	}
+}
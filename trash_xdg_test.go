@@ -0,0 +1,219 @@
+//go:build !windows && !darwin
+
+package webpcon
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// testTrash returns an xdgTrash with its home trash in a temporary folder.
+// With otherVolume, every file counts as being on another filesystem, whose
+// top folder is volume.
+func testTrash(t *testing.T, volume string, otherVolume bool) xdgTrash {
+	t.Helper()
+	home := filepath.Join(t.TempDir(), "Trash")
+	if err := makeTrashDir(home); err != nil {
+		t.Fatal(err)
+	}
+	dev, err := deviceOf(home)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if otherVolume {
+		dev = ^dev
+	}
+	return xdgTrash{home: home, homeDev: dev, uid: 1000, topdir: func(string) string { return volume }}
+}
+
+// trashFile writes a file under dir and trashes it.
+func trashFile(t *testing.T, bin xdgTrash, dir, rel, content string) string {
+	t.Helper()
+	path := filepath.Join(dir, filepath.FromSlash(rel))
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := bin.trash(path); err != nil {
+		t.Fatal(err)
+	}
+	if fileExists(path) {
+		t.Errorf("%s still there", rel)
+	}
+	return path
+}
+
+// checkTrashed checks the trash directory dir holds name with content, and
+// an info file recording path.
+func checkTrashed(t *testing.T, dir, name, content, path string) {
+	t.Helper()
+	if data, err := os.ReadFile(filepath.Join(dir, "files", name)); err != nil || string(data) != content {
+		t.Errorf("%s in %s: %q, %v, want %q", name, dir, data, err, content)
+	}
+	info, err := os.ReadFile(filepath.Join(dir, "info", name+".trashinfo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "Path=" + (&url.URL{Path: path}).EscapedPath() + "\n"
+	if !strings.HasPrefix(string(info), "[Trash Info]\n") || !strings.Contains(string(info), want) || !strings.Contains(string(info), "DeletionDate=") {
+		t.Errorf("%s.trashinfo:\n%s\nwant %q", name, info, want)
+	}
+}
+
+func TestXDGTrashHome(t *testing.T) {
+	src := t.TempDir()
+	bin := testTrash(t, src, false)
+	first := trashFile(t, bin, src, "img/my logo.png", "first")
+	second := trashFile(t, bin, src, "other/my logo.png", "second")
+	checkTrashed(t, bin.home, "my logo.png", "first", first)
+	checkTrashed(t, bin.home, "my logo.2.png", "second", second)
+	if fileExists(filepath.Join(src, ".Trash-1000")) {
+		t.Error("a top directory trash made for a file on the home trash's filesystem")
+	}
+}
+
+func TestXDGTrashTopdir(t *testing.T) {
+	t.Run("own trash", func(t *testing.T) {
+		volume := t.TempDir()
+		bin := testTrash(t, volume, true)
+		trashFile(t, bin, volume, "site/img/logo.png", "logo")
+		checkTrashed(t, filepath.Join(volume, ".Trash-1000"), "logo.png", "logo", "site/img/logo.png")
+		if entries, _ := os.ReadDir(filepath.Join(bin.home, "files")); len(entries) != 0 {
+			t.Errorf("the home trash got %d file(s)", len(entries))
+		}
+	})
+	t.Run("shared trash", func(t *testing.T) {
+		volume := t.TempDir()
+		if err := os.Mkdir(filepath.Join(volume, ".Trash"), 0777); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(filepath.Join(volume, ".Trash"), 0777|os.ModeSticky); err != nil {
+			t.Fatal(err)
+		}
+		bin := testTrash(t, volume, true)
+		trashFile(t, bin, volume, "logo.png", "logo")
+		checkTrashed(t, filepath.Join(volume, ".Trash", "1000"), "logo.png", "logo", "logo.png")
+	})
+	t.Run("shared trash without sticky bit", func(t *testing.T) {
+		volume := t.TempDir()
+		if err := os.Mkdir(filepath.Join(volume, ".Trash"), 0777); err != nil {
+			t.Fatal(err)
+		}
+		bin := testTrash(t, volume, true)
+		trashFile(t, bin, volume, "logo.png", "logo")
+		checkTrashed(t, filepath.Join(volume, ".Trash-1000"), "logo.png", "logo", "logo.png")
+		if fileExists(filepath.Join(volume, ".Trash", "1000")) {
+			t.Error("used a .Trash without the sticky bit")
+		}
+	})
+	t.Run("shared trash a symlink", func(t *testing.T) {
+		volume, elsewhere := t.TempDir(), t.TempDir()
+		os.Chmod(elsewhere, 0777|os.ModeSticky)
+		if err := os.Symlink(elsewhere, filepath.Join(volume, ".Trash")); err != nil {
+			t.Fatal(err)
+		}
+		bin := testTrash(t, volume, true)
+		trashFile(t, bin, volume, "logo.png", "logo")
+		checkTrashed(t, filepath.Join(volume, ".Trash-1000"), "logo.png", "logo", "logo.png")
+	})
+	t.Run("no usable trash", func(t *testing.T) {
+		volume := t.TempDir()
+		if err := os.WriteFile(filepath.Join(volume, ".Trash-1000"), nil, 0644); err != nil {
+			t.Fatal(err)
+		}
+		bin := testTrash(t, volume, true)
+		path := trashFile(t, bin, volume, "logo.png", "logo")
+		checkTrashed(t, bin.home, "logo.png", "logo", path)
+	})
+}
+
+// TestXDGTrashConcurrent trashes files of one name from many goroutines at
+// once: each gets an entry of its own, recording where it came from.
+func TestXDGTrashConcurrent(t *testing.T) {
+	src := t.TempDir()
+	bin := testTrash(t, src, false)
+	const n = 16
+	paths := make([]string, n)
+	for i := range n {
+		paths[i] = filepath.Join(src, fmt.Sprint(i), "logo.png")
+		os.Mkdir(filepath.Dir(paths[i]), 0755)
+		if err := os.WriteFile(paths[i], []byte(fmt.Sprint(i)), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	var wg sync.WaitGroup
+	for i := range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := bin.trash(paths[i]); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	infos, _ := os.ReadDir(filepath.Join(bin.home, "info"))
+	if len(infos) != n {
+		t.Fatalf("%d info files for %d files", len(infos), n)
+	}
+	for _, e := range infos {
+		name := strings.TrimSuffix(e.Name(), ".trashinfo")
+		info, _ := os.ReadFile(filepath.Join(bin.home, "info", e.Name()))
+		data, err := os.ReadFile(filepath.Join(bin.home, "files", name))
+		if err != nil {
+			t.Fatalf("%s has no file: %v", e.Name(), err)
+		}
+		if want := "Path=" + filepath.Join(src, string(data), "logo.png") + "\n"; !strings.Contains(string(info), want) {
+			t.Errorf("%s holds %q but records:\n%s", name, data, info)
+		}
+	}
+}
+
+// TestReserveTrashInfo checks a name counts as taken by its info file alone,
+// as left by a run that stopped between the two.
+func TestReserveTrashInfo(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "Trash")
+	if err := makeTrashDir(dir); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "info", "logo.png.trashinfo"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "files", "logo.2.png"), nil, 0600); err != nil {
+		t.Fatal(err)
+	}
+	name, err := reserveTrashInfo(dir, "logo.png", "/srv/site/logo.png")
+	if err != nil || name != "logo.3.png" {
+		t.Errorf("reserved %q, %v, want logo.3.png", name, err)
+	}
+	if !fileExists(filepath.Join(dir, "info", "logo.3.png.trashinfo")) {
+		t.Error("no info file written for the reserved name")
+	}
+}
+
+// TestConvertTrash converts with --trash: the originals end up in the trash
+// rather than the backup folder.
+func TestConvertTrash(t *testing.T) {
+	t.Setenv("XDG_DATA_HOME", t.TempDir())
+	png := encodeFixture(t, ".png", 12, 10)
+	root := writeFixtureTree(t, []fixtureFile{{"img/logo.png", png}})
+	convertTree(t, root, testOptions(t, "--trash"))
+	files := treeFiles(t, root)
+	if _, ok := files["img/logo.webp"]; !ok {
+		t.Error("no img/logo.webp")
+	}
+	for rel := range files {
+		if strings.HasSuffix(rel, ".png") {
+			t.Errorf("%s left in the tree", rel)
+		}
+	}
+	checkTrashed(t, filepath.Join(os.Getenv("XDG_DATA_HOME"), "Trash"), "logo.png", string(png), filepath.Join(root, "img", "logo.png"))
+}
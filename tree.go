@@ -0,0 +1,187 @@
+package webpcon
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// osTree is a folder on disk, both the fs.FS a conversion reads and the
+// Writer it writes. Unlike os.DirFS it goes through longPath, so names
+// past MAX_PATH work on Windows.
+type osTree string
+
+// file is the path of name on disk.
+func (t osTree) file(name string) string {
+	return filepath.Join(string(t), filepath.FromSlash(name))
+}
+
+func (t osTree) path(name string) string {
+	return longPath(t.file(name))
+}
+
+func (t osTree) Open(name string) (fs.File, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Open(t.path(name))
+}
+
+func (t osTree) Stat(name string) (fs.FileInfo, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "stat", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.Stat(t.path(name))
+}
+
+func (t osTree) ReadDir(name string) ([]fs.DirEntry, error) {
+	if !fs.ValidPath(name) {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrInvalid}
+	}
+	return os.ReadDir(t.path(name))
+}
+
+func (t osTree) CreateFile(name string) (io.WriteCloser, error) {
+	return os.Create(t.path(name))
+}
+
+func (t osTree) Rename(oldname, newname string) error {
+	return os.Rename(t.path(oldname), t.path(newname))
+}
+
+func (t osTree) Remove(name string) error {
+	return os.Remove(t.path(name))
+}
+
+func (t osTree) MkdirAll(name string, perm fs.FileMode) error {
+	return os.MkdirAll(t.path(name), perm)
+}
+
+// treeName turns relPath, a path relative to a tree in the form of the OS,
+// into its name in the tree.
+func treeName(relPath string) string {
+	return filepath.ToSlash(relPath)
+}
+
+// treeHas tells whether the file or folder at relPath exists in fsys.
+func treeHas(fsys fs.FS, relPath string) bool {
+	_, err := fs.Stat(fsys, treeName(relPath))
+	return err == nil
+}
+
+// seekFile is an open file that can be read anywhere, as the header checks
+// and probes need.
+type seekFile interface {
+	fs.File
+	io.ReaderAt
+	io.Seeker
+}
+
+// openSeekable opens name in fsys for random access. Files that can't seek,
+// like those of a zip archive, are read into memory.
+func openSeekable(fsys fs.FS, name string) (seekFile, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	if sf, ok := f.(seekFile); ok {
+		return sf, nil
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, err
+	}
+	return bufferedFile{bytes.NewReader(data), info}, nil
+}
+
+// bufferedFile is a file openSeekable read into memory.
+type bufferedFile struct {
+	*bytes.Reader
+	info fs.FileInfo
+}
+
+func (f bufferedFile) Stat() (fs.FileInfo, error) { return f.info, nil }
+func (f bufferedFile) Close() error               { return nil }
+
+// hashFS is hashFile for the file name in fsys.
+func hashFS(fsys fs.FS, name string) (string, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	if _, err := copyBuffered(h, f); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// writeTreeFile writes what r reads to name in t through a temporary file,
+// so an interrupted write never leaves a truncated file under the final
+// name.
+func writeTreeFile(t Writer, name string, r io.Reader) error {
+	return writeTreeFileChecked(t, name, r, nil)
+}
+
+// writeTreeFileChecked is writeTreeFile, calling check, when not nil, once
+// everything is written and before the file takes its name.
+func writeTreeFileChecked(t Writer, name string, r io.Reader, check func() error) error {
+	if dir := path.Dir(name); dir != "." {
+		if err := t.MkdirAll(dir, 0755); err != nil {
+			return err
+		}
+	}
+	tmp := name + ".tmp"
+	w, err := t.CreateFile(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = copyBuffered(w, r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil && check != nil {
+		err = check()
+	}
+	if err == nil {
+		err = t.Rename(tmp, name)
+	}
+	if err != nil {
+		t.Remove(tmp)
+	}
+	return err
+}
+
+// copyTreeFile copies oldname to newname within t, replacing newname. The
+// content must match sha256, the hex digest from the map file, when given.
+// On disk this is copyFileWith, which keeps the mode and modification time
+// and syncs the copy; other trees stream it through writeTreeFile.
+func copyTreeFile(t Writer, oldname, newname, sha256sum string) error {
+	if dir, ok := t.(osTree); ok {
+		return copyFileWith(dir.file(oldname), dir.file(newname), copyOptions{sync: true, sha256: sha256sum})
+	}
+	in, err := t.Open(oldname)
+	if err != nil {
+		return &copyError{"open", oldname, newname, err}
+	}
+	defer in.Close()
+	h := sha256.New()
+	return writeTreeFileChecked(t, newname, io.TeeReader(in, h), func() error {
+		if got := hex.EncodeToString(h.Sum(nil)); sha256sum != "" && got != sha256sum {
+			return &copyError{"checksum", oldname, newname, fmt.Errorf("got %s, expected %s", got, sha256sum)}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,129 @@
+package webpcon
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"strconv"
+	"strings"
+)
+
+// trimSpec is the border --trim crops off: transparent pixels, or pixels of
+// one color, each channel within tolerance of it.
+type trimSpec struct {
+	transparent bool
+	color       color.NRGBA
+	tolerance   int
+}
+
+// trimBox is how much --trim cropped off each side of an image, in pixels of
+// the source before any resizing, for front-end code to place it as before.
+type trimBox struct {
+	Left   int `json:"left"`
+	Top    int `json:"top"`
+	Right  int `json:"right"`
+	Bottom int `json:"bottom"`
+}
+
+// parseTrim reads a --trim value: "transparent" or "color=#rrggbb".
+func parseTrim(v string) (*trimSpec, error) {
+	if v == "transparent" {
+		return &trimSpec{transparent: true}, nil
+	}
+	if hex, ok := strings.CutPrefix(v, "color="); ok {
+		c, err := parseHexColor(hex)
+		if err != nil {
+			return nil, err
+		}
+		return &trimSpec{color: c}, nil
+	}
+	return nil, fmt.Errorf("--trim expects transparent or color=#rrggbb, got %q", v)
+}
+
+// key describes t for encodeKey.
+func (t *trimSpec) key() string {
+	what := "transparent"
+	if !t.transparent {
+		what = formatHexColor(t.color)
+	}
+	return what + "," + strconv.Itoa(t.tolerance)
+}
+
+// border tells whether the straight RGBA pixel p belongs to the border.
+func (t *trimSpec) border(p []uint8) bool {
+	if t.transparent {
+		return int(p[3]) <= t.tolerance
+	}
+	for i, c := range []uint8{t.color.R, t.color.G, t.color.B, t.color.A} {
+		if d := int(p[i]) - int(c); d > t.tolerance || -d > t.tolerance {
+			return false
+		}
+	}
+	return true
+}
+
+// bounds returns the part of img inside its border, relative to img's
+// bounds. Rows are scanned in from the top and bottom edges and then columns
+// in from the sides, each stopping at the first pixel that isn't border, so
+// only the border and one line past it are read. ok is false when nothing
+// but border is left.
+func (t *trimSpec) bounds(img *image.NRGBA) (r image.Rectangle, ok bool) {
+	w, h := img.Rect.Dx(), img.Rect.Dy()
+	px := func(x, y int) []uint8 {
+		i := y*img.Stride + x*4
+		return img.Pix[i : i+4]
+	}
+	rowBorder := func(y int) bool {
+		for x := 0; x < w; x++ {
+			if !t.border(px(x, y)) {
+				return false
+			}
+		}
+		return true
+	}
+	top, bottom := 0, h
+	for top < h && rowBorder(top) {
+		top++
+	}
+	if top == h {
+		return image.Rectangle{}, false
+	}
+	for bottom > top && rowBorder(bottom-1) {
+		bottom--
+	}
+	colBorder := func(x int) bool {
+		for y := top; y < bottom; y++ {
+			if !t.border(px(x, y)) {
+				return false
+			}
+		}
+		return true
+	}
+	left, right := 0, w
+	for left < w && colBorder(left) {
+		left++
+	}
+	for right > left && colBorder(right-1) {
+		right--
+	}
+	return image.Rect(left, top, right, bottom), true
+}
+
+// trimImage crops the border t describes off img. It returns img as it is
+// with a nil box when there's no border, and an error when the image is all
+// border and would be trimmed to nothing.
+func trimImage(img image.Image, t *trimSpec) (image.Image, *trimBox, error) {
+	src := toNRGBA(img)
+	r, ok := t.bounds(src)
+	if !ok {
+		return img, nil, fmt.Errorf("nothing but border, left untrimmed")
+	}
+	w, h := src.Rect.Dx(), src.Rect.Dy()
+	if r == image.Rect(0, 0, w, h) {
+		return img, nil, nil
+	}
+	dst := image.NewNRGBA(image.Rect(0, 0, r.Dx(), r.Dy()))
+	draw.Draw(dst, dst.Bounds(), src, src.Rect.Min.Add(r.Min), draw.Src)
+	return dst, &trimBox{r.Min.X, r.Min.Y, w - r.Max.X, h - r.Max.Y}, nil
+}
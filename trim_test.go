@@ -0,0 +1,120 @@
+package webpcon
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+// bordered returns a w x h image of border with inner filled by fixtureImage
+// pixels, opaque.
+func bordered(w, h int, border color.NRGBA, inner image.Rectangle) *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, w, h))
+	content := fixtureImage(w, h)
+	for y := range h {
+		for x := range w {
+			c := border
+			if (image.Point{x, y}).In(inner) {
+				c = content.NRGBAAt(x, y)
+				c.A = 0xff
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestTrimImage(t *testing.T) {
+	empty := color.NRGBA{}
+	white := color.NRGBA{0xff, 0xff, 0xff, 0xff}
+	transparent := &trimSpec{transparent: true}
+	tests := []struct {
+		name    string
+		img     image.Image
+		spec    *trimSpec
+		want    *trimBox // nil for untouched
+		wantErr bool
+	}{
+		{"transparent", bordered(20, 10, empty, image.Rect(2, 3, 15, 9)), transparent,
+			&trimBox{2, 3, 5, 1}, false},
+		{"one pixel left", bordered(20, 10, empty, image.Rect(19, 0, 20, 1)), transparent,
+			&trimBox{19, 0, 0, 9}, false},
+		{"no border", bordered(20, 10, empty, image.Rect(0, 0, 20, 10)), transparent,
+			nil, false},
+		{"all border", bordered(20, 10, empty, image.Rectangle{}), transparent,
+			nil, true},
+		{"nearly transparent, no tolerance", bordered(20, 10, color.NRGBA{0, 0, 0, 3}, image.Rect(2, 2, 18, 8)), transparent,
+			nil, false},
+		{"nearly transparent, tolerance 5", bordered(20, 10, color.NRGBA{0, 0, 0, 3}, image.Rect(2, 2, 18, 8)), &trimSpec{transparent: true, tolerance: 5},
+			&trimBox{2, 2, 2, 2}, false},
+		{"colour", bordered(20, 10, white, image.Rect(1, 2, 17, 6)), &trimSpec{color: white},
+			&trimBox{1, 2, 3, 4}, false},
+		{"colour within tolerance", bordered(20, 10, color.NRGBA{0xfa, 0xff, 0xfb, 0xff}, image.Rect(1, 2, 17, 6)), &trimSpec{color: white, tolerance: 5},
+			&trimBox{1, 2, 3, 4}, false},
+		{"colour past tolerance", bordered(20, 10, color.NRGBA{0xf0, 0xf0, 0xf0, 0xff}, image.Rect(1, 2, 17, 6)), &trimSpec{color: white, tolerance: 5},
+			nil, false},
+		{"colour all border", bordered(20, 10, white, image.Rectangle{}), &trimSpec{color: white},
+			nil, true},
+		// Each kind of trim leaves the other kind of border
+		{"colour trim, transparent border", bordered(20, 10, empty, image.Rect(2, 2, 18, 8)), &trimSpec{color: white, tolerance: 10},
+			nil, false},
+		{"transparent trim, white border", bordered(20, 10, white, image.Rect(2, 2, 18, 8)), transparent,
+			nil, false},
+		{"sub-image", bordered(30, 20, empty, image.Rect(12, 8, 20, 14)).SubImage(image.Rect(10, 5, 25, 15)), transparent,
+			&trimBox{2, 3, 5, 1}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, box, err := trimImage(tt.img, tt.spec)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("error %v, want one: %t", err, tt.wantErr)
+			}
+			if tt.want == nil {
+				if box != nil || got != tt.img {
+					t.Errorf("trimmed %+v off, want the image untouched", box)
+				}
+				return
+			}
+			if box == nil || *box != *tt.want {
+				t.Fatalf("trimmed %+v off, want %+v", box, tt.want)
+			}
+			b := tt.img.Bounds()
+			inner := image.Rect(b.Min.X+box.Left, b.Min.Y+box.Top, b.Max.X-box.Right, b.Max.Y-box.Bottom)
+			if got.Bounds() != image.Rect(0, 0, inner.Dx(), inner.Dy()) {
+				t.Fatalf("trimmed image is %v, want %v", got.Bounds(), inner)
+			}
+			for y := range inner.Dy() {
+				for x := range inner.Dx() {
+					if g, w := color.NRGBAModel.Convert(got.At(x, y)), color.NRGBAModel.Convert(tt.img.At(inner.Min.X+x, inner.Min.Y+y)); g != w {
+						t.Fatalf("pixel %d,%d is %v, want %v", x, y, g, w)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestParseTrim(t *testing.T) {
+	for _, tt := range []struct {
+		args []string
+		want string // trimSpec.key, "" for an error
+	}{
+		{[]string{"--trim", "transparent"}, "transparent,0"},
+		{[]string{"--trim", "color=#ffffff", "--trim-tolerance", "5"}, "#ffffff,5"},
+		{[]string{"--trim-tolerance", "5", "--trim", "color=#ffffff"}, "#ffffff,5"},
+		{[]string{"--trim", "white"}, ""},
+		{[]string{"--trim", "color=#12345"}, ""},
+		{[]string{"--trim-tolerance", "5"}, ""},
+		{[]string{"--trim", "transparent", "--trim-tolerance", "256"}, ""},
+	} {
+		opts, err := parseOptions(tt.args)
+		switch {
+		case tt.want == "" && err == nil:
+			t.Errorf("%q accepted", tt.args)
+		case tt.want != "" && err != nil:
+			t.Errorf("%q: %v", tt.args, err)
+		case tt.want != "" && opts.trim.key() != tt.want:
+			t.Errorf("%q: trim %s, want %s", tt.args, opts.trim.key(), tt.want)
+		}
+	}
+}
@@ -0,0 +1,226 @@
+package webpcon
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	"image/jpeg"
+	"image/png"
+	"io"
+	"io/fs"
+	"time"
+
+	"golang.org/x/image/bmp"
+	"golang.org/x/image/tiff"
+)
+
+// unsupportedError is a valid image using a feature the decoders here don't
+// implement, as opposed to a corrupt one. Its message is meant for people.
+type unsupportedError struct {
+	reason string
+}
+
+func (e *unsupportedError) Error() string { return e.reason }
+
+func unsupported(format string, args ...any) error {
+	return &unsupportedError{fmt.Sprintf(format, args...) + " not supported"}
+}
+
+// unsupportedReason tells an unsupported feature from corrupt data in a
+// decoder error. It returns "" for anything else.
+func unsupportedReason(err error) string {
+	var u *unsupportedError
+	var te tiff.UnsupportedError
+	var je jpeg.UnsupportedError
+	switch {
+	case errors.As(err, &u):
+		return u.reason
+	case errors.As(err, &te):
+		return fmt.Sprintf("TIFF %s not supported", string(te))
+	case errors.As(err, &je):
+		return fmt.Sprintf("JPEG %s not supported", string(je))
+	case errors.Is(err, bmp.ErrUnsupported):
+		return "BMP variant not supported"
+	}
+	return ""
+}
+
+// checkSupported reads just the headers of the image name in fsys, so files
+// the decoders can't read are found before anything is moved. Unsupported
+// features give an unsupportedError.
+func checkSupported(fsys fs.FS, name, ext string) error {
+	ext, err := sniffFile(fsys, name, ext)
+	if err != nil {
+		return err
+	}
+	switch ext {
+	case ".bmp":
+		return checkBMP(fsys, name)
+	case ".tiff":
+		return checkTIFF(fsys, name)
+	case ".jpg", ".jpeg", ".jpe", ".jfif":
+		return checkJPEG(fsys, name)
+	case ".avif", ".jxl":
+		return checkOptIn(ext)
+	}
+	return nil
+}
+
+// tiffCompression names the TIFF compression schemes, for messages.
+var tiffCompression = map[int]string{
+	2:     "CCITT RLE",
+	6:     "old-style JPEG",
+	7:     "JPEG",
+	32809: "ThunderScan",
+	34712: "JPEG 2000",
+	34925: "LZMA",
+	50000: "Zstandard",
+	50001: "WebP",
+}
+
+// checkTIFF looks at the first IFD for the compression and sample layout.
+func checkTIFF(fsys fs.FS, name string) error {
+	f, err := openSeekable(fsys, name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	var head [8]byte
+	if _, err := io.ReadFull(f, head[:]); err != nil {
+		return err
+	}
+	var order binary.ByteOrder
+	switch string(head[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return tiff.FormatError("malformed header")
+	}
+	switch order.Uint16(head[2:]) {
+	case 42:
+	case 43:
+		return unsupported("BigTIFF")
+	default:
+		return tiff.FormatError("malformed header")
+	}
+
+	ifd := int64(order.Uint32(head[4:]))
+	var count [2]byte
+	if _, err := f.ReadAt(count[:], ifd); err != nil {
+		return err
+	}
+	entries := make([]byte, 12*int(order.Uint16(count[:])))
+	if _, err := f.ReadAt(entries, ifd+2); err != nil {
+		return err
+	}
+	for e := entries; len(e) >= 12; e = e[12:] {
+		// Both tags hold a single number, stored in the value field itself
+		tag, value := order.Uint16(e), int(order.Uint16(e[8:]))
+		if order.Uint16(e[2:]) == 4 { // LONG rather than SHORT
+			value = int(order.Uint32(e[8:]))
+		}
+		switch tag {
+		case 259: // Compression
+			switch value {
+			case 1, 3, 4, 5, 8, 32773, 32946:
+			default:
+				name, ok := tiffCompression[value]
+				if !ok {
+					name = fmt.Sprint(value)
+				}
+				return unsupported("TIFF compression '%s'", name)
+			}
+		case 284: // PlanarConfiguration
+			if value == 2 {
+				return unsupported("Planar TIFF")
+			}
+		}
+	}
+	return nil
+}
+
+// checkJPEG looks for the frame header, which tells the coding process and
+// the sample precision.
+func checkJPEG(fsys fs.FS, name string) error {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+
+	var b [3]byte
+	if _, err := io.ReadFull(r, b[:2]); err != nil {
+		return err
+	}
+	if b[0] != 0xff || b[1] != 0xd8 {
+		return jpeg.FormatError("missing SOI marker")
+	}
+	for {
+		if _, err := io.ReadFull(r, b[:2]); err != nil {
+			return err
+		}
+		for b[0] == 0xff && b[1] == 0xff { // Fill bytes
+			if b[1], err = r.ReadByte(); err != nil {
+				return err
+			}
+		}
+		if b[0] != 0xff {
+			return jpeg.FormatError("missing marker")
+		}
+		marker := b[1]
+		if marker == 0xd8 || marker == 0x01 || marker >= 0xd0 && marker <= 0xd7 {
+			continue // No length follows
+		}
+		if marker == 0xd9 || marker == 0xda {
+			return nil // Image data before any frame header; the decoder will complain
+		}
+		if _, err := io.ReadFull(r, b[:3]); err != nil {
+			return err
+		}
+		length := int(b[0])<<8 | int(b[1])
+		if length < 3 {
+			return jpeg.FormatError("short segment length")
+		}
+		switch marker {
+		case 0xc0, 0xc1, 0xc2:
+			if b[2] != 8 {
+				return unsupported("%d-bit JPEG", b[2])
+			}
+			return nil
+		case 0xc3:
+			return unsupported("Lossless JPEG")
+		case 0xc5, 0xc6, 0xc7:
+			return unsupported("Hierarchical JPEG")
+		case 0xc9, 0xca, 0xcb, 0xcd, 0xce, 0xcf:
+			return unsupported("Arithmetic-coded JPEG")
+		}
+		if _, err := r.Discard(length - 3); err != nil {
+			return err
+		}
+	}
+}
+
+// decodeExternal runs the --external-decoder command for src and decodes the
+// PNG it writes to stdout.
+func decodeExternal(command, src string, timeout time.Duration) (image.Image, error) {
+	args, err := splitArgs(command)
+	if err != nil {
+		return nil, err
+	}
+	var buf bytes.Buffer
+	if err := execHook(substitute(args, map[string]string{"src": src}), nil, &buf, timeout); err != nil {
+		return nil, fmt.Errorf("external decoder: %v", err)
+	}
+	img, err := png.Decode(&buf)
+	if err != nil {
+		return nil, fmt.Errorf("external decoder output: %v", err)
+	}
+	return img, nil
+}
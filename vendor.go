@@ -0,0 +1,43 @@
+package webpcon
+
+import (
+	"io/fs"
+	"path/filepath"
+	"strings"
+)
+
+// vendoredReason tells why the folder relPath in fsys, the project,
+// holds vendored code whose images are left alone, or "" if it doesn't.
+// Conversions would be overwritten by the next update of the vendored code.
+// Folders given to --vendored-dirs count, and folders that look like a
+// copied package: one named vendor, or one with both a package.json and an
+// .npmignore (a package's own root, not the project's). --include-vendored
+// overrides all of these for the folders it names.
+func (o options) vendoredReason(fsys fs.FS, relPath string) string {
+	if relPath == "." {
+		return ""
+	}
+	key := pathKey(relPath)
+	if o.includeVendored[key] {
+		return ""
+	}
+	switch {
+	case o.vendoredDirs[key]:
+		return "--vendored-dirs"
+	case strings.EqualFold(filepath.Base(relPath), "vendor"):
+		return "named vendor"
+	case treeHas(fsys, filepath.Join(relPath, "package.json")) && treeHas(fsys, filepath.Join(relPath, ".npmignore")):
+		return "package.json and .npmignore"
+	}
+	return ""
+}
+
+// parseDirList reads a comma separated list of folders relative to the
+// project root into set, keyed by pathKey.
+func parseDirList(v string, set map[string]bool) {
+	for _, d := range strings.Split(v, ",") {
+		if d = strings.TrimSpace(d); d != "" {
+			set[pathKey(filepath.Clean(filepath.FromSlash(d)))] = true
+		}
+	}
+}
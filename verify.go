@@ -0,0 +1,142 @@
+package webpcon
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	xwebp "golang.org/x/image/webp"
+)
+
+// verifyWebP checks a freshly written WebP before its original counts as
+// converted: the RIFF header must account for exactly the bytes on disk, and
+// the image must have the expected size. With full, still images are also
+// decoded completely. name is the WebP in fsys.
+func verifyWebP(fsys fs.FS, name string, width, height int, full bool) error {
+	f, err := openSeekable(fsys, name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	var header [21]byte
+	n, err := io.ReadFull(f, header[:])
+	if err != nil && err != io.ErrUnexpectedEOF {
+		return err
+	}
+	if n < 12 || string(header[0:4]) != "RIFF" || string(header[8:12]) != "WEBP" {
+		return fmt.Errorf("not a WebP file")
+	}
+	if size := int64(binary.LittleEndian.Uint32(header[4:8])) + 8; size != info.Size() {
+		return fmt.Errorf("the header says %d bytes but the file has %d, it may be truncated", size, info.Size())
+	}
+
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	cfg, err := xwebp.DecodeConfig(f)
+	if err != nil {
+		return fmt.Errorf("unreadable header: %v", err)
+	}
+	if cfg.Width != width || cfg.Height != height {
+		return fmt.Errorf("the output is %dx%d, expected %dx%d", cfg.Width, cfg.Height, width, height)
+	}
+
+	if !full || isAnimatedWebP(header[:n]) {
+		return nil
+	}
+	if _, err := f.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+	if _, err := decodeWebP(bufio.NewReaderSize(f, ioBufferSize)); err != nil {
+		return fmt.Errorf("doesn't decode: %v", err)
+	}
+	return nil
+}
+
+// missingRef is a reference to a WebP that isn't there.
+type missingRef struct {
+	File string `json:"file"`
+	Ref  string `json:"ref"`
+}
+
+type refReport struct {
+	Files   int          `json:"files"` // Rewritten files checked
+	Refs    int          `json:"refs"`  // WebP references in them
+	Missing []missingRef `json:"missing"`
+}
+
+// verifyRefs checks that every WebP referenced from the source files webpcon
+// rewrote exists, so a partial run can't have left a page pointing at an
+// image that was never written. Rewritten files are those with a copy in the
+// backup, see writeRefFile. It only reads.
+func verifyRefs(root string, asJSON bool) error {
+	report := refReport{Missing: []missingRef{}}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return nil
+		}
+		if info.IsDir() {
+			if skipDirs[info.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		rel, _ := filepath.Rel(root, path)
+		if !refFileExt[strings.ToLower(filepath.Ext(path))] || !fileExists(filepath.Join(root, ".webpcon_backup", rel)) {
+			return nil
+		}
+		data, err := os.ReadFile(longPath(path))
+		if err != nil {
+			fmt.Fprintf(stdout, "❌ Error reading %s: %v\n", path, err)
+			return err
+		}
+		report.Files++
+		for _, ref := range imageRef.FindAllString(string(data), -1) {
+			if !strings.EqualFold(filepath.Ext(ref), ".webp") {
+				continue
+			}
+			target, ok := resolveRefPath(root, filepath.Dir(path), ref)
+			if !ok {
+				continue
+			}
+			report.Refs++
+			if !fileExists(filepath.Join(root, target)) {
+				report.Missing = append(report.Missing, missingRef{filepath.ToSlash(rel), ref})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if asJSON {
+		data, err := json.MarshalIndent(report, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(stdout, string(data))
+	} else if len(report.Missing) > 0 {
+		fmt.Fprintf(stdout, "❌ %d WebP reference(s) point at files that don't exist:\n", len(report.Missing))
+		for _, m := range report.Missing {
+			fmt.Fprintf(stdout, "   %s: %s\n", m.File, m.Ref)
+		}
+	} else {
+		fmt.Fprintf(stdout, "✅ All %d WebP reference(s) in %d rewritten file(s) exist\n", report.Refs, report.Files)
+	}
+	if len(report.Missing) > 0 {
+		return fmt.Errorf("%d WebP reference(s) point at missing files", len(report.Missing))
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package webpcon
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// TestPartialRewrite converts part of a tree with --rewrite-refs, and checks
+// only the references to converted images change, that verify passes, and
+// that it finds a WebP deleted afterwards.
+func TestPartialRewrite(t *testing.T) {
+	log := quietly(t)
+	root := writeFixtureTree(t, []fixtureFile{
+		{"index.html", []byte(`<img src="a.png"><img src="b.png">` + "\n")},
+		{"a.png", encodeFixture(t, ".png", 8, 8)},
+		{"b.png", encodeFixture(t, ".png", 9, 9)},
+	})
+	html := func() string {
+		data, err := os.ReadFile(filepath.Join(root, "index.html"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(data)
+	}
+
+	convertTree(t, root, testOptions(t, "--encoder", "native", "--limit", "1", "--rewrite-refs", "--exclude-converted"))
+	if got, want := html(), `<img src="a.webp"><img src="b.png">`+"\n"; got != want {
+		t.Errorf("after --limit 1, index.html is %q, want %q", got, want)
+	}
+	if err := verifyRefs(root, false); err != nil {
+		t.Errorf("verify after a partial run: %v", err)
+	}
+
+	convertTree(t, root, testOptions(t, "--encoder", "native", "--rewrite-refs"))
+	if got, want := html(), `<img src="a.webp"><img src="b.webp">`+"\n"; got != want {
+		t.Errorf("after the rest, index.html is %q, want %q", got, want)
+	}
+	if err := os.Remove(filepath.Join(root, "b.webp")); err != nil {
+		t.Fatal(err)
+	}
+	log.Reset()
+	if err := verifyRefs(root, true); err == nil {
+		t.Error("verify passed with b.webp missing")
+	}
+	var report refReport
+	if err := json.Unmarshal([]byte(log.String()), &report); err != nil {
+		t.Fatalf("verify --json: %v", err)
+	}
+	if len(report.Missing) != 1 || report.Missing[0] != (missingRef{"index.html", "b.webp"}) || report.Refs != 2 {
+		t.Errorf("verify reported %+v, want b.webp in index.html missing of 2 references", report)
+	}
+	if strings.Contains(log.String(), "a.webp") {
+		t.Error("verify listed a.webp, which exists")
+	}
+}
@@ -0,0 +1,162 @@
+package webpcon
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// walkEntry is a file or folder streamWalk found.
+type walkEntry struct {
+	path      string
+	info      os.FileInfo
+	err       error
+	collision []string // Sources in its folder sharing its WebP name, see findCollisions
+}
+
+// walkDirs is how many folders streamWalk reads at once. Reading folders is
+// mostly waiting on the disk, or on the network for shares, so it is more
+// than there are CPUs. --throttle lowers it, see workers.
+var walkDirs = max(runtime.NumCPU()*2, 8)
+
+// streamWalk lists the tree under root the way filepath.Walk does for the
+// conversion, but reads walkDirs folders at once and sends what it finds as
+// it goes, so the conversion starts before the walk has seen every folder.
+// Folders come in no fixed order, though the entries of each one come
+// together and sorted. skipDirs and vendored folders are sent, for the
+// caller to report, but not descended into. Closing stop ends the walk
+// early; the channel is closed once it is over either way.
+//
+// Collisions can only be found between files of one folder, see
+// folderCollisions, as other folders may not have been read yet.
+func streamWalk(root string, opts options, stop <-chan struct{}) <-chan walkEntry {
+	out := make(chan walkEntry, 256)
+	info, err := os.Lstat(longPath(root))
+	if err != nil {
+		out <- walkEntry{path: root, err: err}
+		close(out)
+		return out
+	}
+
+	var mu sync.Mutex
+	cond := sync.NewCond(&mu)
+	queue := []string{root}
+	pending := 1 // Folders queued or being read
+	stopped := false
+	send := func(e walkEntry) bool {
+		select {
+		case out <- e:
+			return true
+		case <-stop:
+			return false
+		}
+	}
+	if !send(walkEntry{path: root, info: info}) {
+		close(out)
+		return out
+	}
+
+	var wg sync.WaitGroup
+	for range workers(walkDirs) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				mu.Lock()
+				for len(queue) == 0 && pending > 0 && !stopped {
+					cond.Wait()
+				}
+				if len(queue) == 0 || stopped {
+					mu.Unlock()
+					return
+				}
+				dir := queue[len(queue)-1]
+				queue = queue[:len(queue)-1]
+				mu.Unlock()
+
+				subdirs, ok := readFolder(root, dir, opts, send)
+				mu.Lock()
+				queue = append(queue, subdirs...)
+				pending += len(subdirs) - 1
+				stopped = stopped || !ok
+				cond.Broadcast()
+				mu.Unlock()
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(out)
+	}()
+	return out
+}
+
+// readFolder sends the entries of dir, and returns the folders among them
+// to descend into. ok is false once send gives up.
+func readFolder(root, dir string, opts options, send func(walkEntry) bool) (subdirs []string, ok bool) {
+	acquireFile()
+	entries, err := os.ReadDir(longPath(dir))
+	releaseFile()
+	if err != nil {
+		// Like filepath.Walk, a folder that can't be read is sent again with the error
+		info, _ := os.Lstat(longPath(dir))
+		return nil, send(walkEntry{path: dir, info: info, err: err})
+	}
+	var files []walkEntry
+	for _, d := range entries {
+		path := filepath.Join(dir, d.Name())
+		info, err := d.Info()
+		if err != nil {
+			continue // Gone since the folder was read
+		}
+		if d.IsDir() {
+			rel, _ := filepath.Rel(root, path)
+			if !skipDirs[d.Name()] && !opts.excludedDir(rel) && opts.vendoredReason(osTree(root), rel) == "" {
+				subdirs = append(subdirs, path)
+			}
+		}
+		files = append(files, walkEntry{path: path, info: info})
+	}
+	folderCollisions(root, files, opts)
+	for _, e := range files {
+		if !send(e) {
+			return nil, false
+		}
+	}
+	// Read depth first, so the first folder's images come early
+	sort.Sort(sort.Reverse(sort.StringSlice(subdirs)))
+	return subdirs, true
+}
+
+// folderCollisions sets the collision of the files among entries, all of one
+// folder, whose WebP outputs would be the same file on a case-insensitive
+// filesystem, like findCollisions does for the whole tree.
+func folderCollisions(root string, entries []walkEntry, opts options) {
+	groups := map[string][]int{}
+	for i, e := range entries {
+		rel, _ := filepath.Rel(root, e.path)
+		ext, ok := opts.sourceExt(e.info.Name(), rel)
+		if e.info.IsDir() || !ok {
+			continue
+		}
+		key := strings.ToLower(webpRel(e.info.Name(), ext))
+		groups[key] = append(groups[key], i)
+	}
+	for _, g := range groups {
+		if len(g) < 2 {
+			continue
+		}
+		var members []string
+		for _, i := range g {
+			rel, _ := filepath.Rel(root, entries[i].path)
+			members = append(members, filepath.ToSlash(rel))
+		}
+		sort.Strings(members)
+		for _, i := range g {
+			entries[i].collision = members
+		}
+	}
+}
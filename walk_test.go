@@ -0,0 +1,176 @@
+package webpcon
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+// deepTree writes a tree of depth folders nested width to a folder, each
+// holding files empty files, and returns its root.
+func deepTree(tb testing.TB, depth, width, files int) string {
+	tb.Helper()
+	root := tb.TempDir()
+	var fill func(dir string, level int)
+	fill = func(dir string, level int) {
+		for i := range files {
+			if err := os.WriteFile(filepath.Join(dir, fmt.Sprintf("f%d.png", i)), nil, 0644); err != nil {
+				tb.Fatal(err)
+			}
+		}
+		if level == depth {
+			return
+		}
+		for i := range width {
+			sub := filepath.Join(dir, fmt.Sprintf("d%d", i))
+			if err := os.Mkdir(sub, 0755); err != nil {
+				tb.Fatal(err)
+			}
+			fill(sub, level+1)
+		}
+	}
+	fill(root, 0)
+	return root
+}
+
+// walkPaths returns the paths filepath.Walk or streamWalk finds under root,
+// relative and sorted.
+func walkPaths(tb testing.TB, root string, streaming bool) []string {
+	tb.Helper()
+	var paths []string
+	add := func(path string, err error) {
+		if err != nil {
+			tb.Fatal(err)
+		}
+		rel, _ := filepath.Rel(root, path)
+		paths = append(paths, filepath.ToSlash(rel))
+	}
+	if streaming {
+		for e := range streamWalk(root, testOptions(tb), nil) {
+			add(e.path, e.err)
+		}
+	} else {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+			add(path, err)
+			if err == nil && info.IsDir() && skipDirs[info.Name()] {
+				return filepath.SkipDir
+			}
+			return nil
+		})
+	}
+	slices.Sort(paths)
+	return paths
+}
+
+// TestStreamWalk checks streamWalk finds what filepath.Walk does, sending
+// skipped folders without descending into them.
+func TestStreamWalk(t *testing.T) {
+	root := deepTree(t, 4, 3, 2)
+	skipped := filepath.Join(root, "d0", "node_modules")
+	if err := os.MkdirAll(skipped, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(skipped, "a.png"), nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	walked, streamed := walkPaths(t, root, false), walkPaths(t, root, true)
+	if !slices.Equal(streamed, walked) {
+		t.Errorf("streamWalk found %d paths, filepath.Walk %d", len(streamed), len(walked))
+	}
+	if slices.Contains(streamed, "d0/node_modules/a.png") {
+		t.Error("streamWalk descended into node_modules")
+	}
+	if !slices.Contains(streamed, "d0/node_modules") {
+		t.Error("streamWalk didn't send node_modules")
+	}
+}
+
+// TestStreamWalkExclude checks streamWalk doesn't descend into a folder an
+// --exclude-regex pattern leaves alone.
+func TestStreamWalkExclude(t *testing.T) {
+	root := deepTree(t, 2, 2, 1)
+	var paths []string
+	for e := range streamWalk(root, testOptions(t, "--exclude-regex", "^d0/"), nil) {
+		rel, _ := filepath.Rel(root, e.path)
+		paths = append(paths, filepath.ToSlash(rel))
+	}
+	for _, p := range paths {
+		if strings.HasPrefix(p, "d0/") {
+			t.Errorf("streamWalk descended into d0 for %s", p)
+		}
+	}
+	if !slices.Contains(paths, "d1/d0/f0.png") {
+		t.Errorf("streamWalk missed d1/d0/f0.png, found %q", paths)
+	}
+}
+
+// TestStreamWalkStop checks closing stop ends the walk early.
+func TestStreamWalkStop(t *testing.T) {
+	root := deepTree(t, 4, 3, 2)
+	stop := make(chan struct{})
+	walk := streamWalk(root, testOptions(t), stop)
+	<-walk
+	close(stop)
+	n := 0
+	for range walk {
+		n++
+	}
+	if total := len(walkPaths(t, root, false)); n >= total-1 {
+		t.Errorf("%d of %d paths sent after stopping", n, total)
+	}
+}
+
+// The walk benchmarks list a tree of 5461 folders, 6 deep, with 4 files
+// each, as --streaming-walk and the default filepath.Walk do.
+func BenchmarkWalkFilepath(b *testing.B) {
+	root := deepTree(b, 6, 4, 4)
+	b.ResetTimer()
+	for range b.N {
+		filepath.Walk(root, func(path string, info os.FileInfo, err error) error { return err })
+	}
+}
+
+func BenchmarkWalkStreaming(b *testing.B) {
+	root := deepTree(b, 6, 4, 4)
+	opts := testOptions(b)
+	b.ResetTimer()
+	for range b.N {
+		for range streamWalk(root, opts, nil) {
+		}
+	}
+}
+
+// TestStreamWalkJPEGNames checks streamWalk sends JPEGs under every name
+// webpcon takes for them, in any case.
+func TestStreamWalkJPEGNames(t *testing.T) {
+	jpg := encodeFixture(t, ".jpg", 16, 12)
+	root := writeFixtureTree(t, []fixtureFile{
+		{"a.jpg", jpg},
+		{"b.jpeg", jpg},
+		{"c.jpe", jpg},
+		{"d.jfif", jpg},
+		{"sub/E.JPE", jpg},
+		{"sub/F.JFIF", jpg},
+		{"sub/h.jfi", jpg},
+	})
+	opts := testOptions(t)
+	var found []string
+	for e := range streamWalk(root, opts, nil) {
+		if e.err != nil {
+			t.Fatal(e.err)
+		}
+		rel, _ := filepath.Rel(root, e.path)
+		rel = filepath.ToSlash(rel)
+		if _, ok := opts.sourceExt(e.info.Name(), rel); ok && !e.info.IsDir() {
+			found = append(found, rel)
+		}
+	}
+	slices.Sort(found)
+	want := []string{"a.jpg", "b.jpeg", "c.jpe", "d.jfif", "sub/E.JPE", "sub/F.JFIF"}
+	if !slices.Equal(found, want) {
+		t.Errorf("walk found %q, want %q", found, want)
+	}
+}
@@ -0,0 +1,63 @@
+package webpcon
+
+import (
+	"fmt"
+	"time"
+)
+
+const defaultHeartbeat = 30 * time.Second
+
+// timeoutError is returned by watch when a file takes longer than --file-timeout.
+type timeoutError struct {
+	after time.Duration
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("gave up after %s (--file-timeout)", e.after)
+}
+
+// watch runs fn for the file relPath. Once it has taken heartbeat, a line
+// says it is still being worked on, and again every heartbeat after that, so
+// a huge image isn't mistaken for a hang. With a timeout, watch returns a
+// *timeoutError when it runs out, and once interrupt is closed it returns
+// errInterrupted.
+//
+// Encoders can't be interrupted: libwebp through cgo runs to the end once
+// called, and neither the pure Go encoder nor the cwebp backend take a
+// cancellation. A timed-out or interrupted fn is abandoned instead,
+// finishing in the background with its result dropped, so its memory is
+// held until then. fn must not touch anything the caller uses after a
+// timeout.
+func watch(out *fileLog, relPath string, heartbeat, timeout time.Duration, interrupt <-chan struct{}, fn func() error) error {
+	if heartbeat <= 0 && timeout <= 0 && interrupt == nil {
+		return fn()
+	}
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+
+	start := time.Now()
+	var beat <-chan time.Time
+	if heartbeat > 0 {
+		ticker := time.NewTicker(heartbeat)
+		defer ticker.Stop()
+		beat = ticker.C
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	for {
+		select {
+		case err := <-done:
+			return err
+		case <-beat:
+			out.printf("⏳ Still working on %s (%s elapsed)\n", relPath, time.Since(start).Round(time.Second))
+		case <-expired:
+			return &timeoutError{timeout}
+		case <-interrupt:
+			return errInterrupted
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package webpcon
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/color"
+	"image/draw"
+	"math"
+	"os"
+	"path/filepath"
+)
+
+// watermarkPositions are the corners, and the center, --watermark-pos takes.
+var watermarkPositions = map[string]bool{
+	"top-left": true, "top-right": true, "bottom-left": true, "bottom-right": true, "center": true,
+}
+
+// watermarkMinSize is the shortest side an image needs to be stamped. On
+// smaller ones, thumbnails and icons, the overlay would cover too much.
+const watermarkMinSize = 200
+
+// watermark is the --watermark overlay, read once for the run.
+type watermark struct {
+	img     image.Image
+	sum     string // Start of the file's SHA-256, so editing the logo changes encodeKey
+	pos     string // One of watermarkPositions
+	opacity float64
+	scale   float64 // Overlay width as a fraction of the image's
+}
+
+// loadWatermark reads the overlay image at path.
+func loadWatermark(path, pos string, opacity, scale float64) (*watermark, error) {
+	f, err := os.Open(longPath(path))
+	if err != nil {
+		return nil, fmt.Errorf("--watermark: %v", err)
+	}
+	defer f.Close()
+	img, err := decodeImage(f, filepath.Ext(path))
+	if err != nil {
+		return nil, fmt.Errorf("--watermark: %s: %v", path, err)
+	}
+	h := sha256.New()
+	if _, err := f.Seek(0, 0); err != nil {
+		return nil, err
+	}
+	if _, err := copyBuffered(h, f); err != nil {
+		return nil, err
+	}
+	return &watermark{img, hex.EncodeToString(h.Sum(nil))[:12], pos, opacity, scale}, nil
+}
+
+// key describes the watermark for encodeKey.
+func (wm *watermark) key() string {
+	return fmt.Sprintf("%s,%s,%g,%g", wm.sum, wm.pos, wm.opacity, wm.scale)
+}
+
+// stamp composites the overlay onto img, scaled to its share of img's width
+// and inset from the edge by 2% of the shorter side. Images below
+// watermarkMinSize come back as they are, with ok false.
+func (wm *watermark) stamp(img image.Image) (out image.Image, ok bool) {
+	b := img.Bounds()
+	if min(b.Dx(), b.Dy()) < watermarkMinSize {
+		return img, false
+	}
+	ob := wm.img.Bounds()
+	w := max(int(math.Round(float64(b.Dx())*wm.scale)), 1)
+	h := max(int(math.Round(float64(ob.Dy())*float64(w)/float64(ob.Dx()))), 1)
+	overlay := resizeImage(wm.img, w, h, false)
+
+	margin := int(math.Round(float64(min(b.Dx(), b.Dy())) * 0.02))
+	var at image.Point
+	switch wm.pos {
+	case "top-left":
+		at = image.Pt(margin, margin)
+	case "top-right":
+		at = image.Pt(b.Dx()-w-margin, margin)
+	case "bottom-left":
+		at = image.Pt(margin, b.Dy()-h-margin)
+	case "bottom-right":
+		at = image.Pt(b.Dx()-w-margin, b.Dy()-h-margin)
+	case "center":
+		at = image.Pt((b.Dx()-w)/2, (b.Dy()-h)/2)
+	}
+
+	dst := image.NewNRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Src)
+	mask := image.NewUniform(color.Alpha{uint8(math.Round(wm.opacity * 255))})
+	draw.DrawMask(dst, overlay.Bounds().Add(at), overlay, image.Point{}, mask, image.Point{}, draw.Over)
+	return dst, true
+}